@@ -0,0 +1,418 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"log"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/naming"
+)
+
+// Address represents a server the client connects to.
+type Address struct {
+	// Addr is the server address on which a connection will be established.
+	Addr string
+	// Metadata is the information associated with Addr, which may be used
+	// to make load balancing decision.
+	Metadata interface{}
+}
+
+// BalancerGetOptions configures a Get call.
+type BalancerGetOptions struct {
+	// BlockingWait specifies whether Get should block when there is no
+	// connected address.
+	BlockingWait bool
+}
+
+// Balancer chooses network addresses for RPCs.
+// This is the EXPERIMENTAL API and may be changed or extended in the future.
+type Balancer interface {
+	// Start does the initialization work to bootstrap a Balancer. For example,
+	// this function may start the name resolution and watch the updates. It will
+	// be called when dialing.
+	Start(target string) error
+	// Up informs the Balancer that gRPC has a connection to the server at
+	// addr. It returns down which is called once the connection to addr gets
+	// lost or closed.
+	Up(addr Address) (down func(error))
+	// Get gets the address of a server for the RPC corresponding to ctx.
+	// i) If it returns a connected address, gRPC internals issues the RPC on the
+	// connection to this address;
+	// ii) If it returns an address on which the connection is under construction
+	// (initiated by Notify(...)) but not connected, gRPC internals
+	//  * fails RPC if the RPC is fail-fast and connection is in the TransientFailure or
+	//  Shutdown state;
+	//  or
+	//  * issues RPC on the connection otherwise.
+	// iii) If it returns an address on which the connection does not exist, gRPC
+	// internals treats it as an error and will fail the corresponding RPC.
+	//
+	// Therefore, the following is the recommended rule when writing a custom
+	// Balancer. If opts.BlockingWait is true, it should return a connected
+	// address or block if there is no connected address. It should respect the
+	// timeout or cancellation of ctx when blocking. If opts.BlockingWait is
+	// false (for fail-fast RPCs), it should return an address it has notified
+	// via Notify(...) immediately instead of blocking.
+	Get(ctx context.Context, opts BalancerGetOptions) (addr Address, err error)
+	// Notify returns a channel that is used by gRPC internals to watch the
+	// addresses gRPC needs to connect. The addresses might be from a name
+	// resolver or remote load balancer. gRPC internals will compare it with
+	// the existing connected addresses. If the address Balancer notified is
+	// not in the existing connected addresses, gRPC starts to connect the
+	// address. If an address in the existing connected addresses is not in
+	// the notification list, the corresponding connection is shutdown
+	// gracefully. Otherwise, there are no operations to take. Note that the
+	// Address slice must be the full list of the Addresses which should be
+	// connected. It is NOT delta.
+	Notify() <-chan []Address
+	// Close shuts down the balancer.
+	Close() error
+}
+
+// addrRemover is implemented by the balancers which gRPC tells about the
+// addresses it gave up connecting to, e.g., once WithTimeout expires.
+type addrRemover interface {
+	// resolved reports whether the addresses come from a resolver, which
+	// may announce an address again once it is removed. Otherwise gRPC
+	// closes the ClientConn instead of removing the address.
+	resolved() bool
+	// remove drops addr from the addresses to connect to. The blocking Get
+	// calls fail with err once there is no address left.
+	remove(addr Address, err error)
+}
+
+// RoundRobin returns a Balancer that selects addresses round-robin. It uses
+// r to watch the name resolution updates and updates the addresses available
+// correspondingly. If r is nil, the target itself is the only address.
+func RoundRobin(r naming.Resolver) Balancer {
+	return &roundRobin{r: r}
+}
+
+type addrInfo struct {
+	addr      Address
+	connected bool
+}
+
+type roundRobin struct {
+	r      naming.Resolver
+	w      naming.Watcher
+	addrCh chan []Address // the channel to notify gRPC internals the list of addresses the client should connect to.
+
+	mu    sync.Mutex
+	addrs []*addrInfo // all the addresses the client should potentially connect
+	next  int         // index of the next address to return for Get()
+	// waitCh is closed when an address gets connected while the blocking Get
+	// calls are waiting for one.
+	waitCh chan struct{}
+	// err is set by remove once the last address is removed. Get fails
+	// with it until an address is added.
+	err  error
+	done bool // The Balancer is closed.
+}
+
+func (rr *roundRobin) watchAddrUpdates() error {
+	updates, err := rr.w.Next()
+	if err != nil {
+		return err
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for _, update := range updates {
+		addr := Address{
+			Addr:     update.Addr,
+			Metadata: update.Metadata,
+		}
+		switch update.Op {
+		case naming.Add:
+			var exist bool
+			for _, v := range rr.addrs {
+				if addr == v.addr {
+					exist = true
+					break
+				}
+			}
+			if exist {
+				continue
+			}
+			rr.addrs = append(rr.addrs, &addrInfo{addr: addr})
+			rr.err = nil
+		case naming.Delete:
+			for i, v := range rr.addrs {
+				if addr == v.addr {
+					copy(rr.addrs[i:], rr.addrs[i+1:])
+					rr.addrs = rr.addrs[:len(rr.addrs)-1]
+					break
+				}
+			}
+		default:
+			log.Printf("grpc: roundRobin got unknown operation %d for %q", update.Op, update.Addr)
+		}
+	}
+	if rr.done {
+		return ErrClientConnClosing
+	}
+	rr.notify()
+	return nil
+}
+
+// notify sends the full list of the addresses to gRPC internals, replacing
+// the pending one if it has not been consumed. rr.mu must be held.
+func (rr *roundRobin) notify() {
+	open := make([]Address, len(rr.addrs))
+	for i, v := range rr.addrs {
+		open[i] = v.addr
+	}
+	select {
+	case <-rr.addrCh:
+	default:
+	}
+	rr.addrCh <- open
+}
+
+func (rr *roundRobin) Start(target string) error {
+	rr.addrCh = make(chan []Address, 1)
+	if rr.r == nil {
+		rr.mu.Lock()
+		rr.addrs = []*addrInfo{{addr: Address{Addr: target}}}
+		rr.notify()
+		rr.mu.Unlock()
+		return nil
+	}
+	w, err := rr.r.Resolve(target)
+	if err != nil {
+		return err
+	}
+	rr.w = w
+	go func() {
+		for {
+			if err := rr.watchAddrUpdates(); err != nil {
+				// TODO(zhaoq): Record the error with glog.V.
+				log.Printf("grpc: roundRobin.watchAddrUpdates exits due to: %v", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Up sets the connected state of addr and sends notification if there are pending
+// Get() calls.
+func (rr *roundRobin) Up(addr Address) func(error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	var cnt int
+	for _, a := range rr.addrs {
+		if a.addr == addr {
+			if a.connected {
+				return nil
+			}
+			a.connected = true
+		}
+		if a.connected {
+			cnt++
+		}
+	}
+	// addr is only one which is connected. Notify the Get() callers who are blocking.
+	if cnt == 1 && rr.waitCh != nil {
+		close(rr.waitCh)
+		rr.waitCh = nil
+	}
+	return func(err error) {
+		rr.down(addr, err)
+	}
+}
+
+// down unsets the connected state of addr.
+func (rr *roundRobin) down(addr Address, err error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for _, a := range rr.addrs {
+		if addr == a.addr {
+			a.connected = false
+			break
+		}
+	}
+}
+
+func (rr *roundRobin) resolved() bool {
+	return rr.r != nil
+}
+
+// remove drops addr, which gRPC gave up connecting to, and notifies gRPC
+// internals of the remaining addresses. The blocking Get calls fail with err if
+// none is left.
+func (rr *roundRobin) remove(addr Address, err error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.done {
+		return
+	}
+	for i, v := range rr.addrs {
+		if addr == v.addr {
+			copy(rr.addrs[i:], rr.addrs[i+1:])
+			rr.addrs = rr.addrs[:len(rr.addrs)-1]
+			rr.notify()
+			break
+		}
+	}
+	if len(rr.addrs) == 0 {
+		rr.err = err
+		if rr.waitCh != nil {
+			close(rr.waitCh)
+			rr.waitCh = nil
+		}
+	}
+}
+
+// pickConnected returns the next connected address after rr.next. rr.mu must
+// be held.
+func (rr *roundRobin) pickConnected() (Address, bool) {
+	if len(rr.addrs) == 0 {
+		return Address{}, false
+	}
+	if rr.next >= len(rr.addrs) {
+		rr.next = 0
+	}
+	next := rr.next
+	for {
+		a := rr.addrs[next]
+		next = (next + 1) % len(rr.addrs)
+		if a.connected {
+			rr.next = next
+			return a.addr, true
+		}
+		if next == rr.next {
+			// Has iterated all the possible address but none is connected.
+			return Address{}, false
+		}
+	}
+}
+
+// Get returns the next addr in the rotation.
+func (rr *roundRobin) Get(ctx context.Context, opts BalancerGetOptions) (addr Address, err error) {
+	var ch chan struct{}
+	rr.mu.Lock()
+	if rr.done {
+		rr.mu.Unlock()
+		err = ErrClientConnClosing
+		return
+	}
+	if a, ok := rr.pickConnected(); ok {
+		rr.mu.Unlock()
+		return a, nil
+	}
+	if len(rr.addrs) == 0 && rr.err != nil {
+		err = rr.err
+		rr.mu.Unlock()
+		return
+	}
+	if !opts.BlockingWait {
+		if len(rr.addrs) == 0 {
+			rr.mu.Unlock()
+			err = Errorf(codes.Unavailable, "there is no address available")
+			return
+		}
+		// Returns the next addr on rr.addrs for failfast RPCs.
+		addr = rr.addrs[rr.next].addr
+		rr.next = (rr.next + 1) % len(rr.addrs)
+		rr.mu.Unlock()
+		return
+	}
+	// Wait on rr.waitCh for non-failfast RPCs.
+	if rr.waitCh == nil {
+		ch = make(chan struct{})
+		rr.waitCh = ch
+	} else {
+		ch = rr.waitCh
+	}
+	rr.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ch:
+			rr.mu.Lock()
+			if rr.done {
+				rr.mu.Unlock()
+				err = ErrClientConnClosing
+				return
+			}
+			if a, ok := rr.pickConnected(); ok {
+				rr.mu.Unlock()
+				return a, nil
+			}
+			if len(rr.addrs) == 0 && rr.err != nil {
+				err = rr.err
+				rr.mu.Unlock()
+				return
+			}
+			// The newly added addr got removed by down() again.
+			if rr.waitCh == nil {
+				ch = make(chan struct{})
+				rr.waitCh = ch
+			} else {
+				ch = rr.waitCh
+			}
+			rr.mu.Unlock()
+		}
+	}
+}
+
+func (rr *roundRobin) Notify() <-chan []Address {
+	return rr.addrCh
+}
+
+func (rr *roundRobin) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.done {
+		return ErrClientConnClosing
+	}
+	rr.done = true
+	if rr.w != nil {
+		rr.w.Close()
+	}
+	if rr.waitCh != nil {
+		close(rr.waitCh)
+		rr.waitCh = nil
+	}
+	if rr.addrCh != nil {
+		close(rr.addrCh)
+	}
+	return nil
+}
@@ -35,45 +35,114 @@ package grpc
 
 import (
 	"io"
-	"net"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/transport"
 )
 
 // recv receives and parses an RPC response.
 // On error, it returns the error and indicates whether the call should be retried.
 //
-// TODO(zhaoq): Check whether the received message sequence is valid.
-func recv(t transport.ClientTransport, c *callInfo, stream *transport.Stream, reply proto.Message) error {
+// A unary RPC must receive exactly one message unless the server fails the
+// RPC with a non-OK status. Any other message sequence is reported as a
+// codes.Internal error.
+func recv(ctx context.Context, sh stats.Handler, codec Codec, t transport.ClientTransport, c *callInfo, stream *transport.Stream, reply interface{}) error {
 	// Try to acquire header metadata from the server if there is any.
 	var err error
 	c.headerMD, err = stream.Header()
 	if err != nil {
 		return err
 	}
-	p := &parser{s: stream}
+	if stream.TrailersOnly() {
+		// The server failed the RPC before sending any header or message.
+		c.trailerMD = stream.Trailer()
+		if stream.StatusCode() == codes.OK {
+			return transport.StreamErrorf(codes.Internal, "grpc: unary RPC %s completed with OK status but no response message", stream.Method())
+		}
+		return nil
+	}
+	if sh != nil {
+		sh.HandleRPC(ctx, &stats.InHeader{
+			Client:     true,
+			Header:     c.headerMD,
+			WireLength: stream.HeaderWireLength(),
+			RecvTime:   time.Now(),
+		})
+	}
+	if codec, err = recvCodec(codec, stream); err != nil {
+		return err
+	}
+	p := &parser{s: stream, maxMsgSize: c.maxRecvMsgSize}
+	var gotReply bool
 	for {
-		if err = recvProto(p, reply); err != nil {
+		var inPayload *stats.InPayload
+		if sh != nil {
+			inPayload = &stats.InPayload{Client: true}
+		}
+		if err = recvAndUnmarshal(p, codec, stream, reply, inPayload); err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
+		if inPayload != nil {
+			sh.HandleRPC(ctx, inPayload)
+		}
+		if gotReply {
+			// Skip the rest of the messages so that the trailer is
+			// received.
+			for err == nil {
+				_, _, err = p.recvMsg()
+			}
+			if err != io.EOF {
+				return err
+			}
+			c.trailerMD = stream.Trailer()
+			return transport.StreamErrorf(codes.Internal, "grpc: unary RPC %s received more than one response message", stream.Method())
+		}
+		gotReply = true
 	}
 	c.trailerMD = stream.Trailer()
+	if !gotReply && stream.StatusCode() == codes.OK {
+		return transport.StreamErrorf(codes.Internal, "grpc: unary RPC %s completed with OK status but no response message", stream.Method())
+	}
 	return nil
 }
 
 // sendRPC writes out various information of an RPC such as Context and Message.
-func sendRPC(ctx context.Context, callHdr *transport.CallHdr, t transport.ClientTransport, args proto.Message, opts *transport.Options) (_ *transport.Stream, err error) {
+func sendRPC(ctx context.Context, sh stats.Handler, codec Codec, callHdr *transport.CallHdr, t transport.ClientTransport, args interface{}, cp Compressor, maxMsgSize int, opts *transport.Options) (_ *transport.Stream, err error) {
+	var outPayload *stats.OutPayload
+	if sh != nil {
+		outPayload = &stats.OutPayload{Client: true}
+	}
+	outMsg, err := encode(codec, args, cp, maxMsgSize, outPayload)
+	if err != nil {
+		if _, ok := err.(transport.StreamError); ok {
+			return nil, err
+		}
+		return nil, transport.StreamErrorf(codes.Internal, "grpc: %v", err)
+	}
+	defer outMsg.free()
 	stream, err := t.NewStream(ctx, callHdr)
 	if err != nil {
 		return nil, err
 	}
+	if sh != nil {
+		sh.HandleRPC(ctx, &stats.OutHeader{
+			Client:   true,
+			Header:   callHdr.Metadata,
+			SentTime: time.Now(),
+		})
+	}
 	defer func() {
 		if err != nil {
 			if _, ok := err.(transport.ConnectionError); !ok {
@@ -81,30 +150,295 @@ func sendRPC(ctx context.Context, callHdr *transport.CallHdr, t transport.Client
 			}
 		}
 	}()
-	// TODO(zhaoq): Support compression.
-	outBuf, err := encode(args, compressionNone)
-	if err != nil {
-		return nil, transport.StreamErrorf(codes.Internal, "grpc: %v", err)
-	}
-	err = t.Write(stream, outBuf, opts)
+	err = outMsg.write(t, stream, opts)
 	if err != nil {
 		return nil, err
 	}
+	if outPayload != nil {
+		outPayload.SentTime = time.Now()
+		sh.HandleRPC(ctx, outPayload)
+	}
 	// Sent successfully.
 	return stream, nil
 }
 
+// RetryPolicy defines how a unary RPC is retried after an attempt fails
+// with a transport.ConnectionError. The pause before the n-th retry is
+// InitialBackoff * BackoffMultiplier^(n-1), capped by MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an RPC, including the
+	// first one. Zero means the RPC is retried until it succeeds, fails with
+	// an error other than a transport.ConnectionError or its context is done.
+	MaxAttempts int
+	// InitialBackoff is the pause before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper bound of the pause between two attempts.
+	MaxBackoff time.Duration
+	// BackoffMultiplier is the factor by which the pause grows after each
+	// retry.
+	BackoffMultiplier float64
+}
+
+// defaultRetryPolicy is used by a ClientConn unless WithRetryPolicy is given.
+var defaultRetryPolicy = RetryPolicy{
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        time.Second,
+	BackoffMultiplier: 2,
+}
+
+// withDefaults returns p with its unset backoff fields taken from
+// defaultRetryPolicy. An unset MaxBackoff is not made shorter than
+// InitialBackoff.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRetryPolicy.MaxBackoff
+		if p.MaxBackoff < p.InitialBackoff {
+			p.MaxBackoff = p.InitialBackoff
+		}
+	}
+	if p.BackoffMultiplier <= 0 {
+		p.BackoffMultiplier = defaultRetryPolicy.BackoffMultiplier
+	}
+	return p
+}
+
+// backoff returns the pause before the retries-th retry (starting from 0).
+func (p RetryPolicy) backoff(retries int) time.Duration {
+	d, max := float64(p.InitialBackoff), float64(p.MaxBackoff)
+	for d < max && retries > 0 {
+		d *= p.BackoffMultiplier
+		retries--
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(d)
+}
+
+// retryThrottler is the token bucket shared by the RPCs of a ClientConn
+// which suppresses the retries while the attempts keep failing. It starts
+// full with maxTokens tokens. An attempt which fails with a
+// transport.ConnectionError takes a token and an RPC which succeeds puts
+// back ratio tokens. No retry is made while at most half of maxTokens are
+// left. A nil *retryThrottler never throttles.
+type retryThrottler struct {
+	max   float64
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryThrottler(maxTokens, ratio float64) *retryThrottler {
+	return &retryThrottler{
+		max:    maxTokens,
+		ratio:  ratio,
+		tokens: maxTokens,
+	}
+}
+
+// throttle records a failed attempt and reports whether its RPC must not be
+// retried.
+func (t *retryThrottler) throttle() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens--
+	if t.tokens < 0 {
+		t.tokens = 0
+	}
+	return t.tokens <= t.max/2
+}
+
+// succeed records a successful RPC.
+func (t *retryThrottler) succeed() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.tokens += t.ratio
+	if t.tokens > t.max {
+		t.tokens = t.max
+	}
+	t.mu.Unlock()
+}
+
 // callInfo contains all related configuration and information about an RPC.
 type callInfo struct {
+	// failFast makes the RPC fail instead of waiting for the ClientConn to
+	// reconnect after a failed connection attempt. It is set by FailFast.
 	failFast  bool
 	headerMD  metadata.MD
 	trailerMD metadata.MD
+	// compressorType is the name of the registered Compressor selected by
+	// UseCompressor, or identity. Empty means the ClientConn default is
+	// used.
+	compressorType string
+	// contentSubtype is the name of the registered Codec selected by
+	// CallContentSubtype. Empty means the ClientConn default is used.
+	contentSubtype string
+	// contentType is set by CallContentType. Empty means the ClientConn
+	// default is used.
+	contentType string
+	// peer is the server picked by the latest attempt of the RPC.
+	peer *peer.Peer
+	// maxRecvMsgSize is the limit of the size of the response. Zero means
+	// the ClientConn default is used.
+	maxRecvMsgSize int
+	// maxSendMsgSize is the limit of the size of the request. Zero means
+	// the ClientConn default is used.
+	maxSendMsgSize int
+	// maxAttempts is set by MaxCallAttempts. Zero means the MaxAttempts of
+	// the RetryPolicy of the ClientConn is used.
+	maxAttempts int
+	// noRetry is set by DisableRetry. It overrides maxAttempts.
+	noRetry bool
+	// writeBatchSize is set by WriteBatching. Zero means the messages of a
+	// client stream are written as they are sent.
+	writeBatchSize int
+	// recvReader is set by RecvReader.
+	recvReader bool
+	// raw is set by InvokeRaw. The request and the response are the encoded
+	// messages.
+	raw bool
+	// creds is set by PerRPCCredsCallOption. It overrides the per-RPC
+	// credentials of the ClientConn.
+	creds credentials.PerRPCCredentials
+}
+
+// perRPCMetadata returns md with the request metadata of the per-RPC
+// credentials merged into it. creds overrides the credentials configured by
+// WithPerRPCCredentials if it is not nil. It fails with codes.Unauthenticated
+// if the credentials require transport security but cc is insecure.
+func perRPCMetadata(ctx context.Context, cc *ClientConn, creds credentials.PerRPCCredentials, method string, md metadata.MD) (metadata.MD, error) {
+	all := cc.dopts.perRPCCreds
+	if creds != nil {
+		all = []credentials.PerRPCCredentials{creds}
+	}
+	if len(all) == 0 {
+		return md, nil
+	}
+	// The URI of the service, e.g., "https://host/package.Service".
+	uri := "https://" + cc.authority
+	if i := strings.LastIndex(method, "/"); i > 0 {
+		uri += method[:i]
+	}
+	if md == nil {
+		md = metadata.MD{}
+	} else {
+		md = md.Copy()
+	}
+	for _, c := range all {
+		if c.RequireTransportSecurity() && cc.dopts.copts.TransportCredentials == nil {
+			return nil, Errorf(codes.Unauthenticated, "grpc: the credentials require transport level security")
+		}
+		m, err := c.GetRequestMetadata(ctx, uri)
+		select {
+		case <-ctx.Done():
+			return nil, toRPCErr(transport.ContextErr(ctx.Err()))
+		default:
+		}
+		if err != nil {
+			return nil, Errorf(codes.Unauthenticated, "grpc: failed to get the request metadata: %v", err)
+		}
+		for k, v := range m {
+			md[k] = v
+		}
+	}
+	return md, nil
 }
 
 // Invoke is called by the generated code. It sends the RPC request on the
-// wire and returns after response is received.
-func Invoke(ctx context.Context, method string, args, reply proto.Message, cc *ClientConn, opts ...CallOption) error {
-	var c callInfo
+// wire and returns after response is received. If the ClientConn has a
+// UnaryClientInterceptor, the RPC is handed to it instead.
+func Invoke(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, opts ...CallOption) error {
+	opts = combine(cc.dopts.callOptions, opts)
+	if cc.dopts.unaryInt != nil {
+		return cc.dopts.unaryInt(ctx, method, args, reply, cc, invoke, opts...)
+	}
+	return invoke(ctx, method, args, reply, cc, opts...)
+}
+
+// Invoke sends the RPC request on the wire and returns after the response is
+// received, like the function Invoke with cc.
+func (cc *ClientConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...CallOption) error {
+	return Invoke(ctx, method, args, reply, cc, opts...)
+}
+
+// combine returns the CallOptions o1 followed by o2. The slices are not
+// modified.
+func combine(o1, o2 []CallOption) []CallOption {
+	if len(o1) == 0 {
+		return o2
+	}
+	if len(o2) == 0 {
+		return o1
+	}
+	opts := make([]CallOption, 0, len(o1)+len(o2))
+	opts = append(opts, o1...)
+	return append(opts, o2...)
+}
+
+// rawCall is the CallOption added by InvokeRaw.
+var rawCall = beforeCall(func(c *callInfo) error {
+	c.raw = true
+	return nil
+})
+
+// InvokeRaw is like Invoke but the request in and the returned response are
+// the messages as encoded by the Codec of the RPC, which are sent and
+// received as is. It lets a generic client call a method without its message
+// types. The args and reply seen by a UnaryClientInterceptor are in and a
+// *[]byte.
+func InvokeRaw(ctx context.Context, method string, in []byte, cc *ClientConn, opts ...CallOption) ([]byte, error) {
+	var out []byte
+	if err := Invoke(ctx, method, in, &out, cc, append(opts[:len(opts):len(opts)], rawCall)...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// attemptKey is the context key of the number of the attempt of a unary RPC.
+type attemptKey struct{}
+
+// AttemptFromContext returns the number of the attempt of a unary RPC,
+// starting at 1, if ctx is the context of an attempt. The stats of an
+// attempt, e.g., OutHeader and InPayload, are reported with such a context so
+// that the stats handler can tell the retries apart. Begin and End are
+// reported with the context of the RPC.
+func AttemptFromContext(ctx context.Context) (attempt int, ok bool) {
+	attempt, ok = ctx.Value(attemptKey{}).(int)
+	return
+}
+
+// invoke is the UnaryInvoker which performs a unary RPC on cc.
+func invoke(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, opts ...CallOption) (err error) {
+	cc.rpcStarted()
+	defer cc.rpcDone()
+	// The MethodConfig sets the defaults overridden by the CallOptions.
+	mc, _ := cc.GetMethodConfig(method)
+	c := callInfo{
+		maxAttempts:    mc.MaxAttempts,
+		maxRecvMsgSize: mc.MaxRecvMsgSize,
+		maxSendMsgSize: mc.MaxSendMsgSize,
+	}
+	if mc.WaitForReady != nil {
+		c.failFast = !*mc.WaitForReady
+	}
+	timeout := mc.Timeout
+	if _, ok := ctx.Deadline(); !ok && timeout <= 0 {
+		timeout = cc.dopts.callTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	for _, o := range opts {
 		if err := o.before(&c); err != nil {
 			return toRPCErr(err)
@@ -115,58 +449,163 @@ func Invoke(ctx context.Context, method string, args, reply proto.Message, cc *C
 			o.after(&c)
 		}
 	}()
-	host, _, err := net.SplitHostPort(cc.target)
-	if err != nil {
-		return toRPCErr(err)
+	sh := cc.dopts.sh
+	if sh != nil {
+		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: method})
+		sh.HandleRPC(ctx, &stats.Begin{
+			Client:    true,
+			BeginTime: time.Now(),
+			FailFast:  c.failFast,
+		})
+		defer func() {
+			sh.HandleRPC(ctx, &stats.End{
+				Client:  true,
+				EndTime: time.Now(),
+				Error:   err,
+			})
+		}()
+	}
+	var tr trace.Trace
+	if cc.dopts.tracing {
+		tr = newTrace(true, method)
+		defer func() {
+			finishTrace(tr, err)
+		}()
+	}
+	if c.maxRecvMsgSize <= 0 {
+		c.maxRecvMsgSize = cc.dopts.maxRecvMsgSize
+	}
+	if c.maxSendMsgSize <= 0 {
+		c.maxSendMsgSize = cc.dopts.maxSendMsgSize
 	}
 	callHdr := &transport.CallHdr{
-		Host:   host,
-		Method: method,
+		Host:           cc.authority,
+		Method:         method,
+		AcceptCompress: acceptCompress(),
+	}
+	var cp Compressor
+	cp, callHdr.SendCompress = callCompressor(cc.dopts.cp, c.compressorType)
+	codec := cc.dopts.codec
+	if c.contentSubtype != "" {
+		codec = codecs[c.contentSubtype]
+	}
+	callHdr.ContentSubtype = contentSubtype(codec)
+	callHdr.ContentType = cc.dopts.contentType
+	if c.contentType != "" {
+		callHdr.ContentType = c.contentType
+	}
+	if c.raw {
+		codec = rawCodec{codec}
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md, err = perRPCMetadata(ctx, cc, c.creds, method, md)
+	if err != nil {
+		return err
 	}
+	callHdr.Metadata = md
 	topts := &transport.Options{
 		Last:  true,
 		Delay: false,
 	}
-	ts := 0
-	var lastErr error // record the error that happened
-	for {
-		var (
-			err    error
-			t      transport.ClientTransport
-			stream *transport.Stream
-		)
-		// TODO(zhaoq): Need a formal spec of retry strategy for non-failfast rpcs.
-		if lastErr != nil && c.failFast {
-			return toRPCErr(lastErr)
-		}
-		t, ts, err = cc.wait(ctx, ts)
+	rp := cc.dopts.retryPolicy
+	if mc.RetryPolicy != nil {
+		rp = *mc.RetryPolicy
+	}
+	maxAttempts := rp.MaxAttempts
+	if c.maxAttempts > 0 {
+		maxAttempts = c.maxAttempts
+	}
+	if c.noRetry {
+		maxAttempts = 1
+	}
+	// connErr is the ConnectionError which failed the previous attempt. It
+	// is nil on the first attempt.
+	var connErr error
+	for attempt := 1; ; attempt++ {
+		// No attempt is made once ctx is done, whatever failed the previous
+		// one.
+		if err := ctx.Err(); err != nil {
+			return toRPCErr(err)
+		}
+		if attempt > 1 {
+			// Back off before the retry. Give up as soon as ctx is done.
+			timer := cc.dopts.newTimer(rp.backoff(attempt - 2))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return toRPCErr(ctx.Err())
+			case <-timer.C:
+			}
+		}
+		callHdr.Timeout = timeoutFromContext(ctx)
+		// Ask the balancer on every attempt so that a retry may land on a
+		// different backend.
+		t, err := cc.getTransport(ctx, c.failFast)
 		if err != nil {
-			if lastErr != nil {
+			if _, ok := err.(transport.StreamError); ok {
+				// ctx is done.
+				return toRPCErr(err)
+			}
+			if connErr != nil {
 				// This was a retry; return the error from the last attempt.
-				return toRPCErr(lastErr)
+				return toRPCErr(connErr)
+			}
+			switch err.(type) {
+			case rpcError:
+				return err
+			}
+			if err == ErrClientConnTransientFailure {
+				return Errorf(codes.Unavailable, "%v", err)
 			}
 			return Errorf(codes.Internal, "%v", err)
 		}
-		stream, err = sendRPC(ctx, callHdr, t, args, topts)
-		if err != nil {
-			if _, ok := err.(transport.ConnectionError); ok {
-				lastErr = err
-				continue
+		c.peer = &peer.Peer{
+			Addr: t.RemoteAddr(),
+		}
+		if tr != nil {
+			if connErr == nil {
+				tr.LazyLog(&firstLine{client: true, remoteAddr: t.RemoteAddr(), deadline: callHdr.Timeout}, false)
+			} else {
+				tr.LazyPrintf("retry attempt %d to %v after: %v", attempt, t.RemoteAddr(), connErr)
+			}
+		}
+		actx := context.WithValue(ctx, attemptKey{}, attempt)
+		stream, err := sendRPC(actx, sh, codec, callHdr, t, args, cp, c.maxSendMsgSize, topts)
+		if err == nil {
+			// The stream knows the auth information of the transport too.
+			if p, ok := peer.FromContext(stream.Context()); ok {
+				c.peer = p
 			}
-			if lastErr != nil {
-				return toRPCErr(lastErr)
+			// Receive the response
+			err = recv(actx, sh, codec, t, &c, stream, reply)
+			if _, ok := err.(transport.ConnectionError); !ok {
+				t.CloseStream(stream, err)
+				if err != nil {
+					return toRPCErr(err)
+				}
+				if err := statusError(stream); err != nil {
+					return err
+				}
+				cc.throttler.succeed()
+				return nil
 			}
+		}
+		if e, ok := err.(transport.ConnectionError); !ok || !e.Temporary() {
+			// A GOAWAY with an error is not retried.
 			return toRPCErr(err)
 		}
-		// Receive the response
-		lastErr = recv(t, &c, stream, reply)
-		if _, ok := lastErr.(transport.ConnectionError); ok {
-			continue
+		// The attempt failed with a ConnectionError; retry unless it was
+		// the last one allowed or the retries of cc are throttled.
+		throttled := cc.throttler.throttle()
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return toRPCErr(err)
 		}
-		t.CloseStream(stream, lastErr)
-		if lastErr != nil {
-			return toRPCErr(lastErr)
+		if throttled {
+			if tr != nil {
+				tr.LazyPrintf("retry throttled after: %v", err)
+			}
+			return toRPCErr(err)
 		}
-		return Errorf(stream.StatusCode(), stream.StatusDesc())
+		connErr = err
 	}
 }
@@ -0,0 +1,193 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/transport"
+)
+
+// backoffRecorder records the backoffs of a ClientConn while firing their
+// timers right away.
+type backoffRecorder struct {
+	mu sync.Mutex
+	ds []time.Duration
+}
+
+// dialOption returns the DialOption making the ClientConn back off with r.
+func (r *backoffRecorder) dialOption() DialOption {
+	return func(o *dialOptions) {
+		o.newTimer = r.newTimer
+	}
+}
+
+func (r *backoffRecorder) newTimer(d time.Duration) *time.Timer {
+	r.mu.Lock()
+	r.ds = append(r.ds, d)
+	r.mu.Unlock()
+	return time.NewTimer(0)
+}
+
+// atLeast returns the recorded backoffs which are at least min.
+func (r *backoffRecorder) atLeast(min time.Duration) []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ds []time.Duration
+	for _, d := range r.ds {
+		if d >= min {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// startClosingServer starts a server whose transports are closed as soon as a
+// stream arrives, which fails the RPCs with a transport.ConnectionError.
+func startClosingServer(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			st, err := transport.NewServerTransport("http2", conn, &transport.ServerConfig{MaxStreams: math.MaxUint32})
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go st.HandleStreams(func(*transport.Stream) {
+				st.Close()
+			})
+		}
+	}()
+	return lis
+}
+
+func TestInvokeRetryBackoff(t *testing.T) {
+	r := &backoffRecorder{}
+	lis := startClosingServer(t)
+	defer lis.Close()
+	cc, err := Dial(lis.Addr().String(), WithInsecure(), r.dialOption(), WithRetryPolicy(RetryPolicy{
+		MaxAttempts:       4,
+		InitialBackoff:    10 * time.Hour,
+		MaxBackoff:        30 * time.Hour,
+		BackoffMultiplier: 2,
+	}))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := InvokeRaw(ctx, "/foo/Bar", nil, cc); Code(err) != codes.Unavailable {
+		t.Fatalf("InvokeRaw(_, \"/foo/Bar\", _, _) = _, %v, want _, error code: %d", err, codes.Unavailable)
+	}
+	// The reconnection backoffs are shorter.
+	want := []time.Duration{10 * time.Hour, 20 * time.Hour, 30 * time.Hour}
+	if got := r.atLeast(10 * time.Hour); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the retries backed off for %v, want %v", got, want)
+	}
+}
+
+// attemptRecorder is a stats.Handler recording the attempt of each OutHeader
+// event, or 0 if its context has none.
+type attemptRecorder struct {
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (r *attemptRecorder) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *attemptRecorder) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	attempt, _ := AttemptFromContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch s.(type) {
+	case *stats.Begin, *stats.End:
+		if attempt != 0 {
+			r.attempts = append(r.attempts, -attempt)
+		}
+	case *stats.OutHeader:
+		r.attempts = append(r.attempts, attempt)
+	}
+}
+
+func TestAttemptFromContext(t *testing.T) {
+	lis := startClosingServer(t)
+	defer lis.Close()
+	r := &attemptRecorder{}
+	cc, err := Dial(lis.Addr().String(), WithInsecure(), WithStatsHandler(r), WithRetryPolicy(RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    10 * time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+		BackoffMultiplier: 1,
+	}), WithBackoffConfig(BackoffConfig{
+		BaseDelay:  10 * time.Millisecond,
+		MaxDelay:   10 * time.Millisecond,
+		Multiplier: 1,
+	}))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := InvokeRaw(ctx, "/foo/Bar", nil, cc); Code(err) != codes.Unavailable {
+		t.Fatalf("InvokeRaw(_, \"/foo/Bar\", _, _) = _, %v, want _, error code: %d", err, codes.Unavailable)
+	}
+	if _, ok := AttemptFromContext(ctx); ok {
+		t.Fatalf("AttemptFromContext(%v) = _, true, want _, false", ctx)
+	}
+	// Begin and End have no attempt.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(r.attempts, want) {
+		t.Fatalf("the OutHeader events had the attempts %v, want %v", r.attempts, want)
+	}
+}
@@ -35,12 +35,20 @@ package grpc
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/transport"
 )
 
@@ -53,183 +61,1624 @@ var (
 	// ErrClientConnTimeout indicates that the connection could not be
 	// established or re-established within the specified timeout.
 	ErrClientConnTimeout = errors.New("grpc: timed out trying to connect")
+	// ErrClientConnTransientFailure indicates that a failfast RPC was issued
+	// while the ClientConn failed to reach the server and is reconnecting.
+	ErrClientConnTransientFailure = errors.New("grpc: the client connection is in transient failure")
+	// ErrNoTransportSecurity indicates that Dial is given neither
+	// WithTransportCredentials nor WithInsecure.
+	ErrNoTransportSecurity = errors.New("grpc: no transport security set (use grpc.WithInsecure() explicitly or set credentials)")
+	// ErrCredentialsConflict indicates that Dial is given both
+	// WithTransportCredentials and WithInsecure.
+	ErrCredentialsConflict = errors.New("grpc: transport credentials are set for an insecure connection (grpc.WithTransportCredentials() and grpc.WithInsecure() are both called)")
+	// errConnDrain indicates that the connection starts to be torn down
+	// because its address is no longer notified by the balancer.
+	errConnDrain = errors.New("grpc: the connection is drained")
+	// errConnReset indicates that the transport of the connection failed and
+	// is being recreated.
+	errConnReset = errors.New("grpc: the connection is being reset")
 )
 
+// dialOptions configure a Dial call. dialOptions are set by the DialOption
+// values passed to Dial.
+type dialOptions struct {
+	authority      string
+	codec          Codec
+	contentType    string
+	cp             Compressor
+	retryPolicy    RetryPolicy
+	throttling     *retryThrottling
+	methodConfig   map[string]MethodConfig
+	serviceConfig  string
+	bc             BackoffConfig
+	unaryInt       UnaryClientInterceptor
+	chainUnaryInts []UnaryClientInterceptor
+	callOptions    []CallOption
+	maxRecvMsgSize int
+	maxSendMsgSize int
+	block          bool
+	idleTimeout    time.Duration
+	callTimeout    time.Duration
+	poolSize       int
+	resolver       naming.Resolver
+	balancer       Balancer
+	perRPCCreds    []credentials.PerRPCCredentials
+	sh             stats.Handler
+	tracing        bool
+	// insecure is set by WithInsecure.
+	insecure bool
+	// newTimer creates the timers of the backoffs between the attempts of
+	// the RPCs and the connection attempts. Tests replace it to observe the
+	// backoffs without waiting for them.
+	newTimer func(d time.Duration) *time.Timer
+	copts    transport.DialOptions
+}
+
 // DialOption configures how we set up the connection.
-type DialOption func(*transport.DialOptions)
+type DialOption func(*dialOptions)
+
+// WithCodec returns a DialOption which sets a Codec for message encoding and
+// decoding. The default is protobuf.
+func WithCodec(c Codec) DialOption {
+	return func(o *dialOptions) {
+		o.codec = c
+	}
+}
+
+// WithContentType returns a DialOption which sets the content-type sent with
+// the RPCs of the ClientConn, e.g., "application/grpc+proto" for a proxy
+// which requires the subtype. It does not change the Codec. By default, the
+// content-type is derived from the Codec. ct must start with
+// "application/grpc", otherwise Dial fails.
+func WithContentType(ct string) DialOption {
+	return func(o *dialOptions) {
+		o.contentType = ct
+	}
+}
+
+// WithCompressor returns a DialOption which sets a Compressor to use for
+// message compression on the outbound RPCs.
+func WithCompressor(cp Compressor) DialOption {
+	return func(o *dialOptions) {
+		o.cp = cp
+	}
+}
+
+// WithRetryPolicy returns a DialOption which sets the RetryPolicy of the
+// unary RPCs on the ClientConn. By default, an RPC is retried without
+// an attempt limit, backing off from 100ms up to 1s between attempts. The
+// backoff fields of p which are not set take these default values.
+func WithRetryPolicy(p RetryPolicy) DialOption {
+	return func(o *dialOptions) {
+		o.retryPolicy = p.withDefaults()
+	}
+}
+
+// retryThrottling holds the parameters of the retryThrottler of a
+// ClientConn.
+type retryThrottling struct {
+	maxTokens  float64
+	tokenRatio float64
+}
+
+// WithRetryThrottling returns a DialOption which throttles the retries of
+// the unary RPCs of the ClientConn so that a failing server does not get
+// flooded by them. Every attempt failing with a transport.ConnectionError
+// takes a token out of a bucket of maxTokens tokens and every successful RPC
+// puts back tokenRatio tokens. The RPCs are not retried while the bucket is
+// at most half full. maxTokens must be in (0, 1000] and tokenRatio must be
+// positive, otherwise Dial fails. It overrides the retryThrottling of the
+// service config. By default, the retries are not throttled.
+func WithRetryThrottling(maxTokens, tokenRatio float64) DialOption {
+	return func(o *dialOptions) {
+		o.throttling = &retryThrottling{maxTokens: maxTokens, tokenRatio: tokenRatio}
+	}
+}
+
+// validate returns an error if the parameters of rt are out of range.
+func (rt *retryThrottling) validate() error {
+	if rt.maxTokens <= 0 || rt.maxTokens > 1000 {
+		return fmt.Errorf("grpc: maxTokens %v of the retry throttling is not in (0, 1000]", rt.maxTokens)
+	}
+	if rt.tokenRatio <= 0 {
+		return fmt.Errorf("grpc: non-positive tokenRatio %v of the retry throttling", rt.tokenRatio)
+	}
+	return nil
+}
+
+// MethodConfig defines the defaults of the unary RPCs of a method. The
+// CallOptions of an RPC override them.
+type MethodConfig struct {
+	// WaitForReady, if it is not nil, sets the default of FailFast to its
+	// negation.
+	WaitForReady *bool
+	// Timeout, if it is positive, bounds the RPCs unless their context has
+	// an earlier deadline.
+	Timeout time.Duration
+	// MaxAttempts, if it is positive, sets the default of MaxCallAttempts.
+	MaxAttempts int
+	// RetryPolicy, if it is not nil, replaces the RetryPolicy of the
+	// ClientConn.
+	RetryPolicy *RetryPolicy
+	// MaxRecvMsgSize and MaxSendMsgSize, if they are positive, set the
+	// defaults of MaxCallRecvMsgSize and MaxCallSendMsgSize.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+// WithMethodConfig returns a DialOption which sets the MethodConfig of the
+// methods of the ClientConn. The keys of mc are the full method names, e.g.,
+// "/package.service/method", or the service names, e.g., "/package.service",
+// which apply to the methods of the service without an entry of their own.
+func WithMethodConfig(mc map[string]MethodConfig) DialOption {
+	return func(o *dialOptions) {
+		o.methodConfig = mc
+	}
+}
+
+// WithServiceConfig returns a DialOption which applies the JSON service config
+// js, as documented in
+// https://github.com/grpc/grpc/blob/master/doc/service_config.md, to the
+// ClientConn. Its method configs set the MethodConfig of the methods without
+// an entry given to WithMethodConfig, its retry throttling is used unless
+// WithRetryThrottling is given and its load balancing policy is used unless
+// WithBalancer is given. Only "round_robin" is supported. Dial fails
+// if js cannot be parsed.
+func WithServiceConfig(js string) DialOption {
+	return func(o *dialOptions) {
+		o.serviceConfig = js
+	}
+}
+
+// WithBackoffConfig returns a DialOption which sets the BackoffConfig used
+// between the attempts to (re)connect to the server. DefaultBackoffConfig is
+// used if it is not given.
+func WithBackoffConfig(b BackoffConfig) DialOption {
+	return func(o *dialOptions) {
+		o.bc = b
+	}
+}
+
+// WithMaxRecvMsgSize returns a DialOption which sets the maximum size in bytes
+// of a message the ClientConn accepts. Receiving a larger message fails the
+// RPC with codes.ResourceExhausted. The default is 4MB; zero means no limit.
+func WithMaxRecvMsgSize(n int) DialOption {
+	return func(o *dialOptions) {
+		o.maxRecvMsgSize = n
+	}
+}
+
+// WithMaxSendMsgSize returns a DialOption which sets the maximum size in bytes
+// of a message the ClientConn sends. Sending a larger message fails the RPC
+// with codes.ResourceExhausted before anything is written to the transport.
+// By default there is no limit.
+func WithMaxSendMsgSize(n int) DialOption {
+	return func(o *dialOptions) {
+		o.maxSendMsgSize = n
+	}
+}
+
+const (
+	// defaultKeepaliveTime is used if WithKeepaliveParams is given a zero
+	// Time. It is the minimum ping interval typical servers accept.
+	defaultKeepaliveTime = 5 * time.Minute
+	// minKeepaliveTime is the lower bound of the ping interval.
+	minKeepaliveTime = 10 * time.Second
+	// defaultKeepaliveTimeout is used if WithKeepaliveParams is given a zero
+	// Timeout.
+	defaultKeepaliveTimeout = 20 * time.Second
+)
+
+// WithKeepaliveParams returns a DialOption which enables the keepalive pings
+// on the transports of the ClientConn. A zero kp.Time defaults to 5 minutes
+// and a kp.Time below 10 seconds is raised to 10 seconds; a zero kp.Timeout
+// defaults to 20 seconds. A transport whose ping is not acknowledged in time
+// is closed, which fails its RPCs with a connection error.
+func WithKeepaliveParams(kp keepalive.ClientParameters) DialOption {
+	if kp.Time == 0 {
+		kp.Time = defaultKeepaliveTime
+	}
+	if kp.Time < minKeepaliveTime {
+		kp.Time = minKeepaliveTime
+	}
+	if kp.Timeout == 0 {
+		kp.Timeout = defaultKeepaliveTimeout
+	}
+	return func(o *dialOptions) {
+		o.copts.KeepaliveParams = kp
+	}
+}
+
+// WithUnaryInterceptor returns a DialOption which installs i to intercept
+// all the unary RPCs made on the ClientConn.
+func WithUnaryInterceptor(i UnaryClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.unaryInt = i
+	}
+}
+
+// WithDefaultCallOptions returns a DialOption which sets the CallOptions
+// applied to all the RPCs made on the ClientConn. They are applied before the
+// CallOptions of each RPC, which override them. Like when they are passed to
+// a streaming RPC, Header, Trailer, Peer, MaxCallAttempts and DisableRetry
+// have no effect on the streaming RPCs.
+func WithDefaultCallOptions(cos ...CallOption) DialOption {
+	return func(o *dialOptions) {
+		o.callOptions = append(o.callOptions, cos...)
+	}
+}
+
+// WithChainUnaryInterceptor returns a DialOption which installs the chain of
+// interceptors ints for the unary RPCs made on the ClientConn. The first
+// interceptor is the outermost one: each one runs the rest of the chain by
+// calling its invoker, and the invoker of the last one performs the RPC. The
+// interceptor installed by WithUnaryInterceptor, if any, runs before the
+// chain.
+func WithChainUnaryInterceptor(ints ...UnaryClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.chainUnaryInts = append(o.chainUnaryInts, ints...)
+	}
+}
 
 // WithTransportCredentials returns a DialOption which configures a
 // connection level security credentials (e.g., TLS/SSL).
 func WithTransportCredentials(creds credentials.TransportAuthenticator) DialOption {
-	return func(o *transport.DialOptions) {
-		o.AuthOptions = append(o.AuthOptions, creds)
+	return func(o *dialOptions) {
+		o.copts.TransportCredentials = creds
+	}
+}
+
+// WithInsecure returns a DialOption which disables the transport security of
+// the connection. Dial fails unless either WithInsecure or
+// WithTransportCredentials is given, so that plaintext connections are always
+// an explicit choice.
+func WithInsecure() DialOption {
+	return func(o *dialOptions) {
+		o.insecure = true
 	}
 }
 
 // WithPerRPCCredentials returns a DialOption which sets
-// credentials which will place auth state on each outbound RPC.
-func WithPerRPCCredentials(creds credentials.Credentials) DialOption {
-	return func(o *transport.DialOptions) {
-		o.AuthOptions = append(o.AuthOptions, creds)
+// credentials which will place auth state on each outbound RPC. They are the
+// default of the RPCs without PerRPCCredsCallOption.
+func WithPerRPCCredentials(creds credentials.PerRPCCredentials) DialOption {
+	return func(o *dialOptions) {
+		o.perRPCCreds = append(o.perRPCCreds, creds)
+	}
+}
+
+// WithBlock returns a DialOption which makes Dial and DialContext block until
+// the first transport is up, the dial timeout expires or the context of
+// DialContext is done. If the balancer notifies no address at first, e.g.,
+// before the resolver has found any, they keep waiting for one.
+func WithBlock() DialOption {
+	return func(o *dialOptions) {
+		o.block = true
+	}
+}
+
+// WithResolver returns a DialOption which makes the default balancer resolve
+// the target with r, and connect to the resolved addresses instead of dialing
+// the target itself. It has no effect if WithBalancer is given.
+func WithResolver(r naming.Resolver) DialOption {
+	return func(o *dialOptions) {
+		o.resolver = r
+	}
+}
+
+// WithBalancer returns a DialOption which sets a load balancer to pick the
+// address of each RPC. The default is RoundRobin over the addresses resolved
+// by the resolver given to WithResolver, or over the target itself.
+func WithBalancer(b Balancer) DialOption {
+	return func(o *dialOptions) {
+		o.balancer = b
+	}
+}
+
+// WithStatsHandler returns a DialOption which makes h receive the stats of
+// all the RPCs made on the ClientConn.
+func WithStatsHandler(h stats.Handler) DialOption {
+	return func(o *dialOptions) {
+		o.sh = h
+	}
+}
+
+// WithTracing returns a DialOption which traces the RPCs made on the
+// ClientConn using golang.org/x/net/trace, so that they show up on
+// /debug/requests.
+func WithTracing() DialOption {
+	return func(o *dialOptions) {
+		o.tracing = true
+	}
+}
+
+// WithInitialWindowSize returns a DialOption which sets the receive window
+// of each stream, i.e., how many bytes the server may send on a stream before
+// the client reads them. A larger window keeps more data in flight and
+// improves the throughput of the streams on links with a large
+// bandwidth-delay product, at the cost of buffering up to that many bytes
+// per stream in memory when the application reads slowly. Values smaller than
+// the HTTP2 default of 64KB are ignored.
+func WithInitialWindowSize(s int32) DialOption {
+	return func(o *dialOptions) {
+		o.copts.InitialWindowSize = s
+	}
+}
+
+// WithInitialConnWindowSize returns a DialOption which sets the receive
+// window of each connection, which bounds the unread bytes across all the
+// streams on it. It should be at least the stream window in order not to
+// throttle a single fast stream. The memory tradeoff is the same as that of
+// WithInitialWindowSize. Values smaller than the HTTP2 default of 64KB are
+// ignored.
+func WithInitialConnWindowSize(s int32) DialOption {
+	return func(o *dialOptions) {
+		o.copts.InitialConnWindowSize = s
+	}
+}
+
+// WithWriteBufferSize returns a DialOption which makes the transports buffer
+// the frames they write in s bytes, so that the frames written together,
+// e.g., the header frames of a stream, are sent with a single system call.
+// Each connection allocates s bytes once it is established. Zero, the
+// default, disables the buffer.
+func WithWriteBufferSize(s int) DialOption {
+	return func(o *dialOptions) {
+		o.copts.WriteBufferSize = s
+	}
+}
+
+// WithReadBufferSize returns a DialOption which makes the transports read the
+// connection through a buffer of s bytes, which saves system calls when the
+// server sends many small frames, e.g., on a chatty stream. Each connection
+// allocates s bytes once it is established. Zero, the default, disables the
+// buffer.
+func WithReadBufferSize(s int) DialOption {
+	return func(o *dialOptions) {
+		o.copts.ReadBufferSize = s
+	}
+}
+
+// WithAuthority returns a DialOption which sets the authority (the
+// :authority header, i.e., the virtual host) of the RPCs instead of the one
+// derived from the dial target, e.g., when dialing an IP address or a proxy.
+// If the transport credentials authenticate the server by name, the name
+// must match the host of a; if they use the dialed host, they authenticate
+// the server against the host of a instead.
+func WithAuthority(a string) DialOption {
+	return func(o *dialOptions) {
+		o.authority = a
+	}
+}
+
+// WithMaxHeaderListSize returns a DialOption which sets the limit of the size
+// of the header lists the client accepts from the servers, as defined for the
+// HTTP2 SETTINGS_MAX_HEADER_LIST_SIZE, which is announced to them. The RPCs
+// whose header or trailer exceeds it fail with codes.Internal. Zero, the
+// default, means no limit.
+func WithMaxHeaderListSize(n uint32) DialOption {
+	return func(o *dialOptions) {
+		o.copts.MaxHeaderListSize = n
+	}
+}
+
+// WithMaxBufferedBytes returns a DialOption which sets the limit of the bytes
+// buffered by each connection: the bytes of the messages received and not read
+// yet by the RPCs and those being written. Beyond it the new RPCs on the
+// connection fail with codes.ResourceExhausted, and the connection no longer
+// updates its flow control window until the RPCs read their messages. Zero,
+// the default, means no limit.
+func WithMaxBufferedBytes(n int) DialOption {
+	return func(o *dialOptions) {
+		o.copts.MaxBufferedBytes = n
+	}
+}
+
+// WithFrameHook returns a DialOption which applies h to the frames written to
+// the servers, e.g., to test how they cope with malformed frames.
+func WithFrameHook(h transport.FrameHook) DialOption {
+	return func(o *dialOptions) {
+		o.copts.FrameHook = h
+	}
+}
+
+// WithUserAgent returns a DialOption which prepends ua to the user-agent of
+// grpc-go sent with the RPCs. Dial fails if ua is not printable ASCII.
+func WithUserAgent(ua string) DialOption {
+	return func(o *dialOptions) {
+		o.copts.UserAgent = ua
+	}
+}
+
+// WithHeaderHook returns a DialOption which applies h to the header fields
+// of every RPC before they are written, e.g., to reorder or check them for a
+// strict intermediary. An RPC whose fields h rejects fails with
+// codes.Internal.
+func WithHeaderHook(h transport.HeaderHook) DialOption {
+	return func(o *dialOptions) {
+		o.copts.HeaderHook = h
+	}
+}
+
+// WithIdleTimeout returns a DialOption which closes the transports of the
+// ClientConn once it has had no RPC in flight for d. The ClientConn then
+// becomes Idle and reconnects on the next RPC, which waits for the new
+// transport instead of failing. By default, the transports are kept open.
+func WithIdleTimeout(d time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// WithDefaultCallTimeout returns a DialOption which bounds the unary RPCs of
+// the ClientConn to d when their context has no deadline and their
+// MethodConfig has no Timeout. It is a convenience for simple clients: the
+// deadline of the context, when there is one, always takes precedence and
+// is what cancels an RPC.
+func WithDefaultCallTimeout(d time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.callTimeout = d
+	}
+}
+
+// WithConnPoolSize returns a DialOption which makes the ClientConn keep n
+// transports to each address instead of one. The RPCs to an address go to its
+// transports in a round robin, skipping those which have reached the limit of
+// concurrent streams set by the server. It avoids queuing the RPCs behind a
+// single transport when the server has a low MaxConcurrentStreams. Dial fails
+// if n is not positive.
+func WithConnPoolSize(n int) DialOption {
+	return func(o *dialOptions) {
+		o.poolSize = n
 	}
 }
 
 // WithTimeout returns a DialOption that configures a timeout for dialing a client connection.
 func WithTimeout(d time.Duration) DialOption {
-	return func(o *transport.DialOptions) {
-		o.Timeout = d
+	return func(o *dialOptions) {
+		o.copts.Timeout = d
+	}
+}
+
+// WithConnectTimeout returns a DialOption that bounds the establishment of
+// each connection, from the dial until the HTTP/2 settings of the server are
+// received. A connection which does not complete it in time is closed and
+// reconnected. It defaults to 20 seconds.
+func WithConnectTimeout(d time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.copts.ConnectTimeout = d
+	}
+}
+
+// WithTCPKeepAlive returns a DialOption that enables the TCP keepalive probes
+// of the connections, sent every d, if d is positive, or disables them if d is
+// negative. By default, the connections keep the setting of the net package.
+func WithTCPKeepAlive(d time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.copts.TCPKeepAlive = d
+	}
+}
+
+// WithTCPNoDelay returns a DialOption that sets whether TCP_NODELAY is set on
+// the connections. It is by default, so that the messages are not delayed by
+// Nagle's algorithm; WithTCPNoDelay(false) trades the latency for fewer
+// packets.
+func WithTCPNoDelay(noDelay bool) DialOption {
+	return func(o *dialOptions) {
+		o.copts.TCPDelay = !noDelay
 	}
 }
 
-// Dial creates a client connection the given target.
-// TODO(zhaoq): Have an option to make Dial return immediately without waiting
-// for connection to complete.
+// WithDialer returns a DialOption that specifies a function to connect to the
+// addresses of the servers instead of net.Dial, e.g., to dial over a unix
+// socket or an in-memory pipe. ctx is done once the timeout set by
+// WithTimeout expires or the connection attempt is aborted. The transport
+// credentials, if any, secure the connections it returns.
+func WithDialer(f func(ctx context.Context, addr string) (net.Conn, error)) DialOption {
+	return func(o *dialOptions) {
+		o.copts.Dialer = f
+	}
+}
+
+// Dial creates a client connection the given target. Unless WithBlock is
+// given, Dial returns immediately and the connection is established in the
+// background; the RPCs issued in the meantime wait for it.
+//
+// Dial used to block until the connection was up and fail if it could not be
+// established before the timeout set by WithTimeout. Callers relying on that,
+// e.g., to check the connectivity at startup, must now pass WithBlock.
 func Dial(target string, opts ...DialOption) (*ClientConn, error) {
+	return DialContext(context.Background(), target, opts...)
+}
+
+// DialContext creates a client connection to the given target. With
+// WithBlock, it gives up establishing the connection, including an
+// in-progress TCP or security handshake, and returns ctx.Err() once ctx is
+// done. ctx is not used after DialContext returns.
+func DialContext(ctx context.Context, target string, opts ...DialOption) (*ClientConn, error) {
 	if target == "" {
 		return nil, ErrUnspecTarget
 	}
 	cc := &ClientConn{
-		target: target,
+		target:    target,
+		authority: authority(target),
+		dopts: dialOptions{
+			codec:          protoCodec{},
+			retryPolicy:    defaultRetryPolicy,
+			bc:             DefaultBackoffConfig,
+			maxRecvMsgSize: defaultMaxMsgSize,
+			poolSize:       1,
+			newTimer:       time.NewTimer,
+		},
+		conns:      make(map[Address]*addrPool),
+		closeCh:    make(chan struct{}),
+		stateCh:    make(chan struct{}),
+		lastActive: time.Now(),
 	}
 	for _, opt := range opts {
 		opt(&cc.dopts)
 	}
-	if err := cc.resetTransport(false); err != nil {
+	if len(cc.dopts.chainUnaryInts) > 0 {
+		ints := cc.dopts.chainUnaryInts
+		if cc.dopts.unaryInt != nil {
+			ints = append([]UnaryClientInterceptor{cc.dopts.unaryInt}, ints...)
+		}
+		cc.dopts.unaryInt = chainUnaryClientInterceptors(ints)
+	}
+	switch creds := cc.dopts.copts.TransportCredentials; {
+	case creds == nil && !cc.dopts.insecure:
+		return nil, ErrNoTransportSecurity
+	case creds != nil && cc.dopts.insecure:
+		return nil, ErrCredentialsConflict
+	}
+	if ct := cc.dopts.contentType; ct != "" && !validContentType(ct) {
+		return nil, fmt.Errorf("grpc: %q is not a gRPC content-type", ct)
+	}
+	if ua := cc.dopts.copts.UserAgent; !validHeaderValue(ua) {
+		return nil, fmt.Errorf("grpc: %q is not a valid user-agent", ua)
+	}
+	if n := cc.dopts.poolSize; n <= 0 {
+		return nil, fmt.Errorf("grpc: the connection pool size %d is not positive", n)
+	}
+	if cc.dopts.authority != "" {
+		if err := cc.setAuthority(cc.dopts.authority); err != nil {
+			return nil, err
+		}
+	}
+	if cc.dopts.serviceConfig != "" {
+		sc, err := parseServiceConfig(cc.dopts.serviceConfig)
+		if err != nil {
+			return nil, err
+		}
+		for k, mc := range cc.dopts.methodConfig {
+			sc.methods[k] = mc
+		}
+		cc.dopts.methodConfig = sc.methods
+		if cc.dopts.throttling == nil {
+			cc.dopts.throttling = sc.throttling
+		}
+	}
+	if rt := cc.dopts.throttling; rt != nil {
+		if err := rt.validate(); err != nil {
+			return nil, err
+		}
+		cc.throttler = newRetryThrottler(rt.maxTokens, rt.tokenRatio)
+	}
+	// RoundRobin is both the default and the "round_robin" policy of the
+	// service config.
+	if cc.dopts.balancer == nil {
+		cc.dopts.balancer = RoundRobin(cc.dopts.resolver)
+	}
+	if err := cc.dopts.balancer.Start(target); err != nil {
 		return nil, err
 	}
-	cc.shutdownChan = make(chan struct{})
-	// Start to monitor the error status of transport.
-	go cc.transportMonitor()
+	if cc.dopts.block {
+		var timeout <-chan time.Time
+		if d := cc.dopts.copts.Timeout; d > 0 {
+			timer := cc.dopts.newTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var addrs []Address
+		// There is no transport to wait for until an address is notified.
+		for len(addrs) == 0 {
+			var ok bool
+			select {
+			case <-ctx.Done():
+				cc.Close()
+				return nil, ctx.Err()
+			case <-timeout:
+				cc.Close()
+				return nil, ErrClientConnTimeout
+			case addrs, ok = <-cc.dopts.balancer.Notify():
+				if !ok {
+					cc.Close()
+					return nil, ErrClientConnClosing
+				}
+			}
+		}
+		for _, a := range addrs {
+			if err := cc.newAddrConn(ctx, a, true); err != nil {
+				cc.Close()
+				return nil, err
+			}
+		}
+	}
+	go cc.lbWatcher()
+	if cc.dopts.idleTimeout > 0 {
+		go cc.idleMonitor()
+	}
 	return cc, nil
 }
 
+// ConnectivityState indicates the state of a ClientConn.
+type ConnectivityState int
+
+const (
+	// Idle indicates the ClientConn is idle.
+	Idle ConnectivityState = iota
+	// Connecting indicates the ClientConn is connecting.
+	Connecting
+	// Ready indicates the ClientConn is ready for work.
+	Ready
+	// TransientFailure indicates the ClientConn has seen a failure but
+	// expects to recover.
+	TransientFailure
+	// Shutdown indicates the ClientConn has started shutting down.
+	Shutdown
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case Idle:
+		return "IDLE"
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	default:
+		return fmt.Sprintf("ConnectivityState(%d)", int(s))
+	}
+}
+
+// authority returns the authority of target, which is either "host:port" or
+// "scheme://authority/name". It is the host of the name in the target.
+func authority(target string) string {
+	name := target
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+len("://"):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+	return name
+}
+
+// setAuthority makes cc send a as the authority of the RPCs and checks it
+// against the server name expected by the transport credentials.
+func (cc *ClientConn) setAuthority(a string) error {
+	host := a
+	if h, _, err := net.SplitHostPort(a); err == nil {
+		host = h
+	}
+	if c, ok := cc.dopts.copts.TransportCredentials.(credentials.ServerNameOverrider); ok {
+		switch sn := c.ServerName(); sn {
+		case "":
+			cc.dopts.copts.TransportCredentials = c.OverrideServerName(host)
+		case host:
+		default:
+			return fmt.Errorf("grpc: the authority %q does not match the server name %q of the transport credentials", a, sn)
+		}
+	}
+	cc.authority = a
+	return nil
+}
+
+// ClientConnInterface defines the methods the generated client stubs call to
+// perform their RPCs. *ClientConn implements it; the tests of a client may
+// pass a fake instead.
+type ClientConnInterface interface {
+	// Invoke performs a unary RPC and returns after the response is
+	// received into reply.
+	Invoke(ctx context.Context, method string, args, reply interface{}, opts ...CallOption) error
+	// NewStream begins a streaming RPC.
+	NewStream(ctx context.Context, desc *StreamDesc, method string, opts ...CallOption) (ClientStream, error)
+}
+
+// Assert that *ClientConn implements ClientConnInterface.
+var _ ClientConnInterface = (*ClientConn)(nil)
+
 // ClientConn represents a client connection to an RPC service.
 type ClientConn struct {
-	target       string
-	dopts        transport.DialOptions
-	shutdownChan chan struct{}
+	target string
+	// authority is sent as the host of the RPCs.
+	authority string
+	dopts     dialOptions
+	// throttler throttles the retries of the unary RPCs. It is nil unless
+	// the retry throttling is configured.
+	throttler *retryThrottler
+
+	// closeCh is closed once cc starts closing, to stop the idleMonitor.
+	closeCh chan struct{}
 
 	mu sync.Mutex
-	// ready is closed and becomes nil when a new transport is up or failed
-	// due to timeout.
-	ready chan struct{}
 	// Indicates the ClientConn is under destruction.
 	closing bool
-	// Every time a new transport is created, this is incremented by 1. Used
-	// to avoid trying to recreate a transport while the new one is already
-	// under construction.
-	transportSeq int
-	transport    transport.ClientTransport
+	// conns holds the pool of connections of each address notified by the
+	// balancer.
+	conns map[Address]*addrPool
+	// draining holds the transports drained by GracefulClose. Close closes
+	// them right away.
+	draining []transport.ClientTransport
+	// activeRPCs is the number of RPCs in flight and lastActive is when the
+	// latest of them finished. They are only tracked with WithIdleTimeout.
+	activeRPCs int
+	lastActive time.Time
+
+	// stateMu guards stateCh. It must not be held while acquiring any other
+	// lock.
+	stateMu sync.Mutex
+	// stateCh is closed and replaced when the state of cc may have changed.
+	stateCh chan struct{}
 }
 
-func (cc *ClientConn) resetTransport(closeTransport bool) error {
-	var retries int
-	start := time.Now()
+// State returns the connectivity state of cc. cc is Ready if any of its
+// connections is ready, otherwise Connecting if any is connecting and
+// TransientFailure if any has failed to connect. It is Idle when there is no
+// connection, e.g., before the target is resolved.
+func (cc *ClientConn) State() ConnectivityState {
+	cc.mu.Lock()
+	if cc.closing {
+		cc.mu.Unlock()
+		return Shutdown
+	}
+	conns := make([]*addrConn, 0, len(cc.conns)*cc.dopts.poolSize)
+	for _, p := range cc.conns {
+		conns = append(conns, p.conns...)
+	}
+	cc.mu.Unlock()
+	state := Idle
+	for _, ac := range conns {
+		ac.mu.Lock()
+		s := ac.state
+		ac.mu.Unlock()
+		switch s {
+		case Ready:
+			return Ready
+		case Connecting:
+			state = Connecting
+		case TransientFailure:
+			if state == Idle {
+				state = TransientFailure
+			}
+		}
+	}
+	return state
+}
+
+// WaitForStateChange blocks until the state of cc differs from sourceState or
+// ctx is done. It returns the new state, or sourceState and ctx.Err() if ctx
+// is done first.
+func (cc *ClientConn) WaitForStateChange(ctx context.Context, sourceState ConnectivityState) (ConnectivityState, error) {
 	for {
+		cc.stateMu.Lock()
+		ch := cc.stateCh
+		cc.stateMu.Unlock()
+		if s := cc.State(); s != sourceState {
+			return s, nil
+		}
+		select {
+		case <-ctx.Done():
+			return sourceState, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// notifyStateChange wakes up the WaitForStateChange callers to check the
+// state of cc again.
+func (cc *ClientConn) notifyStateChange() {
+	cc.stateMu.Lock()
+	close(cc.stateCh)
+	cc.stateCh = make(chan struct{})
+	cc.stateMu.Unlock()
+}
+
+// lbWatcher runs in a goroutine to connect to the addresses notified by the
+// balancer and tear down the connections to the addresses no longer
+// notified. It returns when the balancer is closed.
+func (cc *ClientConn) lbWatcher() {
+	for addrs := range cc.dopts.balancer.Notify() {
+		var (
+			add []Address   // Addresses need to setup connections.
+			del []*addrPool // Connections need to tear down.
+		)
+		cc.mu.Lock()
+		for _, a := range addrs {
+			// The pool of an address given up is replaced once the
+			// address is notified again.
+			if p, ok := cc.conns[a]; !ok || p.closed() {
+				add = append(add, a)
+			}
+		}
+		for k, p := range cc.conns {
+			var keep bool
+			for _, a := range addrs {
+				if k == a {
+					keep = true
+					break
+				}
+			}
+			if !keep {
+				del = append(del, p)
+				delete(cc.conns, k)
+			}
+		}
+		cc.mu.Unlock()
+		for _, a := range add {
+			cc.newAddrConn(context.Background(), a, false)
+		}
+		for _, p := range del {
+			for _, ac := range p.conns {
+				ac.tearDown(errConnDrain, false)
+			}
+		}
+	}
+}
+
+// rpcStarted and rpcDone track the RPCs in flight for the idleMonitor.
+func (cc *ClientConn) rpcStarted() {
+	if cc.dopts.idleTimeout <= 0 {
+		return
+	}
+	cc.mu.Lock()
+	cc.activeRPCs++
+	cc.mu.Unlock()
+}
+
+func (cc *ClientConn) rpcDone() {
+	if cc.dopts.idleTimeout <= 0 {
+		return
+	}
+	cc.mu.Lock()
+	cc.activeRPCs--
+	cc.lastActive = time.Now()
+	cc.mu.Unlock()
+}
+
+// idleMonitor runs in a goroutine to put the connections of cc into idle once
+// cc has had no RPC in flight for the idle timeout. It returns once cc is
+// closed.
+func (cc *ClientConn) idleMonitor() {
+	d := cc.dopts.idleTimeout
+	wait := d
+	for {
+		timer := cc.dopts.newTimer(wait)
+		select {
+		case <-cc.closeCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		wait = d
 		cc.mu.Lock()
-		t := cc.transport
-		ts := cc.transportSeq
-		// Avoid wait() picking up a dying transport unnecessarily.
-		cc.transportSeq = 0
 		if cc.closing {
 			cc.mu.Unlock()
+			return
+		}
+		if cc.activeRPCs > 0 {
+			cc.mu.Unlock()
+			continue
+		}
+		if idle := time.Since(cc.lastActive); idle < d {
+			cc.mu.Unlock()
+			wait = d - idle
+			continue
+		}
+		// cc.mu is held so that no RPC starts until the transports are
+		// taken away. They are closed once it is released, like in
+		// Reconnect.
+		var ts []transport.ClientTransport
+		for _, p := range cc.conns {
+			for _, ac := range p.conns {
+				if t := ac.enterIdle(); t != nil {
+					ts = append(ts, t)
+				}
+			}
+		}
+		cc.mu.Unlock()
+		for _, t := range ts {
+			t.Close()
+		}
+	}
+}
+
+// newAddrConn creates the pool of connections to addr. If block is true, it
+// returns after their first transports are up or a connection attempt is
+// given up; otherwise the connections are established in the background.
+func (cc *ClientConn) newAddrConn(ctx context.Context, addr Address, block bool) error {
+	p := &addrPool{
+		cc:       cc,
+		addr:     addr,
+		balancer: cc.dopts.balancer,
+	}
+	for i := 0; i < cc.dopts.poolSize; i++ {
+		p.conns = append(p.conns, &addrConn{
+			cc:           cc,
+			addr:         addr,
+			dopts:        cc.dopts,
+			pool:         p,
+			shutdownChan: make(chan struct{}),
+			idle:         make(chan struct{}),
+			resetBackoff: make(chan struct{}),
+		})
+	}
+	cc.mu.Lock()
+	if cc.closing {
+		cc.mu.Unlock()
+		return ErrClientConnClosing
+	}
+	if old, ok := cc.conns[addr]; ok && !old.closed() {
+		cc.mu.Unlock()
+		return nil
+	}
+	cc.conns[addr] = p
+	cc.mu.Unlock()
+	for _, ac := range p.conns {
+		if block {
+			if err := ac.resetTransport(ctx, false); err != nil {
+				return err
+			}
+			// Start to monitor the error status of transport.
+			go ac.transportMonitor()
+			continue
+		}
+		go func(ac *addrConn) {
+			if err := ac.resetTransport(ctx, false); err != nil {
+				// TODO(zhaoq): Record the error with glog.V.
+				log.Printf("grpc: addrConn failed to create the initial transport to %q: %v", addr.Addr, err)
+				return
+			}
+			ac.transportMonitor()
+		}(ac)
+	}
+	return nil
+}
+
+// GetMethodConfig returns the MethodConfig of method, a full method name, set
+// by WithMethodConfig. ok is false if method and its service have none.
+func (cc *ClientConn) GetMethodConfig(method string) (mc MethodConfig, ok bool) {
+	if mc, ok = cc.dopts.methodConfig[method]; ok {
+		return mc, true
+	}
+	if i := strings.LastIndex(method, "/"); i > 0 {
+		mc, ok = cc.dopts.methodConfig[method[:i]]
+	}
+	return mc, ok
+}
+
+// getTransport asks the balancer for an address and returns the transport to
+// it once the transport is up. If failFast is true, it fails instead of
+// blocking when the chosen address failed to connect.
+func (cc *ClientConn) getTransport(ctx context.Context, failFast bool) (transport.ClientTransport, error) {
+	addr, err := cc.dopts.balancer.Get(ctx, BalancerGetOptions{BlockingWait: !failFast})
+	if err != nil {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, transport.ContextErr(err)
+		}
+		return nil, err
+	}
+	cc.mu.Lock()
+	if cc.closing {
+		cc.mu.Unlock()
+		return nil, ErrClientConnClosing
+	}
+	p, ok := cc.conns[addr]
+	cc.mu.Unlock()
+	if !ok {
+		return nil, Errorf(codes.Unavailable, "grpc: there is no connection to %q", addr.Addr)
+	}
+	return p.wait(ctx, failFast)
+}
+
+// Close starts to tear down the ClientConn. Returns ErrClientConnClosing if
+// it has been closed (mostly due to dial time-out).
+// TODO(zhaoq): Make this synchronous to avoid unbounded memory consumption in
+// some edge cases (e.g., the caller opens and closes many ClientConn's in a
+// tight loop.
+func (cc *ClientConn) Close() error {
+	cc.mu.Lock()
+	if cc.closing {
+		draining := cc.draining
+		cc.draining = nil
+		cc.mu.Unlock()
+		if draining == nil {
 			return ErrClientConnClosing
 		}
+		// Interrupt GracefulClose.
+		for _, t := range draining {
+			t.Close()
+		}
+		return nil
+	}
+	cc.closing = true
+	close(cc.closeCh)
+	conns := cc.conns
+	cc.conns = nil
+	cc.mu.Unlock()
+	cc.dopts.balancer.Close()
+	for _, p := range conns {
+		for _, ac := range p.conns {
+			ac.tearDown(ErrClientConnClosing, false)
+		}
+	}
+	cc.notifyStateChange()
+	return nil
+}
+
+// GracefulClose tears down the ClientConn like Close but lets the in-flight
+// RPCs finish instead of failing them. New RPCs fail right away. It blocks
+// until all the RPCs are done and the connections are closed. Calling Close,
+// e.g., after a deadline, closes the remaining connections and makes
+// GracefulClose return. It returns ErrClientConnClosing if cc has been
+// closed.
+func (cc *ClientConn) GracefulClose() error {
+	cc.mu.Lock()
+	if cc.closing {
 		cc.mu.Unlock()
-		if closeTransport {
+		return ErrClientConnClosing
+	}
+	cc.closing = true
+	close(cc.closeCh)
+	conns := cc.conns
+	cc.conns = nil
+	cc.mu.Unlock()
+	cc.dopts.balancer.Close()
+	var draining []transport.ClientTransport
+	for _, p := range conns {
+		for _, ac := range p.conns {
+			if t := ac.tearDown(ErrClientConnClosing, true); t != nil {
+				draining = append(draining, t)
+			}
+		}
+	}
+	cc.mu.Lock()
+	cc.draining = draining
+	cc.mu.Unlock()
+	cc.notifyStateChange()
+	for _, t := range draining {
+		<-t.GracefulClose()
+	}
+	cc.mu.Lock()
+	cc.draining = nil
+	cc.mu.Unlock()
+	return nil
+}
+
+// Reconnect closes the transports of cc, failing the RPCs in flight with
+// codes.Unavailable, and establishes new ones right away, e.g., to pick up
+// the failover of the servers or the change of a DNS record. The connections
+// waiting to retry a failed connection attempt retry at once, and their
+// backoff starts over. The idle connections reconnect too.
+func (cc *ClientConn) Reconnect() {
+	var ts []transport.ClientTransport
+	cc.mu.Lock()
+	for _, p := range cc.conns {
+		for _, ac := range p.conns {
+			if t := ac.reconnect(); t != nil {
+				ts = append(ts, t)
+			}
+		}
+	}
+	cc.mu.Unlock()
+	// Closing the network connections may block, so it is done without
+	// holding cc.mu.
+	for _, t := range ts {
+		t.Close()
+	}
+}
+
+// addrPool is the pool of the connections to an address. There is one
+// connection per pool unless WithConnPoolSize is given. The address is up in
+// the balancer while any of the connections is.
+type addrPool struct {
+	cc       *ClientConn
+	addr     Address
+	balancer Balancer
+	// conns are the connections of the pool. It is not modified once the
+	// pool is created.
+	conns []*addrConn
+	// next is incremented atomically by each wait to pick the connections
+	// in a round robin.
+	next uint32
+
+	mu sync.Mutex // guards the following
+	// ups is the number of connections of the pool which are up, and down
+	// is returned by the balancer when the first of them gets up.
+	ups  int
+	down func(error)
+}
+
+// up notifies the balancer that the address is up when the first connection
+// of p gets up. The returned function is called once the connection is lost,
+// which notifies the balancer when it is the last one.
+func (p *addrPool) up() func(error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ups++
+	if p.ups == 1 {
+		p.down = p.balancer.Up(p.addr)
+	}
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.ups--
+			if p.ups == 0 && p.down != nil {
+				p.down(err)
+				p.down = nil
+			}
+		})
+	}
+}
+
+// closed reports whether all the connections of p are torn down.
+func (p *addrPool) closed() bool {
+	for _, ac := range p.conns {
+		ac.mu.Lock()
+		closing := ac.closing
+		ac.mu.Unlock()
+		if !closing {
+			return false
+		}
+	}
+	return true
+}
+
+// resolved reports whether the address of p is removed from the balancer
+// once p gives up, rather than the ClientConn being closed.
+func (p *addrPool) resolved() bool {
+	r, ok := p.balancer.(addrRemover)
+	return ok && r.resolved()
+}
+
+// giveUp removes the address of p from the balancer with err if all the
+// connections of p are torn down. If the address does not come from a
+// resolver, nothing can announce it again, so the ClientConn is closed
+// instead.
+func (p *addrPool) giveUp(err error) {
+	if !p.closed() {
+		return
+	}
+	r, ok := p.balancer.(addrRemover)
+	if !ok {
+		return
+	}
+	if r.resolved() {
+		r.remove(p.addr, err)
+		return
+	}
+	p.cc.Close()
+}
+
+// wait returns a transport of p for a new RPC. It takes the first transport
+// in a round robin of the connections which is up and has room for a new
+// stream, falling back on the first one up. If none is up, it waits for the
+// next connection of the round robin like addrConn.wait.
+func (p *addrPool) wait(ctx context.Context, failFast bool) (transport.ClientTransport, error) {
+	n := len(p.conns)
+	if n == 1 {
+		return p.conns[0].wait(ctx, failFast)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, transport.ContextErr(err)
+	}
+	next := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+	var saturated transport.ClientTransport
+	for i := 0; i < n; i++ {
+		t := p.conns[(next+i)%n].readyTransport()
+		if t == nil {
+			continue
+		}
+		if !t.Saturated() {
+			return t, nil
+		}
+		if saturated == nil {
+			saturated = t
+		}
+	}
+	if saturated != nil {
+		return saturated, nil
+	}
+	return p.conns[next].wait(ctx, failFast)
+}
+
+// addrConn is a network connection to a given address.
+type addrConn struct {
+	cc           *ClientConn
+	addr         Address
+	dopts        dialOptions
+	pool         *addrPool
+	shutdownChan chan struct{}
+
+	mu sync.Mutex
+	// ready is closed and becomes nil when a new transport is up or failed
+	// due to timeout.
+	ready chan struct{}
+	// Indicates the addrConn is under destruction.
+	closing bool
+	// giveUpErr is why ac gave up connecting. The RPCs waiting for ac fail
+	// with it rather than ErrClientConnClosing.
+	giveUpErr error
+	// transport is nil while a new transport is under construction.
+	transport transport.ClientTransport
+	// transientFailure is true since the latest connection attempt failed
+	// until a new transport is up.
+	transientFailure bool
+	state            ConnectivityState
+	// down is returned by the pool when the transport gets up. It is
+	// called once the transport is lost.
+	down func(error)
+	// idle is closed by enterIdle and replaced once the transportMonitor
+	// starts to reconnect. wake is closed by wait to make it reconnect.
+	idle chan struct{}
+	wake chan struct{}
+	// resetBackoff is closed and replaced by reconnect to cut short the
+	// backoff of resetTransport.
+	resetBackoff chan struct{}
+
+	// The fields below are only accessed by resetTransport, which never runs
+	// concurrently with itself.
+	//
+	// connectedAt is when the current transport was established.
+	connectedAt time.Time
+	// retries is the number of failed connection attempts preceding the
+	// current transport.
+	retries int
+}
+
+// setState updates the connectivity state of ac and notifies the
+// WaitForStateChange callers of the ClientConn. ac.mu must be held.
+func (ac *addrConn) setState(s ConnectivityState) {
+	if ac.state == s {
+		return
+	}
+	ac.state = s
+	ac.cc.notifyStateChange()
+}
+
+// setTransientFailure marks ac as failing to connect and wakes up the waiters
+// so that the failfast ones can give up.
+func (ac *addrConn) setTransientFailure() {
+	ac.mu.Lock()
+	if ac.closing {
+		ac.mu.Unlock()
+		return
+	}
+	ac.transientFailure = true
+	ac.setState(TransientFailure)
+	if ac.ready != nil {
+		close(ac.ready)
+		ac.ready = nil
+	}
+	ac.mu.Unlock()
+}
+
+// resetTransport creates a new transport, closing the current one if
+// closeTransport is true. It gives up and tears down ac if ctx is done.
+func (ac *addrConn) resetTransport(ctx context.Context, closeTransport bool) error {
+	var (
+		retries int
+		// pause is true if the backoff has to be applied before the first
+		// connection attempt.
+		pause bool
+	)
+	bc := ac.dopts.bc
+	if closeTransport && failed(ac.transport) && time.Since(ac.connectedAt) < bc.ResetAfter {
+		// The transport failed soon after it was established. Treat it as a
+		// failed connection attempt so that the reconnection backs off rather
+		// than hammering the server.
+		retries = ac.retries
+		pause = true
+	}
+	start := time.Now()
+	for {
+		ac.mu.Lock()
+		if ac.closing {
+			ac.mu.Unlock()
+			return ErrClientConnClosing
+		}
+		t := ac.transport
+		resetBackoff := ac.resetBackoff
+		// Avoid wait() picking up a dying transport unnecessarily.
+		ac.transport = nil
+		if ac.down != nil {
+			ac.down(errConnReset)
+			ac.down = nil
+		}
+		if !pause {
+			ac.setState(Connecting)
+		}
+		ac.mu.Unlock()
+		if closeTransport && t != nil {
 			t.Close()
 		}
+		if pause {
+			pause = false
+			ac.setTransientFailure()
+			timer := ac.dopts.newTimer(bc.backoff(retries))
+			select {
+			case <-ac.shutdownChan:
+				timer.Stop()
+				return ErrClientConnClosing
+			case <-resetBackoff:
+				timer.Stop()
+				retries = 0
+			case <-timer.C:
+				retries++
+			}
+			start = time.Now()
+			ac.mu.Lock()
+			if !ac.closing {
+				ac.setState(Connecting)
+			}
+			ac.mu.Unlock()
+		}
 		// Adjust timeout for the current try.
-		dopts := cc.dopts
-		if dopts.Timeout < 0 {
-			cc.Close()
-			return ErrClientConnTimeout
-		}
-		if dopts.Timeout > 0 {
-			dopts.Timeout -= time.Since(start)
-			if dopts.Timeout <= 0 {
-				cc.Close()
-				return ErrClientConnTimeout
+		copts := ac.dopts.copts
+		if copts.Timeout < 0 {
+			return ac.giveUp(ErrClientConnTimeout)
+		}
+		if copts.Timeout > 0 {
+			copts.Timeout -= time.Since(start)
+			if copts.Timeout <= 0 {
+				return ac.giveUp(ErrClientConnTimeout)
 			}
 		}
-		newTransport, err := transport.NewClientTransport(cc.target, &dopts)
+		newTransport, err := transport.NewClientTransport(ctx, ac.addr.Addr, &copts)
 		if err != nil {
-			sleepTime := backoff(retries)
+			ac.setTransientFailure()
+			sleepTime := bc.backoff(retries)
 			// Fail early before falling into sleep.
-			if cc.dopts.Timeout > 0 && cc.dopts.Timeout < sleepTime + time.Since(start) {
-				cc.Close()
-				return ErrClientConnTimeout
+			if ac.dopts.copts.Timeout > 0 && ac.dopts.copts.Timeout < sleepTime+time.Since(start) {
+				return ac.giveUp(ErrClientConnTimeout)
 			}
 			closeTransport = false
-			time.Sleep(sleepTime)
-			retries++
+			timer := ac.dopts.newTimer(sleepTime)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ac.giveUp(ctx.Err())
+			case <-ac.shutdownChan:
+				timer.Stop()
+				return ErrClientConnClosing
+			case <-resetBackoff:
+				timer.Stop()
+				retries = 0
+			case <-timer.C:
+				retries++
+			}
 			// TODO(zhaoq): Record the error with glog.V.
-			log.Printf("grpc: ClientConn.resetTransport failed to create client transport: %v; Reconnecting to %q", err, cc.target)
+			log.Printf("grpc: addrConn.resetTransport failed to create client transport: %v; Reconnecting to %q", err, ac.addr.Addr)
 			continue
 		}
-		cc.mu.Lock()
-		if cc.closing {
-			// cc.Close() has been invoked.
-			cc.mu.Unlock()
+		ac.mu.Lock()
+		if ac.closing {
+			// ac.tearDown() has been invoked.
+			ac.mu.Unlock()
 			newTransport.Close()
 			return ErrClientConnClosing
 		}
-		cc.transport = newTransport
-		cc.transportSeq = ts + 1
-		if cc.ready != nil {
-			close(cc.ready)
-			cc.ready = nil
+		ac.transport = newTransport
+		ac.transientFailure = false
+		ac.setState(Ready)
+		ac.connectedAt = time.Now()
+		ac.retries = retries
+		if ac.ready != nil {
+			close(ac.ready)
+			ac.ready = nil
 		}
-		cc.mu.Unlock()
+		ac.down = ac.pool.up()
+		ac.mu.Unlock()
+		return nil
+	}
+}
+
+// giveUp tears down ac once it gives up connecting with err, and returns err.
+// The address is removed from the balancer once all the connections of its
+// pool have given up, which fails the RPCs waiting for it with err. Without a
+// resolver, the ClientConn is closed instead and they fail with
+// ErrClientConnClosing.
+func (ac *addrConn) giveUp(err error) error {
+	resolved := ac.pool.resolved()
+	ac.mu.Lock()
+	if !ac.closing && resolved {
+		ac.giveUpErr = err
+	}
+	ac.mu.Unlock()
+	ac.tearDown(err, false)
+	ac.pool.giveUp(err)
+	return err
+}
+
+// enterIdle takes the transport of ac away, which is recreated once an RPC
+// waits for it. The address stays up in the balancer so that the RPCs keep
+// picking ac. The transport taken away, if any, is returned for the caller to
+// close.
+func (ac *addrConn) enterIdle() transport.ClientTransport {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.closing || ac.transport == nil {
+		return nil
+	}
+	t := ac.transport
+	ac.transport = nil
+	ac.wake = make(chan struct{})
+	close(ac.idle)
+	ac.setState(Idle)
+	return t
+}
+
+// reconnect takes the transport of ac away and makes the transportMonitor
+// connect again at once. A pending backoff is cut short and the backoff
+// starts over from the base delay. The transport taken away, if any, is
+// returned for the caller to close, which fails the RPCs in flight on it.
+func (ac *addrConn) reconnect() transport.ClientTransport {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.closing {
+		return nil
+	}
+	close(ac.resetBackoff)
+	ac.resetBackoff = make(chan struct{})
+	if ac.wake != nil {
+		// ac is idle.
+		close(ac.wake)
+		ac.wake = nil
+	}
+	t := ac.transport
+	if t == nil {
+		// A new transport is under construction.
 		return nil
 	}
+	// The transportMonitor reconnects like after enterIdle, except that it
+	// does not wait for an RPC.
+	ac.transport = nil
+	close(ac.idle)
+	ac.setState(Connecting)
+	return t
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// failed reports whether t has failed. It is false if t is nil.
+func failed(t transport.ClientTransport) bool {
+	if t == nil {
+		return false
+	}
+	select {
+	case <-t.Error():
+		return true
+	default:
+		return false
+	}
 }
 
 // Run in a goroutine to track the error in transport and create the
-// new transport if an error happens. It returns when the channel is closing.
-func (cc *ClientConn) transportMonitor() {
+// new transport if an error happens. It returns when the addrConn is torn
+// down.
+func (ac *addrConn) transportMonitor() {
 	for {
+		ac.mu.Lock()
+		t, idle := ac.transport, ac.idle
+		ac.mu.Unlock()
+		// t is nil if ac has gone idle since the transport was created.
+		var goAway, errCh <-chan struct{}
+		if t != nil {
+			goAway, errCh = t.GoAway(), t.Error()
+		}
+		closeTransport := true
 		select {
-		// shutdownChan is needed to detect the channel teardown when
-		// the ClientConn is idle (i.e., no RPC in flight).
-		case <-cc.shutdownChan:
+		// shutdownChan is needed to detect the teardown when
+		// the addrConn is idle (i.e., no RPC in flight).
+		case <-ac.shutdownChan:
 			return
-		case <-cc.transport.Error():
-			if err := cc.resetTransport(true); err != nil {
-				// The channel is closing.
-				// TODO(zhaoq): Record the error with glog.V.
-				log.Printf("grpc: ClientConn.transportMonitor exits due to: %v", err)
-				return
+		case <-idle:
+			// enterIdle closed the transport. Reconnect once an RPC
+			// needs it.
+			ac.mu.Lock()
+			wake := ac.wake
+			ac.mu.Unlock()
+			if wake != nil {
+				select {
+				case <-ac.shutdownChan:
+					return
+				case <-wake:
+				}
+			}
+			ac.mu.Lock()
+			ac.idle = make(chan struct{})
+			ac.mu.Unlock()
+			closeTransport = false
+		case <-goAway:
+			if isClosed(idle) {
+				// ac went idle meanwhile.
+				continue
+			}
+			// The server is draining the transport. Keep it for the
+			// active RPCs since it closes itself once they are done,
+			// and create a new one for the new RPCs.
+			closeTransport = false
+		case <-errCh:
+			if isClosed(idle) {
+				continue
 			}
-			continue
+		}
+		if err := ac.resetTransport(context.Background(), closeTransport); err != nil {
+			// The addrConn is closing.
+			// TODO(zhaoq): Record the error with glog.V.
+			log.Printf("grpc: addrConn.transportMonitor exits due to: %v", err)
+			return
 		}
 	}
 }
 
-// When wait returns, either the new transport is up or ClientConn is
-// closing. Used to avoid working on a dying transport. It updates and
-// returns the transport and its version when there is no error.
-func (cc *ClientConn) wait(ctx context.Context, ts int) (transport.ClientTransport, int, error) {
+// When wait returns, either the new transport is up, addrConn is closing or
+// ctx is done. Used to avoid working on a dying transport. If failFast is
+// true, wait returns ErrClientConnTransientFailure instead of blocking when
+// the latest connection attempt failed.
+func (ac *addrConn) wait(ctx context.Context, failFast bool) (transport.ClientTransport, error) {
 	for {
-		cc.mu.Lock()
+		// Do not hand out a transport once ctx is done, even if one is
+		// ready.
+		if err := ctx.Err(); err != nil {
+			return nil, transport.ContextErr(err)
+		}
+		ac.mu.Lock()
 		switch {
-		case cc.closing:
-			cc.mu.Unlock()
-			return nil, 0, ErrClientConnClosing
-		case ts < cc.transportSeq:
-			// Worked on a dying transport. Try the new one immediately.
-			defer cc.mu.Unlock()
-			return cc.transport, cc.transportSeq, nil
+		case ac.closing:
+			err := ac.giveUpErr
+			ac.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrClientConnClosing
+		case ac.transport != nil:
+			defer ac.mu.Unlock()
+			return ac.transport, nil
+		case failFast && ac.transientFailure:
+			ac.mu.Unlock()
+			return nil, ErrClientConnTransientFailure
 		default:
-			ready := cc.ready
+			if ac.wake != nil {
+				// Wake up the transportMonitor of the idle ac.
+				close(ac.wake)
+				ac.wake = nil
+			}
+			ready := ac.ready
 			if ready == nil {
 				ready = make(chan struct{})
-				cc.ready = ready
+				ac.ready = ready
 			}
-			cc.mu.Unlock()
+			ac.mu.Unlock()
 			select {
 			case <-ctx.Done():
-				return nil, 0, transport.ContextErr(ctx.Err())
+				return nil, transport.ContextErr(ctx.Err())
 			// Wait until the new transport is ready or failed.
 			case <-ready:
 			}
@@ -237,27 +1686,40 @@ func (cc *ClientConn) wait(ctx context.Context, ts int) (transport.ClientTranspo
 	}
 }
 
-// Close starts to tear down the ClientConn. Returns ErrClientConnClosing if
-// it has been closed (mostly due to dial time-out).
-// TODO(zhaoq): Make this synchronous to avoid unbounded memory consumption in
-// some edge cases (e.g., the caller opens and closes many ClientConn's in a
-// tight loop.
-func (cc *ClientConn) Close() error {
-	cc.mu.Lock()
-	defer cc.mu.Unlock()
-	if cc.closing {
-		return ErrClientConnClosing
+// readyTransport returns the transport of ac, or nil if it is not up or ac is
+// closing.
+func (ac *addrConn) readyTransport() transport.ClientTransport {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.closing {
+		return nil
 	}
-	cc.closing = true
-	if cc.ready != nil {
-		close(cc.ready)
-		cc.ready = nil
+	return ac.transport
+}
+
+// tearDown starts to tear down the addrConn. err is passed to the balancer if
+// the transport is up. The transport is closed unless graceful is set, in
+// which case it is returned for the caller to drain.
+func (ac *addrConn) tearDown(err error, graceful bool) transport.ClientTransport {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.closing {
+		return nil
+	}
+	ac.closing = true
+	ac.setState(Shutdown)
+	if ac.down != nil {
+		ac.down(err)
+		ac.down = nil
 	}
-	if cc.transport != nil {
-		cc.transport.Close()
+	if ac.ready != nil {
+		close(ac.ready)
+		ac.ready = nil
 	}
-	if cc.shutdownChan != nil {
-		close(cc.shutdownChan)
+	close(ac.shutdownChan)
+	if ac.transport == nil || graceful {
+		return ac.transport
 	}
+	ac.transport.Close()
 	return nil
 }
@@ -0,0 +1,206 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+func TestAuthority(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		want   string
+	}{
+		{"localhost:50051", "localhost"},
+		{"[::1]:50051", "::1"},
+		{"localhost", "localhost"},
+		{"dns:///foo.googleapis.com:443", "foo.googleapis.com"},
+		{"dns://8.8.8.8/foo.googleapis.com", "foo.googleapis.com"},
+		{"custom:///myservice", "myservice"},
+	} {
+		if got := authority(test.target); got != test.want {
+			t.Errorf("authority(%q) = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestWithAuthority(t *testing.T) {
+	for _, test := range []struct {
+		serverName string
+		authority  string
+		// wantServerName is the server name of the credentials after Dial.
+		wantServerName string
+		wantErr        bool
+	}{
+		{"x.test.youtube.com", "x.test.youtube.com", "x.test.youtube.com", false},
+		{"x.test.youtube.com", "x.test.youtube.com:443", "x.test.youtube.com", false},
+		{"", "x.test.youtube.com:443", "x.test.youtube.com", false},
+		{"x.test.youtube.com", "foo.test.youtube.com", "", true},
+	} {
+		creds := credentials.NewTLS(&tls.Config{ServerName: test.serverName})
+		cc, err := Dial("127.0.0.1:50051", WithTransportCredentials(creds), WithAuthority(test.authority))
+		if test.wantErr {
+			if err == nil {
+				cc.Close()
+				t.Fatalf("Dial(_, %q) with server name %q = _, <nil>, want _, <non-nil>", test.authority, test.serverName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Dial(_, %q) with server name %q = _, %v, want _, <nil>", test.authority, test.serverName, err)
+		}
+		if cc.authority != test.authority {
+			t.Fatalf("cc.authority = %q, want %q", cc.authority, test.authority)
+		}
+		got := cc.dopts.copts.TransportCredentials.(credentials.ServerNameOverrider).ServerName()
+		if got != test.wantServerName {
+			t.Fatalf("the server name of the credentials = %q, want %q", got, test.wantServerName)
+		}
+		cc.Close()
+	}
+}
+
+func TestDialTransportSecurity(t *testing.T) {
+	creds := credentials.NewTLS(&tls.Config{})
+	for _, test := range []struct {
+		opts    []DialOption
+		wantErr error
+	}{
+		{nil, ErrNoTransportSecurity},
+		{[]DialOption{WithInsecure(), WithTransportCredentials(creds)}, ErrCredentialsConflict},
+		{[]DialOption{WithInsecure()}, nil},
+		{[]DialOption{WithTransportCredentials(creds)}, nil},
+	} {
+		cc, err := Dial("127.0.0.1:50051", test.opts...)
+		if err != test.wantErr {
+			t.Fatalf("Dial(_, %v) = _, %v, want _, %v", test.opts, err, test.wantErr)
+		}
+		if err == nil {
+			cc.Close()
+		}
+	}
+}
+
+func TestRetryThrottler(t *testing.T) {
+	rt := newRetryThrottler(4, 0.5)
+	// 4 tokens: the first failure leaves 3, the second leaves 2 which is
+	// half of maxTokens.
+	if rt.throttle() {
+		t.Fatalf("throttle() = true with 3 tokens left, want false")
+	}
+	if !rt.throttle() {
+		t.Fatalf("throttle() = false with 2 tokens left, want true")
+	}
+	// Four successes put back two tokens.
+	for i := 0; i < 4; i++ {
+		rt.succeed()
+	}
+	if rt.throttle() {
+		t.Fatalf("throttle() = true with 3 tokens left after the successes, want false")
+	}
+	// The bucket never overflows.
+	for i := 0; i < 10; i++ {
+		rt.succeed()
+	}
+	if rt.tokens != 4 {
+		t.Fatalf("rt.tokens = %v after the successes, want 4", rt.tokens)
+	}
+	var nilThrottler *retryThrottler
+	if nilThrottler.throttle() {
+		t.Fatalf("(*retryThrottler)(nil).throttle() = true, want false")
+	}
+}
+
+func TestWithRetryThrottling(t *testing.T) {
+	for _, test := range []struct {
+		maxTokens, tokenRatio float64
+		wantErr               bool
+	}{
+		{10, 0.1, false},
+		{0, 0.1, true},
+		{10, 0, true},
+	} {
+		cc, err := Dial("localhost:0", WithInsecure(), WithRetryThrottling(test.maxTokens, test.tokenRatio))
+		if (err != nil) != test.wantErr {
+			t.Fatalf("Dial(_, _, WithRetryThrottling(%v, %v)) = _, %v, want error: %t", test.maxTokens, test.tokenRatio, err, test.wantErr)
+		}
+		if err == nil {
+			if cc.throttler == nil {
+				t.Fatalf("Dial(_, _, WithRetryThrottling(%v, %v)) returned a ClientConn without a throttler", test.maxTokens, test.tokenRatio)
+			}
+			cc.Close()
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	r := &backoffRecorder{}
+	// Nothing listens on the address once lis is closed.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	cc, err := Dial(addr, WithInsecure(), r.dialOption(), WithBackoffConfig(BackoffConfig{
+		BaseDelay:  time.Hour,
+		MaxDelay:   4 * time.Hour,
+		Multiplier: 2,
+	}))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer cc.Close()
+	want := []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 4 * time.Hour}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := r.atLeast(time.Hour)
+		if len(got) >= len(want) {
+			if !reflect.DeepEqual(got[:len(want)], want) {
+				t.Fatalf("the ClientConn backed off for %v, want %v", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the ClientConn backed off for %v, want at least %d backoffs", got, len(want))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -40,9 +40,11 @@ package credentials // import "google.golang.org/grpc/credentials"
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -53,19 +55,44 @@ import (
 var (
 	// alpnProtoStr are the specified application level protocols for gRPC.
 	alpnProtoStr = []string{"h2-14", "h2-15", "h2-16"}
+	// errHandshakeCanceled is returned by DialWithDialer and ClientHandshake
+	// if they are canceled during the handshake.
+	errHandshakeCanceled = errors.New("credentials: the handshake was canceled")
 )
 
-// Credentials defines the common interface all supported credentials must
-// implement.
-type Credentials interface {
+// PerRPCCredentials defines the common interface for the credentials which
+// need to attach security information to every RPC (e.g., oauth2).
+type PerRPCCredentials interface {
 	// GetRequestMetadata gets the current request metadata, refreshing
-	// tokens if required. This should be called by the transport layer on
-	// each request, and the data should be populated in headers or other
-	// context. When supported by the underlying implementation, ctx can
-	// be used for timeout and cancellation.
+	// tokens if required. This is called by gRPC before each RPC is sent,
+	// and the data is sent as the metadata of the RPC. uri is the URI of
+	// the entry point for the request. When supported by the underlying
+	// implementation, ctx can be used for timeout and cancellation.
 	// TODO(zhaoq): Define the set of the qualified keys instead of leaving
 	// it as an arbitrary string.
-	GetRequestMetadata(ctx context.Context) (map[string]string, error)
+	GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error)
+	// RequireTransportSecurity indicates whether the credentials requires
+	// transport security.
+	RequireTransportSecurity() bool
+}
+
+// AuthInfo defines the common interface for the information about the
+// authentication of a connection, e.g., the certificates verified by TLS.
+type AuthInfo interface {
+	// AuthType returns the name of the authentication protocol.
+	AuthType() string
+}
+
+// TLSInfo contains the auth information of a connection secured by TLS.
+type TLSInfo struct {
+	// State is the state of the connection after the handshake, including
+	// the verified certificate chains of the peer.
+	State tls.ConnectionState
+}
+
+// AuthType returns the type of TLSInfo as a string.
+func (t TLSInfo) AuthType() string {
+	return "tls"
 }
 
 // TransportAuthenticator defines the common interface all supported transport
@@ -78,50 +105,129 @@ type TransportAuthenticator interface {
 	// DialWithDialer connects to the given network address using
 	// dialer.Dial does the authentication handshake specified by the
 	// corresponding authentication protocol. Any timeout or deadline
-	// given in the dialer apply to connection and handshake as a whole.
+	// given in the dialer apply to connection and handshake as a whole,
+	// and closing dialer.Cancel aborts both.
 	DialWithDialer(dialer *net.Dialer, network, addr string) (net.Conn, error)
+	// ClientHandshake does the authentication handshake specified by the
+	// corresponding authentication protocol with the server at addr on
+	// rawConn, which is already connected. The deadline of ctx applies to
+	// the handshake and ctx being done aborts it. rawConn is closed if the
+	// handshake fails.
+	ClientHandshake(ctx context.Context, addr string, rawConn net.Conn) (net.Conn, error)
 	// NewListener creates a listener which accepts connections with requested
 	// authentication handshake.
 	NewListener(lis net.Listener) net.Listener
-	Credentials
+}
+
+// ServerNameOverrider is implemented by the TransportAuthenticators which
+// authenticate the server against a name, e.g., the ones created by NewTLS.
+type ServerNameOverrider interface {
+	// ServerName returns the name the server is authenticated against. It
+	// is empty if the host of the dialed address is used instead.
+	ServerName() string
+	// OverrideServerName returns a copy of the credentials which
+	// authenticate the server against name.
+	OverrideServerName(name string) TransportAuthenticator
 }
 
 // tlsCreds is the credentials required for authenticating a connection.
 type tlsCreds struct {
-	// serverName is used to verify the hostname on the returned
-	// certificates. It is also included in the client's handshake
-	// to support virtual hosting. This is optional. If it is not
-	// set gRPC internals will use the dialing address instead.
-	serverName string
-	// rootCAs defines the set of root certificate authorities
-	// that clients use when verifying server certificates.
-	// If rootCAs is nil, tls uses the host's root CA set.
-	rootCAs *x509.CertPool
-	// certificates contains one or more certificate chains
-	// to present to the other side of the connection.
-	// Server configurations must include at least one certificate.
-	certificates []tls.Certificate
-}
-
-// GetRequestMetadata returns nil, nil since TLS credentials does not have
-// metadata.
-func (c *tlsCreds) GetRequestMetadata(ctx context.Context) (map[string]string, error) {
-	return nil, nil
-}
-
-func (c *tlsCreds) DialWithDialer(dialer *net.Dialer, network, addr string) (_ net.Conn, err error) {
-	name := c.serverName
-	if name == "" {
-		name, _, err = net.SplitHostPort(addr)
+	// config is the TLS configuration the connections are secured with. If
+	// its ServerName is empty, the client uses the host of the dialing
+	// address to verify the server certificate.
+	config *tls.Config
+}
+
+// clientConfig returns the TLS configuration of the connections to addr.
+func (c *tlsCreds) clientConfig(addr string) (*tls.Config, error) {
+	config := c.config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, fmt.Errorf("credentials: failed to parse server address %v", err)
 		}
+		config.ServerName = host
 	}
-	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
-		RootCAs:    c.rootCAs,
-		NextProtos: alpnProtoStr,
-		ServerName: name,
-	})
+	config.NextProtos = appendALPN(config.NextProtos)
+	return config, nil
+}
+
+func (c *tlsCreds) DialWithDialer(dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if dialer.Cancel == nil {
+		config, err := c.clientConfig(addr)
+		if err != nil {
+			return nil, err
+		}
+		return tls.DialWithDialer(dialer, "tcp", addr, config)
+	}
+	// tls.DialWithDialer does not abort the handshake when dialer.Cancel is
+	// closed. Do the handshake here and close the connection to abort it.
+	var deadline time.Time
+	if dialer.Timeout != 0 {
+		deadline = time.Now().Add(dialer.Timeout)
+	}
+	if d := dialer.Deadline; !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	rawConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.handshake(rawConn, addr, deadline, dialer.Cancel)
+}
+
+func (c *tlsCreds) ClientHandshake(ctx context.Context, addr string, rawConn net.Conn) (net.Conn, error) {
+	deadline, _ := ctx.Deadline()
+	return c.handshake(rawConn, addr, deadline, ctx.Done())
+}
+
+// handshake performs the TLS handshake with the server at addr on rawConn.
+// It is aborted at deadline unless it is zero, or once cancel is closed.
+// rawConn is closed if the handshake fails.
+func (c *tlsCreds) handshake(rawConn net.Conn, addr string, deadline time.Time, cancel <-chan struct{}) (net.Conn, error) {
+	config, err := c.clientConfig(addr)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		rawConn.SetDeadline(deadline)
+	}
+	conn := tls.Client(rawConn, config)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			rawConn.Close()
+		case <-done:
+		}
+	}()
+	err = conn.Handshake()
+	close(done)
+	select {
+	case <-cancel:
+		rawConn.Close()
+		return nil, errHandshakeCanceled
+	default:
+	}
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		rawConn.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+func (c *tlsCreds) ServerName() string {
+	return c.config.ServerName
+}
+
+func (c *tlsCreds) OverrideServerName(name string) TransportAuthenticator {
+	config := c.config.Clone()
+	config.ServerName = name
+	return &tlsCreds{config}
 }
 
 // Dial connects to addr and performs TLS handshake.
@@ -132,18 +238,42 @@ func (c *tlsCreds) Dial(network, addr string) (_ net.Conn, err error) {
 // NewListener creates a net.Listener with a TLS configuration constructed
 // from the information in tlsCreds.
 func (c *tlsCreds) NewListener(lis net.Listener) net.Listener {
-	return tls.NewListener(lis, &tls.Config{
-		Certificates: c.certificates,
-		NextProtos:   alpnProtoStr,
-	})
+	config := c.config.Clone()
+	config.NextProtos = appendALPN(config.NextProtos)
+	return tls.NewListener(lis, config)
+}
+
+// appendALPN returns a copy of protos with the application level protocols of
+// gRPC appended unless they are present.
+func appendALPN(protos []string) []string {
+	protos = append([]string(nil), protos...)
+	for _, p := range alpnProtoStr {
+		var present bool
+		for _, q := range protos {
+			if p == q {
+				present = true
+				break
+			}
+		}
+		if !present {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// NewTLS uses c to construct a TransportAuthenticator based on TLS. c is
+// copied on each use, so it must not be modified afterwards.
+func NewTLS(c *tls.Config) TransportAuthenticator {
+	return &tlsCreds{config: c}
 }
 
 // NewClientTLSFromCert constructs a TLS from the input certificate for client.
+// serverName is used to verify the hostname on the returned certificates. It
+// is also included in the client's handshake to support virtual hosting. If
+// it is empty, the host of the dialing address is used.
 func NewClientTLSFromCert(cp *x509.CertPool, serverName string) TransportAuthenticator {
-	return &tlsCreds{
-		serverName: serverName,
-		rootCAs:    cp,
-	}
+	return NewTLS(&tls.Config{ServerName: serverName, RootCAs: cp})
 }
 
 // NewClientTLSFromFile constructs a TLS from the input certificate file for client.
@@ -156,17 +286,12 @@ func NewClientTLSFromFile(certFile, serverName string) (TransportAuthenticator,
 	if !cp.AppendCertsFromPEM(b) {
 		return nil, fmt.Errorf("credentials: failed to append certificates")
 	}
-	return &tlsCreds{
-		serverName: serverName,
-		rootCAs:    cp,
-	}, nil
+	return NewTLS(&tls.Config{ServerName: serverName, RootCAs: cp}), nil
 }
 
 // NewServerTLSFromCert constructs a TLS from the input certificate for server.
 func NewServerTLSFromCert(cert *tls.Certificate) TransportAuthenticator {
-	return &tlsCreds{
-		certificates: []tls.Certificate{*cert},
-	}
+	return NewTLS(&tls.Config{Certificates: []tls.Certificate{*cert}})
 }
 
 // NewServerTLSFromFile constructs a TLS from the input certificate file and key
@@ -176,9 +301,7 @@ func NewServerTLSFromFile(certFile, keyFile string) (TransportAuthenticator, err
 	if err != nil {
 		return nil, err
 	}
-	return &tlsCreds{
-		certificates: []tls.Certificate{cert},
-	}, nil
+	return NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}}), nil
 }
 
 // computeEngine represents credentials for the built-in service account for
@@ -188,7 +311,7 @@ type computeEngine struct {
 	ts oauth2.TokenSource
 }
 
-func (c computeEngine) GetRequestMetadata(ctx context.Context) (map[string]string, error) {
+func (c computeEngine) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
 	token, err := c.ts.Token()
 	if err != nil {
 		return nil, err
@@ -198,10 +321,14 @@ func (c computeEngine) GetRequestMetadata(ctx context.Context) (map[string]strin
 	}, nil
 }
 
+func (c computeEngine) RequireTransportSecurity() bool {
+	return true
+}
+
 // NewComputeEngine constructs the credentials that fetches access tokens from
 // Google Compute Engine (GCE)'s metadata server. It is only valid to use this
 // if your program is running on a GCE instance.
-func NewComputeEngine() Credentials {
+func NewComputeEngine() PerRPCCredentials {
 	return computeEngine{
 		ts: google.ComputeTokenSource(""),
 	}
@@ -212,7 +339,7 @@ type serviceAccount struct {
 	config *jwt.Config
 }
 
-func (s serviceAccount) GetRequestMetadata(ctx context.Context) (map[string]string, error) {
+func (s serviceAccount) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
 	token, err := s.config.TokenSource(ctx).Token()
 	if err != nil {
 		return nil, err
@@ -222,9 +349,13 @@ func (s serviceAccount) GetRequestMetadata(ctx context.Context) (map[string]stri
 	}, nil
 }
 
+func (s serviceAccount) RequireTransportSecurity() bool {
+	return true
+}
+
 // NewServiceAccountFromKey constructs the credentials using the JSON key slice
 // from a Google Developers service account.
-func NewServiceAccountFromKey(jsonKey []byte, scope ...string) (Credentials, error) {
+func NewServiceAccountFromKey(jsonKey []byte, scope ...string) (PerRPCCredentials, error) {
 	config, err := google.JWTConfigFromJSON(jsonKey, scope...)
 	if err != nil {
 		return nil, err
@@ -234,7 +365,7 @@ func NewServiceAccountFromKey(jsonKey []byte, scope ...string) (Credentials, err
 
 // NewServiceAccountFromFile constructs the credentials using the JSON key file
 // of a Google Developers service account.
-func NewServiceAccountFromFile(keyFile string, scope ...string) (Credentials, error) {
+func NewServiceAccountFromFile(keyFile string, scope ...string) (PerRPCCredentials, error) {
 	jsonKey, err := ioutil.ReadFile(keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("credentials: failed to read the service account key file: %v", err)
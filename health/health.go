@@ -0,0 +1,139 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package health provides an implementation of the gRPC Health Checking
+// protocol, which reports the serving status of the services of a server.
+package health
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthServer implements the Health service. The serving status of each
+// service is set by SetServingStatus. The empty service name stands for the
+// overall status of the server.
+type HealthServer struct {
+	mu sync.Mutex
+	// statusMap stores the serving status of the services.
+	statusMap map[string]healthpb.HealthCheckResponse_ServingStatus
+	// updates holds, per service, a channel for each Watch in progress on
+	// which the latest status is pushed.
+	updates map[string]map[chan healthpb.HealthCheckResponse_ServingStatus]bool
+}
+
+// NewHealthServer returns a new HealthServer.
+func NewHealthServer() *HealthServer {
+	return &HealthServer{
+		statusMap: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+		updates:   make(map[string]map[chan healthpb.HealthCheckResponse_ServingStatus]bool),
+	}
+}
+
+// Check returns the serving status of in.Service. It fails with
+// codes.NotFound if the status of the service has not been set.
+func (s *HealthServer) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statusMap[in.Service]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{
+		Status: status,
+	}, nil
+}
+
+// Watch sends the serving status of in.Service on stream, and then sends the
+// new status every time it changes, until the client cancels the RPC. The
+// status is SERVICE_UNKNOWN while it has not been set. Intermediate changes
+// may be skipped if the client reads slower than the status changes.
+func (s *HealthServer) Watch(in *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	service := in.Service
+	// ch always holds the latest status the client has not been sent yet.
+	ch := make(chan healthpb.HealthCheckResponse_ServingStatus, 1)
+	s.mu.Lock()
+	if status, ok := s.statusMap[service]; ok {
+		ch <- status
+	} else {
+		ch <- healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	if s.updates[service] == nil {
+		s.updates[service] = make(map[chan healthpb.HealthCheckResponse_ServingStatus]bool)
+	}
+	s.updates[service][ch] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.updates[service], ch)
+		if len(s.updates[service]) == 0 {
+			delete(s.updates, service)
+		}
+		s.mu.Unlock()
+	}()
+	var last healthpb.HealthCheckResponse_ServingStatus = -1
+	for {
+		select {
+		case status := <-ch:
+			if status == last {
+				continue
+			}
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: status}); err != nil {
+				return err
+			}
+			last = status
+		case <-stream.Context().Done():
+			return grpc.Errorf(codes.Canceled, "stream has ended")
+		}
+	}
+}
+
+// SetServingStatus is called when the serving status of service changes. All
+// the Watch in progress on service are notified.
+func (s *HealthServer) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusMap[service] = status
+	for ch := range s.updates[service] {
+		// Replace the status not sent yet, if any, by the latest one.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
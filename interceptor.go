@@ -0,0 +1,100 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"golang.org/x/net/context"
+)
+
+// UnaryInvoker is called by a UnaryClientInterceptor to complete an RPC.
+type UnaryInvoker func(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, opts ...CallOption) error
+
+// UnaryClientInterceptor intercepts the execution of a unary RPC on the
+// client. invoker performs the actual RPC and it is the responsibility of the
+// interceptor to call it. The interceptor may pass a different context (e.g.,
+// one carrying additional metadata) to invoker and inspect the error it
+// returns.
+type UnaryClientInterceptor func(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, invoker UnaryInvoker, opts ...CallOption) error
+
+// chainUnaryClientInterceptors returns the interceptor running ints in order,
+// the first one being the outermost.
+func chainUnaryClientInterceptors(ints []UnaryClientInterceptor) UnaryClientInterceptor {
+	return func(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, invoker UnaryInvoker, opts ...CallOption) error {
+		return ints[0](ctx, method, args, reply, cc, chainUnaryInvoker(ints[1:], invoker), opts...)
+	}
+}
+
+// chainUnaryInvoker returns the invoker running ints in order before
+// invoker.
+func chainUnaryInvoker(ints []UnaryClientInterceptor, invoker UnaryInvoker) UnaryInvoker {
+	if len(ints) == 0 {
+		return invoker
+	}
+	return func(ctx context.Context, method string, args, reply interface{}, cc *ClientConn, opts ...CallOption) error {
+		return ints[0](ctx, method, args, reply, cc, chainUnaryInvoker(ints[1:], invoker), opts...)
+	}
+}
+
+// UnaryServerInfo consists of various information about a unary RPC on
+// server side.
+type UnaryServerInfo struct {
+	// Server is the service implementation the user provides. This is read-only.
+	Server interface{}
+	// FullMethod is the full RPC method string, i.e., /package.service/method.
+	FullMethod string
+}
+
+// Service returns the service name of FullMethod, i.e., package.service.
+func (i *UnaryServerInfo) Service() string {
+	service, _ := SplitMethodName(i.FullMethod)
+	return service
+}
+
+// Method returns the bare method name of FullMethod.
+func (i *UnaryServerInfo) Method() string {
+	_, method := SplitMethodName(i.FullMethod)
+	return method
+}
+
+// UnaryHandler defines the handler invoked by UnaryServerInterceptor to
+// complete the normal execution of a unary RPC.
+type UnaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// UnaryServerInterceptor provides a hook to intercept the execution of a
+// unary RPC on the server. info contains all the information of this RPC the
+// interceptor can operate on. And handler is the wrapper of the service
+// method implementation. It is the responsibility of the interceptor to
+// invoke handler to complete the RPC. The error it returns is converted to
+// the status of the RPC in the same way as the one returned by a handler.
+type UnaryServerInterceptor func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error)
@@ -0,0 +1,70 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package keepalive defines configurable parameters for point-to-point
+// healthcheck of the connections.
+package keepalive // import "google.golang.org/grpc/keepalive"
+
+import (
+	"time"
+)
+
+// ClientParameters configures how the client actively probes a connection to
+// notice when it is broken, and to keep the intermediaries (e.g., NATs and
+// load balancers) aware of its liveness. They should be set in coordination
+// with the keepalive policy of the server, which may close the connections
+// pinging too often.
+type ClientParameters struct {
+	// Time is how long the client waits without seeing any activity on the
+	// connection before it pings the server.
+	Time time.Duration
+	// Timeout is how long the client waits for any activity (e.g., the ping
+	// ack) after a ping before it closes the connection.
+	Timeout time.Duration
+	// PermitWithoutStream allows the client to ping when there is no active
+	// RPC on the connection.
+	PermitWithoutStream bool
+}
+
+// EnforcementPolicy is the policy of the server on the keepalive pings of the
+// clients. A client violating it more than twice in a row is sent GOAWAY with
+// ENHANCE_YOUR_CALM and the debug data "too_many_pings", and its connection
+// is closed. The count starts over once the server sends data or headers.
+type EnforcementPolicy struct {
+	// MinTime is the minimum time the clients should wait between two
+	// pings.
+	MinTime time.Duration
+	// PermitWithoutStream allows the clients to ping when there is no
+	// active RPC on the connection.
+	PermitWithoutStream bool
+}
@@ -46,53 +46,46 @@ const (
 	binHdrSuffix = "-bin"
 )
 
-// grpc-http2 requires ASCII header key and value (more detail can be found in
-// "Requests" subsection in go/grpc-http2).
-func isASCII(s string) bool {
-	for _, c := range s {
-		if c > 127 {
-			return false
-		}
-	}
-	return true
-}
-
-// encodeKeyValue encodes key and value qualified for transmission via gRPC.
-// Transmitting binary headers violates HTTP/2 spec.
-// TODO(zhaoq): Maybe check if k is ASCII also.
-func encodeKeyValue(k, v string) (string, string) {
-	if isASCII(v) {
+// EncodeKeyValue encodes key and value qualified for transmission via gRPC.
+// The value of a binary key, i.e., a key with the "-bin" suffix, is
+// base64-encoded. The other values are returned as is; they must be printable
+// ASCII to be transmitted.
+func EncodeKeyValue(k, v string) (string, string) {
+	if !strings.HasSuffix(k, binHdrSuffix) {
 		return k, v
 	}
-	key := k + binHdrSuffix
-	val := base64.StdEncoding.EncodeToString([]byte(v))
-	return key, string(val)
+	return k, base64.StdEncoding.EncodeToString([]byte(v))
 }
 
 // DecodeKeyValue returns the original key and value corresponding to the
-// encoded data in k, v.
+// encoded data in k, v. The value of a binary key is base64-decoded, with or
+// without padding.
 func DecodeKeyValue(k, v string) (string, string, error) {
 	if !strings.HasSuffix(k, binHdrSuffix) {
 		return k, v, nil
 	}
-	key := k[:len(k)-len(binHdrSuffix)]
-	val, err := base64.StdEncoding.DecodeString(v)
+	enc := base64.StdEncoding
+	if len(v)%4 != 0 {
+		enc = base64.RawStdEncoding
+	}
+	val, err := enc.DecodeString(v)
 	if err != nil {
 		return "", "", err
 	}
-	return key, string(val), nil
+	return k, string(val), nil
 }
 
 // MD is a mapping from metadata keys to values. Users should use the following
-// two convenience functions New and Pairs to generate MD.
+// two convenience functions New and Pairs to generate MD. The values of the
+// keys with the "-bin" suffix are arbitrary bytes, encoded on the wire by the
+// transport; the other values must be printable ASCII.
 type MD map[string]string
 
 // New creates a MD from given key-value map.
 func New(m map[string]string) MD {
 	md := MD{}
 	for k, v := range m {
-		key, val := encodeKeyValue(k, v)
-		md[key] = val
+		md[k] = v
 	}
 	return md
 }
@@ -110,8 +103,7 @@ func Pairs(kv ...string) MD {
 			k = s
 			continue
 		}
-		key, val := encodeKeyValue(k, s)
-		md[key] = val
+		md[k] = s
 	}
 	return md
 }
@@ -130,15 +122,62 @@ func (md MD) Copy() MD {
 	return out
 }
 
-type mdKey struct{}
+type mdIncomingKey struct{}
+type mdOutgoingKey struct{}
+
+// NewIncomingContext creates a new context with the incoming md attached. It
+// is used by the server to carry the metadata received from the client.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, mdIncomingKey{}, md)
+}
+
+// NewOutgoingContext creates a new context with the outgoing md attached. The
+// RPCs issued with the context send md to the server.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, mdOutgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a new context with the key-value pairs kv
+// added to the outgoing MD of ctx, if any, which is left unmodified. Since MD
+// holds a single value per key, a key already present gets the new value.
+// AppendToOutgoingContext panics if len(kv) is odd.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	if len(kv)%2 == 1 {
+		panic(fmt.Sprintf("metadata: AppendToOutgoingContext got the odd number of input pairs for metadata: %d", len(kv)))
+	}
+	md, _ := FromOutgoingContext(ctx)
+	md = md.Copy()
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return NewOutgoingContext(ctx, md)
+}
 
-// NewContext creates a new context with md attached.
+// FromIncomingContext returns the incoming MD in ctx if it exists. On the
+// server, it is the metadata received from the client.
+func FromIncomingContext(ctx context.Context) (md MD, ok bool) {
+	md, ok = ctx.Value(mdIncomingKey{}).(MD)
+	return
+}
+
+// FromOutgoingContext returns the outgoing MD in ctx if it exists.
+func FromOutgoingContext(ctx context.Context) (md MD, ok bool) {
+	md, ok = ctx.Value(mdOutgoingKey{}).(MD)
+	return
+}
+
+// NewContext creates a new context with the outgoing md attached.
+//
+// Deprecated: use NewOutgoingContext or NewIncomingContext. NewContext will
+// be removed in the next release.
 func NewContext(ctx context.Context, md MD) context.Context {
-	return context.WithValue(ctx, mdKey{}, md)
+	return NewOutgoingContext(ctx, md)
 }
 
-// FromContext returns the MD in ctx if it exists.
+// FromContext returns the incoming MD in ctx if it exists.
+//
+// Deprecated: use FromIncomingContext or FromOutgoingContext. FromContext
+// will be removed in the next release.
 func FromContext(ctx context.Context) (md MD, ok bool) {
-	md, ok = ctx.Value(mdKey{}).(MD)
-	return
+	return FromIncomingContext(ctx)
 }
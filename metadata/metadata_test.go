@@ -36,6 +36,8 @@ package metadata
 import (
 	"reflect"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 const binaryValue = string(128)
@@ -51,8 +53,10 @@ func TestDecodeKeyValue(t *testing.T) {
 		err  error
 	}{
 		{"a", "abc", "a", "abc", nil},
-		{"key-bin", "Zm9vAGJhcg==", "key", "foo\x00bar", nil},
-		{"key-bin", "woA=", "key", binaryValue, nil},
+		{"key", "foo", "key", "foo", nil},
+		{"key-bin", "Zm9vAGJhcg==", "key-bin", "foo\x00bar", nil},
+		{"key-bin", "woA=", "key-bin", binaryValue, nil},
+		{"key-bin", "woA", "key-bin", binaryValue, nil},
 	} {
 		k, v, err := DecodeKeyValue(test.kin, test.vin)
 		if k != test.kout || !reflect.DeepEqual(v, test.vout) || !reflect.DeepEqual(err, test.err) {
@@ -61,6 +65,27 @@ func TestDecodeKeyValue(t *testing.T) {
 	}
 }
 
+func TestEncodeKeyValue(t *testing.T) {
+	for _, test := range []struct {
+		// input
+		kin string
+		vin string
+		// output
+		kout string
+		vout string
+	}{
+		{"a", "abc", "a", "abc"},
+		{"key", "foo", "key", "foo"},
+		{"key-bin", "foo\x00bar", "key-bin", "Zm9vAGJhcg=="},
+		{"key-bin", binaryValue, "key-bin", "woA="},
+	} {
+		k, v := EncodeKeyValue(test.kin, test.vin)
+		if k != test.kout || v != test.vout {
+			t.Fatalf("EncodeKeyValue(%q, %q) = %q, %q, want %q, %q", test.kin, test.vin, k, v, test.kout, test.vout)
+		}
+	}
+}
+
 func TestPairsMD(t *testing.T) {
 	for _, test := range []struct {
 		// input
@@ -69,9 +94,9 @@ func TestPairsMD(t *testing.T) {
 		md MD
 	}{
 		{[]string{}, MD{}},
-		{[]string{"k1", "v1", "k2", binaryValue}, New(map[string]string{
+		{[]string{"k1", "v1", "k2-bin", binaryValue}, New(map[string]string{
 			"k1":     "v1",
-			"k2-bin": "woA=",
+			"k2-bin": binaryValue,
 		})},
 	} {
 		md := Pairs(test.kv...)
@@ -80,3 +105,53 @@ func TestPairsMD(t *testing.T) {
 		}
 	}
 }
+
+func TestIncomingOutgoingContext(t *testing.T) {
+	in := Pairs("k", "in")
+	out := Pairs("k", "out")
+	ctx := NewOutgoingContext(NewIncomingContext(context.Background(), in), out)
+	if md, ok := FromIncomingContext(ctx); !ok || !reflect.DeepEqual(md, in) {
+		t.Fatalf("FromIncomingContext(_) = %v, %t, want %v, true", md, ok, in)
+	}
+	if md, ok := FromOutgoingContext(ctx); !ok || !reflect.DeepEqual(md, out) {
+		t.Fatalf("FromOutgoingContext(_) = %v, %t, want %v, true", md, ok, out)
+	}
+	// The incoming metadata is not sent by the RPCs issued with the context
+	// received by a server.
+	if md, ok := FromOutgoingContext(NewIncomingContext(context.Background(), in)); ok {
+		t.Fatalf("FromOutgoingContext(_) = %v, true, want _, false", md)
+	}
+	if md, ok := FromContext(ctx); !ok || !reflect.DeepEqual(md, in) {
+		t.Fatalf("FromContext(_) = %v, %t, want %v, true", md, ok, in)
+	}
+}
+
+func TestAppendToOutgoingContext(t *testing.T) {
+	orig := Pairs("k1", "v1", "k2", "v2")
+	ctx := NewOutgoingContext(context.Background(), orig)
+	for _, test := range []struct {
+		ctx  context.Context
+		kv   []string
+		want MD
+	}{
+		{context.Background(), []string{"k", "v"}, Pairs("k", "v")},
+		{ctx, nil, orig},
+		{ctx, []string{"k3", "v3"}, Pairs("k1", "v1", "k2", "v2", "k3", "v3")},
+		{ctx, []string{"k2", "v4", "k3-bin", binaryValue}, Pairs("k1", "v1", "k2", "v4", "k3-bin", binaryValue)},
+	} {
+		md, _ := FromOutgoingContext(AppendToOutgoingContext(test.ctx, test.kv...))
+		if !reflect.DeepEqual(md, test.want) {
+			t.Fatalf("AppendToOutgoingContext(_, %v) got MD %v, want %v", test.kv, md, test.want)
+		}
+	}
+	// The MD of the parent context is not modified.
+	if md, _ := FromOutgoingContext(ctx); !reflect.DeepEqual(md, Pairs("k1", "v1", "k2", "v2")) {
+		t.Fatalf("AppendToOutgoingContext modified the MD of its context to %v", md)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("AppendToOutgoingContext(_, %q) did not panic", "k")
+		}
+	}()
+	AppendToOutgoingContext(ctx, "k")
+}
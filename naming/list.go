@@ -0,0 +1,149 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package naming
+
+import (
+	"errors"
+	"sync"
+)
+
+// errWatcherClosed is returned by Next once the Watcher is closed.
+var errWatcherClosed = errors.New("naming: the watcher is closed")
+
+// ListResolver is a Resolver which resolves any target to a list of addresses
+// set by the application, e.g., the backends given on the command line. The
+// list can be replaced with SetAddrs at any time; the Watchers report the
+// added and the deleted addresses.
+type ListResolver struct {
+	mu       sync.Mutex
+	addrs    []string
+	watchers map[*listWatcher]bool
+}
+
+// NewListResolver returns a ListResolver which resolves to addrs.
+func NewListResolver(addrs ...string) *ListResolver {
+	return &ListResolver{
+		addrs:    addrs,
+		watchers: make(map[*listWatcher]bool),
+	}
+}
+
+// Resolve returns a Watcher of the addresses of r. target is ignored.
+func (r *ListResolver) Resolve(target string) (Watcher, error) {
+	w := &listWatcher{
+		r:      r,
+		update: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range r.addrs {
+		w.pending = append(w.pending, &Update{Op: Add, Addr: a})
+	}
+	w.update <- struct{}{}
+	r.watchers[w] = true
+	return w, nil
+}
+
+// SetAddrs replaces the addresses of r with addrs.
+func (r *ListResolver) SetAddrs(addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := make(map[string]bool)
+	for _, a := range r.addrs {
+		old[a] = true
+	}
+	var updates []*Update
+	for _, a := range addrs {
+		if old[a] {
+			delete(old, a)
+			continue
+		}
+		updates = append(updates, &Update{Op: Add, Addr: a})
+	}
+	for _, a := range r.addrs {
+		if old[a] {
+			updates = append(updates, &Update{Op: Delete, Addr: a})
+		}
+	}
+	r.addrs = addrs
+	if len(updates) == 0 {
+		return
+	}
+	for w := range r.watchers {
+		w.pending = append(w.pending, updates...)
+		select {
+		case w.update <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// listWatcher is the Watcher of a ListResolver. Its fields other than r,
+// update and done are guarded by r.mu.
+type listWatcher struct {
+	r *ListResolver
+	// update is signaled when pending is appended to.
+	update chan struct{}
+	done   chan struct{}
+	// pending are the updates not returned by Next yet.
+	pending []*Update
+}
+
+func (w *listWatcher) Next() ([]*Update, error) {
+	for {
+		select {
+		case <-w.update:
+		case <-w.done:
+			return nil, errWatcherClosed
+		}
+		w.r.mu.Lock()
+		updates := w.pending
+		w.pending = nil
+		w.r.mu.Unlock()
+		if len(updates) > 0 {
+			return updates, nil
+		}
+	}
+}
+
+func (w *listWatcher) Close() {
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	if !w.r.watchers[w] {
+		return
+	}
+	delete(w.r.watchers, w)
+	close(w.done)
+}
@@ -0,0 +1,68 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package naming
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListResolver(t *testing.T) {
+	r := NewListResolver("a", "b")
+	w, err := r.Resolve("target")
+	if err != nil {
+		t.Fatalf("Resolve(_) = _, %v, want _, <nil>", err)
+	}
+	for _, test := range []struct {
+		addrs []string
+		want  []*Update
+	}{
+		{nil, []*Update{{Op: Add, Addr: "a"}, {Op: Add, Addr: "b"}}},
+		{[]string{"b", "c"}, []*Update{{Op: Add, Addr: "c"}, {Op: Delete, Addr: "a"}}},
+		{[]string{"c", "b", "d"}, []*Update{{Op: Add, Addr: "d"}}},
+		{[]string{}, []*Update{{Op: Delete, Addr: "c"}, {Op: Delete, Addr: "b"}, {Op: Delete, Addr: "d"}}},
+	} {
+		if test.addrs != nil {
+			r.SetAddrs(test.addrs...)
+		}
+		updates, err := w.Next()
+		if err != nil || !reflect.DeepEqual(updates, test.want) {
+			t.Fatalf("Next() = %v, %v after SetAddrs(%v), want %v, <nil>", updates, err, test.addrs, test.want)
+		}
+	}
+	w.Close()
+	if _, err := w.Next(); err == nil {
+		t.Fatalf("Next() = _, <nil> after Close(), want _, error")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package proxy implements a transparent proxy of gRPC streams, which forwards
+// the RPCs to backends chosen by a StreamDirector without knowing their
+// message types.
+//
+// A proxy server is created with both the Codec of this package and the
+// handler returned by TransparentHandler:
+//
+//	s := grpc.NewServer(
+//		grpc.CustomCodec(proxy.Codec()),
+//		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
+//
+// The ClientConns returned by the director must be dialed with
+// grpc.WithCodec(proxy.Codec()).
+package proxy // import "google.golang.org/grpc/proxy"
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// StreamDirector returns the ClientConn of the backend to which the RPC of
+// method fullMethod is forwarded, and the context of the forwarded RPC. ctx is
+// the context of the inbound RPC; the incoming metadata are only forwarded if
+// the director sets them as the outgoing metadata of the returned context.
+// The RPC fails with the error returned by the director, if any.
+type StreamDirector func(ctx context.Context, fullMethod string) (context.Context, *grpc.ClientConn, error)
+
+// clientStreamDesc describes the forwarded RPCs, which are all served as
+// bidirectional streams.
+var clientStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// TransparentHandler returns a StreamHandler forwarding the RPCs to the
+// backends chosen by director. The messages, headers, trailers and status are
+// passed through unchanged. It is meant to be installed with
+// grpc.UnknownServiceHandler.
+func TransparentHandler(director StreamDirector) grpc.StreamHandler {
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		return handle(director, ss)
+	}
+}
+
+func handle(director StreamDirector, ss grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(ss)
+	if !ok {
+		return grpc.Errorf(codes.Internal, "proxy: the method of the stream is unknown")
+	}
+	ctx, cc, err := director(ss.Context(), method)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cs, err := grpc.NewClientStream(ctx, clientStreamDesc, cc, method)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// The backend stream is aborted if the client goes away.
+		if err := forwardRequests(ss, cs); err != nil {
+			cancel()
+		}
+	}()
+	return forwardResponses(cs, ss)
+}
+
+// forwardRequests sends the messages received from the client to the backend
+// and half-closes the backend stream once the client is done. It returns the
+// error of the client stream, if any. The errors of the backend stream are
+// reported by forwardResponses.
+func forwardRequests(ss grpc.ServerStream, cs grpc.ClientStream) error {
+	for {
+		f := &frame{}
+		if err := ss.RecvMsg(f); err != nil {
+			if err == io.EOF {
+				cs.CloseSend()
+				return nil
+			}
+			return err
+		}
+		if err := cs.SendMsg(f); err != nil {
+			return nil
+		}
+	}
+}
+
+// forwardResponses sends the header, the messages and the trailer of the
+// backend to the client. It returns the status of the backend RPC.
+func forwardResponses(cs grpc.ClientStream, ss grpc.ServerStream) error {
+	for i := 0; ; i++ {
+		f := &frame{}
+		err := cs.RecvMsg(f)
+		if i == 0 {
+			// The header, if any, is received before the first message or
+			// the status.
+			if md, herr := cs.Header(); herr == nil && len(md) > 0 {
+				if err := ss.SendHeader(md); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			ss.SetTrailer(cs.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := ss.SendMsg(f); err != nil {
+			return err
+		}
+	}
+}
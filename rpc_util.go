@@ -35,17 +35,28 @@ package grpc
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	spb "google.golang.org/grpc/status/google_rpc"
 	"google.golang.org/grpc/transport"
 )
 
@@ -72,7 +83,8 @@ func (o afterCall) before(c *callInfo) error { return nil }
 func (o afterCall) after(c *callInfo)        { o(c) }
 
 // Header returns a CallOptions that retrieves the header metadata
-// for a unary RPC.
+// for a unary RPC. md is set once the RPC completes, including when it fails
+// with a non-OK status; it is empty if no header was received.
 func Header(md *metadata.MD) CallOption {
 	return afterCall(func(c *callInfo) {
 		*md = c.headerMD
@@ -80,25 +92,481 @@ func Header(md *metadata.MD) CallOption {
 }
 
 // Trailer returns a CallOptions that retrieves the trailer metadata
-// for a unary RPC.
+// for a unary RPC. Like Header, md is set once the RPC completes; the trailer
+// sent along with a non-OK status is delivered as well.
 func Trailer(md *metadata.MD) CallOption {
 	return afterCall(func(c *callInfo) {
 		*md = c.trailerMD
 	})
 }
 
+// MaxCallRecvMsgSize returns a CallOption which sets the maximum size in bytes
+// of a message the client accepts for an RPC. It overrides the limit of
+// the ClientConn set by WithMaxRecvMsgSize unless n is not positive.
+func MaxCallRecvMsgSize(n int) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.maxRecvMsgSize = n
+		return nil
+	})
+}
+
+// MaxCallSendMsgSize returns a CallOption which sets the maximum size in bytes
+// of a message the client sends for an RPC. It overrides the limit of the
+// ClientConn set by WithMaxSendMsgSize unless n is not positive.
+func MaxCallSendMsgSize(n int) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.maxSendMsgSize = n
+		return nil
+	})
+}
+
+// FailFast returns a CallOption which configures whether an RPC fails
+// immediately when the ClientConn is in transient failure, i.e. its latest
+// attempt to connect to the server failed and it is reconnecting. By default
+// (failFast false) the RPC waits until the ClientConn is ready again or the
+// context of the RPC is done.
+//
+// FailFast only concerns getting a transport to send the RPC on. Retrying an
+// attempt of a unary RPC which failed after it was sent is controlled by the
+// RetryPolicy of the ClientConn, regardless of FailFast.
+func FailFast(failFast bool) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.failFast = failFast
+		return nil
+	})
+}
+
+// MaxCallAttempts returns a CallOption which caps the number of attempts of
+// a unary RPC, including the first one, overriding the MaxAttempts of the
+// RetryPolicy of the ClientConn. MaxCallAttempts(1) disables the retries: the
+// RPC fails with the first transport.ConnectionError it runs into, mapped to
+// an RPC error. n smaller than 1 is ignored.
+func MaxCallAttempts(n int) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.maxAttempts = n
+		return nil
+	})
+}
+
+// DisableRetry returns a CallOption which makes a unary RPC at most once: it
+// is sent on a single transport and fails with the first
+// transport.ConnectionError it runs into, mapped to an RPC error, whatever the
+// MaxCallAttempts options and the RetryPolicy of the ClientConn. The RPC may
+// still have been executed by the server when it fails.
+func DisableRetry() CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.noRetry = true
+		return nil
+	})
+}
+
+// WriteBatching returns a CallOption which makes SendMsg of a client stream
+// buffer the encoded messages instead of writing each of them to the
+// transport. The buffered messages are written at once when at least
+// threshold bytes are buffered, on Flush and on CloseSend, the latter ending
+// the stream with the last of them. It saves syscalls and HTTP2 frames for the
+// streams sending many small messages at the cost of latency: the caller must
+// Flush before waiting for the replies to the buffered messages. It is
+// ignored by unary RPCs. threshold smaller than 1 is ignored.
+func WriteBatching(threshold int) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.writeBatchSize = threshold
+		return nil
+	})
+}
+
+// RecvReader returns a CallOption which makes RecvMsg of a client stream hand
+// back each message as a reader of its bytes instead of decoding it: the
+// argument of RecvMsg must be an *io.Reader, which is set to a reader
+// streaming the bytes of the message as they arrive. The reader is valid until
+// the next call to RecvMsg, which skips its unread bytes. It saves buffering
+// the whole messages of, e.g., file transfers. The compressed messages are
+// still buffered to be decompressed. It is ignored by unary RPCs and by the
+// streams without ServerStreams.
+func RecvReader() CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.recvReader = true
+		return nil
+	})
+}
+
+// PerRPCCredsCallOption returns a CallOption which attaches the request
+// metadata of creds to the call. It overrides the credentials configured by
+// WithPerRPCCredentials for this call only.
+func PerRPCCredsCallOption(creds credentials.PerRPCCredentials) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		c.creds = creds
+		return nil
+	})
+}
+
+// Codec defines the interface gRPC uses to encode and decode messages.
+type Codec interface {
+	// Marshal returns the wire format of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal parses the wire format data into v. data is reused once
+	// Unmarshal returns unless the Codec is a RetainingCodec.
+	Unmarshal(data []byte, v interface{}) error
+	// String returns the name of the Codec. It is sent to the peer as the
+	// content-subtype of the stream, i.e., "application/grpc+<name>", unless
+	// the Codec is the default protobuf one.
+	String() string
+}
+
+// RetainingCodec is implemented by the Codecs whose Unmarshal keeps references
+// to the data it is passed, e.g., to decode without copying. The messages are
+// read into pooled buffers, reused once they are unmarshaled, unless the
+// Codec retains them.
+type RetainingCodec interface {
+	Codec
+	// RetainsData reports whether Unmarshal keeps references to its data.
+	RetainsData() bool
+}
+
+// retainsData reports whether c keeps references to the data it unmarshals.
+func retainsData(c Codec) bool {
+	rc, ok := c.(RetainingCodec)
+	return ok && rc.RetainsData()
+}
+
+// protoCodec is the Codec implementation with protobuf. It is the default
+// Codec of gRPC.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (protoCodec) String() string {
+	return "proto"
+}
+
+// rawCodec passes []byte messages and *[]byte replies through unchanged and
+// hands the others to the embedded Codec.
+type rawCodec struct {
+	Codec
+}
+
+func (c rawCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return c.Codec.Marshal(v)
+}
+
+func (c rawCodec) Unmarshal(data []byte, v interface{}) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = data
+		return nil
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+// RetainsData returns true since the *[]byte replies refer to the data.
+func (rawCodec) RetainsData() bool {
+	return true
+}
+
+// codecs maps a content-subtype to its Codec.
+var codecs = map[string]Codec{
+	"proto": protoCodec{},
+}
+
+// RegisterCodec registers c so that it can be selected by its name
+// c.String() via CallContentSubtype, and so that the server can decode the
+// inbound messages of that content-subtype. It replaces the previously
+// registered Codec of the same name, if any. It must only be called during
+// initialization (e.g., in an init function) since the registry is not
+// guarded by a lock.
+func RegisterCodec(c Codec) {
+	codecs[c.String()] = c
+}
+
+// contentSubtype returns the content-subtype to announce for the messages
+// encoded by c. It is empty for the default protobuf Codec so that the
+// content-type stays "application/grpc".
+func contentSubtype(c Codec) string {
+	if _, ok := c.(protoCodec); ok {
+		return ""
+	}
+	return c.String()
+}
+
+// recvCodec returns the Codec to decode the responses of stream with once its
+// headers are received. It is codec unless the server answered with another
+// registered content-subtype than the one sent. An unknown content-subtype
+// is an error; a missing one means codec is used.
+func recvCodec(codec Codec, stream *transport.Stream) (Codec, error) {
+	subtype := stream.RecvContentSubtype()
+	if subtype == "" || subtype == stream.ContentSubtype() || subtype == codec.String() {
+		return codec, nil
+	}
+	c, ok := codecs[subtype]
+	if !ok {
+		return nil, transport.StreamErrorf(codes.Internal, "grpc: the response has the unknown content-subtype %q", subtype)
+	}
+	if _, ok := codec.(rawCodec); ok {
+		return rawCodec{c}, nil
+	}
+	return c, nil
+}
+
+// Compressor defines the interface gRPC uses to compress a message.
+type Compressor interface {
+	// Do compresses p into w.
+	Do(w io.Writer, p []byte) error
+	// Type returns the compression algorithm the Compressor uses. It is
+	// sent to the peer as the grpc-encoding of the stream.
+	Type() string
+}
+
+// Decompressor defines the interface gRPC uses to decompress a message.
+type Decompressor interface {
+	// Do reads the data from r and uncompresses it.
+	Do(r io.Reader) ([]byte, error)
+	// Type returns the compression algorithm the Decompressor uses.
+	Type() string
+}
+
+// NewGZIPCompressor creates a Compressor based on GZIP.
+func NewGZIPCompressor() Compressor {
+	return &gzipCompressor{}
+}
+
+type gzipCompressor struct {
+}
+
+func (c *gzipCompressor) Do(w io.Writer, p []byte) error {
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func (c *gzipCompressor) Type() string {
+	return "gzip"
+}
+
+// NewGZIPDecompressor creates a Decompressor based on GZIP.
+func NewGZIPDecompressor() Decompressor {
+	return &gzipDecompressor{}
+}
+
+type gzipDecompressor struct {
+}
+
+func (d *gzipDecompressor) Do(r io.Reader) ([]byte, error) {
+	return d.doLimited(r, 0)
+}
+
+func (d *gzipDecompressor) doLimited(r io.Reader, max int) ([]byte, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(z)
+	}
+	return ioutil.ReadAll(io.LimitReader(z, int64(max)+1))
+}
+
+func (d *gzipDecompressor) Type() string {
+	return "gzip"
+}
+
+// compressors maps a compression algorithm name to its Compressor.
+var compressors = map[string]Compressor{
+	"gzip": NewGZIPCompressor(),
+}
+
+// RegisterCompressor registers cp so that it can be selected by its name
+// cp.Type() via UseCompressor. It replaces the previously registered
+// Compressor of the same type, if any. It must only be called during
+// initialization (e.g., in an init function) since the registry is not
+// guarded by a lock.
+func RegisterCompressor(cp Compressor) {
+	compressors[cp.Type()] = cp
+}
+
+// limitedDecompressor is implemented by the Decompressors which can stop
+// uncompressing once the output exceeds a limit, so that a small message
+// inflating to a huge one, e.g., a gzip bomb, is not uncompressed whole.
+type limitedDecompressor interface {
+	// doLimited is like Do but returns at most max+1 bytes if max is
+	// positive.
+	doLimited(r io.Reader, max int) ([]byte, error)
+}
+
+// decompressors maps a grpc-encoding to the Decompressor handling it.
+var decompressors = map[string]Decompressor{
+	"gzip": NewGZIPDecompressor(),
+}
+
+// RegisterDecompressor registers dc so that the inbound messages with the
+// grpc-encoding dc.Type() can be decompressed. It replaces the previously
+// registered Decompressor of the same type, if any. It must only be called
+// during initialization (e.g., in an init function) since the registry is
+// not guarded by a lock.
+func RegisterDecompressor(dc Decompressor) {
+	decompressors[dc.Type()] = dc
+}
+
+// acceptCompress returns the grpc-accept-encoding announcing the registered
+// Decompressors, sorted by name.
+func acceptCompress() string {
+	names := make([]string, 0, len(decompressors))
+	for name := range decompressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// selectCompressor returns the first registered Compressor among names which
+// is listed by accept, a grpc-accept-encoding. It is nil if there is none,
+// i.e., the messages are not compressed.
+func selectCompressor(names []string, accept string) Compressor {
+	for _, name := range names {
+		cp, ok := compressors[name]
+		if !ok {
+			continue
+		}
+		for _, a := range strings.Split(accept, ",") {
+			if strings.TrimSpace(a) == name {
+				return cp
+			}
+		}
+	}
+	return nil
+}
+
+// CallContentSubtype returns a CallOption that encodes the messages of the
+// RPC with the registered Codec named subtype, which is also sent to the
+// server as the content-subtype. It overrides the Codec set by WithCodec.
+func CallContentSubtype(subtype string) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		if _, ok := codecs[subtype]; !ok {
+			return transport.StreamErrorf(codes.Unimplemented, "grpc: Codec is not registered for %q", subtype)
+		}
+		c.contentSubtype = subtype
+		return nil
+	})
+}
+
+// validContentType reports whether ct is a gRPC content-type, i.e.,
+// "application/grpc" optionally followed by a subtype or parameters.
+func validContentType(ct string) bool {
+	const base = "application/grpc"
+	return ct == base || strings.HasPrefix(ct, base+"+") || strings.HasPrefix(ct, base+";")
+}
+
+// validHeaderValue reports whether v can be sent as the value of a header
+// field, i.e., it is made of printable ASCII.
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// CallContentType returns a CallOption that sends ct as the content-type of
+// the RPC, e.g., "application/grpc+proto" for a proxy which requires the
+// subtype. It overrides the content-type set by WithContentType. It does not
+// change the Codec of the RPC. ct must start with "application/grpc".
+func CallContentType(ct string) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		if !validContentType(ct) {
+			return transport.StreamErrorf(codes.InvalidArgument, "grpc: %q is not a gRPC content-type", ct)
+		}
+		c.contentType = ct
+		return nil
+	})
+}
+
+// Peer returns a CallOption that retrieves the information of the server
+// which served a unary RPC, including the auth information of the connection
+// if it is secured. p is left untouched if the RPC failed before a transport
+// to the server was picked.
+func Peer(p *peer.Peer) CallOption {
+	return afterCall(func(c *callInfo) {
+		if c.peer != nil {
+			*p = *c.peer
+		}
+	})
+}
+
+// identity is the grpc-encoding of the messages which are not compressed.
+const identity = "identity"
+
+// callCompressor returns the Compressor of a call and the grpc-encoding
+// announced for it, given the Compressor cp of the ClientConn and the
+// compressorType of the call. identity disables the compression even if cp
+// is set.
+func callCompressor(cp Compressor, compressorType string) (Compressor, string) {
+	switch compressorType {
+	case "":
+	case identity:
+		return nil, identity
+	default:
+		cp = compressors[compressorType]
+	}
+	if cp == nil {
+		return nil, ""
+	}
+	return cp, cp.Type()
+}
+
+// UseCompressor returns a CallOption which compresses the outbound messages
+// of the call with the registered Compressor named name. It overrides the
+// Compressor configured by WithCompressor for this call only. The name
+// "identity" sends the messages of the call uncompressed. The call fails if
+// no Compressor is registered under name.
+func UseCompressor(name string) CallOption {
+	return beforeCall(func(c *callInfo) error {
+		if _, ok := compressors[name]; !ok && name != identity {
+			return transport.StreamErrorf(codes.Unimplemented, "grpc: Compressor is not registered for %q", name)
+		}
+		c.compressorType = name
+		return nil
+	})
+}
+
 // The format of the payload: compressed or not?
 type payloadFormat uint8
 
 const (
 	compressionNone payloadFormat = iota // no compression
-	compressionFlate
-	// More formats
+	compressionMade                      // compressed with the algorithm in grpc-encoding
 )
 
+// defaultMaxMsgSize is the default limit of the size of a received message.
+const defaultMaxMsgSize = 4 * 1024 * 1024
+
 // parser reads complelete gRPC messages from the underlying reader.
 type parser struct {
 	s io.Reader
+	// maxMsgSize is the maximum length of a message the parser accepts.
+	// Zero means no limit.
+	maxMsgSize int
+	// cur is the reader of the message returned by recvMsgReader. Its
+	// unread bytes are skipped before the next message is read.
+	cur *msgReader
+	// buf is the pooled buffer of the message returned by recvPooledMsg,
+	// until release puts it back.
+	buf *[]byte
+}
+
+// recvBufPool keeps the buffers the messages are read into by recvPooledMsg.
+var recvBufPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
 }
 
 // msgFixedHeader defines the header of a gRPC message (go/grpc-wirefmt).
@@ -112,59 +580,342 @@ type msgFixedHeader struct {
 // EOF is returned with nil msg and 0 pf if the entire stream is done. Other
 // non-nil error is returned if something is wrong on reading.
 func (p *parser) recvMsg() (pf payloadFormat, msg []byte, err error) {
-	var hdr msgFixedHeader
-	if err := binary.Read(p.s, binary.BigEndian, &hdr); err != nil {
+	return p.readMsg(false)
+}
+
+// recvPooledMsg is like recvMsg but reads the message into a pooled buffer,
+// which is only valid until release is called.
+func (p *parser) recvPooledMsg() (pf payloadFormat, msg []byte, err error) {
+	return p.readMsg(true)
+}
+
+// release puts the buffer of the message returned by recvPooledMsg back into
+// the pool unless it is larger than maxPooledMsgSize.
+func (p *parser) release() {
+	if p.buf != nil {
+		if cap(*p.buf) <= maxPooledMsgSize {
+			recvBufPool.Put(p.buf)
+		}
+		p.buf = nil
+	}
+}
+
+func (p *parser) readMsg(pooled bool) (pf payloadFormat, msg []byte, err error) {
+	p.release()
+	hdr, err := p.recvHeader()
+	if err != nil {
 		return 0, nil, err
 	}
 	if hdr.Length == 0 {
 		return hdr.T, nil, nil
 	}
-	msg = make([]byte, int(hdr.Length))
+	n := int(hdr.Length)
+	if pooled {
+		p.buf = recvBufPool.Get().(*[]byte)
+		if cap(*p.buf) < n {
+			*p.buf = make([]byte, n)
+		}
+		msg = (*p.buf)[:n]
+	} else {
+		msg = make([]byte, n)
+	}
 	if _, err := io.ReadFull(p.s, msg); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
+		p.release()
 		return 0, nil, err
 	}
 	return hdr.T, msg, nil
 }
 
-// encode serializes msg and prepends the message header. If msg is nil, it
-// generates the message header of 0 message length.
-func encode(msg proto.Message, pf payloadFormat) ([]byte, error) {
-	var buf bytes.Buffer
-	// Write message fixed header.
-	buf.WriteByte(uint8(pf))
-	var b []byte
-	var length uint32
+// recvMsgReader reads the header of the next message and returns a reader of
+// its bytes, bounded by its length, which streams them from the stream as
+// they arrive rather than buffering the whole message. The reader is valid
+// until the next read of p, which skips its unread bytes. The errors are those
+// of recvMsg.
+func (p *parser) recvMsgReader() (pf payloadFormat, r io.Reader, err error) {
+	hdr, err := p.recvHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	p.cur = &msgReader{r: p.s, n: int64(hdr.Length)}
+	return hdr.T, p.cur, nil
+}
+
+// recvHeader skips the unread bytes of the current message, if any, and reads
+// the header of the next one, whose length is checked against maxMsgSize.
+func (p *parser) recvHeader() (hdr msgFixedHeader, err error) {
+	if p.cur != nil {
+		_, err := io.Copy(ioutil.Discard, p.cur)
+		p.cur = nil
+		if err != nil {
+			return hdr, err
+		}
+	}
+	if err := binary.Read(p.s, binary.BigEndian, &hdr); err != nil {
+		return hdr, err
+	}
+	if p.maxMsgSize > 0 && int64(hdr.Length) > int64(p.maxMsgSize) {
+		return hdr, transport.StreamErrorf(codes.ResourceExhausted, "grpc: received message length %d exceeds the limit %d", hdr.Length, p.maxMsgSize)
+	}
+	return hdr, nil
+}
+
+// msgReader reads the n remaining bytes of a message from r.
+type msgReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *msgReader) Read(b []byte) (int, error) {
+	if m.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > m.n {
+		b = b[:m.n]
+	}
+	n, err := m.r.Read(b)
+	m.n -= int64(n)
+	if err == io.EOF && m.n > 0 {
+		// The stream ended in the middle of the message.
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// encodedMsg is a message encoded by encode, i.e., its header followed by its
+// payload, ready to be written to a transport. The encodedMsgs are pooled so
+// that the send path of a stream does not allocate a buffer per message: free
+// must be called once the message is written.
+//
+// The header and the payload are written in a single contiguous buffer rather
+// than in two writes: the transports ignore Options.Delay, so a separate
+// header write would cost a DATA frame and a flush per message. As a result,
+// a message larger than maxPooledMsgSize gets a new buffer on every send,
+// which is preferred to pinning such buffers in the pool.
+type encodedMsg struct {
+	buf []byte
+	pb  proto.Buffer
+}
+
+var encodedMsgPool = sync.Pool{
+	New: func() interface{} { return new(encodedMsg) },
+}
+
+// maxPooledMsgSize is the capacity above which the buffers of the encodedMsgs
+// and of the received messages are not put back into their pools, so that a
+// single large message does not stay pinned in memory.
+const maxPooledMsgSize = 1 << 20
+
+// Write appends p to the payload so that a Compressor can write into m.
+func (m *encodedMsg) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	return len(p), nil
+}
+
+// len returns the length of m, header included.
+func (m *encodedMsg) len() int {
+	return len(m.buf)
+}
+
+// bytes returns m in a single slice, which is only valid until free is called.
+func (m *encodedMsg) bytes() []byte {
+	return m.buf
+}
+
+// msgWriter is implemented by both the ClientTransports and the
+// ServerTransports.
+type msgWriter interface {
+	Write(s *transport.Stream, data []byte, opts *transport.Options) error
+}
+
+// write writes m to stream s of t with opts.
+func (m *encodedMsg) write(t msgWriter, s *transport.Stream, opts *transport.Options) error {
+	return t.Write(s, m.buf, opts)
+}
+
+// free puts m back into the pool. m must not be used afterwards.
+func (m *encodedMsg) free() {
+	if cap(m.buf) > maxPooledMsgSize {
+		return
+	}
+	m.buf = m.buf[:0]
+	encodedMsgPool.Put(m)
+}
+
+// encode serializes msg with c, compresses it with cp if cp is not nil and prepends
+// the message header. If msg is nil, it generates the message header of 0
+// message length. A StreamError with codes.ResourceExhausted is returned if
+// maxMsgSize is positive and the length of the message exceeds it. The sizes
+// of the message are recorded in outPayload if it is not nil. The Protocol
+// Buffer messages are marshaled right into the pooled buffer of the returned
+// message unless they are compressed or recorded in outPayload.
+func encode(c Codec, msg interface{}, cp Compressor, maxMsgSize int, outPayload *stats.OutPayload) (*encodedMsg, error) {
+	m := encodedMsgPool.Get().(*encodedMsg)
+	// Reserve the room of the message header.
+	m.buf = append(m.buf[:0], 0, 0, 0, 0, 0)
+	pf := compressionNone
 	if msg != nil {
-		var err error
-		// TODO(zhaoq): optimize to reduce memory alloc and copying.
-		b, err = proto.Marshal(msg)
+		pm, ok := msg.(proto.Message)
+		if _, isProto := c.(protoCodec); isProto && ok && cp == nil && outPayload == nil {
+			m.pb.SetBuf(m.buf)
+			err := m.pb.Marshal(pm)
+			m.buf = m.pb.Bytes()
+			m.pb.SetBuf(nil)
+			if err != nil {
+				m.free()
+				return nil, err
+			}
+		} else {
+			b, err := c.Marshal(msg)
+			if err != nil {
+				m.free()
+				return nil, err
+			}
+			if outPayload != nil {
+				outPayload.Payload = msg
+				outPayload.Data = b
+				outPayload.Length = len(b)
+			}
+			switch {
+			case cp != nil && len(b) > 0:
+				// An empty message is sent uncompressed, as compressing it
+				// would only make it longer.
+				if err := cp.Do(m, b); err != nil {
+					m.free()
+					return nil, err
+				}
+				pf = compressionMade
+			default:
+				m.buf = append(m.buf, b...)
+			}
+		}
+	}
+	length := m.len() - msgHeaderLen
+	if maxMsgSize > 0 && length > maxMsgSize {
+		m.free()
+		return nil, transport.StreamErrorf(codes.ResourceExhausted, "grpc: message length %d exceeds the limit %d", length, maxMsgSize)
+	}
+	// Write message fixed header.
+	m.buf[0] = uint8(pf)
+	binary.BigEndian.PutUint32(m.buf[1:msgHeaderLen], uint32(length))
+	if outPayload != nil {
+		outPayload.WireLength = m.len()
+	}
+	return m, nil
+}
+
+// decompress returns the uncompressed payload d of a received message. pf is
+// the payload format in the message header and recvCompress is the
+// grpc-encoding announced by the peer for the stream. A StreamError with
+// codes.ResourceExhausted is returned if maxMsgSize is positive and the
+// uncompressed payload exceeds it.
+func decompress(pf payloadFormat, d []byte, recvCompress string, maxMsgSize int) ([]byte, error) {
+	switch pf {
+	case compressionNone:
+		return d, nil
+	case compressionMade:
+		if recvCompress == "" {
+			return nil, transport.StreamErrorf(codes.Unimplemented, "grpc: received a compressed message without grpc-encoding")
+		}
+		dc, ok := decompressors[recvCompress]
+		if !ok {
+			return nil, transport.StreamErrorf(codes.Unimplemented, "grpc: no Decompressor is registered for grpc-encoding %q", recvCompress)
+		}
+		if len(d) == 0 {
+			// Some peers flag the empty messages as compressed too.
+			return d, nil
+		}
+		var (
+			b   []byte
+			err error
+		)
+		if ld, ok := dc.(limitedDecompressor); ok {
+			b, err = ld.doLimited(bytes.NewReader(d), maxMsgSize)
+		} else {
+			b, err = dc.Do(bytes.NewReader(d))
+		}
 		if err != nil {
-			return nil, err
+			return nil, transport.StreamErrorf(codes.Internal, "grpc: failed to decompress the received message: %v", err)
 		}
-		length = uint32(len(b))
+		if maxMsgSize > 0 && len(b) > maxMsgSize {
+			return nil, transport.StreamErrorf(codes.ResourceExhausted, "grpc: received message exceeds the limit %d once uncompressed", maxMsgSize)
+		}
+		return b, nil
 	}
-	var szHdr [4]byte
-	binary.BigEndian.PutUint32(szHdr[:], length)
-	buf.Write(szHdr[:])
-	buf.Write(b)
-	return buf.Bytes(), nil
+	return nil, transport.StreamErrorf(codes.Unimplemented, "grpc: received unexpected payload format %d", pf)
 }
 
-func recvProto(p *parser, m proto.Message) error {
-	pf, d, err := p.recvMsg()
+// msgHeaderLen is the length of the header prepended to each message.
+const msgHeaderLen = 5
+
+// recvAndUnmarshal reads a message from p, decompresses it according to the
+// grpc-encoding of s and unmarshals it into m with c. The sizes of the message are
+// recorded in inPayload if it is not nil. The message is read into a pooled
+// buffer unless c retains it or inPayload refers to it.
+func recvAndUnmarshal(p *parser, c Codec, s *transport.Stream, m interface{}, inPayload *stats.InPayload) error {
+	var (
+		pf  payloadFormat
+		d   []byte
+		err error
+	)
+	if inPayload == nil && !retainsData(c) {
+		pf, d, err = p.recvPooledMsg()
+		defer p.release()
+	} else {
+		pf, d, err = p.recvMsg()
+	}
 	if err != nil {
 		return err
 	}
-	switch pf {
-	case compressionNone:
-		if err := proto.Unmarshal(d, m); err != nil {
-			return Errorf(codes.Internal, "grpc: %v", err)
+	wireLength := msgHeaderLen + len(d)
+	if d, err = decompress(pf, d, s.RecvCompress(), p.maxMsgSize); err != nil {
+		return err
+	}
+	if err := c.Unmarshal(d, m); err != nil {
+		return Errorf(codes.Internal, "grpc: %v", err)
+	}
+	if inPayload != nil {
+		inPayload.RecvTime = time.Now()
+		inPayload.Payload = m
+		inPayload.Data = d
+		inPayload.Length = len(d)
+		inPayload.WireLength = wireLength
+	}
+	return nil
+}
+
+// recvReader sets m, which must be an *io.Reader, to the reader of the next
+// message received by p. A compressed message is read and decompressed whole.
+func recvReader(p *parser, s *transport.Stream, m interface{}, inPayload *stats.InPayload) error {
+	rp, ok := m.(*io.Reader)
+	if !ok {
+		return Errorf(codes.Internal, "grpc: RecvMsg of a stream with RecvReader takes an *io.Reader, got %T", m)
+	}
+	pf, r, err := p.recvMsgReader()
+	if err != nil {
+		return err
+	}
+	length := int(p.cur.n)
+	wireLength := msgHeaderLen + length
+	if pf == compressionMade {
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
 		}
-	default:
-		return Errorf(codes.Internal, "gprc: compression is not supported yet.")
+		if d, err = decompress(pf, d, s.RecvCompress(), p.maxMsgSize); err != nil {
+			return err
+		}
+		r = bytes.NewReader(d)
+		length = len(d)
+	}
+	*rp = r
+	if inPayload != nil {
+		inPayload.RecvTime = time.Now()
+		inPayload.Payload = m
+		inPayload.Length = length
+		inPayload.WireLength = wireLength
 	}
 	return nil
 }
@@ -173,46 +924,145 @@ func recvProto(p *parser, m proto.Message) error {
 type rpcError struct {
 	code codes.Code
 	desc string
+	// details is the serialized status details sent by the server, if any.
+	// It is kept as a string so that rpcError stays comparable.
+	details string
 }
 
 func (e rpcError) Error() string {
 	return fmt.Sprintf("rpc error: code = %d desc = %q", e.code, e.desc)
 }
 
-// Code returns the error code for err if it was produced by the rpc system.
-// Otherwise, it returns codes.Unknown.
+// GRPCStatus returns the status of e for status.FromError. The details are
+// those of the google.rpc.Status sent by the server, if it sent one.
+func (e rpcError) GRPCStatus() *status.Status {
+	p := &spb.Status{}
+	if e.details != "" {
+		if err := proto.Unmarshal([]byte(e.details), p); err != nil {
+			p = &spb.Status{}
+		}
+	}
+	p.Code = int32(e.code)
+	p.Message = e.desc
+	return status.FromProto(p)
+}
+
+// grpcStatus is implemented by the errors of the status package.
+type grpcStatus interface {
+	GRPCStatus() *status.Status
+}
+
+// fromStatus returns the rpcError of st. st is sent as the status details if it
+// has any details.
+func fromStatus(st *status.Status) rpcError {
+	e := rpcError{code: st.Code(), desc: st.Message()}
+	if p := st.Proto(); len(p.Details) > 0 {
+		if b, err := proto.Marshal(p); err == nil {
+			e.details = string(b)
+		}
+	}
+	return e
+}
+
+// Code returns the error code for err if it was produced by the rpc system,
+// e.g., returned by Invoke, Errorf or status.Status.Err. It returns codes.OK if err is nil and
+// codes.Unknown for any other error.
 func Code(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
 	if e, ok := err.(rpcError); ok {
 		return e.code
 	}
+	if e, ok := err.(grpcStatus); ok {
+		return e.GRPCStatus().Code()
+	}
 	return codes.Unknown
 }
 
+// ErrorDesc returns the description of err if it was produced by the rpc
+// system or the status package. It returns "" if err is nil and err.Error() for any other error.
+func ErrorDesc(err error) string {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(rpcError); ok {
+		return e.desc
+	}
+	if e, ok := err.(grpcStatus); ok {
+		return e.GRPCStatus().Message()
+	}
+	return err.Error()
+}
+
+// statusError returns the error for the status the server reported on
+// stream; it returns nil if the status is OK.
+func statusError(stream *transport.Stream) error {
+	if stream.StatusCode() == codes.OK {
+		return nil
+	}
+	return rpcError{
+		code:    stream.StatusCode(),
+		desc:    stream.StatusDesc(),
+		details: string(stream.StatusDetails()),
+	}
+}
+
 // Errorf returns an error containing an error code and a description;
-// Errorf returns nil if c is OK.
+// Errorf returns nil if c is OK. It is status.Errorf, except that the errors
+// it returns with the same code and description are equal.
 func Errorf(c codes.Code, format string, a ...interface{}) error {
-	if c == codes.OK {
+	st := status.Newf(c, format, a...)
+	if st.Code() == codes.OK {
 		return nil
 	}
-	return rpcError{
-		code: c,
-		desc: fmt.Sprintf(format, a...),
+	return fromStatus(st)
+}
+
+// SplitMethodName splits the full RPC method string fullMethod, i.e.,
+// /package.service/method, into the service name package.service and the
+// bare method name. The leading slash is optional. Both names are empty if
+// fullMethod is malformed.
+func SplitMethodName(fullMethod string) (service, method string) {
+	m := strings.TrimPrefix(fullMethod, "/")
+	pos := strings.LastIndex(m, "/")
+	if pos <= 0 || pos == len(m)-1 {
+		return "", ""
 	}
+	return m[:pos], m[pos+1:]
 }
 
-// toRPCErr converts a transport error into a rpcError if possible.
+// toRPCErr converts an error into a rpcError if possible, keeping the code
+// carried by the error: the errors of the transport, the errors of the
+// context and the network errors are mapped to their canonical code. The
+// other errors are converted to codes.Unknown.
 func toRPCErr(err error) error {
 	switch e := err.(type) {
+	case rpcError:
+		return e
 	case transport.StreamError:
 		return rpcError{
 			code: e.Code,
 			desc: e.Desc,
 		}
 	case transport.ConnectionError:
+		// The connection broke or could not be established.
 		return rpcError{
-			code: codes.Internal,
+			code: codes.Unavailable,
 			desc: e.Desc,
 		}
+	case *net.OpError:
+		// The network failed, e.g., the connection was refused or reset.
+		if e.Timeout() {
+			return Errorf(codes.DeadlineExceeded, "%v", err)
+		}
+		return Errorf(codes.Unavailable, "%v", err)
+	}
+	switch err {
+	case context.Canceled:
+		return Errorf(codes.Canceled, "%v", err)
+	case context.DeadlineExceeded:
+		return Errorf(codes.DeadlineExceeded, "%v", err)
 	}
 	return Errorf(codes.Unknown, "grpc: failed to convert %v to rpcErr", err)
 }
@@ -245,21 +1095,53 @@ func convertCode(err error) codes.Code {
 	return codes.Unknown
 }
 
-const (
-	// how long to wait after the first failure before retrying
-	baseDelay = 1.0 * time.Second
-	// upper bound on backoff delay
-	maxDelay      = 120 * time.Second
-	backoffFactor = 2.0 // backoff increases by this factor on each retry
-	backoffRange  = 0.4 // backoff is randomized downwards by this factor
-)
+// timeoutFromContext returns the time remaining until the deadline of ctx, or
+// 0 if ctx has no deadline. The result is never negative; an expired deadline
+// is detected by the transport when the stream is created.
+func timeoutFromContext(ctx context.Context) time.Duration {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if d := dl.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// BackoffConfig defines how a ClientConn backs off between its attempts to
+// (re)connect to the server.
+type BackoffConfig struct {
+	// BaseDelay is how long to wait after the first failure before retrying.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound on backoff delay.
+	MaxDelay time.Duration
+	// Multiplier is the factor by which the backoff increases on each retry.
+	Multiplier float64
+	// Jitter is the factor by which the backoff is randomized downwards.
+	Jitter float64
+	// ResetAfter is how long a transport has to stay healthy for the backoff
+	// to start over from BaseDelay once it fails. A transport failing sooner
+	// counts as a failed connection attempt.
+	ResetAfter time.Duration
+}
+
+// DefaultBackoffConfig is used by a ClientConn unless WithBackoffConfig is
+// given.
+var DefaultBackoffConfig = BackoffConfig{
+	BaseDelay:  1.0 * time.Second,
+	MaxDelay:   120 * time.Second,
+	Multiplier: 2.0,
+	Jitter:     0.4,
+	ResetAfter: 10 * time.Second,
+}
 
-// backoff returns a value in [0, maxDelay] that increases exponentially with
-// retries, starting from baseDelay.
-func backoff(retries int) time.Duration {
-	backoff, max := float64(baseDelay), float64(maxDelay)
+// backoff returns a value in [0, MaxDelay] that increases exponentially with
+// retries, starting from BaseDelay.
+func (bc BackoffConfig) backoff(retries int) time.Duration {
+	backoff, max := float64(bc.BaseDelay), float64(bc.MaxDelay)
 	for backoff < max && retries > 0 {
-		backoff = backoff * backoffFactor
+		backoff = backoff * bc.Multiplier
 		retries--
 	}
 	if backoff > max {
@@ -268,10 +1150,27 @@ func backoff(retries int) time.Duration {
 
 	// Randomize backoff delays so that if a cluster of requests start at
 	// the same time, they won't operate in lockstep.  We just subtract up
-	// to 40% so that we obey maxDelay.
-	backoff -= backoff * backoffRange * rand.Float64()
+	// to Jitter of it so that we obey MaxDelay.
+	backoff -= backoff * bc.Jitter * rand.Float64()
 	if backoff < 0 {
 		return 0
 	}
 	return time.Duration(backoff)
 }
+
+// The SupportPackageIsVersion constants are referenced from the generated
+// protocol buffer files to assert that they are compatible with this version
+// of the grpc package. A generated file built against an incompatible runtime
+// then fails to compile instead of misbehaving at run time.
+//
+// A new constant is added when a change in the generated code requires a
+// synchronized update of grpc-go and protoc-gen-go. They should not be
+// referenced from any other code.
+const (
+	// SupportPackageIsVersion1 is referenced by the files calling the
+	// functions Invoke and NewClientStream.
+	SupportPackageIsVersion1 = true
+	// SupportPackageIsVersion2 is referenced by the files whose clients
+	// take a ClientConnInterface.
+	SupportPackageIsVersion2 = true
+)
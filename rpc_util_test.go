@@ -35,15 +35,20 @@ package grpc
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	perfpb "google.golang.org/grpc/test/codec_perf"
 	"google.golang.org/grpc/transport"
 )
@@ -64,7 +69,7 @@ func TestSimpleParsing(t *testing.T) {
 		{[]byte{0, 0, 0, 0, 10, 'a'}, io.ErrUnexpectedEOF, nil, compressionNone},
 	} {
 		buf := bytes.NewReader(test.p)
-		parser := &parser{buf}
+		parser := &parser{s: buf}
 		pt, b, err := parser.recvMsg()
 		if err != test.err || !bytes.Equal(b, test.b) || pt != test.pt {
 			t.Fatalf("parser{%v}.recvMsg() = %v, %v, %v\nwant %v, %v, %v", test.p, pt, b, err, test.pt, test.b, test.err)
@@ -76,7 +81,7 @@ func TestMultipleParsing(t *testing.T) {
 	// Set a byte stream consists of 3 messages with their headers.
 	p := []byte{0, 0, 0, 0, 1, 'a', 0, 0, 0, 0, 2, 'b', 'c', 0, 0, 0, 0, 1, 'd'}
 	b := bytes.NewReader(p)
-	parser := &parser{b}
+	parser := &parser{s: b}
 
 	wantRecvs := []struct {
 		pt   payloadFormat
@@ -101,25 +106,277 @@ func TestMultipleParsing(t *testing.T) {
 	}
 }
 
+func TestPooledParsing(t *testing.T) {
+	// The 2 last messages are larger than the buffers of the previous ones.
+	p := []byte{0, 0, 0, 0, 1, 'a', 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 'b', 'c', 'd', 0, 0, 0, 0, 4, 'e', 'f', 'g', 'h', 0, 0, 0, 0, 9, 'i'}
+	parser := &parser{s: bytes.NewReader(p)}
+	for i, want := range []string{"a", "", "bcd", "efgh"} {
+		_, data, err := parser.recvPooledMsg()
+		if err != nil || string(data) != want {
+			t.Fatalf("after %d calls, parser{%v}.recvPooledMsg() = _, %q, %v, want _, %q, <nil>", i, p, data, err, want)
+		}
+		parser.release()
+	}
+	if _, _, err := parser.recvPooledMsg(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("parser{%v}.recvPooledMsg() = _, _, %v, want _, _, %v", p, err, io.ErrUnexpectedEOF)
+	}
+	if parser.buf != nil {
+		t.Fatalf("the buffer of the truncated message is not released")
+	}
+}
+
+func TestRetainsData(t *testing.T) {
+	for _, test := range []struct {
+		c    Codec
+		want bool
+	}{
+		{protoCodec{}, false},
+		{rawCodec{protoCodec{}}, true},
+	} {
+		if got := retainsData(test.c); got != test.want {
+			t.Fatalf("retainsData(%T) = %t, want %t", test.c, got, test.want)
+		}
+	}
+}
+
+func TestParsingReader(t *testing.T) {
+	p := []byte{0, 0, 0, 0, 3, 'a', 'b', 'c', 0, 0, 0, 0, 2, 'd', 'e', 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 'f'}
+	parser := &parser{s: bytes.NewReader(p)}
+	// The bytes of a message are bounded by its length.
+	_, r, err := parser.recvMsgReader()
+	if err != nil {
+		t.Fatalf("parser{%v}.recvMsgReader() = _, _, %v, want _, _, <nil>", p, err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "abc" {
+		t.Fatalf("reading the 1st message got %q, %v, want %q, <nil>", b, err, "abc")
+	}
+	// The unread bytes of a message are skipped by the next read.
+	_, r, err = parser.recvMsgReader()
+	if err != nil {
+		t.Fatalf("parser{%v}.recvMsgReader() = _, _, %v, want _, _, <nil>", p, err)
+	}
+	b := make([]byte, 1)
+	if _, err := r.Read(b); err != nil || b[0] != 'd' {
+		t.Fatalf("reading the 2nd message got %q, %v, want %q, <nil>", b, err, "d")
+	}
+	if _, data, err := parser.recvMsg(); err != nil || len(data) != 0 {
+		t.Fatalf("parser{%v}.recvMsg() = _, %v, %v, want _, [], <nil>", p, data, err)
+	}
+	// The stream ends in the middle of the last message.
+	_, r, err = parser.recvMsgReader()
+	if err != nil {
+		t.Fatalf("parser{%v}.recvMsgReader() = _, _, %v, want _, _, <nil>", p, err)
+	}
+	if b, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF || string(b) != "f" {
+		t.Fatalf("reading the last message got %q, %v, want %q, %v", b, err, "f", io.ErrUnexpectedEOF)
+	}
+	if _, _, err := parser.recvMsgReader(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("parser{%v}.recvMsgReader() = _, _, %v, want _, _, %v", p, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestParsingMaxMsgSize(t *testing.T) {
+	for _, test := range []struct {
+		// input
+		p          []byte
+		maxMsgSize int
+		// outputs
+		err error
+		b   []byte
+	}{
+		{[]byte{0, 0, 0, 0, 2, 'a', 'b'}, 0, nil, []byte("ab")},
+		{[]byte{0, 0, 0, 0, 2, 'a', 'b'}, 2, nil, []byte("ab")},
+		{[]byte{0, 0, 0, 0, 2, 'a', 'b'}, 1, transport.StreamErrorf(codes.ResourceExhausted, "grpc: received message length 2 exceeds the limit 1"), nil},
+		{[]byte{0, 0xff, 0xff, 0xff, 0xff}, 1024, transport.StreamErrorf(codes.ResourceExhausted, "grpc: received message length 4294967295 exceeds the limit 1024"), nil},
+	} {
+		parser := &parser{s: bytes.NewReader(test.p), maxMsgSize: test.maxMsgSize}
+		_, b, err := parser.recvMsg()
+		if err != test.err || !bytes.Equal(b, test.b) {
+			t.Fatalf("parser{%v, %d}.recvMsg() = _, %v, %v\nwant _, %v, %v", test.p, test.maxMsgSize, b, err, test.b, test.err)
+		}
+	}
+}
+
 func TestEncode(t *testing.T) {
 	for _, test := range []struct {
 		// input
 		msg proto.Message
-		pt  payloadFormat
+		cp  Compressor
 		// outputs
 		b   []byte
 		err error
 	}{
-		{nil, compressionNone, []byte{0, 0, 0, 0, 0}, nil},
+		{nil, nil, []byte{0, 0, 0, 0, 0}, nil},
+		{nil, NewGZIPCompressor(), []byte{0, 0, 0, 0, 0}, nil},
+		{&perfpb.Buffer{}, nil, []byte{0, 0, 0, 0, 0}, nil},
+		// An empty message is not compressed.
+		{&perfpb.Buffer{}, NewGZIPCompressor(), []byte{0, 0, 0, 0, 0}, nil},
 	} {
-		b, err := encode(test.msg, test.pt)
+		b, err := encodeBytes(protoCodec{}, test.msg, test.cp, 0)
 		if err != test.err || !bytes.Equal(b, test.b) {
-			t.Fatalf("encode(_, %d) = %v, %v\nwant %v, %v", test.pt, b, err, test.b, test.err)
+			t.Fatalf("encode(_, %v) = %v, %v\nwant %v, %v", test.cp, b, err, test.b, test.err)
+		}
+	}
+}
+
+// encodeBytes returns msg encoded by encode in a new slice.
+func encodeBytes(c Codec, msg interface{}, cp Compressor, maxMsgSize int) ([]byte, error) {
+	m, err := encode(c, msg, cp, maxMsgSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+	return append([]byte(nil), m.bytes()...), nil
+}
+
+func TestEncodeLargePayload(t *testing.T) {
+	body := bytes.Repeat([]byte{'a'}, 32*1024)
+	for _, c := range []Codec{protoCodec{}, rawCodec{protoCodec{}}} {
+		msg := interface{}(&perfpb.Buffer{Body: body})
+		if _, ok := c.(rawCodec); ok {
+			msg = body
+		}
+		m, err := encode(c, msg, nil, 0, nil)
+		if err != nil {
+			t.Fatalf("encode(%v, _) = _, %v, want _, <nil>", c, err)
+		}
+		// The payload is right behind the header so that the message is
+		// written to the transport at once.
+		p := &parser{s: bytes.NewReader(m.bytes())}
+		pf, d, err := p.recvMsg()
+		want, _ := c.Marshal(msg)
+		if err != nil || pf != compressionNone || !bytes.Equal(d, want) {
+			t.Fatalf("parser{%v}.recvMsg() = %v, %d bytes, %v, want %v, %d bytes, <nil>", c, pf, len(d), err, compressionNone, len(want))
+		}
+		if m.len() != msgHeaderLen+len(want) {
+			t.Fatalf("encode(%v, _).len() = %d, want %d", c, m.len(), msgHeaderLen+len(want))
+		}
+		m.free()
+	}
+}
+
+func TestEncodeMaxMsgSize(t *testing.T) {
+	msg := &perfpb.Buffer{Body: bytes.Repeat([]byte{'a'}, 1024)}
+	for _, test := range []struct {
+		cp         Compressor
+		maxMsgSize int
+		err        error
+	}{
+		{nil, 0, nil},
+		{nil, 2048, nil},
+		{nil, 1024, transport.StreamErrorf(codes.ResourceExhausted, "grpc: message length 1027 exceeds the limit 1024")},
+		// The limit applies to the compressed message.
+		{NewGZIPCompressor(), 1024, nil},
+	} {
+		if _, err := encodeBytes(protoCodec{}, msg, test.cp, test.maxMsgSize); err != test.err {
+			t.Fatalf("encode(_, %v, %d) = _, %v, want _, %v", test.cp, test.maxMsgSize, err, test.err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	msg := &perfpb.Buffer{Body: bytes.Repeat([]byte{'a'}, 1024)}
+	b, err := encodeBytes(protoCodec{}, msg, NewGZIPCompressor(), 0)
+	if err != nil {
+		t.Fatalf("encode(%v, gzip) = _, %v, want _, <nil>", msg, err)
+	}
+	p := &parser{s: bytes.NewReader(b)}
+	pf, d, err := p.recvMsg()
+	if err != nil || pf != compressionMade {
+		t.Fatalf("parser{%v}.recvMsg() = %v, _, %v, want %v, _, <nil>", b, pf, err, compressionMade)
+	}
+	for _, test := range []struct {
+		recvCompress string
+		code         codes.Code
+	}{
+		{"", codes.Unimplemented},
+		{"deflate", codes.Unimplemented},
+		{"gzip", codes.OK},
+	} {
+		out, err := decompress(pf, d, test.recvCompress, 0)
+		if test.code != codes.OK {
+			if e, ok := err.(transport.StreamError); !ok || e.Code != test.code {
+				t.Fatalf("decompress(%v, _, %q) = _, %v, want _, error code %d", pf, test.recvCompress, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("decompress(%v, _, %q) = _, %v, want _, <nil>", pf, test.recvCompress, err)
+		}
+		got := &perfpb.Buffer{}
+		if err := proto.Unmarshal(out, got); err != nil || !proto.Equal(got, msg) {
+			t.Fatalf("decompress(%v, _, %q) got message %v (err %v), want %v", pf, test.recvCompress, got, err, msg)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// 16 MiB of zeros compress to about 16 KiB, far below the limit.
+	msg := &perfpb.Buffer{Body: make([]byte, 16<<20)}
+	b, err := encodeBytes(protoCodec{}, msg, NewGZIPCompressor(), 0)
+	if err != nil {
+		t.Fatalf("encode(%v, gzip) = _, %v, want _, <nil>", msg, err)
+	}
+	p := &parser{s: bytes.NewReader(b), maxMsgSize: defaultMaxMsgSize}
+	pf, d, err := p.recvMsg()
+	if err != nil || pf != compressionMade {
+		t.Fatalf("parser{_}.recvMsg() = %v, _, %v, want %v, _, <nil>", pf, err, compressionMade)
+	}
+	_, err = decompress(pf, d, "gzip", defaultMaxMsgSize)
+	if e, ok := err.(transport.StreamError); !ok || e.Code != codes.ResourceExhausted {
+		t.Fatalf("decompress(%v, _, %q, %d) = _, %v, want _, error code %d", pf, "gzip", defaultMaxMsgSize, err, codes.ResourceExhausted)
+	}
+	// The uncompressed size is not limited unless a limit is given.
+	if out, err := decompress(pf, d, "gzip", 0); err != nil || len(out) <= defaultMaxMsgSize {
+		t.Fatalf("decompress(%v, _, %q, 0) = %d bytes, %v, want more than %d bytes, <nil>", pf, "gzip", len(out), err, defaultMaxMsgSize)
+	}
+}
+
+func TestEmptyMessageRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		// input
+		b            []byte
+		recvCompress string
+		// outputs
+		pf payloadFormat
+	}{
+		{nil, "", compressionNone},
+		{nil, "gzip", compressionNone},
+		// An empty message flagged as compressed.
+		{[]byte{1, 0, 0, 0, 0}, "gzip", compressionMade},
+	} {
+		b := test.b
+		if b == nil {
+			var err error
+			if b, err = encodeBytes(protoCodec{}, &perfpb.Buffer{}, NewGZIPCompressor(), 0); err != nil {
+				t.Fatalf("encode(_, %v, gzip) = _, %v, want _, <nil>", &perfpb.Buffer{}, err)
+			}
+		}
+		// The message is followed by another one, which must not be read.
+		p := &parser{s: bytes.NewReader(append(b, 0, 0, 0, 0, 1, 'a'))}
+		pf, d, err := p.recvMsg()
+		if err != nil || pf != test.pf || len(d) != 0 {
+			t.Fatalf("parser{%v}.recvMsg() = %v, %v, %v, want %v, [], <nil>", b, pf, d, err, test.pf)
+		}
+		if d, err = decompress(pf, d, test.recvCompress, 0); err != nil || len(d) != 0 {
+			t.Fatalf("decompress(%v, _, %q) = %v, %v, want [], <nil>", pf, test.recvCompress, d, err)
+		}
+		got := &perfpb.Buffer{Body: []byte("stale")}
+		if err := (protoCodec{}).Unmarshal(d, got); err != nil || !proto.Equal(got, &perfpb.Buffer{}) {
+			t.Fatalf("protoCodec.Unmarshal(%v, _) got message %v (err %v), want an empty message", d, got, err)
 		}
 	}
 }
 
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 func TestToRPCErr(t *testing.T) {
+	connRefusedErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	timeoutErr := &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
 	for _, test := range []struct {
 		// input
 		errIn error
@@ -127,7 +384,14 @@ func TestToRPCErr(t *testing.T) {
 		errOut error
 	}{
 		{transport.StreamErrorf(codes.Unknown, ""), Errorf(codes.Unknown, "")},
-		{transport.ErrConnClosing, Errorf(codes.Internal, transport.ErrConnClosing.Desc)},
+		{transport.StreamErrorf(codes.ResourceExhausted, "too large"), Errorf(codes.ResourceExhausted, "too large")},
+		{transport.ErrConnClosing, Errorf(codes.Unavailable, "%s", transport.ErrConnClosing.Desc)},
+		{Errorf(codes.NotFound, "not found"), Errorf(codes.NotFound, "not found")},
+		{context.Canceled, Errorf(codes.Canceled, "%v", context.Canceled)},
+		{context.DeadlineExceeded, Errorf(codes.DeadlineExceeded, "%v", context.DeadlineExceeded)},
+		{connRefusedErr, Errorf(codes.Unavailable, "%v", connRefusedErr)},
+		{timeoutErr, Errorf(codes.DeadlineExceeded, "%v", timeoutErr)},
+		{errors.New("oops"), Errorf(codes.Unknown, "grpc: failed to convert oops to rpcErr")},
 	} {
 		err := toRPCErr(test.errIn)
 		if err != test.errOut {
@@ -136,6 +400,49 @@ func TestToRPCErr(t *testing.T) {
 	}
 }
 
+func TestCodeAndErrorDesc(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code codes.Code
+		desc string
+	}{
+		{nil, codes.OK, ""},
+		{Errorf(codes.NotFound, "no %s", "such file"), codes.NotFound, "no such file"},
+		{Errorf(codes.Internal, ""), codes.Internal, ""},
+		{status.Errorf(codes.NotFound, "no %s", "such file"), codes.NotFound, "no such file"},
+		{status.Error(codes.Internal, ""), codes.Internal, ""},
+		{errors.New("oops"), codes.Unknown, "oops"},
+		{transport.StreamErrorf(codes.Canceled, "canceled"), codes.Unknown, transport.StreamErrorf(codes.Canceled, "canceled").Error()},
+	} {
+		if code := Code(test.err); code != test.code {
+			t.Fatalf("Code(%v) = %v, want %v", test.err, code, test.code)
+		}
+		if desc := ErrorDesc(test.err); desc != test.desc {
+			t.Fatalf("ErrorDesc(%v) = %q, want %q", test.err, desc, test.desc)
+		}
+	}
+}
+
+func TestErrorfMatchesStatus(t *testing.T) {
+	for _, c := range []codes.Code{codes.OK, codes.NotFound, codes.Internal} {
+		err := Errorf(c, "no %s", "such file")
+		serr := status.Errorf(c, "no %s", "such file")
+		if c == codes.OK {
+			if err != nil || serr != nil {
+				t.Fatalf("Errorf(%v, _) = %v and status.Errorf(%v, _) = %v, want <nil> and <nil>", c, err, c, serr)
+			}
+			continue
+		}
+		if err.Error() != serr.Error() {
+			t.Fatalf("Errorf(%v, _) = %q, want %q like status.Errorf", c, err.Error(), serr.Error())
+		}
+		st, ok := status.FromError(err)
+		if !ok || st.Code() != c || st.Message() != "no such file" {
+			t.Fatalf("status.FromError(%v) = %v, %q, %t, want %v, %q, true", err, st.Code(), st.Message(), ok, c, "no such file")
+		}
+	}
+}
+
 func TestContextErr(t *testing.T) {
 	for _, test := range []struct {
 		// input
@@ -154,38 +461,136 @@ func TestContextErr(t *testing.T) {
 }
 
 func TestBackoff(t *testing.T) {
+	bc := DefaultBackoffConfig
 	for _, test := range []struct {
 		retries   int
 		maxResult time.Duration
 	}{
 		{0, time.Second},
-		{1, time.Duration(1e9 * math.Pow(backoffFactor, 1))},
-		{2, time.Duration(1e9 * math.Pow(backoffFactor, 2))},
-		{3, time.Duration(1e9 * math.Pow(backoffFactor, 3))},
-		{4, time.Duration(1e9 * math.Pow(backoffFactor, 4))},
-		{int(math.Log2(float64(maxDelay)/float64(baseDelay))) + 1, maxDelay},
+		{1, time.Duration(1e9 * math.Pow(bc.Multiplier, 1))},
+		{2, time.Duration(1e9 * math.Pow(bc.Multiplier, 2))},
+		{3, time.Duration(1e9 * math.Pow(bc.Multiplier, 3))},
+		{4, time.Duration(1e9 * math.Pow(bc.Multiplier, 4))},
+		{int(math.Log2(float64(bc.MaxDelay)/float64(bc.BaseDelay))) + 1, bc.MaxDelay},
 	} {
-		delay := backoff(test.retries)
+		delay := bc.backoff(test.retries)
 		if delay < 0 || delay > test.maxResult {
 			t.Errorf("backoff(%d) = %v outside [0, %v]", test.retries, delay, test.maxResult)
 		}
 	}
 }
 
+func TestBackoffConfig(t *testing.T) {
+	bc := BackoffConfig{
+		BaseDelay:  10 * time.Millisecond,
+		MaxDelay:   100 * time.Millisecond,
+		Multiplier: 3,
+	}
+	for _, test := range []struct {
+		retries int
+		want    time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 30 * time.Millisecond},
+		{2, 90 * time.Millisecond},
+		{3, 100 * time.Millisecond},
+	} {
+		// No Jitter, so the backoff is deterministic.
+		if got := bc.backoff(test.retries); got != test.want {
+			t.Errorf("%v.backoff(%d) = %v, want %v", bc, test.retries, got, test.want)
+		}
+	}
+}
+
+func TestTimeoutFromContext(t *testing.T) {
+	if d := timeoutFromContext(context.Background()); d != 0 {
+		t.Fatalf("timeoutFromContext(context.Background()) = %v, want 0", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if d := timeoutFromContext(ctx); d <= 0 || d > time.Hour {
+		t.Fatalf("timeoutFromContext(_) = %v, want in (0, %v]", d, time.Hour)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if d := timeoutFromContext(ctx); d != 0 {
+		t.Fatalf("timeoutFromContext(_) = %v for an expired deadline, want 0", d)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+	}
+	for _, test := range []struct {
+		retries int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	} {
+		if got := p.backoff(test.retries); got != test.want {
+			t.Errorf("%v.backoff(%d) = %v, want %v", p, test.retries, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffDefaults(t *testing.T) {
+	for _, test := range []struct {
+		p    RetryPolicy
+		want []time.Duration
+	}{
+		// The unset fields take the default values.
+		{RetryPolicy{MaxAttempts: 5}, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}},
+		// MaxBackoff is not shorter than InitialBackoff.
+		{RetryPolicy{MaxAttempts: 5, InitialBackoff: 3 * time.Second}, []time.Duration{3 * time.Second, 3 * time.Second}},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond, BackoffMultiplier: 3}, []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 90 * time.Millisecond, 270 * time.Millisecond, 810 * time.Millisecond, time.Second}},
+	} {
+		var o dialOptions
+		WithRetryPolicy(test.p)(&o)
+		for i, want := range test.want {
+			if got := o.retryPolicy.backoff(i); got != want {
+				t.Errorf("WithRetryPolicy(%v): backoff(%d) = %v, want %v", test.p, i, got, want)
+			}
+		}
+	}
+}
+
 // bmEncode benchmarks encoding a Protocol Buffer message containing mSize
 // bytes.
 func bmEncode(b *testing.B, mSize int) {
 	msg := &perfpb.Buffer{Body: make([]byte, mSize)}
-	encoded, _ := encode(msg, compressionNone)
+	encoded, _ := encodeBytes(protoCodec{}, msg, nil, 0)
 	encodedSz := int64(len(encoded))
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		encode(msg, compressionNone)
+		m, _ := encode(protoCodec{}, msg, nil, 0, nil)
+		m.free()
 	}
 	b.SetBytes(encodedSz)
 }
 
+// bmEncodeRaw benchmarks encoding mSize bytes passed through by rawCodec,
+// as done by the proxies.
+func bmEncodeRaw(b *testing.B, mSize int) {
+	var msg interface{} = make([]byte, mSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, _ := encode(rawCodec{protoCodec{}}, msg, nil, 0, nil)
+		m.free()
+	}
+	b.SetBytes(int64(msgHeaderLen + mSize))
+}
+
 func BenchmarkEncode1B(b *testing.B) {
 	bmEncode(b, 1)
 }
@@ -209,3 +614,69 @@ func BenchmarkEncode512KiB(b *testing.B) {
 func BenchmarkEncode1MiB(b *testing.B) {
 	bmEncode(b, 1024*1024)
 }
+
+// BenchmarkEncode4MiB encodes messages larger than maxPooledMsgSize, whose
+// buffers are not pooled.
+func BenchmarkEncode4MiB(b *testing.B) {
+	bmEncode(b, 4*1024*1024)
+}
+
+func BenchmarkEncodeRaw1KiB(b *testing.B) {
+	bmEncodeRaw(b, 1024)
+}
+
+func BenchmarkEncodeRaw1MiB(b *testing.B) {
+	bmEncodeRaw(b, 1024*1024)
+}
+
+func BenchmarkEncodeRaw4MiB(b *testing.B) {
+	bmEncodeRaw(b, 4*1024*1024)
+}
+
+func TestSplitMethodName(t *testing.T) {
+	for _, test := range []struct {
+		fullMethod  string
+		wantService string
+		wantMethod  string
+	}{
+		{"/grpc.testing.TestService/UnaryCall", "grpc.testing.TestService", "UnaryCall"},
+		{"grpc.testing.TestService/UnaryCall", "grpc.testing.TestService", "UnaryCall"},
+		{"/a/b/UnaryCall", "a/b", "UnaryCall"},
+		{"/UnaryCall", "", ""},
+		{"//UnaryCall", "", ""},
+		{"/grpc.testing.TestService/", "", ""},
+		{"", "", ""},
+	} {
+		service, method := SplitMethodName(test.fullMethod)
+		if service != test.wantService || method != test.wantMethod {
+			t.Fatalf("SplitMethodName(%q) = %q, %q, want %q, %q", test.fullMethod, service, method, test.wantService, test.wantMethod)
+		}
+	}
+}
+
+func TestSelectCompressor(t *testing.T) {
+	for _, test := range []struct {
+		names  []string
+		accept string
+		want   string
+	}{
+		{nil, "gzip", ""},
+		{[]string{"gzip"}, "", ""},
+		{[]string{"gzip"}, "gzip", "gzip"},
+		{[]string{"gzip"}, "deflate, gzip", "gzip"},
+		{[]string{"gzip"}, "deflate", ""},
+		// Unregistered Compressors are skipped.
+		{[]string{"deflate", "gzip"}, "deflate,gzip", "gzip"},
+	} {
+		var got string
+		if cp := selectCompressor(test.names, test.accept); cp != nil {
+			got = cp.Type()
+		}
+		if got != test.want {
+			t.Fatalf("selectCompressor(%v, %q) = %q, want %q", test.names, test.accept, got, test.want)
+		}
+	}
+	if got, want := acceptCompress(), "gzip"; got != want {
+		t.Fatalf("acceptCompress() = %q, want %q", got, want)
+	}
+}
@@ -39,18 +39,21 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"reflect"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/transport"
 )
 
-type methodHandler func(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error)
+type methodHandler func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error)
 
 // MethodDesc represents an RPC service's method specification.
 type MethodDesc struct {
@@ -66,6 +69,10 @@ type ServiceDesc struct {
 	HandlerType interface{}
 	Methods     []MethodDesc
 	Streams     []StreamDesc
+	// Metadata is the metadata of the service, reported by GetServiceInfo.
+	// The generated code sets it to the name of the proto file defining the
+	// service.
+	Metadata interface{}
 }
 
 // service consists of the information of the server serving this service and
@@ -74,6 +81,27 @@ type service struct {
 	server interface{} // the server for service methods
 	md     map[string]*MethodDesc
 	sd     map[string]*StreamDesc
+	mdata  interface{}
+}
+
+// MethodInfo contains the information of an RPC, including its method name and
+// type.
+type MethodInfo struct {
+	// Name is the method name only, without the service name or package name.
+	Name string
+	// IsClientStream indicates whether the RPC is a client streaming RPC.
+	IsClientStream bool
+	// IsServerStream indicates whether the RPC is a server streaming RPC.
+	IsServerStream bool
+}
+
+// ServiceInfo contains the information of a service: its methods and its
+// metadata.
+type ServiceInfo struct {
+	Methods []MethodInfo
+	// Metadata is the metadata specified in the ServiceDesc when registering
+	// the service.
+	Metadata interface{}
 }
 
 // Server is a gRPC server to serve RPC requests.
@@ -82,16 +110,180 @@ type Server struct {
 	mu    sync.Mutex
 	lis   map[net.Listener]bool
 	conns map[transport.ServerTransport]bool
-	m     map[string]*service // service name -> service info
+	// drain is set by GracefulStop. The new connections are closed.
+	drain bool
+	// cv is signaled when a connection is removed from conns.
+	cv *sync.Cond
+	m  map[string]*service // service name -> service info
+	// rpcs records the RPCs in flight with the transport they arrived on and
+	// the time they started.
+	rpcs map[*transport.Stream]activeRPC
+	// limiters enforce the callLimits of opts, by full method name.
+	limiters map[string]*callLimiter
+}
+
+// callLimiter bounds the concurrent calls of a method.
+type callLimiter struct {
+	// sem holds a value for each call running.
+	sem   chan struct{}
+	queue bool
+}
+
+// acquire waits for the room to run a call whose context is ctx, or fails
+// with the status of the call if there is none and l does not queue the calls
+// or ctx is done.
+func (l *callLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if !l.queue {
+		return Errorf(codes.ResourceExhausted, "grpc: the limit of %d concurrent calls of the method is reached", cap(l.sem))
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return toRPCErr(ctx.Err())
+	}
+}
+
+// release frees the room taken by acquire.
+func (l *callLimiter) release() {
+	<-l.sem
 }
 
+type activeRPC struct {
+	t     transport.ServerTransport
+	start time.Time
+}
+
+// RPCInfo describes an RPC in flight on a Server.
+type RPCInfo struct {
+	// Method is the full method name, i.e., /service/method.
+	Method string
+	// Peer is the address of the client.
+	Peer net.Addr
+	// StartTime is the time the RPC arrived on the server.
+	StartTime time.Time
+	// BytesReceived and BytesSent are the numbers of message bytes,
+	// including the gRPC message headers, received and sent so far.
+	BytesReceived int64
+	BytesSent     int64
+}
+
+type rpcsByStartTime []RPCInfo
+
+func (r rpcsByStartTime) Len() int           { return len(r) }
+func (r rpcsByStartTime) Less(i, j int) bool { return r[i].StartTime.Before(r[j].StartTime) }
+func (r rpcsByStartTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
 type options struct {
-	maxConcurrentStreams uint32
+	codec                 Codec
+	maxConcurrentStreams  uint32
+	initialWindowSize     int32
+	initialConnWindowSize int32
+	writeBufferSize       int
+	readBufferSize        int
+	maxHeaderListSize     uint32
+	maxBufferedBytes      int
+	frameHook             transport.FrameHook
+	keepalivePolicy       *keepalive.EnforcementPolicy
+	maxRecvMsgSize        int
+	unaryInt              UnaryServerInterceptor
+	sh                    stats.Handler
+	tracing               bool
+	responseCompressors   []string
+	unknownStreamDesc     *StreamDesc
+	errorMapper           func(error) (codes.Code, string, []byte)
+	callLimits            map[string]callLimit
+}
+
+// callLimit is the limit of the concurrent calls of a method set by
+// MaxConcurrentCalls.
+type callLimit struct {
+	n     int
+	queue bool
 }
 
 // A ServerOption sets options.
 type ServerOption func(*options)
 
+// InitialWindowSize returns a ServerOption that sets the receive window of
+// each stream announced to the clients. See WithInitialWindowSize for the
+// tradeoff. Values smaller than 64KB are ignored.
+func InitialWindowSize(s int32) ServerOption {
+	return func(o *options) {
+		o.initialWindowSize = s
+	}
+}
+
+// InitialConnWindowSize returns a ServerOption that sets the receive window
+// of each connection. See WithInitialConnWindowSize for the tradeoff. Values
+// smaller than 64KB are ignored.
+func InitialConnWindowSize(s int32) ServerOption {
+	return func(o *options) {
+		o.initialConnWindowSize = s
+	}
+}
+
+// WriteBufferSize returns a ServerOption that sets the size of the write
+// buffer of each connection. See WithWriteBufferSize for the tradeoff. Zero,
+// the default, disables the buffer.
+func WriteBufferSize(s int) ServerOption {
+	return func(o *options) {
+		o.writeBufferSize = s
+	}
+}
+
+// ReadBufferSize returns a ServerOption that sets the size of the read buffer
+// of each connection. See WithReadBufferSize for the tradeoff. Zero, the
+// default, disables the buffer.
+func ReadBufferSize(s int) ServerOption {
+	return func(o *options) {
+		o.readBufferSize = s
+	}
+}
+
+// MaxHeaderListSize returns a ServerOption that sets the limit of the size of
+// the header lists the server accepts from the clients. See
+// WithMaxHeaderListSize. It does not apply to ServeHTTP, whose limit is that
+// of the http.Server.
+func MaxHeaderListSize(n uint32) ServerOption {
+	return func(o *options) {
+		o.maxHeaderListSize = n
+	}
+}
+
+// MaxBufferedBytes returns a ServerOption that sets the limit of the bytes
+// buffered by each connection, see WithMaxBufferedBytes. Beyond it the new
+// RPCs are refused with codes.Unavailable. It does not apply to ServeHTTP.
+func MaxBufferedBytes(n int) ServerOption {
+	return func(o *options) {
+		o.maxBufferedBytes = n
+	}
+}
+
+// FrameHook returns a ServerOption that applies h to the frames written to the
+// clients, e.g., to test how they cope with malformed responses. It does not
+// apply to ServeHTTP.
+func FrameHook(h transport.FrameHook) ServerOption {
+	return func(o *options) {
+		o.frameHook = h
+	}
+}
+
+// KeepaliveEnforcementPolicy returns a ServerOption that enforces kep on the
+// keepalive pings of the clients, which protects the server from the clients
+// flooding it with pings. By default, the pings are not policed. It does not
+// apply to ServeHTTP.
+func KeepaliveEnforcementPolicy(kep keepalive.EnforcementPolicy) ServerOption {
+	return func(o *options) {
+		o.keepalivePolicy = &kep
+	}
+}
+
 // MaxConcurrentStreams returns an Option that will apply a limit on the number
 // of concurrent streams to each ServerTransport.
 func MaxConcurrentStreams(n uint32) ServerOption {
@@ -100,19 +292,128 @@ func MaxConcurrentStreams(n uint32) ServerOption {
 	}
 }
 
+// MaxConcurrentCalls returns a ServerOption that limits to n the RPCs of
+// method, the full method name /service/method, running at once on the server,
+// across all its connections. The RPCs beyond the limit wait for the ones
+// running to finish if queue is true, until their context is done; otherwise
+// they fail at once with codes.ResourceExhausted. The limit applies before the
+// interceptors and the handler run. n smaller than 1 is ignored.
+func MaxConcurrentCalls(method string, n int, queue bool) ServerOption {
+	return func(o *options) {
+		if o.callLimits == nil {
+			o.callLimits = make(map[string]callLimit)
+		}
+		o.callLimits[method] = callLimit{n: n, queue: queue}
+	}
+}
+
+// ResponseCompressors returns a ServerOption which compresses the responses
+// with the first of the registered Compressors named names that the client
+// accepts, as announced by its grpc-accept-encoding. The responses are not
+// compressed if the client accepts none of them, which is the default.
+func ResponseCompressors(names ...string) ServerOption {
+	return func(o *options) {
+		o.responseCompressors = names
+	}
+}
+
+// UnknownServiceHandler returns a ServerOption which serves the RPCs of the
+// unregistered services and methods with h as bidirectional streaming RPCs,
+// instead of failing them with codes.Unimplemented. The method of the RPC is
+// given by MethodFromServerStream. It allows, e.g., to proxy the RPCs whose
+// message types are not known by the server.
+func UnknownServiceHandler(h StreamHandler) ServerOption {
+	return func(o *options) {
+		o.unknownStreamDesc = &StreamDesc{
+			StreamName:    "unknown_service_handler",
+			Handler:       h,
+			ClientStreams: true,
+			ServerStreams: true,
+		}
+	}
+}
+
+// MaxRecvMsgSize returns a ServerOption which sets the maximum size in bytes
+// of a message the server accepts. Receiving a larger message fails the RPC
+// with codes.ResourceExhausted. The default is 4MB; zero means no limit.
+func MaxRecvMsgSize(n int) ServerOption {
+	return func(o *options) {
+		o.maxRecvMsgSize = n
+	}
+}
+
+// CustomCodec returns a ServerOption that sets a Codec for message encoding
+// and decoding. It is used for the RPCs whose content-subtype is not served
+// by a registered Codec. The default is protobuf.
+func CustomCodec(c Codec) ServerOption {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// UnaryInterceptor returns a ServerOption which installs i to intercept all
+// the unary RPCs served by the server.
+func UnaryInterceptor(i UnaryServerInterceptor) ServerOption {
+	return func(o *options) {
+		o.unaryInt = i
+	}
+}
+
+// StatsHandler returns a ServerOption which makes h receive the stats of all
+// the RPCs served by the server.
+func StatsHandler(h stats.Handler) ServerOption {
+	return func(o *options) {
+		o.sh = h
+	}
+}
+
+// ErrorMapper returns a ServerOption which makes f translate the errors
+// returned by the handlers into the status code, description and serialized
+// details sent to the clients, so that the handlers can return plain Go
+// errors. f is not called for the errors created by Errorf. If f returns
+// codes.OK, the error is converted as if no mapper were installed.
+func ErrorMapper(f func(err error) (code codes.Code, desc string, details []byte)) ServerOption {
+	return func(o *options) {
+		o.errorMapper = f
+	}
+}
+
+// Tracing returns a ServerOption which traces the RPCs served by the server
+// using golang.org/x/net/trace, so that they show up on /debug/requests.
+func Tracing() ServerOption {
+	return func(o *options) {
+		o.tracing = true
+	}
+}
+
 // NewServer creates a gRPC server which has no service registered and has not
 // started to accept requests yet.
 func NewServer(opt ...ServerOption) *Server {
-	var opts options
+	opts := options{
+		codec:          protoCodec{},
+		maxRecvMsgSize: defaultMaxMsgSize,
+	}
 	for _, o := range opt {
 		o(&opts)
 	}
-	return &Server{
+	s := &Server{
 		lis:   make(map[net.Listener]bool),
 		opts:  opts,
 		conns: make(map[transport.ServerTransport]bool),
 		m:     make(map[string]*service),
+		rpcs:  make(map[*transport.Stream]activeRPC),
 	}
+	for method, l := range opts.callLimits {
+		if l.n < 1 {
+			continue
+		}
+		if s.limiters == nil {
+			s.limiters = make(map[string]*callLimiter)
+		}
+		s.limiters[method] = &callLimiter{sem: make(chan struct{}, l.n), queue: l.queue}
+	}
+	s.cv = sync.NewCond(&s.mu)
+	return s
 }
 
 // RegisterService register a service and its implementation to the gRPC
@@ -134,6 +435,7 @@ func (s *Server) RegisterService(sd *ServiceDesc, ss interface{}) {
 		server: ss,
 		md:     make(map[string]*MethodDesc),
 		sd:     make(map[string]*StreamDesc),
+		mdata:  sd.Metadata,
 	}
 	for i := range sd.Methods {
 		d := &sd.Methods[i]
@@ -146,6 +448,36 @@ func (s *Server) RegisterService(sd *ServiceDesc, ss interface{}) {
 	s.m[sd.ServiceName] = srv
 }
 
+// GetServiceInfo returns a map from the name of each service registered on s
+// to its ServiceInfo. The methods are in no particular order.
+func (s *Server) GetServiceInfo() map[string]ServiceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]ServiceInfo)
+	for n, srv := range s.m {
+		methods := make([]MethodInfo, 0, len(srv.md)+len(srv.sd))
+		for m := range srv.md {
+			methods = append(methods, MethodInfo{
+				Name:           m,
+				IsClientStream: false,
+				IsServerStream: false,
+			})
+		}
+		for m, d := range srv.sd {
+			methods = append(methods, MethodInfo{
+				Name:           m,
+				IsClientStream: d.ClientStreams,
+				IsServerStream: d.ServerStreams,
+			})
+		}
+		ret[n] = ServiceInfo{
+			Methods:  methods,
+			Metadata: srv.mdata,
+		}
+	}
+	return ret
+}
+
 var (
 	// ErrServerStopped indicates that the operation is now illegal because of
 	// the server being stopped.
@@ -177,12 +509,23 @@ func (s *Server) Serve(lis net.Listener) error {
 		}
 
 		s.mu.Lock()
-		if s.conns == nil {
+		if s.conns == nil || s.drain {
 			s.mu.Unlock()
 			c.Close()
 			return nil
 		}
-		st, err := transport.NewServerTransport("http2", c, s.opts.maxConcurrentStreams)
+		config := &transport.ServerConfig{
+			MaxStreams:            s.opts.maxConcurrentStreams,
+			InitialWindowSize:     s.opts.initialWindowSize,
+			InitialConnWindowSize: s.opts.initialConnWindowSize,
+			WriteBufferSize:       s.opts.writeBufferSize,
+			ReadBufferSize:        s.opts.readBufferSize,
+			MaxHeaderListSize:     s.opts.maxHeaderListSize,
+			MaxBufferedBytes:      s.opts.maxBufferedBytes,
+			FrameHook:             s.opts.frameHook,
+			KeepalivePolicy:       s.opts.keepalivePolicy,
+		}
+		st, err := transport.NewServerTransport("http2", c, config)
 		if err != nil {
 			s.mu.Unlock()
 			c.Close()
@@ -198,143 +541,362 @@ func (s *Server) Serve(lis net.Listener) error {
 			})
 			s.mu.Lock()
 			delete(s.conns, st)
+			s.cv.Broadcast()
 			s.mu.Unlock()
 		}()
 	}
 }
 
-func (s *Server) sendProto(t transport.ServerTransport, stream *transport.Stream, msg proto.Message, pf payloadFormat, opts *transport.Options) error {
-	p, err := encode(msg, pf)
+// ServeHTTP implements the http.Handler interface, reading the gRPC request r
+// and calling the registered handler to reply to it. It allows s to be served
+// by an http.Server supporting HTTP/2 and trailers, next to the other
+// handlers of the http.Server. Requests which are not gRPC requests are
+// replied with an HTTP error.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st, err := transport.NewServerHandlerTransport(w, r)
 	if err != nil {
-		// This typically indicates a fatal issue (e.g., memory
-		// corruption or hardware faults) the application program
-		// cannot handle.
-		//
-		// TODO(zhaoq): There exist other options also such as only closing the
-		// faulty stream locally and remotely (Other streams can keep going). Find
-		// the optimal option.
-		log.Fatalf("grpc: Server failed to encode proto message %v", err)
+		return
+	}
+	s.mu.Lock()
+	if s.conns == nil || s.drain {
+		s.mu.Unlock()
+		st.Close()
+		http.Error(w, ErrServerStopped.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	return t.Write(stream, p, opts)
+	s.conns[st] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, st)
+		s.cv.Broadcast()
+		s.mu.Unlock()
+	}()
+	st.HandleStreams(func(stream *transport.Stream) {
+		s.handleStream(st, stream)
+	})
 }
 
-func (s *Server) processUnaryRPC(t transport.ServerTransport, stream *transport.Stream, srv *service, md *MethodDesc) {
-	p := &parser{s: stream}
-	for {
-		pf, req, err := p.recvMsg()
-		if err == io.EOF {
-			// The entire stream is done (for unary RPC only).
-			return
-		}
-		if err != nil {
-			switch err := err.(type) {
-			case transport.ConnectionError:
-				// Nothing to do here.
-			case transport.StreamError:
-				if err := t.WriteStatus(stream, err.Code, err.Desc); err != nil {
-					log.Printf("grpc: Server.processUnaryRPC failed to write status: %v", err)
-				}
-			default:
-				panic(fmt.Sprintf("grpc: Unexpected error (%T) from recvMsg: %v", err, err))
-			}
-			return
+// getCodec returns the Codec for the content-subtype of stream. The default
+// Codec of s is used if the content-subtype is empty or not registered.
+func (s *Server) getCodec(stream *transport.Stream) Codec {
+	subtype := stream.ContentSubtype()
+	if subtype == "" || subtype == s.opts.codec.String() {
+		return s.opts.codec
+	}
+	if c, ok := codecs[subtype]; ok {
+		return c
+	}
+	return s.opts.codec
+}
+
+// getCompressor returns the Compressor of the responses on stream and announces
+// it in the headers. It is nil if the responses are not compressed.
+func (s *Server) getCompressor(stream *transport.Stream) Compressor {
+	cp := selectCompressor(s.opts.responseCompressors, stream.AcceptCompress())
+	if cp != nil {
+		stream.SetSendCompress(cp.Type())
+	}
+	return cp
+}
+
+func (s *Server) sendResponse(t transport.ServerTransport, stream *transport.Stream, msg interface{}, codec Codec, cp Compressor, outPayload *stats.OutPayload, opts *transport.Options) error {
+	m, err := encode(codec, msg, cp, 0, outPayload)
+	if err != nil {
+		if _, ok := err.(transport.StreamError); ok {
+			return err
 		}
-		switch pf {
-		case compressionNone:
-			statusCode := codes.OK
-			statusDesc := ""
-			reply, appErr := md.Handler(srv.server, stream.Context(), req)
-			if appErr != nil {
-				if err, ok := appErr.(rpcError); ok {
-					statusCode = err.code
-					statusDesc = err.desc
-				} else {
-					statusCode = convertCode(appErr)
-					statusDesc = appErr.Error()
-				}
-				if err := t.WriteStatus(stream, statusCode, statusDesc); err != nil {
-					log.Printf("grpc: Server.processUnaryRPC failed to write status: %v", err)
-				}
-				return
-			}
-			opts := &transport.Options{
-				Last:  true,
-				Delay: false,
-			}
-			if err := s.sendProto(t, stream, reply, compressionNone, opts); err != nil {
-				if _, ok := err.(transport.ConnectionError); ok {
-					return
-				}
-				if e, ok := err.(transport.StreamError); ok {
-					statusCode = e.Code
-					statusDesc = e.Desc
-				} else {
-					statusCode = codes.Unknown
-					statusDesc = err.Error()
-				}
-			}
-			if err := t.WriteStatus(stream, statusCode, statusDesc); err != nil {
+		return transport.StreamErrorf(codes.Internal, "grpc: failed to encode the response: %v", err)
+	}
+	defer m.free()
+	return m.write(t, stream, opts)
+}
+
+// ctxErr returns the error to fail an RPC with if its context ctx is done
+// before the handler returns, e.g., the handler overran the deadline set by
+// the client. It returns nil otherwise.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return Errorf(convertCode(err), "%v", err)
+	}
+	return nil
+}
+
+// processUnaryRPC serves a unary RPC on stream. It returns the error the RPC
+// ended with, which is reported to the stats handler.
+func (s *Server) processUnaryRPC(t transport.ServerTransport, stream *transport.Stream, srv *service, md *MethodDesc) (err error) {
+	ctx := stream.Context()
+	sh := s.opts.sh
+	if sh != nil {
+		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: stream.Method()})
+		sh.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		defer func() {
+			sh.HandleRPC(ctx, &stats.End{
+				EndTime: time.Now(),
+				Error:   err,
+			})
+		}()
+	}
+	codec := s.getCodec(stream)
+	p := &parser{s: stream, maxMsgSize: s.opts.maxRecvMsgSize}
+	var (
+		pf  payloadFormat
+		req []byte
+	)
+	if sh == nil && !retainsData(codec) {
+		// The request is unmarshaled by the handler, hence the buffer is
+		// reused once it returns.
+		pf, req, err = p.recvPooledMsg()
+		defer p.release()
+	} else {
+		pf, req, err = p.recvMsg()
+	}
+	if err == io.EOF {
+		// The entire stream is done (for unary RPC only).
+		return nil
+	}
+	wireLength := msgHeaderLen + len(req)
+	if err == nil {
+		req, err = decompress(pf, req, stream.RecvCompress(), p.maxMsgSize)
+	}
+	if err != nil {
+		switch err := err.(type) {
+		case transport.ConnectionError:
+			// Nothing to do here.
+		case transport.StreamError:
+			if err := t.WriteStatus(stream, err.Code, err.Desc); err != nil {
 				log.Printf("grpc: Server.processUnaryRPC failed to write status: %v", err)
 			}
 		default:
-			panic(fmt.Sprintf("payload format to be supported: %d", pf))
+			panic(fmt.Sprintf("grpc: Unexpected error (%T) from recvMsg: %v", err, err))
+		}
+		return err
+	}
+	statusCode := codes.OK
+	statusDesc := ""
+	cp := s.getCompressor(stream)
+	dec := func(m interface{}) error {
+		if err := codec.Unmarshal(req, m); err != nil {
+			return err
 		}
+		if sh != nil {
+			sh.HandleRPC(ctx, &stats.InPayload{
+				RecvTime:   time.Now(),
+				Payload:    m,
+				Data:       req,
+				Length:     len(req),
+				WireLength: wireLength,
+			})
+		}
+		return nil
+	}
+	reply, appErr := md.Handler(srv.server, ctx, dec, s.opts.unaryInt)
+	if appErr == nil {
+		appErr = ctxErr(ctx)
 	}
+	if appErr != nil {
+		e := s.toRPCStatus(appErr)
+		if e.details != "" {
+			stream.SetStatusDetails([]byte(e.details))
+		}
+		if err := t.WriteStatus(stream, e.code, e.desc); err != nil {
+			log.Printf("grpc: Server.processUnaryRPC failed to write status: %v", err)
+		}
+		return e
+	}
+	opts := &transport.Options{
+		Last:  true,
+		Delay: false,
+	}
+	var outPayload *stats.OutPayload
+	if sh != nil {
+		outPayload = &stats.OutPayload{}
+	}
+	if err := s.sendResponse(t, stream, reply, codec, cp, outPayload, opts); err != nil {
+		if _, ok := err.(transport.ConnectionError); ok {
+			return err
+		}
+		if e, ok := err.(transport.StreamError); ok {
+			statusCode = e.Code
+			statusDesc = e.Desc
+		} else {
+			statusCode = codes.Unknown
+			statusDesc = err.Error()
+		}
+	} else if outPayload != nil {
+		outPayload.SentTime = time.Now()
+		sh.HandleRPC(ctx, outPayload)
+	}
+	if err := t.WriteStatus(stream, statusCode, statusDesc); err != nil {
+		log.Printf("grpc: Server.processUnaryRPC failed to write status: %v", err)
+	}
+	if statusCode != codes.OK {
+		return Errorf(statusCode, "%s", statusDesc)
+	}
+	return nil
 }
 
-func (s *Server) processStreamingRPC(t transport.ServerTransport, stream *transport.Stream, srv *service, sd *StreamDesc) {
+// processStreamingRPC serves a streaming RPC on stream. It returns the error
+// the RPC ended with, which is reported to the stats handler.
+func (s *Server) processStreamingRPC(t transport.ServerTransport, stream *transport.Stream, srv *service, sd *StreamDesc) (err error) {
 	ss := &serverStream{
-		t: t,
-		s: stream,
-		p: &parser{s: stream},
-	}
-	if appErr := sd.Handler(srv.server, ss); appErr != nil {
-		if err, ok := appErr.(rpcError); ok {
-			ss.statusCode = err.code
-			ss.statusDesc = err.desc
-		} else {
-			ss.statusCode = convertCode(appErr)
-			ss.statusDesc = appErr.Error()
+		t:     t,
+		s:     stream,
+		p:     &parser{s: stream, maxMsgSize: s.opts.maxRecvMsgSize},
+		codec: s.getCodec(stream),
+		cp:    s.getCompressor(stream),
+		ctx:   stream.Context(),
+		sh:    s.opts.sh,
+	}
+	if sh := ss.sh; sh != nil {
+		ss.ctx = sh.TagRPC(ss.ctx, &stats.RPCTagInfo{FullMethodName: stream.Method()})
+		sh.HandleRPC(ss.ctx, &stats.Begin{BeginTime: time.Now()})
+		defer func() {
+			sh.HandleRPC(ss.ctx, &stats.End{
+				EndTime: time.Now(),
+				Error:   err,
+			})
+		}()
+	}
+	var server interface{}
+	if srv != nil {
+		server = srv.server
+	}
+	appErr := sd.Handler(server, ss)
+	if appErr == nil {
+		appErr = ctxErr(ss.ctx)
+	}
+	if appErr != nil {
+		e := s.toRPCStatus(appErr)
+		ss.statusCode = e.code
+		ss.statusDesc = e.desc
+		if e.details != "" {
+			stream.SetStatusDetails([]byte(e.details))
 		}
+		err = e
+	}
+	if err := ss.flushHeader(); err != nil {
+		log.Printf("grpc: Server.processStreamingRPC failed to write header: %v", err)
 	}
 	if err := t.WriteStatus(ss.s, ss.statusCode, ss.statusDesc); err != nil {
 		log.Printf("grpc: Server.processStreamingRPC failed to write status: %v", err)
 	}
+	return err
+}
+
+// toRPCStatus converts the error returned by a handler into the status sent to
+// the client, using the error mapper of s if any.
+func (s *Server) toRPCStatus(appErr error) rpcError {
+	if e, ok := appErr.(rpcError); ok {
+		return e
+	}
+	if e, ok := appErr.(grpcStatus); ok {
+		return fromStatus(e.GRPCStatus())
+	}
+	if f := s.opts.errorMapper; f != nil {
+		if code, desc, details := f(appErr); code != codes.OK {
+			return rpcError{code: code, desc: desc, details: string(details)}
+		}
+	}
+	return rpcError{code: convertCode(appErr), desc: appErr.Error()}
 }
 
 func (s *Server) handleStream(t transport.ServerTransport, stream *transport.Stream) {
-	sm := stream.Method()
-	if sm != "" && sm[0] == '/' {
-		sm = sm[1:]
+	s.mu.Lock()
+	s.rpcs[stream] = activeRPC{t: t, start: time.Now()}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.rpcs, stream)
+		s.mu.Unlock()
+	}()
+	if !s.opts.tracing {
+		s.dispatch(t, stream)
+		return
 	}
-	pos := strings.LastIndex(sm, "/")
-	if pos == -1 {
-		if err := t.WriteStatus(stream, codes.InvalidArgument, fmt.Sprintf("malformed method name: %q", stream.Method())); err != nil {
+	tr := newTrace(false, stream.Method())
+	tr.LazyLog(&firstLine{remoteAddr: t.RemoteAddr()}, false)
+	finishTrace(tr, s.dispatch(t, stream))
+}
+
+// dispatch serves stream with the handler of its method. It returns the error
+// the RPC ended with.
+func (s *Server) dispatch(t transport.ServerTransport, stream *transport.Stream) error {
+	service, method := SplitMethodName(stream.Method())
+	if service == "" {
+		desc := fmt.Sprintf("malformed method name: %q", stream.Method())
+		if err := t.WriteStatus(stream, codes.InvalidArgument, desc); err != nil {
 			log.Printf("grpc: Server.handleStream failed to write status: %v", err)
 		}
-		return
+		return Errorf(codes.InvalidArgument, "%s", desc)
+	}
+	if l := s.limiters[stream.Method()]; l != nil {
+		if err := l.acquire(stream.Context()); err != nil {
+			if err := t.WriteStatus(stream, Code(err), ErrorDesc(err)); err != nil {
+				log.Printf("grpc: Server.handleStream failed to write status: %v", err)
+			}
+			return err
+		}
+		defer l.release()
 	}
-	service := sm[:pos]
-	method := sm[pos+1:]
 	srv, ok := s.m[service]
 	if !ok {
-		if err := t.WriteStatus(stream, codes.Unimplemented, fmt.Sprintf("unknown service %v", service)); err != nil {
+		if sd := s.opts.unknownStreamDesc; sd != nil {
+			return s.processStreamingRPC(t, stream, nil, sd)
+		}
+		desc := fmt.Sprintf("unknown service %v", service)
+		if err := t.WriteStatus(stream, codes.Unimplemented, desc); err != nil {
 			log.Printf("grpc: Server.handleStream failed to write status: %v", err)
 		}
-		return
+		return Errorf(codes.Unimplemented, "%s", desc)
 	}
 	// Unary RPC or Streaming RPC?
 	if md, ok := srv.md[method]; ok {
-		s.processUnaryRPC(t, stream, srv, md)
-		return
+		return s.processUnaryRPC(t, stream, srv, md)
 	}
 	if sd, ok := srv.sd[method]; ok {
-		s.processStreamingRPC(t, stream, srv, sd)
-		return
+		return s.processStreamingRPC(t, stream, srv, sd)
+	}
+	if sd := s.opts.unknownStreamDesc; sd != nil {
+		return s.processStreamingRPC(t, stream, nil, sd)
 	}
-	if err := t.WriteStatus(stream, codes.Unimplemented, fmt.Sprintf("unknown method %v", method)); err != nil {
+	desc := fmt.Sprintf("unknown method %v", method)
+	if err := t.WriteStatus(stream, codes.Unimplemented, desc); err != nil {
 		log.Printf("grpc: Server.handleStream failed to write status: %v", err)
 	}
+	return Errorf(codes.Unimplemented, "%s", desc)
+}
+
+// ActiveRPCs returns a snapshot of the RPCs in flight on s, the oldest first.
+// It is meant for debugging, e.g., to find out what a stuck server is doing.
+func (s *Server) ActiveRPCs() []RPCInfo {
+	s.mu.Lock()
+	rpcs := make([]RPCInfo, 0, len(s.rpcs))
+	for stream, r := range s.rpcs {
+		rpcs = append(rpcs, RPCInfo{
+			Method:        stream.Method(),
+			Peer:          r.t.RemoteAddr(),
+			StartTime:     r.start,
+			BytesReceived: stream.BytesReceived(),
+			BytesSent:     stream.BytesSent(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Sort(rpcsByStartTime(rpcs))
+	return rpcs
+}
+
+// BufferedBytes returns the number of bytes buffered by the connections of s:
+// the bytes of the messages received and not read yet by the handlers and
+// those being written.
+func (s *Server) BufferedBytes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for c := range s.conns {
+		n += c.BufferedBytes()
+	}
+	return n
 }
 
 // Stop stops the gRPC server. Once Stop returns, the server stops accepting
@@ -345,6 +907,8 @@ func (s *Server) Stop() {
 	s.lis = nil
 	cs := s.conns
 	s.conns = nil
+	// Interrupt GracefulStop if it is in progress.
+	s.cv.Broadcast()
 	s.mu.Unlock()
 	for lis := range listeners {
 		lis.Close()
@@ -354,6 +918,36 @@ func (s *Server) Stop() {
 	}
 }
 
+// GracefulStop stops the gRPC server gracefully. It stops the server from
+// accepting new connections and RPCs, sends GOAWAY on the connected
+// connections so that the clients move the new RPCs elsewhere, and blocks
+// until all the pending RPCs are finished and the connections are closed.
+// Calling Stop, e.g., after a deadline, closes the remaining connections and
+// makes GracefulStop return.
+func (s *Server) GracefulStop() {
+	s.mu.Lock()
+	if s.drain || s.conns == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.drain = true
+	listeners := s.lis
+	s.lis = nil
+	for c := range s.conns {
+		c.Drain()
+	}
+	s.mu.Unlock()
+	for lis := range listeners {
+		lis.Close()
+	}
+	s.mu.Lock()
+	for len(s.conns) != 0 {
+		s.cv.Wait()
+	}
+	s.conns = nil
+	s.mu.Unlock()
+}
+
 // TestingCloseConns closes all exiting transports but keeps s.lis accepting new
 // connections. This is for test only now.
 func (s *Server) TestingCloseConns() {
@@ -382,6 +976,17 @@ func SendHeader(ctx context.Context, md metadata.MD) error {
 	return t.WriteHeader(stream, md)
 }
 
+// UserAgent returns the user-agent announced by the client of the RPC. The ctx
+// is the RPC handler's Context or one derived from it. ok is false if ctx is
+// not.
+func UserAgent(ctx context.Context) (ua string, ok bool) {
+	stream, ok := transport.StreamFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return stream.UserAgent(), true
+}
+
 // SetTrailer sets the trailer metadata that will be sent when an RPC returns.
 // It may be called at most once from a unary RPC handler. The ctx is the RPC
 // handler's Context or one derived from it.
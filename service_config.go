@@ -0,0 +1,186 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceConfig is the parsed form of a service config, the JSON document
+// which sets the policies of the services of a target. See
+// https://github.com/grpc/grpc/blob/master/doc/service_config.md.
+type serviceConfig struct {
+	// lbPolicy is the name of the load balancing policy. It is empty if the
+	// config does not set one.
+	lbPolicy string
+	// methods maps the full method names and the service names to their
+	// MethodConfig like the keys given to WithMethodConfig.
+	methods map[string]MethodConfig
+	// throttling is nil if the config does not set the retry throttling.
+	throttling *retryThrottling
+}
+
+// The jsonX types mirror the JSON service config. The unknown fields are
+// ignored so that a config written for newer clients still applies.
+type jsonName struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+type jsonRetryPolicy struct {
+	MaxAttempts       int      `json:"maxAttempts"`
+	InitialBackoff    *string  `json:"initialBackoff"`
+	MaxBackoff        *string  `json:"maxBackoff"`
+	BackoffMultiplier *float64 `json:"backoffMultiplier"`
+}
+
+type jsonMethodConfig struct {
+	Name                    []jsonName       `json:"name"`
+	WaitForReady            *bool            `json:"waitForReady"`
+	Timeout                 *string          `json:"timeout"`
+	MaxRequestMessageBytes  int              `json:"maxRequestMessageBytes"`
+	MaxResponseMessageBytes int              `json:"maxResponseMessageBytes"`
+	RetryPolicy             *jsonRetryPolicy `json:"retryPolicy"`
+}
+
+type jsonRetryThrottling struct {
+	MaxTokens  float64 `json:"maxTokens"`
+	TokenRatio float64 `json:"tokenRatio"`
+}
+
+type jsonServiceConfig struct {
+	LoadBalancingPolicy string               `json:"loadBalancingPolicy"`
+	MethodConfig        []jsonMethodConfig   `json:"methodConfig"`
+	RetryThrottling     *jsonRetryThrottling `json:"retryThrottling"`
+}
+
+// parseServiceConfig parses the JSON service config js.
+func parseServiceConfig(js string) (*serviceConfig, error) {
+	var jsc jsonServiceConfig
+	if err := json.Unmarshal([]byte(js), &jsc); err != nil {
+		return nil, fmt.Errorf("grpc: failed to parse the service config: %v", err)
+	}
+	sc := &serviceConfig{
+		methods: make(map[string]MethodConfig),
+	}
+	switch p := strings.ToLower(jsc.LoadBalancingPolicy); p {
+	case "", "round_robin":
+		sc.lbPolicy = p
+	default:
+		return nil, fmt.Errorf("grpc: unsupported load balancing policy %q in the service config", jsc.LoadBalancingPolicy)
+	}
+	if jrt := jsc.RetryThrottling; jrt != nil {
+		sc.throttling = &retryThrottling{maxTokens: jrt.MaxTokens, tokenRatio: jrt.TokenRatio}
+		if err := sc.throttling.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, jmc := range jsc.MethodConfig {
+		mc, err := jmc.methodConfig()
+		if err != nil {
+			return nil, err
+		}
+		if len(jmc.Name) == 0 {
+			return nil, fmt.Errorf("grpc: a method config of the service config has no name")
+		}
+		for _, n := range jmc.Name {
+			if n.Service == "" {
+				return nil, fmt.Errorf("grpc: a name of the service config has no service")
+			}
+			k := "/" + n.Service
+			if n.Method != "" {
+				k += "/" + n.Method
+			}
+			if _, ok := sc.methods[k]; ok {
+				return nil, fmt.Errorf("grpc: %q has more than one method config in the service config", k)
+			}
+			sc.methods[k] = mc
+		}
+	}
+	return sc, nil
+}
+
+func (jmc *jsonMethodConfig) methodConfig() (mc MethodConfig, err error) {
+	mc.WaitForReady = jmc.WaitForReady
+	if jmc.Timeout != nil {
+		if mc.Timeout, err = parseDuration(*jmc.Timeout); err != nil {
+			return mc, err
+		}
+	}
+	mc.MaxSendMsgSize = jmc.MaxRequestMessageBytes
+	mc.MaxRecvMsgSize = jmc.MaxResponseMessageBytes
+	if jrp := jmc.RetryPolicy; jrp != nil {
+		// The fields left out keep the values of defaultRetryPolicy.
+		rp := defaultRetryPolicy
+		if jrp.MaxAttempts < 0 {
+			return mc, fmt.Errorf("grpc: negative maxAttempts %d in the service config", jrp.MaxAttempts)
+		}
+		rp.MaxAttempts = jrp.MaxAttempts
+		if jrp.InitialBackoff != nil {
+			if rp.InitialBackoff, err = parseDuration(*jrp.InitialBackoff); err != nil {
+				return mc, err
+			}
+		}
+		if jrp.MaxBackoff != nil {
+			if rp.MaxBackoff, err = parseDuration(*jrp.MaxBackoff); err != nil {
+				return mc, err
+			}
+		}
+		if jrp.BackoffMultiplier != nil {
+			if *jrp.BackoffMultiplier <= 0 {
+				return mc, fmt.Errorf("grpc: non-positive backoffMultiplier %v in the service config", *jrp.BackoffMultiplier)
+			}
+			rp.BackoffMultiplier = *jrp.BackoffMultiplier
+		}
+		mc.RetryPolicy = &rp
+	}
+	return mc, nil
+}
+
+// parseDuration parses the JSON form of a protobuf Duration, a number of
+// seconds followed by "s", e.g., "1.5s".
+func parseDuration(s string) (time.Duration, error) {
+	if !strings.HasSuffix(s, "s") {
+		return 0, fmt.Errorf("grpc: malformed duration %q in the service config", s)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("grpc: malformed duration %q in the service config", s)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
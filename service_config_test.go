@@ -0,0 +1,118 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package grpc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+	waitForReady := true
+	for _, test := range []struct {
+		js      string
+		methods map[string]MethodConfig
+		wantErr bool
+	}{
+		{`{}`, map[string]MethodConfig{}, false},
+		{`{"loadBalancingPolicy": "ROUND_ROBIN", "unknownField": 1}`, map[string]MethodConfig{}, false},
+		{
+			`{
+				"methodConfig": [{
+					"name": [{"service": "foo", "method": "Bar"}, {"service": "baz"}],
+					"waitForReady": true,
+					"timeout": "1.5s",
+					"maxRequestMessageBytes": 1024,
+					"maxResponseMessageBytes": 2048
+				}]
+			}`,
+			map[string]MethodConfig{
+				"/foo/Bar": {WaitForReady: &waitForReady, Timeout: 1500 * time.Millisecond, MaxSendMsgSize: 1024, MaxRecvMsgSize: 2048},
+				"/baz":     {WaitForReady: &waitForReady, Timeout: 1500 * time.Millisecond, MaxSendMsgSize: 1024, MaxRecvMsgSize: 2048},
+			},
+			false,
+		},
+		{
+			`{
+				"methodConfig": [{
+					"name": [{"service": "foo"}],
+					"retryPolicy": {"maxAttempts": 3, "maxBackoff": "10s", "retryableStatusCodes": ["UNAVAILABLE"]}
+				}]
+			}`,
+			map[string]MethodConfig{
+				"/foo": {RetryPolicy: &RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second, BackoffMultiplier: 2}},
+			},
+			false,
+		},
+		{`{`, nil, true},
+		{`{"loadBalancingPolicy": "grpclb"}`, nil, true},
+		{`{"methodConfig": [{"timeout": "1s"}]}`, nil, true},
+		{`{"methodConfig": [{"name": [{"method": "Bar"}]}]}`, nil, true},
+		{`{"methodConfig": [{"name": [{"service": "foo"}]}, {"name": [{"service": "foo"}]}]}`, nil, true},
+		{`{"methodConfig": [{"name": [{"service": "foo"}], "timeout": "1"}]}`, nil, true},
+		{`{"methodConfig": [{"name": [{"service": "foo"}], "timeout": "-1s"}]}`, nil, true},
+		{`{"methodConfig": [{"name": [{"service": "foo"}], "retryPolicy": {"backoffMultiplier": 0}}]}`, nil, true},
+	} {
+		sc, err := parseServiceConfig(test.js)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("parseServiceConfig(%s) = _, %v, want error: %t", test.js, err, test.wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(sc.methods, test.methods) {
+			t.Fatalf("parseServiceConfig(%s) = %+v, _, want the methods %+v", test.js, sc, test.methods)
+		}
+	}
+}
+
+func TestParseRetryThrottling(t *testing.T) {
+	for _, test := range []struct {
+		js      string
+		want    *retryThrottling
+		wantErr bool
+	}{
+		{`{}`, nil, false},
+		{`{"retryThrottling": {"maxTokens": 10, "tokenRatio": 0.1}}`, &retryThrottling{maxTokens: 10, tokenRatio: 0.1}, false},
+		{`{"retryThrottling": {"maxTokens": 0, "tokenRatio": 0.1}}`, nil, true},
+		{`{"retryThrottling": {"maxTokens": 1001, "tokenRatio": 0.1}}`, nil, true},
+		{`{"retryThrottling": {"maxTokens": 10}}`, nil, true},
+	} {
+		sc, err := parseServiceConfig(test.js)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("parseServiceConfig(%s) = _, %v, want error: %t", test.js, err, test.wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(sc.throttling, test.want) {
+			t.Fatalf("parseServiceConfig(%s) = %+v, _, want the retry throttling %+v", test.js, sc, test.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Code generated by protoc-gen-go.
+// source: status.proto
+// DO NOT EDIT!
+
+/*
+Package google_rpc is a generated protocol buffer package.
+
+It is generated from these files:
+	status.proto
+
+It has these top-level messages:
+	Status
+*/
+package google_rpc
+
+import proto "github.com/golang/protobuf/proto"
+import google_protobuf "github.com/golang/protobuf/ptypes/any"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+// Status is the status of an RPC along with its details, as sent in the
+// grpc-status-details-bin trailer.
+type Status struct {
+	// The status code, one of google.golang.org/grpc/codes.
+	Code int32 `protobuf:"varint,1,opt,name=code" json:"code,omitempty"`
+	// The description of the status.
+	Message string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	// The messages carrying the details of the error.
+	Details []*google_protobuf.Any `protobuf:"bytes,3,rep,name=details" json:"details,omitempty"`
+}
+
+func (m *Status) Reset()         { *m = Status{} }
+func (m *Status) String() string { return proto.CompactTextString(m) }
+func (*Status) ProtoMessage()    {}
+
+func (m *Status) GetDetails() []*google_protobuf.Any {
+	if m != nil {
+		return m.Details
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Status)(nil), "google.rpc.Status")
+}
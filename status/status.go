@@ -0,0 +1,182 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package status implements the status of the RPCs along with its details,
+// which are sent as a google.rpc.Status in the grpc-status-details-bin
+// trailer. The handlers return the errors made by Error, Errorf or
+// Status.Err, and the errors of the RPCs are decoded, details included, by
+// FromError and Status.Details.
+package status
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	spb "google.golang.org/grpc/status/google_rpc"
+)
+
+// Status is the status of an RPC. It is immutable; a nil Status is OK.
+type Status struct {
+	s *spb.Status
+}
+
+// New returns a Status with the code c and the description msg.
+func New(c codes.Code, msg string) *Status {
+	return &Status{s: &spb.Status{Code: int32(c), Message: msg}}
+}
+
+// Newf returns New(c, fmt.Sprintf(format, a...)).
+func Newf(c codes.Code, format string, a ...interface{}) *Status {
+	return New(c, fmt.Sprintf(format, a...))
+}
+
+// Error returns the error of the Status with the code c and the description
+// msg, or nil if c is OK.
+func Error(c codes.Code, msg string) error {
+	return New(c, msg).Err()
+}
+
+// Errorf returns Error(c, fmt.Sprintf(format, a...)).
+func Errorf(c codes.Code, format string, a ...interface{}) error {
+	return Error(c, fmt.Sprintf(format, a...))
+}
+
+// FromProto returns a Status of a copy of s.
+func FromProto(s *spb.Status) *Status {
+	return &Status{s: proto.Clone(s).(*spb.Status)}
+}
+
+// FromError returns the Status of err if it was produced by Status.Err or by
+// the rpc system, e.g., returned by Invoke. It returns nil and true if err is
+// nil, and a Status with codes.Unknown and false for any other error.
+func FromError(err error) (s *Status, ok bool) {
+	if err == nil {
+		return nil, true
+	}
+	if se, ok := err.(interface {
+		GRPCStatus() *Status
+	}); ok {
+		return se.GRPCStatus(), true
+	}
+	return New(codes.Unknown, err.Error()), false
+}
+
+// Code returns the status code of s.
+func (s *Status) Code() codes.Code {
+	if s == nil || s.s == nil {
+		return codes.OK
+	}
+	return codes.Code(s.s.Code)
+}
+
+// Message returns the description of s.
+func (s *Status) Message() string {
+	if s == nil || s.s == nil {
+		return ""
+	}
+	return s.s.Message
+}
+
+// Proto returns a copy of s as a google.rpc.Status.
+func (s *Status) Proto() *spb.Status {
+	if s == nil || s.s == nil {
+		return &spb.Status{}
+	}
+	return proto.Clone(s.s).(*spb.Status)
+}
+
+// Err returns the error of s, or nil if s is OK. A handler returning it ends
+// the RPC with s, details included.
+func (s *Status) Err() error {
+	if s.Code() == codes.OK {
+		return nil
+	}
+	return &statusError{s: s.Proto()}
+}
+
+// WithDetails returns a copy of s with details appended to its details. It
+// fails if s is OK, which has no details, or if a detail cannot be marshaled
+// into a google.protobuf.Any, e.g., because its type is not registered with
+// the proto package.
+func (s *Status) WithDetails(details ...proto.Message) (*Status, error) {
+	if s.Code() == codes.OK {
+		return nil, fmt.Errorf("status: no details can be added to an OK status")
+	}
+	p := s.Proto()
+	for _, d := range details {
+		any, err := ptypes.MarshalAny(d)
+		if err != nil {
+			return nil, fmt.Errorf("status: failed to marshal %v: %v", d, err)
+		}
+		p.Details = append(p.Details, any)
+	}
+	return &Status{s: p}, nil
+}
+
+// Details returns the details of s, decoded into the messages of their
+// registered types. A detail which cannot be decoded is returned as the error
+// explaining why.
+func (s *Status) Details() []interface{} {
+	if s == nil || s.s == nil {
+		return nil
+	}
+	details := make([]interface{}, 0, len(s.s.Details))
+	for _, any := range s.s.Details {
+		d, err := ptypes.Empty(any)
+		if err == nil {
+			err = ptypes.UnmarshalAny(any, d)
+		}
+		if err != nil {
+			details = append(details, err)
+			continue
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+// statusError is the error of a Status.
+type statusError struct {
+	s *spb.Status
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %q", e.s.Code, e.s.Message)
+}
+
+// GRPCStatus returns the Status of e.
+func (e *statusError) GRPCStatus() *Status {
+	return &Status{s: e.s}
+}
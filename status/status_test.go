@@ -0,0 +1,121 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package status
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/grpc/codes"
+)
+
+func TestErrRoundTrip(t *testing.T) {
+	st, err := New(codes.NotFound, "user not found").WithDetails(&duration.Duration{Seconds: 5}, &duration.Duration{Nanos: 7})
+	if err != nil {
+		t.Fatalf("New(_, _).WithDetails(_) = _, %v, want _, <nil>", err)
+	}
+	got, ok := FromError(st.Err())
+	if !ok || got.Code() != codes.NotFound || got.Message() != "user not found" {
+		t.Fatalf("FromError(%v) = %v, %q, %t, want %v, %q, true", st.Err(), got.Code(), got.Message(), ok, codes.NotFound, "user not found")
+	}
+	details := got.Details()
+	want := []proto.Message{&duration.Duration{Seconds: 5}, &duration.Duration{Nanos: 7}}
+	if len(details) != len(want) {
+		t.Fatalf("Details() = %v, want %v", details, want)
+	}
+	for i, d := range details {
+		if m, ok := d.(proto.Message); !ok || !proto.Equal(m, want[i]) {
+			t.Fatalf("Details()[%d] = %v, want %v", i, d, want[i])
+		}
+	}
+}
+
+func TestOK(t *testing.T) {
+	st := New(codes.OK, "")
+	if err := st.Err(); err != nil {
+		t.Fatalf("New(codes.OK, _).Err() = %v, want <nil>", err)
+	}
+	if _, err := st.WithDetails(&duration.Duration{}); err == nil {
+		t.Fatalf("New(codes.OK, _).WithDetails(_) = _, <nil>, want _, an error")
+	}
+	if st, ok := FromError(nil); !ok || st.Code() != codes.OK {
+		t.Fatalf("FromError(nil) = %v, %t, want %v, true", st.Code(), ok, codes.OK)
+	}
+}
+
+func TestFromOtherError(t *testing.T) {
+	st, ok := FromError(errors.New("boom"))
+	if ok || st.Code() != codes.Unknown || st.Message() != "boom" {
+		t.Fatalf("FromError(errors.New(%q)) = %v, %q, %t, want %v, %q, false", "boom", st.Code(), st.Message(), ok, codes.Unknown, "boom")
+	}
+}
+
+func TestUndecodableDetail(t *testing.T) {
+	any, err := ptypes.MarshalAny(&duration.Duration{Seconds: 5})
+	if err != nil {
+		t.Fatalf("ptypes.MarshalAny(_) = _, %v, want _, <nil>", err)
+	}
+	any.TypeUrl = "type.googleapis.com/unknown.Type"
+	p := New(codes.Internal, "").Proto()
+	p.Details = append(p.Details, any)
+	details := FromProto(p).Details()
+	if len(details) != 1 {
+		t.Fatalf("Details() = %v, want 1 detail", details)
+	}
+	if _, ok := details[0].(error); !ok {
+		t.Fatalf("Details()[0] = %v, want an error", details[0])
+	}
+}
+
+func TestError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code codes.Code
+		msg  string
+	}{
+		{Error(codes.NotFound, "user not found"), codes.NotFound, "user not found"},
+		{Errorf(codes.Internal, "%d users lost", 2), codes.Internal, "2 users lost"},
+	} {
+		st, ok := FromError(test.err)
+		if !ok || st.Code() != test.code || st.Message() != test.msg {
+			t.Fatalf("FromError(%v) = %v, %q, %t, want %v, %q, true", test.err, st.Code(), st.Message(), ok, test.code, test.msg)
+		}
+	}
+	if err := Errorf(codes.OK, "fine"); err != nil {
+		t.Fatalf("Errorf(%v, _) = %v, want <nil>", codes.OK, err)
+	}
+}
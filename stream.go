@@ -36,24 +36,37 @@ package grpc
 import (
 	"errors"
 	"io"
-	"net"
+	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/transport"
 )
 
-type streamHandler func(srv interface{}, stream ServerStream) error
+// StreamHandler defines the handler called by the server to serve a
+// streaming RPC. srv is the service implementation, which is nil for the
+// handler installed by UnknownServiceHandler.
+type StreamHandler func(srv interface{}, stream ServerStream) error
 
-// StreamDesc represents a streaming RPC service's method specification.
+// StreamDesc represents a streaming RPC service's method specification. It is
+// used by the generated code on both sides: the server dispatches the stream
+// to Handler, and the client stream uses the streaming directions to decide
+// how the RPC ends.
 type StreamDesc struct {
+	// StreamName is the method name without the service prefix.
 	StreamName string
-	Handler    streamHandler
+	// Handler is invoked by the server with a ServerStream for the RPC.
+	Handler StreamHandler
 
 	// At least one of these is true.
+	// ServerStreams indicates the server can send multiple messages.
 	ServerStreams bool
+	// ClientStreams indicates the client can send multiple messages. A
+	// client streaming RPC without ServerStreams receives exactly one
+	// response after which RecvMsg reports the status.
 	ClientStreams bool
 }
 
@@ -61,23 +74,26 @@ type StreamDesc struct {
 type Stream interface {
 	// Context returns the context for this stream.
 	Context() context.Context
-	// SendProto blocks until it sends m, the stream is done or the stream
+	// SendMsg blocks until it sends m, the stream is done or the stream
 	// breaks.
 	// On error, it aborts the stream and returns an RPC status on client
 	// side. On server side, it simply returns the error to the caller.
-	// SendProto is called by generated code.
-	SendProto(m proto.Message) error
-	// RecvProto blocks until it receives a proto message or the stream is
+	// SendMsg is called by generated code.
+	SendMsg(m interface{}) error
+	// RecvMsg blocks until it receives a message or the stream is
 	// done. On client side, it returns io.EOF when the stream is done. On
 	// any other error, it aborts the streama nd returns an RPC status. On
 	// server side, it simply returns the error to the caller.
-	RecvProto(m proto.Message) error
+	// On client side, the messages received before the status of the RPC
+	// are all returned before it, even if the RPC fails.
+	RecvMsg(m interface{}) error
 }
 
 // ClientStream defines the interface a client stream has to satify.
 type ClientStream interface {
 	// Header returns the header metedata received from the server if there
-	// is any. It blocks if the metadata is not ready to read.
+	// is any. It blocks until the header arrives, which may be before the
+	// first message (see ServerStream.SendHeader), or the stream ends.
 	Header() (metadata.MD, error)
 	// Trailer returns the trailer metadata from the server. It must be called
 	// after stream.Recv() returns non-nil error (including io.EOF) for
@@ -86,46 +102,184 @@ type ClientStream interface {
 	// present. Otherwise, it could returns an empty MD even though trailer
 	// is present.
 	Trailer() metadata.MD
-	// CloseSend closes the send direction of the stream. It closes the stream
+	// CloseSend closes the send direction of the stream, after writing the
+	// messages buffered with WriteBatching, if any. It closes the stream
 	// when non-nil error is met.
 	CloseSend() error
+	// Flush writes the messages buffered with WriteBatching, if any. It
+	// closes the stream when non-nil error is met.
+	Flush() error
 	Stream
 }
 
+// NewStream creates a new Stream for the client side, like NewClientStream
+// with cc.
+func (cc *ClientConn) NewStream(ctx context.Context, desc *StreamDesc, method string, opts ...CallOption) (ClientStream, error) {
+	return NewClientStream(ctx, desc, cc, method, opts...)
+}
+
 // NewClientStream creates a new Stream for the client side. This is called
 // by generated code.
 func NewClientStream(ctx context.Context, desc *StreamDesc, cc *ClientConn, method string, opts ...CallOption) (ClientStream, error) {
-	// TODO(zhaoq): CallOption is omitted. Add support when it is needed.
-	host, _, err := net.SplitHostPort(cc.target)
-	if err != nil {
-		return nil, toRPCErr(err)
+	opts = combine(cc.dopts.callOptions, opts)
+	var c callInfo
+	for _, o := range opts {
+		if err := o.before(&c); err != nil {
+			return nil, toRPCErr(err)
+		}
+	}
+	// The RPC is done once the goroutine below sees s done, or right away if
+	// no stream is created.
+	cc.rpcStarted()
+	// Header, Trailer and Peer only apply to the unary RPCs: a ClientStream
+	// provides the same through its Header, Trailer and Context. The retry
+	// options only apply to the unary RPCs too.
+	codec := cc.dopts.codec
+	if c.contentSubtype != "" {
+		codec = codecs[c.contentSubtype]
+	}
+	if c.maxRecvMsgSize <= 0 {
+		c.maxRecvMsgSize = cc.dopts.maxRecvMsgSize
+	}
+	if c.maxSendMsgSize <= 0 {
+		c.maxSendMsgSize = cc.dopts.maxSendMsgSize
+	}
+	sh := cc.dopts.sh
+	if sh != nil {
+		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: method})
+		sh.HandleRPC(ctx, &stats.Begin{
+			Client:    true,
+			BeginTime: time.Now(),
+			FailFast:  c.failFast,
+		})
+	}
+	cs := &clientStream{
+		ctx:   ctx,
+		desc:  desc,
+		codec: codec,
+		sh:    sh,
+
+		maxSendMsgSize: c.maxSendMsgSize,
+		writeBatchSize: c.writeBatchSize,
+		recvReader:     c.recvReader && desc.ServerStreams,
 	}
 	callHdr := &transport.CallHdr{
-		Host:   host,
-		Method: method,
+		Host:           cc.authority,
+		Method:         method,
+		Timeout:        timeoutFromContext(ctx),
+		ContentSubtype: contentSubtype(codec),
+		AcceptCompress: acceptCompress(),
+	}
+	cs.cp, callHdr.SendCompress = callCompressor(cc.dopts.cp, c.compressorType)
+	callHdr.ContentType = cc.dopts.contentType
+	if c.contentType != "" {
+		callHdr.ContentType = c.contentType
 	}
-	t, _, err := cc.wait(ctx, 0)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md, err := perRPCMetadata(ctx, cc, c.creds, method, md)
 	if err != nil {
-		return nil, toRPCErr(err)
+		cs.finish(err)
+		cc.rpcDone()
+		return nil, err
+	}
+	callHdr.Metadata = md
+	t, err := cc.getTransport(ctx, c.failFast)
+	if err != nil {
+		if err == ErrClientConnTransientFailure {
+			err = Errorf(codes.Unavailable, "%v", err)
+		} else {
+			err = toRPCErr(err)
+		}
+		cs.finish(err)
+		cc.rpcDone()
+		return nil, err
 	}
 	s, err := t.NewStream(ctx, callHdr)
 	if err != nil {
-		return nil, toRPCErr(err)
+		err = toRPCErr(err)
+		cs.finish(err)
+		cc.rpcDone()
+		return nil, err
 	}
-	return &clientStream{
-		t:    t,
-		s:    s,
-		p:    &parser{s: s},
-		desc: desc,
-	}, nil
+	if sh != nil {
+		sh.HandleRPC(ctx, &stats.OutHeader{
+			Client:   true,
+			Header:   callHdr.Metadata,
+			SentTime: time.Now(),
+		})
+	}
+	cs.t = t
+	cs.s = s
+	cs.p = &parser{s: s, maxMsgSize: c.maxRecvMsgSize}
+	// Reset the stream once ctx is done, so that the server stops as well
+	// even if neither SendMsg nor RecvMsg is called any more. The context of
+	// s is also done once the stream is closed, in which case CloseStream
+	// does nothing.
+	go func() {
+		select {
+		case <-t.Error():
+			// The stream is gone with the transport.
+		case <-t.Closed():
+			// The transport was closed, e.g., by Reconnect or a drain,
+			// which does not cancel the context of s.
+		case <-s.Context().Done():
+			t.CloseStream(s, transport.ContextErr(s.Context().Err()))
+		}
+		cc.rpcDone()
+	}()
+	return cs, nil
 }
 
 // clientStream implements a client side Stream.
 type clientStream struct {
-	t    transport.ClientTransport
-	s    *transport.Stream
-	p    *parser
-	desc *StreamDesc
+	t     transport.ClientTransport
+	s     *transport.Stream
+	p     *parser
+	desc  *StreamDesc
+	codec Codec
+	cp    Compressor
+	// ctx is the context of the RPC returned by the stats handler.
+	ctx context.Context
+	sh  stats.Handler
+
+	maxSendMsgSize int
+	// writeBatchSize is the threshold of WriteBatching; zero if the
+	// messages are not batched.
+	writeBatchSize int
+	// wbuf holds the messages buffered by SendMsg with WriteBatching.
+	// pending holds their OutPayload stats, reported once they are written.
+	wbuf    []byte
+	pending []*stats.OutPayload
+	// recvReader is set if RecvMsg hands back the readers of the messages.
+	recvReader bool
+	// gotHeader is set once RecvMsg has reported the InHeader stats.
+	gotHeader bool
+	// rcodec decodes the responses. It is set by the first RecvMsg once
+	// the headers are received. See recvCodec.
+	rcodec Codec
+
+	mu sync.Mutex
+	// finished is set once the End stats is reported.
+	finished bool
+}
+
+// finish reports the End stats of the RPC with err, which is nil if the RPC
+// succeeded. Only the first call takes effect.
+func (cs *clientStream) finish(err error) {
+	if cs.sh == nil {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.finished {
+		return
+	}
+	cs.finished = true
+	cs.sh.HandleRPC(cs.ctx, &stats.End{
+		Client:  true,
+		EndTime: time.Now(),
+		Error:   err,
+	})
 }
 
 func (cs *clientStream) Context() context.Context {
@@ -138,15 +292,16 @@ func (cs *clientStream) Header() (metadata.MD, error) {
 		if _, ok := err.(transport.ConnectionError); !ok {
 			cs.t.CloseStream(cs.s, err)
 		}
+		return nil, toRPCErr(err)
 	}
-	return m, err
+	return m, nil
 }
 
 func (cs *clientStream) Trailer() metadata.MD {
 	return cs.s.Trailer()
 }
 
-func (cs *clientStream) SendProto(m proto.Message) (err error) {
+func (cs *clientStream) SendMsg(m interface{}) (err error) {
 	defer func() {
 		if err == nil || err == io.EOF {
 			return
@@ -155,31 +310,129 @@ func (cs *clientStream) SendProto(m proto.Message) (err error) {
 			cs.t.CloseStream(cs.s, err)
 		}
 		err = toRPCErr(err)
+		cs.finish(err)
 	}()
-	out, err := encode(m, compressionNone)
+	var outPayload *stats.OutPayload
+	if cs.sh != nil {
+		outPayload = &stats.OutPayload{Client: true}
+	}
+	out, err := encode(cs.codec, m, cs.cp, cs.maxSendMsgSize, outPayload)
 	if err != nil {
+		if _, ok := err.(transport.StreamError); ok {
+			return err
+		}
 		return transport.StreamErrorf(codes.Internal, "grpc: %v", err)
 	}
-	return cs.t.Write(cs.s, out, &transport.Options{Last: false})
+	defer out.free()
+	if cs.writeBatchSize > 0 {
+		cs.wbuf = append(cs.wbuf, out.bytes()...)
+		if outPayload != nil {
+			cs.pending = append(cs.pending, outPayload)
+		}
+		if len(cs.wbuf) < cs.writeBatchSize {
+			return nil
+		}
+		return cs.write(false)
+	}
+	if err := out.write(cs.t, cs.s, &transport.Options{Last: false}); err != nil {
+		return err
+	}
+	if outPayload != nil {
+		outPayload.SentTime = time.Now()
+		cs.sh.HandleRPC(cs.ctx, outPayload)
+	}
+	return nil
 }
 
-func (cs *clientStream) RecvProto(m proto.Message) (err error) {
-	err = recvProto(cs.p, m)
+// write writes the messages buffered with WriteBatching in a single write,
+// which ends the send direction of the stream if last is true. Their
+// OutPayload stats are reported on success.
+func (cs *clientStream) write(last bool) error {
+	// Delay is cleared since the messages have already been batched.
+	err := cs.t.Write(cs.s, cs.wbuf, &transport.Options{Last: last, Delay: false})
+	cs.wbuf = cs.wbuf[:0]
+	pending := cs.pending
+	cs.pending = nil
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, p := range pending {
+		p.SentTime = now
+		cs.sh.HandleRPC(cs.ctx, p)
+	}
+	return nil
+}
+
+func (cs *clientStream) Flush() error {
+	if len(cs.wbuf) == 0 {
+		return nil
+	}
+	return cs.closeOnError(cs.write(false))
+}
+
+func (cs *clientStream) RecvMsg(m interface{}) (err error) {
+	defer func() {
+		// A non-nil err indicates the end of the stream.
+		if err == io.EOF {
+			cs.finish(nil)
+		} else if err != nil {
+			cs.finish(err)
+		}
+	}()
+	var inPayload *stats.InPayload
+	if cs.sh != nil {
+		inPayload = &stats.InPayload{Client: true}
+		if !cs.gotHeader {
+			// The header precedes the messages. A trailers-only response
+			// has none.
+			if md, err := cs.s.Header(); err == nil {
+				cs.gotHeader = true
+				if !cs.s.TrailersOnly() {
+					cs.sh.HandleRPC(cs.ctx, &stats.InHeader{
+						Client:     true,
+						Header:     md,
+						WireLength: cs.s.HeaderWireLength(),
+						RecvTime:   time.Now(),
+					})
+				}
+			}
+		}
+	}
+	if cs.rcodec == nil {
+		// A stream without headers fails below.
+		cs.rcodec = cs.codec
+		if _, err := cs.s.Header(); err == nil {
+			if cs.rcodec, err = recvCodec(cs.codec, cs.s); err != nil {
+				cs.t.CloseStream(cs.s, err)
+				return toRPCErr(err)
+			}
+		}
+	}
+	if cs.recvReader {
+		err = recvReader(cs.p, cs.s, m, inPayload)
+	} else {
+		err = recvAndUnmarshal(cs.p, cs.rcodec, cs.s, m, inPayload)
+	}
 	if err == nil {
+		if inPayload != nil {
+			cs.sh.HandleRPC(cs.ctx, inPayload)
+		}
 		if !cs.desc.ClientStreams || cs.desc.ServerStreams {
 			return
 		}
 		// Special handling for client streaming rpc.
-		err = recvProto(cs.p, m)
+		err = recvAndUnmarshal(cs.p, cs.rcodec, cs.s, m, nil)
 		cs.t.CloseStream(cs.s, err)
 		if err == nil {
 			return toRPCErr(errors.New("grpc: client streaming protocol violation: get <nil>, want <EOF>"))
 		}
 		if err == io.EOF {
 			if cs.s.StatusCode() == codes.OK {
+				cs.finish(nil)
 				return nil
 			}
-			return Errorf(cs.s.StatusCode(), cs.s.StatusDesc())
+			return statusError(cs.s)
 		}
 		return toRPCErr(err)
 	}
@@ -191,28 +444,44 @@ func (cs *clientStream) RecvProto(m proto.Message) (err error) {
 			// Returns io.EOF to indicate the end of the stream.
 			return
 		}
-		return Errorf(cs.s.StatusCode(), cs.s.StatusDesc())
+		return statusError(cs.s)
 	}
 	return toRPCErr(err)
 }
 
-func (cs *clientStream) CloseSend() (err error) {
-	err = cs.t.Write(cs.s, nil, &transport.Options{Last: true})
+func (cs *clientStream) CloseSend() error {
+	return cs.closeOnError(cs.write(true))
+}
+
+// closeOnError closes the stream if err is neither nil nor io.EOF, and
+// returns err converted to an RPC error.
+func (cs *clientStream) closeOnError(err error) error {
 	if err == nil || err == io.EOF {
-		return
+		return err
 	}
 	if _, ok := err.(transport.ConnectionError); !ok {
 		cs.t.CloseStream(cs.s, err)
 	}
 	err = toRPCErr(err)
-	return
+	cs.finish(err)
+	return err
 }
 
 // ServerStream defines the interface a server stream has to satisfy.
+//
+// RecvMsg of a ServerStream returns io.EOF once the client has called
+// CloseSend. An error returned by the handler is converted to an RPC status
+// and sent in the trailer.
 type ServerStream interface {
-	// SendHeader sends the header metadata. It should not be called
-	// after SendProto. It fails if called multiple times or if
-	// called after SendProto.
+	// SetHeader sets the header metadata. It may be called multiple times;
+	// all the provided metadata is merged and sent with the first of
+	// SendHeader, SendMsg or the RPC status. It fails once the header has
+	// been sent.
+	SetHeader(metadata.MD) error
+	// SendHeader sends the header metadata along with the metadata set by
+	// SetHeader right away, e.g., before the first message is produced. It
+	// fails with transport.ErrIllegalHeaderWrite if called multiple times or
+	// after SendMsg.
 	SendHeader(metadata.MD) error
 	// SetTrailer sets the trailer metadata which will be sent with the
 	// RPC status.
@@ -225,18 +494,79 @@ type serverStream struct {
 	t          transport.ServerTransport
 	s          *transport.Stream
 	p          *parser
+	codec      Codec
+	cp         Compressor
 	statusCode codes.Code
 	statusDesc string
+	// header is the metadata set by SetHeader which has not been sent.
+	header     metadata.MD
+	headerSent bool
+	// ctx is the context of the RPC returned by the stats handler.
+	ctx context.Context
+	sh  stats.Handler
+}
+
+// MethodFromServerStream returns the full method name of the RPC served by
+// stream, i.e., /package.service/method. ok is false if stream was not created
+// by a Server.
+func MethodFromServerStream(stream ServerStream) (method string, ok bool) {
+	ss, ok := stream.(*serverStream)
+	if !ok {
+		return "", false
+	}
+	return ss.s.Method(), true
 }
 
 func (ss *serverStream) Context() context.Context {
-	return ss.s.Context()
+	return ss.ctx
+}
+
+func (ss *serverStream) SetHeader(md metadata.MD) error {
+	if ss.headerSent {
+		return transport.ErrIllegalHeaderWrite
+	}
+	if md.Len() == 0 {
+		return nil
+	}
+	if ss.header == nil {
+		ss.header = metadata.MD{}
+	}
+	for k, v := range md {
+		ss.header[k] = v
+	}
+	return nil
 }
 
 func (ss *serverStream) SendHeader(md metadata.MD) error {
+	if ss.headerSent {
+		return transport.ErrIllegalHeaderWrite
+	}
+	ss.headerSent = true
+	if ss.header.Len() > 0 {
+		h := ss.header
+		ss.header = nil
+		for k, v := range md {
+			h[k] = v
+		}
+		md = h
+	}
 	return ss.t.WriteHeader(ss.s, md)
 }
 
+// flushHeader sends the metadata set by SetHeader if no header has been sent.
+func (ss *serverStream) flushHeader() error {
+	if ss.headerSent {
+		return nil
+	}
+	ss.headerSent = true
+	if ss.header.Len() == 0 {
+		return nil
+	}
+	h := ss.header
+	ss.header = nil
+	return ss.t.WriteHeader(ss.s, h)
+}
+
 func (ss *serverStream) SetTrailer(md metadata.MD) {
 	if md.Len() == 0 {
 		return
@@ -245,15 +575,40 @@ func (ss *serverStream) SetTrailer(md metadata.MD) {
 	return
 }
 
-func (ss *serverStream) SendProto(m proto.Message) error {
-	out, err := encode(m, compressionNone)
+func (ss *serverStream) SendMsg(m interface{}) error {
+	if err := ss.flushHeader(); err != nil {
+		return err
+	}
+	var outPayload *stats.OutPayload
+	if ss.sh != nil {
+		outPayload = &stats.OutPayload{}
+	}
+	out, err := encode(ss.codec, m, ss.cp, 0, outPayload)
 	if err != nil {
 		err = transport.StreamErrorf(codes.Internal, "grpc: %v", err)
 		return err
 	}
-	return ss.t.Write(ss.s, out, &transport.Options{Last: false})
+	defer out.free()
+	if err := out.write(ss.t, ss.s, &transport.Options{Last: false}); err != nil {
+		return err
+	}
+	if outPayload != nil {
+		outPayload.SentTime = time.Now()
+		ss.sh.HandleRPC(ss.ctx, outPayload)
+	}
+	return nil
 }
 
-func (ss *serverStream) RecvProto(m proto.Message) error {
-	return recvProto(ss.p, m)
+func (ss *serverStream) RecvMsg(m interface{}) error {
+	var inPayload *stats.InPayload
+	if ss.sh != nil {
+		inPayload = &stats.InPayload{}
+	}
+	if err := recvAndUnmarshal(ss.p, ss.codec, ss.s, m, inPayload); err != nil {
+		return err
+	}
+	if inPayload != nil {
+		ss.sh.HandleRPC(ss.ctx, inPayload)
+	}
+	return nil
 }
@@ -0,0 +1,231 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package bufconn provides a net.Conn implemented by a buffer and related
+// dialing and listening functionality, so that a Server and a ClientConn can
+// talk over memory in tests.
+package bufconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Listener implements a net.Listener that creates local, buffered net.Conns
+// via its Accept and Dial methods.
+type Listener struct {
+	mu   sync.Mutex
+	sz   int
+	ch   chan net.Conn
+	done chan struct{}
+}
+
+var errClosed = errors.New("bufconn: listener closed")
+
+// Listen returns a Listener that can only be contacted by its own Dialers and
+// creates buffered connections between the two. sz is the size of the
+// buffer of each direction of the connections.
+func Listen(sz int) *Listener {
+	return &Listener{sz: sz, ch: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept blocks until Dial is called, then returns a net.Conn for the server
+// half of the connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, errClosed
+	case c := <-l.ch:
+		return c, nil
+	}
+}
+
+// Close stops the listener.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		// Already closed.
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+// Addr reports the address of the listener.
+func (l *Listener) Addr() net.Addr { return addr{} }
+
+// Dial creates an in-memory full-duplex network connection, unblocks Accept
+// by providing it the server half of the connection, and returns the client
+// half of the connection.
+func (l *Listener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background(), "")
+}
+
+// DialContext is like Dial but gives up once ctx is done. addr is ignored so
+// that it can be passed to grpc.WithDialer.
+func (l *Listener) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	p1, p2 := newPipe(l.sz), newPipe(l.sz)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, errClosed
+	case l.ch <- &conn{p1, p2}:
+		return &conn{p2, p1}, nil
+	}
+}
+
+// pipe is a buffered one-way connection.
+type pipe struct {
+	mu sync.Mutex
+	// rwait is signaled when data is written to buf or the pipe is closed;
+	// wwait when data is read from buf or the pipe is closed.
+	rwait sync.Cond
+	wwait sync.Cond
+	// buf holds the data written and not read yet, at most sz bytes.
+	buf []byte
+	sz  int
+	// closed is set once the reading side is closed; writeClosed once the
+	// writing side is.
+	closed      bool
+	writeClosed bool
+}
+
+func newPipe(sz int) *pipe {
+	p := &pipe{sz: sz}
+	p.rwait.L = &p.mu
+	p.wwait.L = &p.mu
+	return p
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.wwait.Broadcast()
+			return n, nil
+		}
+		if p.writeClosed {
+			return 0, io.EOF
+		}
+		p.rwait.Wait()
+	}
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for len(b) > 0 {
+		if p.closed || p.writeClosed {
+			return n, io.ErrClosedPipe
+		}
+		avail := p.sz - len(p.buf)
+		if avail <= 0 {
+			p.wwait.Wait()
+			continue
+		}
+		if avail > len(b) {
+			avail = len(b)
+		}
+		p.buf = append(p.buf, b[:avail]...)
+		b = b[avail:]
+		n += avail
+		p.rwait.Broadcast()
+	}
+	return n, nil
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.rwait.Broadcast()
+	p.wwait.Broadcast()
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeClosed = true
+	p.rwait.Broadcast()
+	p.wwait.Broadcast()
+}
+
+// conn is a half of a connection, reading from r and writing to w.
+type conn struct {
+	r *pipe
+	w *pipe
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Close closes both directions: the reads of c fail and the peer reads io.EOF
+// once it has read the data written before.
+func (c *conn) Close() error {
+	c.r.closeRead()
+	c.w.closeWrite()
+	return nil
+}
+
+func (*conn) LocalAddr() net.Addr  { return addr{} }
+func (*conn) RemoteAddr() net.Addr { return addr{} }
+
+// The deadlines are not supported; the connections never time out.
+func (*conn) SetDeadline(t time.Time) error      { return nil }
+func (*conn) SetReadDeadline(t time.Time) error  { return nil }
+func (*conn) SetWriteDeadline(t time.Time) error { return nil }
+
+type addr struct{}
+
+func (addr) Network() string { return "bufconn" }
+func (addr) String() string  { return "bufconn" }
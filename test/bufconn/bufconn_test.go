@@ -0,0 +1,117 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package bufconn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func dialAccept(t *testing.T, l *Listener) (client, server io.ReadWriteCloser) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("l.Accept() = _, %v, want _, <nil>", err)
+			return
+		}
+		server = c
+	}()
+	c, err := l.Dial()
+	if err != nil {
+		t.Fatalf("l.Dial() = _, %v, want _, <nil>", err)
+	}
+	<-done
+	if server == nil {
+		t.FailNow()
+	}
+	return c, server
+}
+
+func TestConn(t *testing.T) {
+	l := Listen(7)
+	defer l.Close()
+	client, server := dialAccept(t, l)
+	// Writes larger than the buffer block until the peer reads them.
+	for _, test := range []struct {
+		w io.Writer
+		r io.Reader
+	}{
+		{client, server},
+		{server, client},
+	} {
+		data := bytes.Repeat([]byte("0123456789"), 100)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := test.w.Write(data)
+			errc <- err
+		}()
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(test.r, got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("io.ReadFull(_, _) got %q, %v, want %q, <nil>", got, err, data)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("Write(_) = _, %v, want _, <nil>", err)
+		}
+	}
+	// The peer reads the pending data then io.EOF once the connection is
+	// closed.
+	if _, err := client.Write([]byte("bye")); err != nil {
+		t.Fatalf("client.Write(_) = _, %v, want _, <nil>", err)
+	}
+	client.Close()
+	if got, err := ioutil.ReadAll(server); err != nil || string(got) != "bye" {
+		t.Fatalf("ioutil.ReadAll(server) = %q, %v, want %q, <nil>", got, err, "bye")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("client.Read(_) = _, %v, want _, %v", err, io.ErrClosedPipe)
+	}
+	if _, err := server.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("server.Write(_) = _, %v, want _, %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l := Listen(7)
+	l.Close()
+	if _, err := l.Accept(); err != errClosed {
+		t.Fatalf("l.Accept() = _, %v, want _, %v", err, errClosed)
+	}
+	if _, err := l.Dial(); err != errClosed {
+		t.Fatalf("l.Dial() = _, %v, want _, %v", err, errClosed)
+	}
+}
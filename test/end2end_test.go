@@ -34,22 +34,48 @@
 package grpc_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/proxy"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 	testpb "google.golang.org/grpc/test/grpc_testing"
+	"google.golang.org/grpc/transport"
 )
 
 var (
@@ -63,7 +89,11 @@ type testServer struct {
 }
 
 func (s *testServer) EmptyCall(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) {
-	if _, ok := metadata.FromContext(ctx); ok {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if d, ok := md["status-details-bin"]; ok {
+			// Echo the requested status details back to the client.
+			grpc.SetTrailer(ctx, metadata.Pairs("grpc-status-details-bin", d))
+		}
 		// For testing purpose, returns an error if there is attached metadata.
 		return nil, grpc.Errorf(codes.DataLoss, "got extra metadata")
 	}
@@ -89,7 +119,7 @@ func newPayload(t testpb.PayloadType, size int32) *testpb.Payload {
 }
 
 func (s *testServer) UnaryCall(ctx context.Context, in *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
-	md, ok := metadata.FromContext(ctx)
+	md, ok := metadata.FromIncomingContext(ctx)
 	if ok {
 		if err := grpc.SendHeader(ctx, md); err != nil {
 			log.Fatalf("grpc.SendHeader(%v, %v) = %v, want %v", ctx, md, err, nil)
@@ -104,7 +134,7 @@ func (s *testServer) UnaryCall(ctx context.Context, in *testpb.SimpleRequest) (*
 }
 
 func (s *testServer) StreamingOutputCall(args *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
-	if _, ok := metadata.FromContext(stream.Context()); ok {
+	if _, ok := metadata.FromIncomingContext(stream.Context()); ok {
 		// For testing purpose, returns an error if there is attached metadata.
 		return grpc.Errorf(codes.DataLoss, "got extra metadata")
 	}
@@ -140,7 +170,7 @@ func (s *testServer) StreamingInputCall(stream testpb.TestService_StreamingInput
 }
 
 func (s *testServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
-	md, ok := metadata.FromContext(stream.Context())
+	md, ok := metadata.FromIncomingContext(stream.Context())
 	if ok {
 		if err := stream.SendHeader(md); err != nil {
 			log.Fatalf("%v.SendHeader(%v) = %v, want %v", stream, md, err, nil)
@@ -171,6 +201,12 @@ func (s *testServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServ
 }
 
 func (s *testServer) HalfDuplexCall(stream testpb.TestService_HalfDuplexCallServer) error {
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		// The header is sent along with the first response.
+		if err := stream.SetHeader(md); err != nil {
+			log.Fatalf("%v.SetHeader(%v) = %v, want %v", stream, md, err, nil)
+		}
+	}
 	msgBuf := make([]*testpb.StreamingOutputCallRequest, 0)
 	for {
 		in, err := stream.Recv()
@@ -202,7 +238,7 @@ func (s *testServer) HalfDuplexCall(stream testpb.TestService_HalfDuplexCallServ
 const tlsDir = "testdata/"
 
 func TestDialTimeout(t *testing.T) {
-	conn, err := grpc.Dial("Non-Existent.Server:80", grpc.WithTimeout(time.Millisecond))
+	conn, err := grpc.Dial("Non-Existent.Server:80", grpc.WithTimeout(time.Millisecond), grpc.WithBlock(), grpc.WithInsecure())
 	if err == nil {
 		conn.Close()
 	}
@@ -216,7 +252,7 @@ func TestTLSDialTimeout(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create credentials %v", err)
 	}
-	conn, err := grpc.Dial("Non-Existent.Server:80", grpc.WithTransportCredentials(creds), grpc.WithTimeout(time.Millisecond))
+	conn, err := grpc.Dial("Non-Existent.Server:80", grpc.WithTransportCredentials(creds), grpc.WithTimeout(time.Millisecond), grpc.WithBlock())
 	if err == nil {
 		conn.Close()
 	}
@@ -225,286 +261,3247 @@ func TestTLSDialTimeout(t *testing.T) {
 	}
 }
 
-func TestReconnectTimeout(t *testing.T) {
-	lis, err := net.Listen("tcp", ":0")
+func TestWithDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
 	if err != nil {
-		t.Fatalf("Failed to listen: %v", err)
+		t.Fatalf("Failed to create a temporary directory: %v", err)
 	}
-	_, port, err := net.SplitHostPort(lis.Addr().String())
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "sock")
+	lis, err := net.Listen("unix", sock)
 	if err != nil {
-		t.Fatalf("Failed to parse listener address: %v", err)
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	addr := "localhost:" + port
-	conn, err := grpc.Dial(addr, grpc.WithTimeout(time.Second))
+	s := grpc.NewServer()
+	defer s.Stop()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	screds, err := credentials.NewServerTLSFromFile(tlsDir+"server1.pem", tlsDir+"server1.key")
 	if err != nil {
-		t.Fatalf("Failed to dial to the server %q: %v", addr, err)
+		t.Fatalf("Failed to generate credentials %v", err)
 	}
-	lis.Close()
-	tc := testpb.NewTestServiceClient(conn)
-	waitC := make(chan struct{})
-	go func() {
-		defer close(waitC)
-		argSize := 271828
-		respSize := 314159
-		req := &testpb.SimpleRequest{
-			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-			ResponseSize: proto.Int32(int32(respSize)),
-			Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	go s.Serve(screds.NewListener(lis))
+	var dialed []string
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		timeout := time.Second
+		if d, ok := ctx.Deadline(); ok {
+			timeout = d.Sub(time.Now())
 		}
-		_, err := tc.UnaryCall(context.Background(), req)
-		if err != grpc.Errorf(codes.Internal, "%v", grpc.ErrClientConnClosing) {
-			t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.Internal, "%v", grpc.ErrClientConnClosing))
-		}
-	}()
-	// Block untill reconnect times out.
-	<-waitC
-	if err := conn.Close(); err != grpc.ErrClientConnClosing {
-		t.Fatalf("%v.Close() = %v, want %v", conn, err, grpc.ErrClientConnClosing)
+		return net.DialTimeout("unix", sock, timeout)
 	}
-}
-
-func setUp(useTLS bool, maxStream uint32) (s *grpc.Server, tc testpb.TestServiceClient) {
-	lis, err := net.Listen("tcp", ":0")
+	creds, err := credentials.NewClientTLSFromFile(tlsDir+"ca.pem", "x.test.youtube.com")
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		t.Fatalf("Failed to create credentials %v", err)
 	}
-	_, port, err := net.SplitHostPort(lis.Addr().String())
+	// The target is only passed to the dialer.
+	conn, err := grpc.Dial("test.server:1", grpc.WithDialer(dialer), grpc.WithTransportCredentials(creds), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("Failed to parse listener address: %v", err)
-	}
-	s = grpc.NewServer(grpc.MaxConcurrentStreams(maxStream))
-	testpb.RegisterTestServiceServer(s, &testServer{})
-	if useTLS {
-		creds, err := credentials.NewServerTLSFromFile(tlsDir+"server1.pem", tlsDir+"server1.key")
-		if err != nil {
-			log.Fatalf("Failed to generate credentials %v", err)
-		}
-		go s.Serve(creds.NewListener(lis))
-	} else {
-		go s.Serve(lis)
+		t.Fatalf("grpc.Dial(_, WithDialer(_)) = _, %v, want _, <nil>", err)
 	}
-	addr := "localhost:" + port
-	var conn *grpc.ClientConn
-	if useTLS {
-		creds, err := credentials.NewClientTLSFromFile(tlsDir+"ca.pem", "x.test.youtube.com")
-		if err != nil {
-			log.Fatalf("Failed to create credentials %v", err)
-		}
-		conn, err = grpc.Dial(addr, grpc.WithTransportCredentials(creds))
-	} else {
-		conn, err = grpc.Dial(addr)
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
 	}
-	if err != nil {
-		log.Fatalf("Dial(%q) = %v", addr, err)
+	if want := []string{"test.server:1"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("The dialer was called with %v, want %v", dialed, want)
 	}
-	tc = testpb.NewTestServiceClient(conn)
-	return
 }
 
-func TestEmptyUnary(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	reply, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
-	if err != nil || !proto.Equal(&testpb.Empty{}, reply) {
-		t.Fatalf("TestService/EmptyCall(_, _) = %v, %v, want %v, <nil>", reply, err, &testpb.Empty{})
+func TestWithDialerTimeout(t *testing.T) {
+	// The dialer never connects; it returns once its context is done.
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
 	}
-}
-
-func TestFailedEmptyUnary(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	ctx := metadata.NewContext(context.Background(), testMetadata)
-	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err != grpc.Errorf(codes.DataLoss, "got extra metadata") {
-		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.DataLoss, "got extra metadata"))
+	conn, err := grpc.Dial("test.server:1", grpc.WithDialer(dialer), grpc.WithTimeout(10*time.Millisecond), grpc.WithBlock(), grpc.WithInsecure())
+	if err == nil {
+		conn.Close()
+	}
+	if err != grpc.ErrClientConnTimeout {
+		t.Fatalf("grpc.Dial(_, _) = %v, %v, want %v", conn, err, grpc.ErrClientConnTimeout)
 	}
 }
 
-func TestLargeUnary(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
+func TestBufconn(t *testing.T) {
+	lis := bufconn.Listen(1 << 16)
+	s := grpc.NewServer()
 	defer s.Stop()
-	argSize := 271828
-	respSize := 314159
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(lis)
+	conn, err := grpc.Dial("bufconn", grpc.WithDialer(lis.DialContext), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, WithDialer(_)) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	// Messages much larger than the buffer go through.
 	req := &testpb.SimpleRequest{
 		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-		ResponseSize: proto.Int32(int32(respSize)),
-		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+		ResponseSize: proto.Int32(1 << 20),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 1<<20),
 	}
 	reply, err := tc.UnaryCall(context.Background(), req)
 	if err != nil {
 		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
 	}
-	pt := reply.GetPayload().GetType()
-	ps := len(reply.GetPayload().GetBody())
-	if pt != testpb.PayloadType_COMPRESSABLE || ps != respSize {
-		t.Fatalf("Got the reply with type %d len %d; want %d, %d", pt, ps, testpb.PayloadType_COMPRESSABLE, respSize)
+	if size := len(reply.GetPayload().GetBody()); size != 1<<20 {
+		t.Fatalf("Got reply body of length %d, want %d", size, 1<<20)
 	}
 }
 
-func TestMetadataUnaryRPC(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	argSize := 2718
-	respSize := 314
-	req := &testpb.SimpleRequest{
-		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-		ResponseSize: proto.Int32(int32(respSize)),
-		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+func TestDialContextCancel(t *testing.T) {
+	// The server accepts the TCP connection but never completes the TLS
+	// handshake.
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	var header, trailer metadata.MD
-	ctx := metadata.NewContext(context.Background(), testMetadata)
-	_, err := tc.UnaryCall(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	creds, err := credentials.NewClientTLSFromFile(tlsDir+"ca.pem", "x.test.youtube.com")
 	if err != nil {
-		t.Fatalf("TestService.UnaryCall(%v, _, _, _) = _, %v; want _, <nil>", ctx, err)
+		t.Fatalf("Failed to create credentials %v", err)
 	}
-	if !reflect.DeepEqual(testMetadata, header) {
-		t.Fatalf("Received header metadata %v, want %v", header, testMetadata)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err == nil {
+		conn.Close()
 	}
-	if !reflect.DeepEqual(testMetadata, trailer) {
-		t.Fatalf("Received trailer metadata %v, want %v", trailer, testMetadata)
+	if err != context.Canceled {
+		t.Fatalf("grpc.DialContext(_, _) = %v, %v, want %v", conn, err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("grpc.DialContext(_, _) took %v after the cancellation, want it to return promptly", d)
 	}
 }
 
-func performOneRPC(t *testing.T, tc testpb.TestServiceClient, wg *sync.WaitGroup) {
-	argSize := 2718
-	respSize := 314
-	req := &testpb.SimpleRequest{
-		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-		ResponseSize: proto.Int32(int32(respSize)),
-		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
-	}
-	reply, err := tc.UnaryCall(context.Background(), req)
+func TestNonBlockingDial(t *testing.T) {
+	// Dial returns before the connection is up.
+	conn, err := grpc.Dial("Non-Existent.Server:80", grpc.WithTimeout(time.Second), grpc.WithInsecure())
 	if err != nil {
-		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+		t.Fatalf("grpc.Dial(_, _) = %v, %v, want _, <nil>", conn, err)
 	}
-	pt := reply.GetPayload().GetType()
-	ps := len(reply.GetPayload().GetBody())
-	if pt != testpb.PayloadType_COMPRESSABLE || ps != respSize {
-		t.Fatalf("Got the reply with type %d len %d; want %d, %d", pt, ps, testpb.PayloadType_COMPRESSABLE, respSize)
+	defer conn.Close()
+	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	tc := testpb.NewTestServiceClient(conn)
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
 	}
-	wg.Done()
 }
 
-// This test mimics a user who sends 1000 RPCs concurrently on a faulty transport.
-// TODO(zhaoq): Refactor to make this clearer and add more cases to test racy
-// and error-prone paths.
-func TestRetry(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		time.Sleep(1 * time.Second)
-		// The server shuts down the network connection to make a
-		// transport error which will be detected by the client side
-		// code.
-		s.TestingCloseConns()
-		wg.Done()
-	}()
-	// All these RPCs should succeed eventually.
-	for i := 0; i < 1000; i++ {
-		time.Sleep(2 * time.Millisecond)
-		wg.Add(1)
-		go performOneRPC(t, tc, &wg)
+func TestDialWithBlock(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	// Nothing listens on addr any more.
+	lis.Close()
+	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithBlock(), grpc.WithInsecure())
+	if err == nil {
+		conn.Close()
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("grpc.DialContext(_, %q, WithBlock()) = %v, %v, want _, %v", addr, conn, err, context.DeadlineExceeded)
 	}
-	wg.Wait()
 }
 
-// TODO(zhaoq): Have a better test coverage of timeout and cancellation mechanism.
-func TestRPCTimeout(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	argSize := 2718
-	respSize := 314
-	req := &testpb.SimpleRequest{
-		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-		ResponseSize: proto.Int32(int32(respSize)),
-		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+func TestConnectivityState(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	// Performs 100 RPCs with various timeout values so that
-	// the RPCs could timeout on different stages of their lifetime. This
-	// is the best-effort to cover various cases when an rpc gets cancelled.
-	for i := 1; i <= 100; i++ {
-		ctx, _ := context.WithTimeout(context.Background(), time.Duration(i)*time.Microsecond)
-		reply, err := tc.UnaryCall(ctx, req)
-		if grpc.Code(err) != codes.DeadlineExceeded {
-			t.Fatalf(`TestService/UnaryCallv(_, _) = %v, %v; want <nil>, error code: %d`, reply, err, codes.DeadlineExceeded)
+	s := grpc.NewServer()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	state := conn.State()
+	for state != grpc.Ready {
+		if state, err = conn.WaitForStateChange(ctx, state); err != nil {
+			t.Fatalf("timed out waiting for the ClientConn to be ready: %v", err)
 		}
 	}
+	// The state does not change while the connection is healthy.
+	shortCtx, _ := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if state, err := conn.WaitForStateChange(shortCtx, grpc.Ready); state != grpc.Ready || err != context.DeadlineExceeded {
+		t.Fatalf("conn.WaitForStateChange(_, %v) = %v, %v, want %v, %v", grpc.Ready, state, err, grpc.Ready, context.DeadlineExceeded)
+	}
+	s.Stop()
+	if state, err := conn.WaitForStateChange(ctx, grpc.Ready); err != nil || (state != grpc.Connecting && state != grpc.TransientFailure) {
+		t.Fatalf("conn.WaitForStateChange(_, %v) = %v, %v, want %v or %v, <nil>", grpc.Ready, state, err, grpc.Connecting, grpc.TransientFailure)
+	}
+	conn.Close()
+	if state := conn.State(); state != grpc.Shutdown {
+		t.Fatalf("conn.State() = %v, want %v", state, grpc.Shutdown)
+	}
 }
 
-func TestCancel(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	argSize := 2718
-	respSize := 314
-	req := &testpb.SimpleRequest{
-		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
-		ResponseSize: proto.Int32(int32(respSize)),
-		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	time.AfterFunc(1*time.Millisecond, cancel)
-	reply, err := tc.UnaryCall(ctx, req)
-	if grpc.Code(err) != codes.Canceled {
-		t.Fatalf(`TestService/UnaryCall(_, _) = %v, %v; want <nil>, error code: %d`, reply, err, codes.Canceled)
+type testWatcher struct {
+	updates chan []*naming.Update
+	done    chan struct{}
+}
+
+func (w *testWatcher) Next() ([]*naming.Update, error) {
+	select {
+	case u := <-w.updates:
+		return u, nil
+	case <-w.done:
+		return nil, errors.New("the watcher is closed")
 	}
 }
 
-// The following tests the gRPC streaming RPC implementations.
-// TODO(zhaoq): Have better coverage on error cases.
-var (
-	reqSizes  = []int{27182, 8, 1828, 45904}
-	respSizes = []int{31415, 9, 2653, 58979}
-)
+func (w *testWatcher) Close() {
+	close(w.done)
+}
 
-func TestPingPong(t *testing.T) {
-	s, tc := setUp(true, math.MaxUint32)
-	defer s.Stop()
-	stream, err := tc.FullDuplexCall(context.Background())
+type testResolver struct {
+	w *testWatcher
+}
+
+func (r *testResolver) Resolve(target string) (naming.Watcher, error) {
+	return r.w, nil
+}
+
+func startTestServer(t *testing.T) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	var index int
-	for index < len(reqSizes) {
-		respParam := []*testpb.ResponseParameters{
-			{
-				Size: proto.Int32(int32(respSizes[index])),
-			},
-		}
-		req := &testpb.StreamingOutputCallRequest{
-			ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
-			ResponseParameters: respParam,
-			Payload:            newPayload(testpb.PayloadType_COMPRESSABLE, int32(reqSizes[index])),
-		}
-		if err := stream.Send(req); err != nil {
-			t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
-		}
-		reply, err := stream.Recv()
-		if err != nil {
-			t.Fatalf("%v.Recv() = %v, want <nil>", stream, err)
+	s := grpc.NewServer()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+func TestTransparentProxy(t *testing.T) {
+	backend, addr := startTestServer(t)
+	defer backend.Stop()
+	bconn, err := grpc.Dial(addr, grpc.WithCodec(proxy.Codec()), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q, _) = _, %v, want _, <nil>", addr, err)
+	}
+	defer bconn.Close()
+	director := func(ctx context.Context, method string) (context.Context, *grpc.ClientConn, error) {
+		if method == "/grpc.testing.TestService/StreamingInputCall" {
+			return nil, nil, grpc.Errorf(codes.PermissionDenied, "denied by director")
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		return metadata.NewOutgoingContext(ctx, md.Copy()), bconn, nil
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	// The proxy does not know the test service.
+	s := grpc.NewServer(grpc.CustomCodec(proxy.Codec()), grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	// The messages, header and trailer are forwarded both ways.
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(314),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 2718),
+	}
+	var header, trailer metadata.MD
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+	reply, err := tc.UnaryCall(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil || len(reply.GetPayload().GetBody()) != 314 {
+		t.Fatalf("TestService/UnaryCall(_, _) = %v, %v, want a reply of len %d, <nil>", reply, err, 314)
+	}
+	if !reflect.DeepEqual(header, testMetadata) || !reflect.DeepEqual(trailer, testMetadata) {
+		t.Fatalf("Received header %v and trailer %v, want %v", header, trailer, testMetadata)
+	}
+	// The status of the backend is forwarded.
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err != grpc.Errorf(codes.DataLoss, "got extra metadata") {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.DataLoss, "got extra metadata"))
+	}
+	// The error of the director fails the RPC.
+	stream, err := tc.StreamingInputCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.StreamingInputCall(_) = _, %v, want _, <nil>", tc, err)
+	}
+	if _, err := stream.CloseAndRecv(); err != grpc.Errorf(codes.PermissionDenied, "denied by director") {
+		t.Fatalf("%v.CloseAndRecv() = _, %v, want _, %v", stream, err, grpc.Errorf(codes.PermissionDenied, "denied by director"))
+	}
+	// Streams are forwarded message by message.
+	dstream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want _, <nil>", tc, err)
+	}
+	for _, size := range respSizes {
+		sreq := &testpb.StreamingOutputCallRequest{
+			ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(int32(size))}},
+		}
+		if err := dstream.Send(sreq); err != nil {
+			t.Fatalf("%v.Send(%v) = %v, want <nil>", dstream, sreq, err)
+		}
+		sreply, err := dstream.Recv()
+		if err != nil || len(sreply.GetPayload().GetBody()) != size {
+			t.Fatalf("%v.Recv() = %v, %v, want a reply of len %d, <nil>", dstream, sreply, err, size)
+		}
+	}
+	if err := dstream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", dstream, err)
+	}
+	if _, err := dstream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", dstream, err, io.EOF)
+	}
+}
+
+func TestRecvReader(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q, _) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	stream, err := grpc.NewClientStream(context.Background(), desc, conn, "/grpc.testing.TestService/StreamingOutputCall", grpc.RecvReader())
+	if err != nil {
+		t.Fatalf("grpc.NewClientStream(_, _, _, _, RecvReader()) = _, %v, want _, <nil>", err)
+	}
+	var params []*testpb.ResponseParameters
+	for _, size := range respSizes {
+		params = append(params, &testpb.ResponseParameters{Size: proto.Int32(int32(size))})
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: params,
+	}
+	if err := stream.SendMsg(req); err != nil {
+		t.Fatalf("%v.SendMsg(%v) = %v, want <nil>", stream, req, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	for i, size := range respSizes {
+		var r io.Reader
+		if err := stream.RecvMsg(&r); err != nil {
+			t.Fatalf("%v.RecvMsg(_) = %v, want <nil>", stream, err)
+		}
+		// Every other message is left unread, which is skipped by the
+		// next RecvMsg.
+		if i%2 == 1 {
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading the message %d = _, %v, want _, <nil>", i, err)
+		}
+		reply := &testpb.StreamingOutputCallResponse{}
+		if err := proto.Unmarshal(b, reply); err != nil || len(reply.GetPayload().GetBody()) != size {
+			t.Fatalf("the message %d is %v (%v), want a reply of len %d", i, reply, err, size)
+		}
+	}
+	var r io.Reader
+	if err := stream.RecvMsg(&r); err != io.EOF {
+		t.Fatalf("%v.RecvMsg(_) = %v, want %v", stream, err, io.EOF)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	s1, addr1 := startTestServer(t)
+	defer s1.Stop()
+	s2, addr2 := startTestServer(t)
+	defer s2.Stop()
+	w := &testWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	w.updates <- []*naming.Update{{Op: naming.Add, Addr: addr1}}
+	conn, err := grpc.Dial("test:///foo", grpc.WithResolver(&testResolver{w}), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	var p peer.Peer
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err != nil || p.Addr.String() != addr1 {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v on %v, want _, <nil> on %s", err, p.Addr, addr1)
+	}
+	// The ClientConn moves to addr2 once addr1 is deleted.
+	w.updates <- []*naming.Update{{Op: naming.Delete, Addr: addr1}, {Op: naming.Add, Addr: addr2}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err == nil && p.Addr.String() == addr2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/EmptyCall(_, _) was served by %v, want %s", p.Addr, addr2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s1, addr1 := startTestServer(t)
+	defer s1.Stop()
+	s2, addr2 := startTestServer(t)
+	defer s2.Stop()
+	w := &testWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	w.updates <- []*naming.Update{{Op: naming.Add, Addr: addr1}, {Op: naming.Add, Addr: addr2}}
+	conn, err := grpc.Dial("test:///foo", grpc.WithBalancer(grpc.RoundRobin(&testResolver{w})), grpc.WithBlock(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	var p peer.Peer
+	served := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		served[p.Addr.String()]++
+	}
+	if served[addr1] != 5 || served[addr2] != 5 {
+		t.Fatalf("RPCs served by %v, want 5 by each of %s and %s", served, addr1, addr2)
+	}
+}
+
+func TestListResolver(t *testing.T) {
+	// Nothing listens on dead.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	dead := lis.Addr().String()
+	lis.Close()
+	s1, addr1 := startTestServer(t)
+	defer s1.Stop()
+	r := naming.NewListResolver(dead, addr1)
+	conn, err := grpc.Dial("test:///foo", grpc.WithResolver(r), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	var p peer.Peer
+	// The RPCs fail over to the healthy address.
+	for i := 0; i < 5; i++ {
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err != nil || p.Addr.String() != addr1 {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v on %v, want _, <nil> on %s", err, p.Addr, addr1)
+		}
+	}
+	// The ClientConn follows the replaced list.
+	s2, addr2 := startTestServer(t)
+	defer s2.Stop()
+	r.SetAddrs(addr2)
+	s1.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err == nil && p.Addr.String() == addr2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/EmptyCall(_, _) was served by %v, want %s", p.Addr, addr2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	s, addr := startTestServer(t)
+	conn, err := grpc.Dial(addr, grpc.WithBlock(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	// The new RPCs fail once the client sees GOAWAY and cannot reconnect.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.FailFast(true))
+		if err != nil && grpc.Code(err) == codes.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code %d", err, codes.Unavailable)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatalf("GracefulStop returned before the active RPC finished")
+	default:
+	}
+	// The active RPC is not affected.
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GracefulStop did not return after the active RPC finished")
+	}
+}
+
+func TestDialWithBlockNoAddress(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	w := &testWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	// Dial does not return until an address is resolved and connected to.
+	w.updates <- []*naming.Update{}
+	time.AfterFunc(100*time.Millisecond, func() {
+		w.updates <- []*naming.Update{{Op: naming.Add, Addr: addr}}
+	})
+	conn, err := grpc.Dial("test:///foo", grpc.WithResolver(&testResolver{w}), grpc.WithBlock(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	if state := conn.State(); state != grpc.Ready {
+		t.Fatalf("conn.State() = %v, want %v", state, grpc.Ready)
+	}
+	// Dial fails once the dial timeout expires if no address is resolved.
+	w = &testWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	w.updates <- []*naming.Update{}
+	conn, err = grpc.Dial("test:///foo", grpc.WithResolver(&testResolver{w}), grpc.WithTimeout(100*time.Millisecond), grpc.WithBlock(), grpc.WithInsecure())
+	if err == nil {
+		conn.Close()
+	}
+	if err != grpc.ErrClientConnTimeout {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, %v", err, grpc.ErrClientConnTimeout)
+	}
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse listener address: %v", err)
+	}
+	addr := "localhost:" + port
+	conn, err := grpc.Dial(addr, grpc.WithTimeout(time.Second), grpc.WithBlock(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial to the server %q: %v", addr, err)
+	}
+	lis.Close()
+	// Wait until the connection is lost so that the RPC below waits for the
+	// reconnection rather than being sent on the dying transport.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if state, err := conn.WaitForStateChange(ctx, grpc.Ready); err != nil {
+		t.Fatalf("conn.WaitForStateChange(_, %v) = %v, %v, want _, <nil>", grpc.Ready, state, err)
+	}
+	tc := testpb.NewTestServiceClient(conn)
+	waitC := make(chan struct{})
+	go func() {
+		defer close(waitC)
+		argSize := 271828
+		respSize := 314159
+		req := &testpb.SimpleRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseSize: proto.Int32(int32(respSize)),
+			Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+		}
+		_, err := tc.UnaryCall(context.Background(), req)
+		if err != grpc.Errorf(codes.Internal, "%v", grpc.ErrClientConnClosing) {
+			t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.Internal, "%v", grpc.ErrClientConnClosing))
+		}
+	}()
+	// Block untill reconnect times out.
+	<-waitC
+	if err := conn.Close(); err != grpc.ErrClientConnClosing {
+		t.Fatalf("%v.Close() = %v, want %v", conn, err, grpc.ErrClientConnClosing)
+	}
+}
+
+func TestReconnectTimeoutRecovery(t *testing.T) {
+	// Nothing listens on addr until it is announced again.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	w := &testWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	w.updates <- []*naming.Update{{Op: naming.Add, Addr: addr}}
+	conn, err := grpc.Dial("test:///foo", grpc.WithResolver(&testResolver{w}), grpc.WithTimeout(100*time.Millisecond), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	want := grpc.Errorf(codes.Internal, "%v", grpc.ErrClientConnTimeout)
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != want {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, want)
+	}
+	// The ClientConn connects again once the address given up is announced
+	// again.
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s again: %v", addr, err)
+	}
+	s := grpc.NewServer()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+	w.updates <- []*naming.Update{{Op: naming.Add, Addr: addr}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func setUp(useTLS bool, maxStream uint32, dopts ...grpc.DialOption) (s *grpc.Server, tc testpb.TestServiceClient) {
+	return setUpWithOptions(useTLS, []grpc.ServerOption{grpc.MaxConcurrentStreams(maxStream)}, dopts...)
+}
+
+func setUpWithOptions(useTLS bool, sopts []grpc.ServerOption, dopts ...grpc.DialOption) (s *grpc.Server, tc testpb.TestServiceClient) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	if err != nil {
+		log.Fatalf("Failed to parse listener address: %v", err)
+	}
+	s = grpc.NewServer(sopts...)
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	if useTLS {
+		creds, err := credentials.NewServerTLSFromFile(tlsDir+"server1.pem", tlsDir+"server1.key")
+		if err != nil {
+			log.Fatalf("Failed to generate credentials %v", err)
+		}
+		go s.Serve(creds.NewListener(lis))
+	} else {
+		go s.Serve(lis)
+	}
+	addr := "localhost:" + port
+	var conn *grpc.ClientConn
+	if useTLS {
+		creds, err := credentials.NewClientTLSFromFile(tlsDir+"ca.pem", "x.test.youtube.com")
+		if err != nil {
+			log.Fatalf("Failed to create credentials %v", err)
+		}
+		conn, err = grpc.Dial(addr, append(dopts, grpc.WithTransportCredentials(creds))...)
+	} else {
+		conn, err = grpc.Dial(addr, append(dopts, grpc.WithInsecure())...)
+	}
+	if err != nil {
+		log.Fatalf("Dial(%q) = %v", addr, err)
+	}
+	tc = testpb.NewTestServiceClient(conn)
+	return
+}
+
+func TestEmptyUnary(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	reply, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+	if err != nil || !proto.Equal(&testpb.Empty{}, reply) {
+		t.Fatalf("TestService/EmptyCall(_, _) = %v, %v, want %v, <nil>", reply, err, &testpb.Empty{})
+	}
+}
+
+func TestFailedEmptyUnary(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err != grpc.Errorf(codes.DataLoss, "got extra metadata") {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.DataLoss, "got extra metadata"))
+	}
+}
+
+func TestStatusDetails(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	want := []proto.Message{&duration.Duration{Seconds: 5}}
+	details := marshalDetails(t, codes.DataLoss, "got extra metadata", want...)
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("status-details-bin", string(details)))
+	_, err := tc.EmptyCall(ctx, &testpb.Empty{})
+	if grpc.Code(err) != codes.DataLoss {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DataLoss)
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		t.Fatalf("status.FromError(%v) = _, false, want _, true", err)
+	}
+	if st.Code() != codes.DataLoss || st.Message() != "got extra metadata" || !equalDetails(st.Details(), want) {
+		t.Fatalf("status = (%d, %q, %v), want (%d, %q, %v)", st.Code(), st.Message(), st.Details(), codes.DataLoss, "got extra metadata", want)
+	}
+}
+
+// marshalDetails returns the serialized google.rpc.Status of c, msg and
+// details, as sent in the grpc-status-details-bin trailer.
+func marshalDetails(t *testing.T, c codes.Code, msg string, details ...proto.Message) []byte {
+	st, err := status.New(c, msg).WithDetails(details...)
+	if err != nil {
+		t.Fatalf("status.New(_, _).WithDetails(_) = _, %v, want _, <nil>", err)
+	}
+	b, err := proto.Marshal(st.Proto())
+	if err != nil {
+		t.Fatalf("proto.Marshal(_) = _, %v, want _, <nil>", err)
+	}
+	return b
+}
+
+// equalDetails reports whether the status details got decode to want.
+func equalDetails(got []interface{}, want []proto.Message) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i, d := range got {
+		if m, ok := d.(proto.Message); !ok || !proto.Equal(m, want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	var gotMethod string
+	var gotErr error
+	interceptor := func(ctx context.Context, method string, args, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		gotMethod = method
+		ctx = metadata.NewOutgoingContext(ctx, testMetadata)
+		gotErr = invoker(ctx, method, args, reply, cc, opts...)
+		return gotErr
+	}
+	s, tc := setUp(true, math.MaxUint32, grpc.WithUnaryInterceptor(interceptor))
+	defer s.Stop()
+	// EmptyCall fails if the interceptor attached the metadata to the context.
+	wantErr := grpc.Errorf(codes.DataLoss, "got extra metadata")
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != wantErr {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, wantErr)
+	}
+	if want := "/grpc.testing.TestService/EmptyCall"; gotMethod != want {
+		t.Fatalf("The interceptor got method %q, want %q", gotMethod, want)
+	}
+	if gotErr != wantErr {
+		t.Fatalf("The interceptor got error %v from the invoker, want %v", gotErr, wantErr)
+	}
+}
+
+type ctxKey string
+
+func TestChainUnaryClientInterceptor(t *testing.T) {
+	var order []string
+	// interceptor records its name and adds it to the values of the context
+	// seen by the rest of the chain.
+	interceptor := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, args, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, name)
+			if name != "first" {
+				if got, _ := ctx.Value(ctxKey("first")).(bool); !got {
+					t.Errorf("the interceptor %q did not get the context of the first one", name)
+				}
+			}
+			return invoker(context.WithValue(ctx, ctxKey(name), true), method, args, reply, cc, opts...)
+		}
+	}
+	// The last interceptor checks the context it gets and calls the RPC.
+	last := func(ctx context.Context, method string, args, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		order = append(order, "last")
+		for _, name := range []string{"first", "second", "third"} {
+			if got, _ := ctx.Value(ctxKey(name)).(bool); !got {
+				t.Errorf("the last interceptor did not get the context value of %q", name)
+			}
+		}
+		return invoker(ctx, method, args, reply, cc, opts...)
+	}
+	s, tc := setUp(false, math.MaxUint32,
+		grpc.WithUnaryInterceptor(interceptor("first")),
+		grpc.WithChainUnaryInterceptor(interceptor("second"), interceptor("third")),
+		grpc.WithChainUnaryInterceptor(last))
+	defer s.Stop()
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if want := []string{"first", "second", "third", "last"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("the interceptors ran in the order %v, want %v", order, want)
+	}
+	// An error of the RPC goes back through the chain.
+	errDenied := grpc.Errorf(codes.PermissionDenied, "denied")
+	deny := func(ctx context.Context, method string, args, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return errDenied
+	}
+	var gotErr error
+	check := func(ctx context.Context, method string, args, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		gotErr = invoker(ctx, method, args, reply, cc, opts...)
+		return gotErr
+	}
+	conn, err := grpc.Dial("localhost:0", grpc.WithInsecure(), grpc.WithChainUnaryInterceptor(check, deny))
+	if err != nil {
+		t.Fatalf("grpc.Dial(_) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	if err := grpc.Invoke(context.Background(), "/foo/Bar", &testpb.Empty{}, &testpb.Empty{}, conn); err != errDenied {
+		t.Fatalf("grpc.Invoke(_, \"/foo/Bar\", _, _, _) = %v, want %v", err, errDenied)
+	}
+	if gotErr != errDenied {
+		t.Fatalf("the outer interceptor got %v from the chain, want %v", gotErr, errDenied)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	var methods []string
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		methods = append(methods, info.FullMethod)
+		if got, want := info.Service()+"/"+info.Method(), strings.TrimPrefix(info.FullMethod, "/"); got != want {
+			t.Errorf("UnaryServerInfo.Service()/Method() = %q, want %q", got, want)
+		}
+		if _, ok := info.Server.(*testServer); !ok {
+			t.Errorf("UnaryServerInfo.Server = %T, want *testServer", info.Server)
+		}
+		if _, ok := req.(*testpb.SimpleRequest); ok {
+			return nil, grpc.Errorf(codes.PermissionDenied, "denied by interceptor")
+		}
+		return handler(ctx, req)
+	}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)})
+	defer s.Stop()
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	want := grpc.Errorf(codes.PermissionDenied, "denied by interceptor")
+	if _, err := tc.UnaryCall(context.Background(), &testpb.SimpleRequest{}); err != want {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, %v", err, want)
+	}
+	wantMethods := []string{"/grpc.testing.TestService/EmptyCall", "/grpc.testing.TestService/UnaryCall"}
+	if !reflect.DeepEqual(methods, wantMethods) {
+		t.Fatalf("intercepted methods = %v, want %v", methods, wantMethods)
+	}
+}
+
+// handlerCtx is what a handler finds in its context.
+type handlerCtx struct {
+	md       metadata.MD
+	peer     net.Addr
+	deadline time.Time
+}
+
+func newHandlerCtx(ctx context.Context) handlerCtx {
+	var hc handlerCtx
+	hc.md, _ = metadata.FromIncomingContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok {
+		hc.peer = p.Addr
+	}
+	hc.deadline, _ = ctx.Deadline()
+	return hc
+}
+
+func TestServerStreamContext(t *testing.T) {
+	ctxs := make(chan handlerCtx, 2)
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctxs <- newHandlerCtx(ctx)
+		return &testpb.Empty{}, nil
+	}
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		ctxs <- newHandlerCtx(stream.Context())
+		return stream.RecvMsg(new(testpb.Empty))
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(interceptor), grpc.UnknownServiceHandler(streamHandler))
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(metadata.NewOutgoingContext(context.Background(), testMetadata), deadline)
+	defer cancel()
+	if _, err := testpb.NewTestServiceClient(conn).EmptyCall(ctx, &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := grpc.NewClientStream(ctx, desc, conn, "/foo/Bar")
+	if err != nil {
+		t.Fatalf("grpc.NewClientStream(_, _, _, \"/foo/Bar\") = _, %v, want _, <nil>", err)
+	}
+	if err := stream.SendMsg(&testpb.Empty{}); err != nil {
+		t.Fatalf("%v.SendMsg(_) = %v, want <nil>", stream, err)
+	}
+	if err := stream.RecvMsg(new(testpb.Empty)); err != io.EOF {
+		t.Fatalf("%v.RecvMsg(_) = %v, want %v", stream, err, io.EOF)
+	}
+	unary, streaming := <-ctxs, <-ctxs
+	for _, hc := range []handlerCtx{unary, streaming} {
+		if !reflect.DeepEqual(hc.md, testMetadata) {
+			t.Fatalf("the handler got the metadata %v, want %v", hc.md, testMetadata)
+		}
+		if hc.peer == nil {
+			t.Fatalf("the handler got no peer")
+		}
+		// The deadline is sent with a resolution which may round it up.
+		if d := hc.deadline.Sub(deadline); d < -time.Second || d > time.Second {
+			t.Fatalf("the handler got the deadline %v, want about %v", hc.deadline, deadline)
+		}
+	}
+	if unary.peer.String() != streaming.peer.String() {
+		t.Fatalf("the streaming handler got the peer %v, want %v like the unary one", streaming.peer, unary.peer)
+	}
+}
+
+func TestPeerAuthInfo(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(tlsDir+"server1.pem", tlsDir+"server1.key")
+	if err != nil {
+		t.Fatalf("Failed to load the key pair: %v", err)
+	}
+	b, err := ioutil.ReadFile(tlsDir + "ca.pem")
+	if err != nil {
+		t.Fatalf("Failed to read the CA: %v", err)
+	}
+	cp := x509.NewCertPool()
+	if !cp.AppendCertsFromPEM(b) {
+		t.Fatalf("Failed to append the CA")
+	}
+	// The server requires the client to present a certificate verified by
+	// the same CA, which is also the certificate of the server.
+	screds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    cp,
+	})
+	ccreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cp,
+		ServerName:   "x.test.youtube.com",
+	})
+	var serverPeer *peer.Peer
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		serverPeer, _ = peer.FromContext(ctx)
+		return handler(ctx, req)
+	}
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	defer s.Stop()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(screds.NewListener(lis))
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(ccreds))
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	var clientPeer peer.Peer
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&clientPeer)); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	for _, p := range []*peer.Peer{serverPeer, &clientPeer} {
+		if p == nil {
+			t.Fatalf("the server found no peer in the context of the handler")
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok {
+			t.Fatalf("Peer.AuthInfo = %#v, want a credentials.TLSInfo", p.AuthInfo)
+		}
+		// Both ends present server1.pem.
+		if chains := info.State.VerifiedChains; len(chains) == 0 || chains[0][0].Subject.CommonName != "*.test.google.com" {
+			t.Fatalf("Peer.AuthInfo has the verified chains %v, want a chain of %q", chains, "*.test.google.com")
+		}
+	}
+}
+
+func TestLargeUnary(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	argSize := 271828
+	respSize := 314159
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	reply, err := tc.UnaryCall(context.Background(), req)
+	if err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	pt := reply.GetPayload().GetType()
+	ps := len(reply.GetPayload().GetBody())
+	if pt != testpb.PayloadType_COMPRESSABLE || ps != respSize {
+		t.Fatalf("Got the reply with type %d len %d; want %d, %d", pt, ps, testpb.PayloadType_COMPRESSABLE, respSize)
+	}
+}
+
+type testStatsHandler struct {
+	mu     sync.Mutex
+	events []stats.RPCStats
+	// done is closed once the End event is received.
+	done chan struct{}
+}
+
+func (h *testStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *testStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, s)
+	if _, ok := s.(*stats.End); ok {
+		close(h.done)
+	}
+}
+
+// kinds returns the types of the received events in order.
+func (h *testStatsHandler) kinds() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var k []string
+	for _, e := range h.events {
+		k = append(k, reflect.TypeOf(e).Elem().Name())
+	}
+	return k
+}
+
+func TestStatsHandler(t *testing.T) {
+	ch := &testStatsHandler{done: make(chan struct{})}
+	sh := &testStatsHandler{done: make(chan struct{})}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.StatsHandler(sh)}, grpc.WithStatsHandler(ch))
+	defer s.Stop()
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(100),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 200),
+	}
+	reply, err := tc.UnaryCall(context.Background(), req)
+	if err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	for _, test := range []struct {
+		h    *testStatsHandler
+		want []string
+		out  proto.Message
+	}{
+		{ch, []string{"Begin", "OutHeader", "OutPayload", "InHeader", "InPayload", "End"}, req},
+		{sh, []string{"Begin", "InPayload", "OutPayload", "End"}, reply},
+	} {
+		select {
+		case <-test.h.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the End event")
+		}
+		if got := test.h.kinds(); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("got events %v, want %v", got, test.want)
+		}
+		var sentTime time.Time
+		for _, e := range test.h.events {
+			switch e := e.(type) {
+			case *stats.OutHeader:
+				sentTime = e.SentTime
+			case *stats.InHeader:
+				if e.WireLength <= 0 || e.RecvTime.Before(sentTime) {
+					t.Fatalf("InHeader has WireLength %d, RecvTime %v, want a positive length after %v", e.WireLength, e.RecvTime, sentTime)
+				}
+			case *stats.OutPayload:
+				if e.Length != proto.Size(test.out) || e.WireLength != e.Length+5 {
+					t.Fatalf("OutPayload has Length %d, WireLength %d, want %d, %d", e.Length, e.WireLength, proto.Size(test.out), proto.Size(test.out)+5)
+				}
+			case *stats.End:
+				if e.Error != nil {
+					t.Fatalf("End.Error = %v, want <nil>", e.Error)
+				}
+			}
+		}
+	}
+}
+
+// wireLength returns the length of the message d on the wire, compressed
+// with gzip if compressed is true.
+func wireLength(t *testing.T, d []byte, compressed bool) int {
+	if !compressed {
+		return len(d) + 5
+	}
+	var buf bytes.Buffer
+	if err := grpc.NewGZIPCompressor().Do(&buf, d); err != nil {
+		t.Fatalf("failed to compress the message: %v", err)
+	}
+	return buf.Len() + 5
+}
+
+func TestServerStatsPayloads(t *testing.T) {
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(3141),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 2718),
+	}
+	sreq := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(3141)}},
+		Payload:            newPayload(testpb.PayloadType_COMPRESSABLE, 2718),
+	}
+	for _, compressed := range []bool{false, true} {
+		sh := &testStatsHandler{done: make(chan struct{})}
+		sopts := []grpc.ServerOption{grpc.StatsHandler(sh)}
+		var dopts []grpc.DialOption
+		if compressed {
+			sopts = append(sopts, grpc.ResponseCompressors("gzip"))
+			dopts = append(dopts, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+		}
+		s, tc := setUpWithOptions(false, sopts, dopts...)
+		// checkPayloads checks the sizes of the messages of the last RPC
+		// and resets sh for the next one.
+		checkPayloads := func(rpc string, want []string) {
+			select {
+			case <-sh.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for the End event", rpc)
+			}
+			if got := sh.kinds(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got events %v, want %v", rpc, got, want)
+			}
+			for _, e := range sh.events {
+				var payload interface{}
+				var data []byte
+				var length, wireLen int
+				switch e := e.(type) {
+				case *stats.InPayload:
+					payload, data, length, wireLen = e.Payload, e.Data, e.Length, e.WireLength
+				case *stats.OutPayload:
+					payload, data, length, wireLen = e.Payload, e.Data, e.Length, e.WireLength
+				default:
+					continue
+				}
+				if n := proto.Size(payload.(proto.Message)); length != n || len(data) != n {
+					t.Fatalf("%s with compression %t: %T has Length %d and %d bytes of Data, want %d", rpc, compressed, e, length, len(data), n)
+				}
+				if n := wireLength(t, data, compressed); wireLen != n {
+					t.Fatalf("%s with compression %t: %T has WireLength %d, want %d", rpc, compressed, e, wireLen, n)
+				}
+			}
+			sh.events = nil
+			sh.done = make(chan struct{})
+		}
+		if _, err := tc.UnaryCall(context.Background(), req); err != nil {
+			t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		checkPayloads("UnaryCall", []string{"Begin", "InPayload", "OutPayload", "End"})
+		stream, err := tc.FullDuplexCall(context.Background())
+		if err != nil {
+			t.Fatalf("TestService/FullDuplexCall(_) = _, %v, want _, <nil>", err)
+		}
+		if err := stream.Send(sreq); err != nil {
+			t.Fatalf("%v.Send(_) = %v, want <nil>", stream, err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+		}
+		checkPayloads("FullDuplexCall", []string{"Begin", "InPayload", "OutPayload", "End"})
+		s.Stop()
+	}
+}
+
+func TestEmptyMessages(t *testing.T) {
+	sh := &testStatsHandler{done: make(chan struct{})}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.StatsHandler(sh), grpc.ResponseCompressors("gzip")}, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+	defer s.Stop()
+	// checkPayloads checks that the messages of the last RPC were sent as
+	// a bare header and resets sh for the next one.
+	checkPayloads := func(rpc string, want []string) {
+		select {
+		case <-sh.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for the End event", rpc)
+		}
+		if got := sh.kinds(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got events %v, want %v", rpc, got, want)
+		}
+		for _, e := range sh.events {
+			switch e := e.(type) {
+			case *stats.InPayload:
+				if e.Length != 0 || e.WireLength != 5 {
+					t.Fatalf("%s: InPayload has Length %d, WireLength %d, want 0, 5", rpc, e.Length, e.WireLength)
+				}
+			case *stats.OutPayload:
+				if e.Length != 0 || e.WireLength != 5 {
+					t.Fatalf("%s: OutPayload has Length %d, WireLength %d, want 0, 5", rpc, e.Length, e.WireLength)
+				}
+			}
+		}
+		sh.events = nil
+		sh.done = make(chan struct{})
+	}
+	reply, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+	if err != nil || !proto.Equal(reply, &testpb.Empty{}) {
+		t.Fatalf("TestService/EmptyCall(_, _) = %v, %v, want %v, <nil>", reply, err, &testpb.Empty{})
+	}
+	checkPayloads("EmptyCall", []string{"Begin", "InPayload", "OutPayload", "End"})
+	// The server sends no response to the empty requests.
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("TestService/FullDuplexCall(_) = _, %v, want _, <nil>", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(&testpb.StreamingOutputCallRequest{}); err != nil {
+			t.Fatalf("%v.Send(_) = %v, want <nil>", stream, err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	checkPayloads("FullDuplexCall", []string{"Begin", "InPayload", "InPayload", "End"})
+}
+
+// startUnknownServiceServer starts a server which serves all the RPCs with h.
+func startUnknownServiceServer(t *testing.T, h grpc.StreamHandler) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.UnknownServiceHandler(h))
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+func TestUnaryMoreThanOneResponse(t *testing.T) {
+	s, addr := startUnknownServiceServer(t, func(srv interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(new(testpb.Empty)); err != nil {
+			return err
+		}
+		stream.SetTrailer(testMetadata)
+		for i := 0; i < 2; i++ {
+			if err := stream.SendMsg(&testpb.Empty{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q, _) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	var trailer metadata.MD
+	err = grpc.Invoke(context.Background(), "/foo/Bar", &testpb.Empty{}, &testpb.Empty{}, conn, grpc.Trailer(&trailer))
+	if grpc.Code(err) != codes.Internal {
+		t.Fatalf("grpc.Invoke(_, \"/foo/Bar\", _, _, _) = %v, want error code %d", err, codes.Internal)
+	}
+	if !reflect.DeepEqual(trailer, testMetadata) {
+		t.Fatalf("Received trailer %v, want %v", trailer, testMetadata)
+	}
+}
+
+func TestUnaryNoResponse(t *testing.T) {
+	s, addr := startUnknownServiceServer(t, func(srv interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(new(testpb.Empty)); err != nil {
+			return err
+		}
+		stream.SetTrailer(testMetadata)
+		return nil
+	})
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q, _) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	var trailer metadata.MD
+	err = grpc.Invoke(context.Background(), "/foo/Bar", &testpb.Empty{}, &testpb.Empty{}, conn, grpc.Trailer(&trailer))
+	if grpc.Code(err) != codes.Internal {
+		t.Fatalf("grpc.Invoke(_, \"/foo/Bar\", _, _, _) = %v, want error code %d", err, codes.Internal)
+	}
+	if !reflect.DeepEqual(trailer, testMetadata) {
+		t.Fatalf("Received trailer %v, want %v", trailer, testMetadata)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	s, tc := setUpWithOptions(true, []grpc.ServerOption{grpc.Tracing()}, grpc.WithTracing())
+	defer s.Stop()
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err != grpc.Errorf(codes.DataLoss, "got extra metadata") {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, grpc.Errorf(codes.DataLoss, "got extra metadata"))
+	}
+}
+
+func TestDefaultCallTimeout(t *testing.T) {
+	// The interceptor reports the time left before the deadline of each
+	// RPC, or 0 if it has none.
+	left := make(chan time.Duration, 1)
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var d time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			d = deadline.Sub(time.Now())
+		}
+		left <- d
+		return handler(ctx, req)
+	}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)}, grpc.WithDefaultCallTimeout(time.Minute))
+	defer s.Stop()
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if d := <-left; d <= 0 || d > time.Minute {
+		t.Fatalf("the RPC without deadline had %v left, want at most %v", d, time.Minute)
+	}
+	// The deadline of the context takes precedence, even if it is later.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if d := <-left; d <= time.Minute {
+		t.Fatalf("the RPC with a deadline in %v had %v left, want more than %v", time.Hour, d, time.Minute)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	uas := make(chan string, 1)
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ua, ok := grpc.UserAgent(ctx)
+		if !ok {
+			return nil, grpc.Errorf(codes.Internal, "grpc.UserAgent(_) = _, false, want _, true")
+		}
+		uas <- ua
+		return handler(ctx, req)
+	}
+	for _, test := range []struct {
+		dopts []grpc.DialOption
+		want  string
+	}{
+		{nil, "grpc-go/0.7"},
+		{[]grpc.DialOption{grpc.WithUserAgent("myapp/1.0")}, "myapp/1.0 grpc-go/0.7"},
+	} {
+		s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)}, test.dopts...)
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		if got := <-uas; got != test.want {
+			t.Fatalf("the server received the user-agent %q, want %q", got, test.want)
+		}
+		s.Stop()
+	}
+	if _, err := grpc.Dial("localhost:0", grpc.WithInsecure(), grpc.WithUserAgent("myapp\r\n")); err == nil {
+		t.Fatalf("grpc.Dial(_, WithUserAgent(%q)) = _, <nil>, want an error", "myapp\r\n")
+	}
+}
+
+func TestActiveRPCs(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	if rpcs := s.ActiveRPCs(); len(rpcs) != 0 {
+		t.Fatalf("s.ActiveRPCs() = %v, want []", rpcs)
+	}
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(10)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	reply, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	rpcs := s.ActiveRPCs()
+	if len(rpcs) != 1 {
+		t.Fatalf("s.ActiveRPCs() = %v, want 1 RPC", rpcs)
+	}
+	r := rpcs[0]
+	if r.Method != "/grpc.testing.TestService/FullDuplexCall" {
+		t.Fatalf("the active RPC has the method %q, want %q", r.Method, "/grpc.testing.TestService/FullDuplexCall")
+	}
+	if r.Peer == nil {
+		t.Fatalf("the active RPC has no peer")
+	}
+	if age := time.Since(r.StartTime); age < 0 || age > time.Minute {
+		t.Fatalf("the active RPC is %v old, want a fresh RPC", age)
+	}
+	// Each message is preceded by a 5-byte gRPC message header.
+	if want := int64(proto.Size(req) + 5); r.BytesReceived != want {
+		t.Fatalf("the active RPC received %d bytes, want %d", r.BytesReceived, want)
+	}
+	if want := int64(proto.Size(reply) + 5); r.BytesSent != want {
+		t.Fatalf("the active RPC sent %d bytes, want %d", r.BytesSent, want)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	// The RPC is removed once its handler has returned.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.ActiveRPCs()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("s.ActiveRPCs() = %v after the RPC finished, want []", s.ActiveRPCs())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var errNoSuchUser = errors.New("no such user")
+
+func TestErrorMapper(t *testing.T) {
+	wantDetails := []proto.Message{&duration.Duration{Seconds: 5}}
+	details := marshalDetails(t, codes.NotFound, "user not found", wantDetails...)
+	mapper := func(err error) (codes.Code, string, []byte) {
+		if err == errNoSuchUser {
+			return codes.NotFound, "user not found", details
+		}
+		return codes.OK, "", nil
+	}
+	var appErr error
+	// The unary RPCs of the test service fail with appErr.
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, appErr
+	}
+	// The streaming RPCs of the unknown services fail with appErr.
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		return appErr
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.ErrorMapper(mapper), grpc.UnaryInterceptor(interceptor), grpc.UnknownServiceHandler(streamHandler))
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	for _, test := range []struct {
+		appErr      error
+		wantCode    codes.Code
+		wantDesc    string
+		wantDetails []proto.Message
+	}{
+		{errNoSuchUser, codes.NotFound, "user not found", wantDetails},
+		// The errors not known to the mapper are converted as usual.
+		{errors.New("boom"), codes.Unknown, "boom", nil},
+		// The statuses built by the handlers are kept.
+		{grpc.Errorf(codes.PermissionDenied, "denied"), codes.PermissionDenied, "denied", nil},
+	} {
+		appErr = test.appErr
+		desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+		stream, err := grpc.NewClientStream(context.Background(), desc, conn, "/foo/Bar")
+		if err != nil {
+			t.Fatalf("grpc.NewClientStream(_, _, _, \"/foo/Bar\") = _, %v, want _, <nil>", err)
+		}
+		for _, err := range []error{
+			func() error { _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); return err }(),
+			stream.RecvMsg(new(testpb.Empty)),
+		} {
+			st, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("status.FromError(%v) = _, false, want _, true", err)
+			}
+			if st.Code() != test.wantCode || st.Message() != test.wantDesc || !equalDetails(st.Details(), test.wantDetails) {
+				t.Fatalf("the handler error %v led to the status %v, %q, %v, want %v, %q, %v", test.appErr, st.Code(), st.Message(), st.Details(), test.wantCode, test.wantDesc, test.wantDetails)
+			}
+		}
+	}
+}
+
+func TestStatusWithDetails(t *testing.T) {
+	st, err := status.New(codes.NotFound, "user not found").WithDetails(&duration.Duration{Seconds: 5})
+	if err != nil {
+		t.Fatalf("status.New(_, _).WithDetails(_) = _, %v, want _, <nil>", err)
+	}
+	// The unary RPCs of the test service and the streaming RPCs of the
+	// unknown services fail with st.
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, st.Err()
+	}
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		return st.Err()
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(interceptor), grpc.UnknownServiceHandler(streamHandler))
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := grpc.NewClientStream(context.Background(), desc, conn, "/foo/Bar")
+	if err != nil {
+		t.Fatalf("grpc.NewClientStream(_, _, _, \"/foo/Bar\") = _, %v, want _, <nil>", err)
+	}
+	for _, err := range []error{
+		func() error { _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); return err }(),
+		stream.RecvMsg(new(testpb.Empty)),
+	} {
+		got, ok := status.FromError(err)
+		if !ok {
+			t.Fatalf("status.FromError(%v) = _, false, want _, true", err)
+		}
+		if got.Code() != codes.NotFound || got.Message() != "user not found" {
+			t.Fatalf("the RPC failed with the status %v, %q, want %v, %q", got.Code(), got.Message(), codes.NotFound, "user not found")
+		}
+		details := got.Details()
+		if len(details) != 1 {
+			t.Fatalf("the status has the details %v, want 1 detail", details)
+		}
+		if d, ok := details[0].(proto.Message); !ok || !proto.Equal(d, &duration.Duration{Seconds: 5}) {
+			t.Fatalf("the status has the detail %v, want %v", details[0], &duration.Duration{Seconds: 5})
+		}
+	}
+}
+
+func TestServerDeadlineExceeded(t *testing.T) {
+	var ctxErr error
+	// The interceptor overruns the deadline before running the handler,
+	// which succeeds regardless.
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		<-ctx.Done()
+		ctxErr = ctx.Err()
+		return handler(ctx, req)
+	}
+	sh := &testStatsHandler{done: make(chan struct{})}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor), grpc.StatsHandler(sh)})
+	defer s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); err == nil || grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+	select {
+	case <-sh.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the End event")
+	}
+	// The server's deadline may be beaten by the client's cancellation.
+	want := codes.DeadlineExceeded
+	if ctxErr == context.Canceled {
+		want = codes.Canceled
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	end := sh.events[len(sh.events)-1].(*stats.End)
+	if end.Error == nil || grpc.Code(end.Error) != want {
+		t.Fatalf("the server ended the RPC with %v, want error code: %d", end.Error, want)
+	}
+}
+
+// countingCodec is the protobuf codec under another name which counts the
+// messages it marshals.
+type countingCodec struct {
+	name      string
+	mu        sync.Mutex
+	marshaled int
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.mu.Lock()
+	c.marshaled++
+	c.mu.Unlock()
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (c *countingCodec) String() string {
+	return c.name
+}
+
+func (c *countingCodec) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.marshaled
+}
+
+func TestCustomCodec(t *testing.T) {
+	cc := &countingCodec{name: "counting"}
+	sc := &countingCodec{name: "counting"}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.CustomCodec(sc)}, grpc.WithCodec(cc))
+	defer s.Stop()
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if cc.count() != 1 || sc.count() != 1 {
+		t.Fatalf("the client and server codecs marshaled %d, %d messages, want 1, 1", cc.count(), sc.count())
+	}
+}
+
+var registeredCodec = &countingCodec{name: "counting-registered"}
+
+func init() {
+	grpc.RegisterCodec(registeredCodec)
+}
+
+func TestCallContentSubtype(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	base := registeredCodec.count()
+	// The server picks the registered codec by the content-subtype.
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.CallContentSubtype(registeredCodec.name)); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if got := registeredCodec.count() - base; got != 2 {
+		t.Fatalf("the registered codec marshaled %d messages, want 2", got)
+	}
+	stream, err := tc.FullDuplexCall(context.Background(), grpc.CallContentSubtype(registeredCodec.name))
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	if got := registeredCodec.count() - base; got != 4 {
+		t.Fatalf("the registered codec marshaled %d messages, want 4", got)
+	}
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.CallContentSubtype("unregistered")); err == nil || grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.Unimplemented)
+	}
+}
+
+func TestLargeWindows(t *testing.T) {
+	const window = 1 << 20
+	sopts := []grpc.ServerOption{grpc.InitialWindowSize(window), grpc.InitialConnWindowSize(window)}
+	s, tc := setUpWithOptions(false, sopts, grpc.WithInitialWindowSize(window), grpc.WithInitialConnWindowSize(window))
+	defer s.Stop()
+	argSize := 271828
+	respSize := 314159
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	reply, err := tc.UnaryCall(context.Background(), req)
+	if err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if ps := len(reply.GetPayload().GetBody()); ps != respSize {
+		t.Fatalf("Got the reply with len %d; want %d", ps, respSize)
+	}
+}
+
+func TestWithAuthority(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	screds, err := credentials.NewServerTLSFromFile(tlsDir+"server1.pem", tlsDir+"server1.key")
+	if err != nil {
+		t.Fatalf("Failed to generate credentials %v", err)
+	}
+	s := grpc.NewServer()
+	defer s.Stop()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(screds.NewListener(lis))
+	// The client dials the IP address and authenticates the server against
+	// the authority.
+	creds, err := credentials.NewClientTLSFromFile(tlsDir+"ca.pem", "")
+	if err != nil {
+		t.Fatalf("Failed to create credentials %v", err)
+	}
+	addr := lis.Addr().String()
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds), grpc.WithAuthority("x.test.youtube.com"))
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+}
+
+// setUpHealth starts a server serving the Health service with hs and dials
+// it.
+func setUpHealth(hs *health.HealthServer) (*grpc.Server, *grpc.ClientConn) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	if hs != nil {
+		healthpb.RegisterHealthServer(s, hs)
+	}
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Dial(%q) = %v", lis.Addr().String(), err)
+	}
+	return s, conn
+}
+
+func TestHealthCheck(t *testing.T) {
+	hs := health.NewHealthServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("grpc.testing.TestService", healthpb.HealthCheckResponse_NOT_SERVING)
+	s, cc := setUpHealth(hs)
+	defer s.Stop()
+	defer cc.Close()
+	for _, test := range []struct {
+		service    string
+		wantStatus healthpb.HealthCheckResponse_ServingStatus
+		wantCode   codes.Code
+	}{
+		{"", healthpb.HealthCheckResponse_SERVING, codes.OK},
+		{"grpc.testing.TestService", healthpb.HealthCheckResponse_NOT_SERVING, codes.OK},
+		{"grpc.testing.Unknown", healthpb.HealthCheckResponse_UNKNOWN, codes.NotFound},
+	} {
+		status, err := health.Check(context.Background(), cc, test.service)
+		if status != test.wantStatus || (err != nil) != (test.wantCode != codes.OK) || (err != nil && grpc.Code(err) != test.wantCode) {
+			t.Fatalf("health.Check(_, _, %q) = %v, %v, want %v, error code %d", test.service, status, err, test.wantStatus, test.wantCode)
+		}
+	}
+}
+
+func TestHealthCheckUnimplemented(t *testing.T) {
+	s, cc := setUpHealth(nil)
+	defer s.Stop()
+	defer cc.Close()
+	if _, err := health.Check(context.Background(), cc, ""); grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("health.Check(_, _, \"\") = _, %v, want _, error code %d", err, codes.Unimplemented)
+	}
+}
+
+func TestHealthWatch(t *testing.T) {
+	hs := health.NewHealthServer()
+	s, cc := setUpHealth(hs)
+	defer s.Stop()
+	defer cc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := healthpb.NewHealthClient(cc).Watch(ctx, &healthpb.HealthCheckRequest{Service: "grpc.testing.TestService"})
+	if err != nil {
+		t.Fatalf("Watch(_, _) = _, %v, want _, <nil>", err)
+	}
+	recv := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		resp, err := stream.Recv()
+		if err != nil || resp.Status != want {
+			t.Fatalf("stream.Recv() = %v, %v, want status %v", resp, err, want)
+		}
+	}
+	recv(healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+	hs.SetServingStatus("grpc.testing.TestService", healthpb.HealthCheckResponse_SERVING)
+	recv(healthpb.HealthCheckResponse_SERVING)
+	// Setting the same status or the status of another service is not a
+	// transition of the watched service.
+	hs.SetServingStatus("grpc.testing.TestService", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("grpc.testing.TestService", healthpb.HealthCheckResponse_NOT_SERVING)
+	recv(healthpb.HealthCheckResponse_NOT_SERVING)
+	cancel()
+	if _, err := stream.Recv(); grpc.Code(err) != codes.Canceled {
+		t.Fatalf("stream.Recv() = _, %v, want _, error code %d", err, codes.Canceled)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := grpc.NewServer()
+	defer s.Stop()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	ts := httptest.NewUnstartedServer(s)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	client := ts.Client()
+	resp, err := proto.Marshal(&testpb.SimpleResponse{
+		Payload: newPayload(testpb.PayloadType_COMPRESSABLE, 0),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal the response: %v", err)
+	}
+	// An empty request in a gRPC frame: uncompressed, length 0.
+	emptyMsg := []byte{0, 0, 0, 0, 0}
+	for _, test := range []struct {
+		method      string
+		contentType string
+		wantHTTP    int
+		wantStatus  string
+		wantBody    []byte
+	}{
+		{"/grpc.testing.TestService/UnaryCall", "application/grpc", http.StatusOK, "0", append([]byte{0, 0, 0, 0, byte(len(resp))}, resp...)},
+		{"/grpc.testing.TestService/EmptyCall", "application/grpc+proto", http.StatusOK, "15", []byte{}},
+		{"/grpc.testing.TestService/Unknown", "application/grpc", http.StatusOK, "12", []byte{}},
+		{"/grpc.testing.TestService/UnaryCall", "text/plain", http.StatusUnsupportedMediaType, "", nil},
+	} {
+		req, err := http.NewRequest("POST", ts.URL+test.method, bytes.NewReader(emptyMsg))
+		if err != nil {
+			t.Fatalf("http.NewRequest(_, %q, _) = _, %v", test.method, err)
+		}
+		req.Header.Set("Content-Type", test.contentType)
+		req.Header.Set("Key1", "value1")
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Post(%q, %q) failed: %v", test.method, test.contentType, err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read the response of %q: %v", test.method, err)
+		}
+		if r.StatusCode != test.wantHTTP {
+			t.Fatalf("Post(%q, %q) got HTTP status %d, want %d", test.method, test.contentType, r.StatusCode, test.wantHTTP)
+		}
+		if test.wantBody == nil {
+			continue
+		}
+		if got := r.Trailer.Get("Grpc-Status"); got != test.wantStatus {
+			t.Fatalf("Post(%q, %q) got grpc-status %q, want %q", test.method, test.contentType, got, test.wantStatus)
+		}
+		if !bytes.Equal(body, test.wantBody) {
+			t.Fatalf("Post(%q, %q) got body %v, want %v", test.method, test.contentType, body, test.wantBody)
+		}
+		if test.wantStatus != "0" {
+			continue
+		}
+		// UnaryCall echoes the metadata in the header and the trailer.
+		if h, tr := r.Header.Get("Key1"), r.Trailer.Get("Key1"); h != "value1" || tr != "value1" {
+			t.Fatalf("Post(%q, %q) got key1 %q in header and %q in trailer, want %q", test.method, test.contentType, h, tr, "value1")
+		}
+	}
+}
+
+func TestMaxRecvMsgSize(t *testing.T) {
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.MaxRecvMsgSize(1024)}, grpc.WithMaxRecvMsgSize(2048))
+	defer s.Stop()
+	for _, test := range []struct {
+		argSize  int32
+		respSize int32
+		opts     []grpc.CallOption
+		code     codes.Code
+	}{
+		{10, 10, nil, codes.OK},
+		// The server rejects the large request.
+		{2048, 10, nil, codes.ResourceExhausted},
+		// The ClientConn rejects the large response.
+		{10, 4096, nil, codes.ResourceExhausted},
+		// The CallOption overrides the limit of the ClientConn.
+		{10, 4096, []grpc.CallOption{grpc.MaxCallRecvMsgSize(8192)}, codes.OK},
+		{10, 1024, []grpc.CallOption{grpc.MaxCallRecvMsgSize(512)}, codes.ResourceExhausted},
+	} {
+		req := &testpb.SimpleRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseSize: proto.Int32(test.respSize),
+			Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, test.argSize),
+		}
+		_, err := tc.UnaryCall(context.Background(), req, test.opts...)
+		code := codes.OK
+		if err != nil {
+			code = grpc.Code(err)
+		}
+		if code != test.code {
+			t.Fatalf("TestService/UnaryCall(_, {%d bytes, want %d bytes}) = _, %v, want _, error code: %d", test.argSize, test.respSize, err, test.code)
+		}
+	}
+}
+
+func TestDefaultCallOptions(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024)))
+	defer s.Stop()
+	for _, test := range []struct {
+		respSize int32
+		opts     []grpc.CallOption
+		code     codes.Code
+	}{
+		{512, nil, codes.OK},
+		// The default CallOption applies to the RPC.
+		{2048, nil, codes.ResourceExhausted},
+		// The CallOption of the RPC overrides the default one.
+		{2048, []grpc.CallOption{grpc.MaxCallRecvMsgSize(4096)}, codes.OK},
+	} {
+		req := &testpb.SimpleRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseSize: proto.Int32(test.respSize),
+		}
+		if _, err := tc.UnaryCall(context.Background(), req, test.opts...); grpc.Code(err) != test.code {
+			t.Fatalf("TestService/UnaryCall(_, {want %d bytes}) = _, %v, want _, error code: %d", test.respSize, err, test.code)
+		}
+		stream, err := tc.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{
+			ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(test.respSize)}},
+		}, test.opts...)
+		if err != nil {
+			t.Fatalf("%v.StreamingOutputCall(_) = _, %v, want _, <nil>", tc, err)
+		}
+		if _, err := stream.Recv(); grpc.Code(err) != test.code {
+			t.Fatalf("%v.Recv() of %d bytes = _, %v, want _, error code: %d", stream, test.respSize, err, test.code)
+		}
+	}
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	// UnaryCall echoes the metadata in the header and the trailer.
+	bigMD := metadata.Pairs("key1", strings.Repeat("a", 4096))
+	for _, test := range []struct {
+		desc  string
+		sopts []grpc.ServerOption
+		dopts []grpc.DialOption
+	}{
+		// The client rejects the header of the response.
+		{"client limit", nil, []grpc.DialOption{grpc.WithMaxHeaderListSize(1024)}},
+		// The server rejects the header of the request and resets the
+		// stream.
+		{"server limit", []grpc.ServerOption{grpc.MaxHeaderListSize(1024)}, nil},
+	} {
+		s, tc := setUpWithOptions(false, test.sopts, test.dopts...)
+		req := &testpb.SimpleRequest{ResponseType: testpb.PayloadType_COMPRESSABLE.Enum()}
+		// The small headers are accepted.
+		smallMD := metadata.Pairs("key1", "value1")
+		if _, err := tc.UnaryCall(metadata.NewOutgoingContext(context.Background(), smallMD), req); err != nil {
+			t.Fatalf("%s: TestService/UnaryCall(_, _) with a small header = _, %v, want _, <nil>", test.desc, err)
+		}
+		if _, err := tc.UnaryCall(metadata.NewOutgoingContext(context.Background(), bigMD), req); grpc.Code(err) != codes.Internal {
+			t.Fatalf("%s: TestService/UnaryCall(_, _) with a large header = _, %v, want _, error code: %d", test.desc, err, codes.Internal)
+		}
+		// The connection is still usable.
+		if _, err := tc.UnaryCall(context.Background(), req); err != nil {
+			t.Fatalf("%s: TestService/UnaryCall(_, _) after the large header = _, %v, want _, <nil>", test.desc, err)
+		}
+		s.Stop()
+	}
+}
+
+func TestMaxSendMsgSize(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32, grpc.WithMaxSendMsgSize(1024))
+	defer s.Stop()
+	for _, test := range []struct {
+		argSize int32
+		opts    []grpc.CallOption
+		code    codes.Code
+	}{
+		{10, nil, codes.OK},
+		{2048, nil, codes.ResourceExhausted},
+		// The CallOption overrides the limit of the ClientConn.
+		{2048, []grpc.CallOption{grpc.MaxCallSendMsgSize(4096)}, codes.OK},
+		{512, []grpc.CallOption{grpc.MaxCallSendMsgSize(256)}, codes.ResourceExhausted},
+	} {
+		req := &testpb.SimpleRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseSize: proto.Int32(10),
+			Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, test.argSize),
+		}
+		_, err := tc.UnaryCall(context.Background(), req, test.opts...)
+		code := codes.OK
+		if err != nil {
+			code = grpc.Code(err)
+		}
+		if code != test.code {
+			t.Fatalf("TestService/UnaryCall(_, {%d bytes}) = _, %v, want _, error code: %d", test.argSize, err, test.code)
+		}
+	}
+}
+
+func TestMetadataUnaryRPC(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	argSize := 2718
+	respSize := 314
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	var header, trailer metadata.MD
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+	_, err := tc.UnaryCall(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("TestService.UnaryCall(%v, _, _, _) = _, %v; want _, <nil>", ctx, err)
+	}
+	if !reflect.DeepEqual(testMetadata, header) {
+		t.Fatalf("Received header metadata %v, want %v", header, testMetadata)
+	}
+	if !reflect.DeepEqual(testMetadata, trailer) {
+		t.Fatalf("Received trailer metadata %v, want %v", trailer, testMetadata)
+	}
+}
+
+func TestBinaryMetadata(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	// The values cover all the bytes, including those which are not valid
+	// in the headers without encoding.
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	md := metadata.MD{
+		"key1":     "value1",
+		"key2-bin": string(all),
+		"key3-bin": "",
+		"key4-bin": "\x00\xff\x80\n",
+	}
+	var header, trailer metadata.MD
+	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	if _, err := tc.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatalf("TestService.UnaryCall(%v, _, _, _) = _, %v; want _, <nil>", ctx, err)
+	}
+	if !reflect.DeepEqual(md, header) {
+		t.Fatalf("Received header metadata %v, want %v", header, md)
+	}
+	if !reflect.DeepEqual(md, trailer) {
+		t.Fatalf("Received trailer metadata %v, want %v", trailer, md)
+	}
+}
+
+func TestNonASCIIMetadata(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	for _, v := range []string{"\x00", "value\n", "\x80", "caf\u00e9"} {
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("key", v))
+		if _, err := tc.UnaryCall(ctx, &testpb.SimpleRequest{}); grpc.Code(err) != codes.Internal {
+			t.Fatalf("TestService.UnaryCall(_, _) with metadata value %q = _, %v; want _, error code %d", v, err, codes.Internal)
+		}
+	}
+}
+
+type testPerRPCCredentials struct {
+	md              map[string]string
+	requireSecurity bool
+}
+
+func (c testPerRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return c.md, nil
+}
+
+func (c testPerRPCCredentials) RequireTransportSecurity() bool {
+	return c.requireSecurity
+}
+
+func TestPerRPCCredentials(t *testing.T) {
+	dialCreds := testPerRPCCredentials{md: map[string]string{"authorization": "Bearer dial"}, requireSecurity: true}
+	callCreds := testPerRPCCredentials{md: map[string]string{"authorization": "Bearer call"}, requireSecurity: true}
+	for _, test := range []struct {
+		useTLS bool
+		opts   []grpc.CallOption
+		want   string
+		code   codes.Code
+	}{
+		{true, nil, "Bearer dial", codes.OK},
+		{true, []grpc.CallOption{grpc.PerRPCCredsCallOption(callCreds)}, "Bearer call", codes.OK},
+		{false, nil, "", codes.Unauthenticated},
+	} {
+		s, tc := setUp(test.useTLS, math.MaxUint32, grpc.WithPerRPCCredentials(dialCreds))
+		req := &testpb.SimpleRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseSize: proto.Int32(1),
+		}
+		var header metadata.MD
+		_, err := tc.UnaryCall(context.Background(), req, append(test.opts, grpc.Header(&header))...)
+		s.Stop()
+		if test.code != codes.OK {
+			if err == nil || grpc.Code(err) != test.code {
+				t.Fatalf("TestService/UnaryCall(_, _) with TLS %t = _, %v, want _, error code %d", test.useTLS, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("TestService/UnaryCall(_, _) with TLS %t = _, %v, want _, <nil>", test.useTLS, err)
+		}
+		if got := header["authorization"]; got != test.want {
+			t.Fatalf("Received authorization %q, want %q", got, test.want)
+		}
+	}
+	// The per-call credentials apply to the streams too.
+	s, tc := setUp(true, math.MaxUint32, grpc.WithPerRPCCredentials(dialCreds))
+	defer s.Stop()
+	stream, err := tc.FullDuplexCall(context.Background(), grpc.PerRPCCredsCallOption(callCreds))
+	if err != nil {
+		t.Fatalf("TestService/FullDuplexCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("%v.Header() = _, %v, want _, <nil>", stream, err)
+	}
+	if got := header["authorization"]; got != "Bearer call" {
+		t.Fatalf("Received authorization %q, want %q", got, "Bearer call")
+	}
+}
+
+func TestCompressedUnary(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+	defer s.Stop()
+	argSize := 271828
+	respSize := 314159
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	reply, err := tc.UnaryCall(context.Background(), req)
+	if err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if ps := len(reply.GetPayload().GetBody()); ps != respSize {
+		t.Fatalf("Got the reply with len %d; want %d", ps, respSize)
+	}
+}
+
+func TestResponseCompressors(t *testing.T) {
+	respSize := 314159
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+	}
+	sreq := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(int32(respSize))}},
+	}
+	for _, test := range []struct {
+		names      []string
+		compressed bool
+	}{
+		{[]string{"gzip"}, true},
+		{[]string{"unknown", "gzip"}, true},
+		// The server falls back to identity.
+		{[]string{"unknown"}, false},
+		{nil, false},
+	} {
+		ch := &testStatsHandler{done: make(chan struct{})}
+		s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.ResponseCompressors(test.names...)}, grpc.WithStatsHandler(ch))
+		// checkInPayloads checks whether the responses of the last RPC
+		// were compressed and resets ch for the next one.
+		checkInPayloads := func(rpc string) {
+			<-ch.done
+			for _, e := range ch.events {
+				if e, ok := e.(*stats.InPayload); ok {
+					if compressed := e.WireLength < e.Length; compressed != test.compressed {
+						t.Fatalf("%s with ResponseCompressors(%v): InPayload has Length %d, WireLength %d, want compressed %t", rpc, test.names, e.Length, e.WireLength, test.compressed)
+					}
+				}
+			}
+			ch.events = nil
+			ch.done = make(chan struct{})
+		}
+		reply, err := tc.UnaryCall(context.Background(), req)
+		if err != nil {
+			t.Fatalf("TestService/UnaryCall(_, _) with ResponseCompressors(%v) = _, %v, want _, <nil>", test.names, err)
+		}
+		if ps := len(reply.GetPayload().GetBody()); ps != respSize {
+			t.Fatalf("Got the reply with len %d; want %d", ps, respSize)
+		}
+		checkInPayloads("UnaryCall")
+		stream, err := tc.StreamingOutputCall(context.Background(), sreq)
+		if err != nil {
+			t.Fatalf("TestService/StreamingOutputCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		sreply, err := stream.Recv()
+		if err != nil || len(sreply.GetPayload().GetBody()) != respSize {
+			t.Fatalf("%v.Recv() = %v, %v, want a reply of len %d, <nil>", stream, sreply, err, respSize)
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+		}
+		checkInPayloads("StreamingOutputCall")
+		s.Stop()
+	}
+}
+
+func TestUseCompressor(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	argSize := 2718
+	respSize := 314
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	if _, err := tc.UnaryCall(context.Background(), req, grpc.UseCompressor("gzip")); err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _, UseCompressor(%q)) = _, %v, want _, <nil>", "gzip", err)
+	}
+	if _, err := tc.UnaryCall(context.Background(), req, grpc.UseCompressor("unknown")); grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("TestService/UnaryCall(_, _, UseCompressor(%q)) = _, %v, want _, error code %d", "unknown", err, codes.Unimplemented)
+	}
+}
+
+func TestUseCompressorIdentity(t *testing.T) {
+	var encodings []string
+	hook := func(fields []hpack.HeaderField) ([]hpack.HeaderField, error) {
+		var enc, accept string
+		for _, f := range fields {
+			switch f.Name {
+			case "grpc-encoding":
+				enc = f.Value
+			case "grpc-accept-encoding":
+				accept = f.Value
+			}
+		}
+		encodings = append(encodings, enc+";"+accept)
+		return fields, nil
+	}
+	s, tc := setUp(true, math.MaxUint32, grpc.WithCompressor(grpc.NewGZIPCompressor()), grpc.WithHeaderHook(hook))
+	defer s.Stop()
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(314),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 2718),
+	}
+	if _, err := tc.UnaryCall(context.Background(), req); err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if _, err := tc.UnaryCall(context.Background(), req, grpc.UseCompressor("identity")); err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _, UseCompressor(%q)) = _, %v, want _, <nil>", "identity", err)
+	}
+	stream, err := tc.FullDuplexCall(context.Background(), grpc.UseCompressor("identity"))
+	if err != nil {
+		t.Fatalf("TestService/FullDuplexCall(_, UseCompressor(%q)) = _, %v, want _, <nil>", "identity", err)
+	}
+	sreq := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(314)}},
+		Payload:            newPayload(testpb.PayloadType_COMPRESSABLE, 2718),
+	}
+	if err := stream.Send(sreq); err != nil {
+		t.Fatalf("%v.Send(_) = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	// The client still accepts compressed responses.
+	want := []string{"gzip;gzip", "identity;gzip", "identity;gzip"}
+	if !reflect.DeepEqual(encodings, want) {
+		t.Fatalf("the RPCs sent grpc-encoding;grpc-accept-encoding %v, want %v", encodings, want)
+	}
+}
+
+func TestFrameHook(t *testing.T) {
+	const (
+		frameData    = 0x0
+		frameHeaders = 0x1
+	)
+	// corrupt makes the server flag its messages as compressed.
+	var corrupt int32
+	shook := func(frame []byte) ([]byte, error) {
+		if atomic.LoadInt32(&corrupt) == 1 && frame[3] == frameData && len(frame) > 9 {
+			frame[9] = 1
+		}
+		return frame, nil
+	}
+	// The client counts its HEADERS and DATA frames.
+	var headers, data int32
+	chook := func(frame []byte) ([]byte, error) {
+		switch frame[3] {
+		case frameHeaders:
+			atomic.AddInt32(&headers, 1)
+		case frameData:
+			atomic.AddInt32(&data, 1)
+		}
+		return frame, nil
+	}
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.FrameHook(shook)}, grpc.WithFrameHook(chook))
+	defer s.Stop()
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(314),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, 271),
+	}
+	for _, test := range []struct {
+		corrupt int32
+		code    codes.Code
+	}{
+		{0, codes.OK},
+		// The response has no grpc-encoding.
+		{1, codes.Unimplemented},
+		// The connection is still usable.
+		{0, codes.OK},
+	} {
+		atomic.StoreInt32(&corrupt, test.corrupt)
+		if _, err := tc.UnaryCall(context.Background(), req); grpc.Code(err) != test.code {
+			t.Fatalf("TestService/UnaryCall(_, _) with the responses corrupted: %t = _, %v, want _, error code: %d", test.corrupt == 1, err, test.code)
+		}
+	}
+	if h, d := atomic.LoadInt32(&headers), atomic.LoadInt32(&data); h != 3 || d != 3 {
+		t.Fatalf("the client wrote %d HEADERS and %d DATA frames, want 3 and 3", h, d)
+	}
+}
+
+func TestClientConnInvoke(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(314),
+	}
+	reply := new(testpb.SimpleResponse)
+	if err := conn.Invoke(context.Background(), "/grpc.testing.TestService/UnaryCall", req, reply); err != nil {
+		t.Fatalf("%v.Invoke(_, \"/grpc.testing.TestService/UnaryCall\", _, _) = %v, want <nil>", conn, err)
+	}
+	if n := len(reply.GetPayload().GetBody()); n != 314 {
+		t.Fatalf("Got the reply with a payload of length %d, want %d", n, 314)
+	}
+	if err := conn.Invoke(context.Background(), "/grpc.testing.TestService/Unknown", req, reply); grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("%v.Invoke(_, \"/grpc.testing.TestService/Unknown\", _, _) = %v, want error code: %d", conn, err, codes.Unimplemented)
+	}
+}
+
+// fakeClientConn is a grpc.ClientConnInterface replying to the unary RPCs with
+// a canned response, which lets a client be tested without a server.
+type fakeClientConn struct {
+	methods []string
+	reply   proto.Message
+}
+
+func (cc *fakeClientConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	cc.methods = append(cc.methods, method)
+	proto.Merge(reply.(proto.Message), cc.reply)
+	return nil
+}
+
+func (cc *fakeClientConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cc.methods = append(cc.methods, method)
+	return nil, grpc.Errorf(codes.Unimplemented, "fakeClientConn does not support streams")
+}
+
+func TestFakeClientConn(t *testing.T) {
+	want := &testpb.SimpleResponse{Payload: newPayload(testpb.PayloadType_COMPRESSABLE, 3)}
+	cc := &fakeClientConn{reply: want}
+	tc := testpb.NewTestServiceClient(cc)
+	reply, err := tc.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	if err != nil || !proto.Equal(reply, want) {
+		t.Fatalf("TestService/UnaryCall(_, _) = %v, %v, want %v, <nil>", reply, err, want)
+	}
+	if _, err := tc.FullDuplexCall(context.Background()); grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("TestService/FullDuplexCall(_) = _, %v, want _, error code: %d", err, codes.Unimplemented)
+	}
+	methods := []string{"/grpc.testing.TestService/UnaryCall", "/grpc.testing.TestService/FullDuplexCall"}
+	if !reflect.DeepEqual(cc.methods, methods) {
+		t.Fatalf("the fake ClientConn got the RPCs %v, want %v", cc.methods, methods)
+	}
+}
+
+func TestInvokeRaw(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	respSize := 314
+	in, err := proto.Marshal(&testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+	})
+	if err != nil {
+		t.Fatalf("proto.Marshal(_) = _, %v, want _, <nil>", err)
+	}
+	out, err := grpc.InvokeRaw(context.Background(), "/grpc.testing.TestService/UnaryCall", in, conn)
+	if err != nil {
+		t.Fatalf("InvokeRaw(_, \"/grpc.testing.TestService/UnaryCall\", _, _) = _, %v, want _, <nil>", err)
+	}
+	reply := new(testpb.SimpleResponse)
+	if err := proto.Unmarshal(out, reply); err != nil {
+		t.Fatalf("proto.Unmarshal(_, _) = %v, want <nil>", err)
+	}
+	if n := len(reply.GetPayload().GetBody()); n != respSize {
+		t.Fatalf("Got the reply with a payload of length %d, want %d", n, respSize)
+	}
+	// The status of a failed RPC is reported like by Invoke.
+	if _, err := grpc.InvokeRaw(context.Background(), "/grpc.testing.TestService/Unknown", in, conn); grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("InvokeRaw(_, \"/grpc.testing.TestService/Unknown\", _, _) = _, %v, want _, error code: %d", err, codes.Unimplemented)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithContentType("application/grpc+proto"))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	for _, test := range []struct {
+		ct   string
+		code codes.Code
+	}{
+		{"application/grpc", codes.OK},
+		{"application/grpc+proto", codes.OK},
+		{"application/grpc; charset=utf-8", codes.OK},
+		{"application/grpcfoo", codes.InvalidArgument},
+		{"text/plain", codes.InvalidArgument},
+	} {
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.CallContentType(test.ct))
+		if test.code == codes.OK {
+			if err != nil {
+				t.Fatalf("TestService/EmptyCall(_, _, CallContentType(%q)) = _, %v, want _, <nil>", test.ct, err)
+			}
+			continue
+		}
+		if grpc.Code(err) != test.code {
+			t.Fatalf("TestService/EmptyCall(_, _, CallContentType(%q)) = _, %v, want _, error code: %d", test.ct, err, test.code)
+		}
+	}
+	if _, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithContentType("text/plain")); err == nil {
+		t.Fatalf("Dial(%q, _, WithContentType(\"text/plain\")) = _, <nil>, want _, non-nil", addr)
+	}
+}
+
+func TestPeerUnaryRPC(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	var p peer.Peer
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Peer(&p)); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _, _) = _, %v, want _, <nil>", err)
+	}
+	if p.Addr == nil {
+		t.Fatalf("grpc.Peer got nil address, want the server address")
+	}
+	if _, port, err := net.SplitHostPort(p.Addr.String()); err != nil || port == "" {
+		t.Fatalf("grpc.Peer got address %v, want a host:port address", p.Addr)
+	}
+}
+
+func performOneRPC(t *testing.T, tc testpb.TestServiceClient, wg *sync.WaitGroup) {
+	argSize := 2718
+	respSize := 314
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	reply, err := tc.UnaryCall(context.Background(), req)
+	if err != nil {
+		t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	pt := reply.GetPayload().GetType()
+	ps := len(reply.GetPayload().GetBody())
+	if pt != testpb.PayloadType_COMPRESSABLE || ps != respSize {
+		t.Fatalf("Got the reply with type %d len %d; want %d, %d", pt, ps, testpb.PayloadType_COMPRESSABLE, respSize)
+	}
+	wg.Done()
+}
+
+// This test mimics a user who sends 1000 RPCs concurrently on a faulty transport.
+// TODO(zhaoq): Refactor to make this clearer and add more cases to test racy
+// and error-prone paths.
+func TestRetry(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		time.Sleep(1 * time.Second)
+		// The server shuts down the network connection to make a
+		// transport error which will be detected by the client side
+		// code.
+		s.TestingCloseConns()
+		wg.Done()
+	}()
+	// All these RPCs should succeed eventually.
+	for i := 0; i < 1000; i++ {
+		time.Sleep(2 * time.Millisecond)
+		wg.Add(1)
+		go performOneRPC(t, tc, &wg)
+	}
+	wg.Wait()
+}
+
+// blockingInterceptor blocks the first n unary RPCs until release is closed.
+// started receives a value once each of them reaches the server.
+type blockingInterceptor struct {
+	mu      sync.Mutex
+	n       int
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingInterceptor(n int) *blockingInterceptor {
+	return &blockingInterceptor{
+		n:       n,
+		started: make(chan struct{}, n),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingInterceptor) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	b.mu.Lock()
+	block := b.n > 0
+	b.n--
+	b.mu.Unlock()
+	if block {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return handler(ctx, req)
+}
+
+func TestMaxCallAttempts(t *testing.T) {
+	b := newBlockingInterceptor(2)
+	defer close(b.release)
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(b.intercept)})
+	defer s.Stop()
+	for _, test := range []struct {
+		opts []grpc.CallOption
+		code codes.Code
+	}{
+		// A single attempt fails with the ConnectionError.
+		{[]grpc.CallOption{grpc.MaxCallAttempts(1)}, codes.Unavailable},
+		// The retry is served without blocking.
+		{nil, codes.OK},
+	} {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, test.opts...)
+			errc <- err
+		}()
+		<-b.started
+		s.TestingCloseConns()
+		err := <-errc
+		if test.code == codes.OK {
+			if err != nil {
+				t.Fatalf("TestService/EmptyCall(_, _, %v) = _, %v, want _, <nil>", test.opts, err)
+			}
+		} else if grpc.Code(err) != test.code {
+			t.Fatalf("TestService/EmptyCall(_, _, %v) = _, %v, want _, error code: %d", test.opts, err, test.code)
+		}
+	}
+}
+
+func TestMaxConcurrentCalls(t *testing.T) {
+	const method = "/grpc.testing.TestService/EmptyCall"
+	for _, queue := range []bool{false, true} {
+		b := newBlockingInterceptor(1)
+		s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(b.intercept), grpc.MaxConcurrentCalls(method, 1, queue)})
+		errc := make(chan error, 1)
+		go func() {
+			_, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+			errc <- err
+		}()
+		<-b.started
+		// The other methods are not limited.
+		req := &testpb.SimpleRequest{ResponseType: testpb.PayloadType_COMPRESSABLE.Enum()}
+		if _, err := tc.UnaryCall(context.Background(), req); err != nil {
+			t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		if queue {
+			// The second call waits for the first one.
+			go func() {
+				_, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+				errc <- err
+			}()
+			for len(s.ActiveRPCs()) != 2 {
+				time.Sleep(time.Millisecond)
+			}
+			close(b.release)
+			if err := <-errc; err != nil {
+				t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+			}
+		} else {
+			if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); grpc.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("TestService/EmptyCall(_, _) beyond the limit = _, %v, want _, error code: %d", err, codes.ResourceExhausted)
+			}
+			close(b.release)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		// The room is given back once the calls are done.
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+		s.Stop()
+	}
+}
+
+func TestDisableRetry(t *testing.T) {
+	b := newBlockingInterceptor(1)
+	defer close(b.release)
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(b.intercept)}, grpc.WithDefaultCallOptions(grpc.MaxCallAttempts(3)))
+	defer s.Stop()
+	opts := []grpc.CallOption{grpc.DisableRetry(), grpc.MaxCallAttempts(2)}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, opts...)
+		errc <- err
+	}()
+	<-b.started
+	s.TestingCloseConns()
+	if err := <-errc; grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("TestService/EmptyCall(_, _, %v) = _, %v, want _, error code: %d", opts, err, codes.Unavailable)
+	}
+	// The RPC reached the server only once.
+	b.mu.Lock()
+	n := b.n
+	b.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("TestService/EmptyCall(_, _, %v) reached the server %d times, want 1", opts, 1-n)
+	}
+}
+
+func TestRetryWaitError(t *testing.T) {
+	b := newBlockingInterceptor(1)
+	defer close(b.release)
+	s, tc := setUpWithOptions(false, []grpc.ServerOption{grpc.UnaryInterceptor(b.intercept)})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tc.EmptyCall(ctx, &testpb.Empty{})
+		errc <- err
+	}()
+	<-b.started
+	// The retry keeps waiting for a transport until ctx is done, after
+	// which the RPC fails with the error of ctx rather than the
+	// ConnectionError of the first attempt.
+	s.Stop()
+	if err := <-errc; grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+}
+
+func TestDeadlineUnavailableBackend(t *testing.T) {
+	// Nothing listens on addr.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	for _, timeout := range []time.Duration{0, 100 * time.Millisecond} {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		_, err := tc.EmptyCall(ctx, &testpb.Empty{})
+		cancel()
+		if grpc.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("TestService/EmptyCall(_, _) with timeout %v = _, %v, want _, error code: %d", timeout, err, codes.DeadlineExceeded)
+		}
+		if d := time.Since(start); d > timeout+time.Second {
+			t.Fatalf("TestService/EmptyCall(_, _) with timeout %v returned after %v", timeout, d)
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32)
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	s.Stop()
+	// Failfast RPCs give up once the ClientConn fails to reconnect.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.FailFast(true))
+		if grpc.Code(err) == codes.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/EmptyCall(_, _, FailFast(true)) = _, %v, want _, error code: %d", err, codes.Unavailable)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// So do the failfast streams.
+	if _, err := tc.FullDuplexCall(context.Background(), grpc.FailFast(true)); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("TestService/FullDuplexCall(_, FailFast(true)) = _, %v, want _, error code: %d", err, codes.Unavailable)
+	}
+	// The others wait for the ClientConn to be ready until their deadline.
+	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := tc.EmptyCall(ctx, &testpb.Empty{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+	ctx, _ = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := tc.FullDuplexCall(ctx); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/FullDuplexCall(_) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+}
+
+func TestMethodConfig(t *testing.T) {
+	// Nothing listens on addr.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	waitForReady := false
+	mc := map[string]grpc.MethodConfig{
+		"/grpc.testing.TestService":           {WaitForReady: &waitForReady},
+		"/grpc.testing.TestService/EmptyCall": {Timeout: 100 * time.Millisecond},
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithMethodConfig(mc))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	if got, ok := conn.GetMethodConfig("/grpc.testing.TestService/UnaryCall"); !ok || got.WaitForReady != &waitForReady {
+		t.Fatalf("GetMethodConfig(%q) = %v, %t, want the config of the service", "/grpc.testing.TestService/UnaryCall", got, ok)
+	}
+	if _, ok := conn.GetMethodConfig("/grpc.testing.OtherService/EmptyCall"); ok {
+		t.Fatalf("GetMethodConfig(%q) = _, true, want _, false", "/grpc.testing.OtherService/EmptyCall")
+	}
+	tc := testpb.NewTestServiceClient(conn)
+	// The Timeout of EmptyCall bounds the RPCs waiting for the ClientConn.
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+	// UnaryCall fails fast by the config of the service.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := tc.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		if grpc.Code(err) == codes.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestService/UnaryCall(_, _) = _, %v, want _, error code: %d", err, codes.Unavailable)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The CallOptions override the config.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := tc.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.FailFast(false)); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/UnaryCall(_, _, FailFast(false)) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+}
+
+func TestServiceConfig(t *testing.T) {
+	// Nothing listens on addr.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	if _, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithServiceConfig(`{"methodConfig": [{"timeout": "1s"}]}`)); err == nil {
+		t.Fatalf("Dial(%q, WithServiceConfig(<without name>)) = _, <nil>, want _, error", addr)
+	}
+	sc := `{
+		"loadBalancingPolicy": "round_robin",
+		"methodConfig": [{
+			"name": [{"service": "grpc.testing.TestService", "method": "EmptyCall"}],
+			"timeout": "0.1s"
+		}]
+	}`
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithServiceConfig(sc))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	if _, err := testpb.NewTestServiceClient(conn).EmptyCall(context.Background(), &testpb.Empty{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, error code: %d", err, codes.DeadlineExceeded)
+	}
+}
+
+// TODO(zhaoq): Have a better test coverage of timeout and cancellation mechanism.
+func TestRPCTimeout(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	argSize := 2718
+	respSize := 314
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	// Performs 100 RPCs with various timeout values so that
+	// the RPCs could timeout on different stages of their lifetime. This
+	// is the best-effort to cover various cases when an rpc gets cancelled.
+	for i := 1; i <= 100; i++ {
+		ctx, _ := context.WithTimeout(context.Background(), time.Duration(i)*time.Microsecond)
+		reply, err := tc.UnaryCall(ctx, req)
+		if grpc.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf(`TestService/UnaryCallv(_, _) = %v, %v; want <nil>, error code: %d`, reply, err, codes.DeadlineExceeded)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	argSize := 2718
+	respSize := 314
+	req := &testpb.SimpleRequest{
+		ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseSize: proto.Int32(int32(respSize)),
+		Payload:      newPayload(testpb.PayloadType_COMPRESSABLE, int32(argSize)),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(1*time.Millisecond, cancel)
+	reply, err := tc.UnaryCall(ctx, req)
+	if grpc.Code(err) != codes.Canceled {
+		t.Fatalf(`TestService/UnaryCall(_, _) = %v, %v; want <nil>, error code: %d`, reply, err, codes.Canceled)
+	}
+}
+
+// The following tests the gRPC streaming RPC implementations.
+// TODO(zhaoq): Have better coverage on error cases.
+var (
+	reqSizes  = []int{27182, 8, 1828, 45904}
+	respSizes = []int{31415, 9, 2653, 58979}
+)
+
+// waitHandler sends the header and a message and then blocks until the RPC is
+// done. It reports the error of the context of the RPC on done.
+func waitHandler(done chan<- error) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(new(testpb.Empty)); err != nil {
+			return err
+		}
+		if err := stream.SendMsg(new(testpb.Empty)); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		done <- stream.Context().Err()
+		return nil
+	}
+}
+
+func TestCancelPropagation(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	s := grpc.NewServer(grpc.UnknownServiceHandler(waitHandler(done)))
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(_, _) = _, %v, want _, <nil>", err)
+	}
+	defer conn.Close()
+	// A unary RPC canceled while it waits for the end of the response.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := grpc.Invoke(ctx, "/foo/Bar", new(testpb.Empty), new(testpb.Empty), conn); grpc.Code(err) != codes.Canceled {
+		t.Fatalf("grpc.Invoke(_, \"/foo/Bar\", _, _, _) = %v, want error code: %d", err, codes.Canceled)
+	}
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("The server observed %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The server did not observe the cancellation of the unary RPC")
+	}
+	// A stream canceled after a message without calling RecvMsg again.
+	ctx, cancel = context.WithCancel(context.Background())
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := grpc.NewClientStream(ctx, desc, conn, "/foo/Bar")
+	if err != nil {
+		t.Fatalf("grpc.NewClientStream(_, _, _, \"/foo/Bar\") = _, %v, want _, <nil>", err)
+	}
+	if err := stream.SendMsg(new(testpb.Empty)); err != nil {
+		t.Fatalf("%v.SendMsg(_) = %v, want <nil>", stream, err)
+	}
+	if err := stream.RecvMsg(new(testpb.Empty)); err != nil {
+		t.Fatalf("%v.RecvMsg(_) = %v, want <nil>", stream, err)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("The server observed %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The server did not observe the cancellation of the stream")
+	}
+	if err := stream.RecvMsg(new(testpb.Empty)); grpc.Code(err) != codes.Canceled {
+		t.Fatalf("%v.RecvMsg(_) = %v, want error code: %d", stream, err, codes.Canceled)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	var index int
+	for index < len(reqSizes) {
+		respParam := []*testpb.ResponseParameters{
+			{
+				Size: proto.Int32(int32(respSizes[index])),
+			},
+		}
+		req := &testpb.StreamingOutputCallRequest{
+			ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseParameters: respParam,
+			Payload:            newPayload(testpb.PayloadType_COMPRESSABLE, int32(reqSizes[index])),
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+		}
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("%v.Recv() = %v, want <nil>", stream, err)
 		}
 		pt := reply.GetPayload().GetType()
 		if pt != testpb.PayloadType_COMPRESSABLE {
 			t.Fatalf("Got the reply of type %d, want %d", pt, testpb.PayloadType_COMPRESSABLE)
 		}
-		size := len(reply.GetPayload().GetBody())
-		if size != int(respSizes[index]) {
-			t.Fatalf("Got reply body of length %d, want %d", size, respSizes[index])
+		size := len(reply.GetPayload().GetBody())
+		if size != int(respSizes[index]) {
+			t.Fatalf("Got reply body of length %d, want %d", size, respSizes[index])
+		}
+		index++
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() got %v, want %v", stream, err, nil)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v failed to complele the ping pong test: %v", stream, err)
+	}
+}
+
+// doPingPong sends n requests on a FullDuplexCall and receives their replies
+// one by one. It returns the first error.
+func doPingPong(tc testpb.TestServiceClient, n, reqSize, respSize int) error {
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		return err
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(int32(respSize))}},
+		Payload:            newPayload(testpb.PayloadType_COMPRESSABLE, int32(reqSize)),
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+		reply, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if size := len(reply.GetPayload().GetBody()); size != respSize {
+			return fmt.Errorf("got reply body of length %d, want %d", size, respSize)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		return fmt.Errorf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	return nil
+}
+
+func TestBufferSizes(t *testing.T) {
+	// Buffers smaller than the frames are flushed midway through them.
+	for _, size := range []int{16, 32 * 1024} {
+		sopts := []grpc.ServerOption{grpc.WriteBufferSize(size), grpc.ReadBufferSize(size)}
+		s, tc := setUpWithOptions(false, sopts, grpc.WithWriteBufferSize(size), grpc.WithReadBufferSize(size))
+		for i := range reqSizes {
+			if err := doPingPong(tc, 1, reqSizes[i], respSizes[i]); err != nil {
+				t.Fatalf("Ping pong with buffers of %d bytes failed: %v", size, err)
+			}
+		}
+		ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+		var header metadata.MD
+		if _, err := tc.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header)); err != nil || !reflect.DeepEqual(header, testMetadata) {
+			t.Fatalf("TestService/UnaryCall(_, _) = _, %v with header %v, want _, <nil> with %v", err, header, testMetadata)
+		}
+		s.Stop()
+	}
+}
+
+func benchmarkPingPong(b *testing.B, size int) {
+	sopts := []grpc.ServerOption{grpc.WriteBufferSize(size), grpc.ReadBufferSize(size)}
+	s, tc := setUpWithOptions(false, sopts, grpc.WithWriteBufferSize(size), grpc.WithReadBufferSize(size))
+	defer s.Stop()
+	b.ResetTimer()
+	if err := doPingPong(tc, b.N, 10, 10); err != nil {
+		b.Fatalf("Ping pong failed: %v", err)
+	}
+}
+
+func BenchmarkPingPongUnbuffered(b *testing.B) {
+	benchmarkPingPong(b, 0)
+}
+
+func BenchmarkPingPongBuffered32KiB(b *testing.B) {
+	benchmarkPingPong(b, 32*1024)
+}
+
+// benchmarkStreamingInput benchmarks a client stream sending messages of size
+// bytes, which shows the allocations of the send path.
+func benchmarkStreamingInput(b *testing.B, size int32) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	stream, err := tc.StreamingInputCall(context.Background())
+	if err != nil {
+		b.Fatalf("%v.StreamingInputCall(_) = _, %v, want _, <nil>", tc, err)
+	}
+	req := &testpb.StreamingInputCallRequest{
+		Payload: newPayload(testpb.PayloadType_COMPRESSABLE, size),
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := stream.Send(req); err != nil {
+			b.Fatalf("%v.Send(_) = %v, want <nil>", stream, err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		b.Fatalf("%v.CloseAndRecv() = _, %v, want _, <nil>", stream, err)
+	}
+}
+
+// benchmarkStreamingOutput benchmarks a server stream receiving b.N
+// responses of size bytes, which shows the allocations of the receive path.
+func benchmarkStreamingOutput(b *testing.B, size int32) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	params := make([]*testpb.ResponseParameters, b.N)
+	for i := range params {
+		params[i] = &testpb.ResponseParameters{Size: proto.Int32(size)}
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: params,
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	stream, err := tc.StreamingOutputCall(context.Background(), req)
+	if err != nil {
+		b.Fatalf("%v.StreamingOutputCall(_) = _, %v, want _, <nil>", tc, err)
+	}
+	reply := new(testpb.StreamingOutputCallResponse)
+	for i := 0; i < b.N; i++ {
+		if err := stream.RecvMsg(reply); err != nil {
+			b.Fatalf("%v.RecvMsg(_) = %v, want <nil>", stream, err)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		b.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+}
+
+func BenchmarkStreamingOutput64B(b *testing.B) {
+	benchmarkStreamingOutput(b, 64)
+}
+
+func BenchmarkStreamingOutput1KiB(b *testing.B) {
+	benchmarkStreamingOutput(b, 1024)
+}
+
+func BenchmarkStreamingOutput64KiB(b *testing.B) {
+	benchmarkStreamingOutput(b, 64*1024)
+}
+
+func BenchmarkStreamingInput1KiB(b *testing.B) {
+	benchmarkStreamingInput(b, 1024)
+}
+
+func BenchmarkStreamingInput64KiB(b *testing.B) {
+	benchmarkStreamingInput(b, 64*1024)
+}
+
+func BenchmarkStreamingInput1MiB(b *testing.B) {
+	benchmarkStreamingInput(b, 1024*1024)
+}
+
+func TestClientConnGracefulClose(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	for _, abort := range []bool{false, true} {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+		}
+		tc := testpb.NewTestServiceClient(conn)
+		stream, err := tc.FullDuplexCall(context.Background())
+		if err != nil {
+			t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+		}
+		req := &testpb.StreamingOutputCallRequest{
+			ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+		}
+		closed := make(chan error, 1)
+		go func() {
+			closed <- conn.GracefulClose()
+		}()
+		// GracefulClose waits for the stream while the new RPCs fail.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("TestService/EmptyCall(_, _) = _, <nil> after GracefulClose, want _, error")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case err := <-closed:
+			t.Fatalf("GracefulClose() = %v before the stream is done, want it to block", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if abort {
+			// Close interrupts GracefulClose and the stream.
+			if err := conn.Close(); err != nil {
+				t.Fatalf("%v.Close() = %v, want <nil>", conn, err)
+			}
+			if _, err := stream.Recv(); err == nil {
+				t.Fatalf("%v.Recv() = _, <nil> after Close, want _, error", stream)
+			}
+		} else {
+			if err := stream.Send(req); err != nil {
+				t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+			}
+			if _, err := stream.Recv(); err != nil {
+				t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+			}
+			if _, err := stream.Recv(); err != io.EOF {
+				t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+			}
+		}
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatalf("GracefulClose() = %v, want <nil>", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GracefulClose() did not return once the stream was done")
+		}
+		if err := conn.Close(); err != grpc.ErrClientConnClosing {
+			t.Fatalf("%v.Close() = %v, want %v", conn, err, grpc.ErrClientConnClosing)
 		}
-		index++
-	}
-	if err := stream.CloseSend(); err != nil {
-		t.Fatalf("%v.CloseSend() got %v, want %v", stream, err, nil)
-	}
-	if _, err := stream.Recv(); err != io.EOF {
-		t.Fatalf("%v failed to complele the ping pong test: %v", stream, err)
 	}
 }
 
 func TestMetadataStreamingRPC(t *testing.T) {
 	s, tc := setUp(true, math.MaxUint32)
 	defer s.Stop()
-	ctx := metadata.NewContext(context.Background(), testMetadata)
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
 	stream, err := tc.FullDuplexCall(ctx)
 	if err != nil {
 		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
@@ -552,6 +3549,35 @@ func TestMetadataStreamingRPC(t *testing.T) {
 	}
 }
 
+func TestSetHeaderStreamingRPC(t *testing.T) {
+	s, tc := setUp(true, math.MaxUint32)
+	defer s.Stop()
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
+	stream, err := tc.HalfDuplexCall(ctx)
+	if err != nil {
+		t.Fatalf("%v.HalfDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if headerMD, err := stream.Header(); err != nil || !reflect.DeepEqual(testMetadata, headerMD) {
+		t.Fatalf("%v.Header() = %v, %v, want %v, <nil>", stream, headerMD, err, testMetadata)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+}
+
 func TestServerStreaming(t *testing.T) {
 	s, tc := setUp(true, math.MaxUint32)
 	defer s.Stop()
@@ -610,7 +3636,7 @@ func TestFailedServerStreaming(t *testing.T) {
 		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
 		ResponseParameters: respParam,
 	}
-	ctx := metadata.NewContext(context.Background(), testMetadata)
+	ctx := metadata.NewOutgoingContext(context.Background(), testMetadata)
 	stream, err := tc.StreamingOutputCall(ctx, req)
 	if err != nil {
 		t.Fatalf("%v.StreamingOutputCall(_) = _, %v, want <nil>", tc, err)
@@ -647,6 +3673,86 @@ func TestClientStreaming(t *testing.T) {
 	}
 }
 
+func TestClientStreamingWriteBatching(t *testing.T) {
+	for _, threshold := range []int{1, 1000, 1 << 20} {
+		ch := &testStatsHandler{done: make(chan struct{})}
+		s, tc := setUpWithOptions(false, nil, grpc.WithStatsHandler(ch))
+		stream, err := tc.StreamingInputCall(context.Background(), grpc.WriteBatching(threshold))
+		if err != nil {
+			t.Fatalf("%v.StreamingInputCall(_, WriteBatching(%d)) = _, %v, want <nil>", tc, threshold, err)
+		}
+		var sum int
+		for _, size := range reqSizes {
+			req := &testpb.StreamingInputCallRequest{
+				Payload: newPayload(testpb.PayloadType_COMPRESSABLE, int32(size)),
+			}
+			if err := stream.Send(req); err != nil {
+				t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+			}
+			sum += size
+		}
+		reply, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatalf("%v.CloseAndRecv() got error %v, want %v", stream, err, nil)
+		}
+		if reply.GetAggregatedPayloadSize() != int32(sum) {
+			t.Fatalf("%v.CloseAndRecv().GetAggregatePayloadSize() = %v; want %v", stream, reply.GetAggregatedPayloadSize(), sum)
+		}
+		<-ch.done
+		// Every buffered message is reported once it is written.
+		var n int
+		for _, k := range ch.kinds() {
+			if k == "OutPayload" {
+				n++
+			}
+		}
+		if n != len(reqSizes) {
+			t.Fatalf("WriteBatching(%d) got %d OutPayload events, want %d", threshold, n, len(reqSizes))
+		}
+		s.Stop()
+	}
+}
+
+func TestPingPongWriteBatching(t *testing.T) {
+	s, tc := setUp(false, math.MaxUint32)
+	defer s.Stop()
+	stream, err := tc.FullDuplexCall(context.Background(), grpc.WriteBatching(1<<20))
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	for i := range reqSizes {
+		req := &testpb.StreamingOutputCallRequest{
+			ResponseType: testpb.PayloadType_COMPRESSABLE.Enum(),
+			ResponseParameters: []*testpb.ResponseParameters{
+				{
+					Size: proto.Int32(int32(respSizes[i])),
+				},
+			},
+			Payload: newPayload(testpb.PayloadType_COMPRESSABLE, int32(reqSizes[i])),
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+		}
+		// The request stays in the buffer until it is flushed.
+		if err := stream.Flush(); err != nil {
+			t.Fatalf("%v.Flush() = %v, want <nil>", stream, err)
+		}
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("%v.Recv() = %v, want <nil>", stream, err)
+		}
+		if size := len(reply.GetPayload().GetBody()); size != respSizes[i] {
+			t.Fatalf("Got reply body of length %d, want %d", size, respSizes[i])
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() got %v, want %v", stream, err, nil)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v failed to complele the ping pong test: %v", stream, err)
+	}
+}
+
 func TestExceedMaxStreamsLimit(t *testing.T) {
 	// Only allows 1 live stream per server transport.
 	s, tc := setUp(true, 1)
@@ -665,3 +3771,445 @@ func TestExceedMaxStreamsLimit(t *testing.T) {
 		t.Fatalf("got %v, want error code %d", err, codes.Unavailable)
 	}
 }
+
+func TestConnPool(t *testing.T) {
+	// Only allows 1 live stream per server transport, so that the streams
+	// spread over the 2 transports of the pool.
+	s, tc := setUp(true, 1, grpc.WithConnPoolSize(2), grpc.WithBlock())
+	defer s.Stop()
+	// The round robin makes an RPC on each transport, which receives the
+	// settings of max concurrent streams meanwhile.
+	for i := 0; i < 2; i++ {
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, <nil>", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if _, err := tc.StreamingInputCall(ctx); err != nil {
+			t.Fatalf("TestService/StreamingInputCall(_) = _, %v, want _, <nil>", err)
+		}
+	}
+	// Both transports are saturated now.
+	if _, err := tc.StreamingInputCall(context.Background()); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("TestService/StreamingInputCall(_) = _, %v, want _, error code %d", err, codes.Unavailable)
+	}
+	if _, err := grpc.Dial("localhost:0", grpc.WithInsecure(), grpc.WithConnPoolSize(0)); err == nil {
+		t.Fatalf("grpc.Dial(_, WithConnPoolSize(0)) = _, <nil>, want an error")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	idleTimeout := 100 * time.Millisecond
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithIdleTimeout(idleTimeout))
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	// An active stream keeps the connection up.
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	time.Sleep(3 * idleTimeout)
+	if state := conn.State(); state != grpc.Ready {
+		t.Fatalf("conn.State() = %v with an active stream, want %v", state, grpc.Ready)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("%v.CloseSend() = %v, want <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+	for i := 0; i < 3; i++ {
+		// The connection goes idle once the RPCs are done ...
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		state := conn.State()
+		for state != grpc.Idle {
+			if state, err = conn.WaitForStateChange(ctx, state); err != nil {
+				t.Fatalf("conn.WaitForStateChange(_, %v) = _, %v, want _, <nil>", state, err)
+			}
+		}
+		cancel()
+		// ... and reconnects for the next RPC, which does not fail.
+		if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+			t.Fatalf("TestService/EmptyCall(_, _) = _, %v after idling, want _, <nil>", err)
+		}
+	}
+}
+
+// contentTypeWriter replaces the content-type of the response with ct, or
+// drops it if ct is empty.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	ct string
+}
+
+func (w contentTypeWriter) WriteHeader(code int) {
+	if w.ct == "" {
+		// A nil value suppresses the sniffed content-type of net/http.
+		w.Header()["Content-Type"] = nil
+	} else {
+		w.Header().Set("Content-Type", w.ct)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w contentTypeWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestResponseContentSubtype(t *testing.T) {
+	s := grpc.NewServer()
+	defer s.Stop()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	var ct string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(contentTypeWriter{w, ct}, r)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	for _, test := range []struct {
+		ct   string
+		code codes.Code
+	}{
+		// A missing content-subtype falls back to the codec of the call.
+		{"", codes.OK},
+		{"application/grpc", codes.OK},
+		{"application/grpc+proto", codes.OK},
+		// Another registered codec is used to decode the responses.
+		{"application/grpc+" + registeredCodec.name, codes.OK},
+		{"application/grpc+unknown", codes.Internal},
+	} {
+		ct = test.ct
+		_, err := tc.EmptyCall(context.Background(), &testpb.Empty{})
+		if test.code == codes.OK && err != nil || test.code != codes.OK && grpc.Code(err) != test.code {
+			t.Fatalf("TestService/EmptyCall(_, _) with the response content-type %q = _, %v, want error code %d", test.ct, err, test.code)
+		}
+		stream, err := tc.FullDuplexCall(context.Background())
+		if err != nil {
+			t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+		}
+		_, err = stream.Recv()
+		if test.code == codes.OK && err != nil || test.code != codes.OK && grpc.Code(err) != test.code {
+			t.Fatalf("%v.Recv() with the response content-type %q = _, %v, want error code %d", stream, test.ct, err, test.code)
+		}
+		stream.CloseSend()
+	}
+}
+
+func TestTrailersOnly(t *testing.T) {
+	// The server fails all the RPCs with a single HEADERS frame ending the
+	// stream.
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.NotFound)))
+		w.Header().Set("Grpc-Message", "no such thing")
+		w.Header().Set("Key1", "value1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	ch := &testStatsHandler{done: make(chan struct{})}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})), grpc.WithStatsHandler(ch))
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	want := grpc.Errorf(codes.NotFound, "no such thing")
+	var header, trailer metadata.MD
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}, grpc.Header(&header), grpc.Trailer(&trailer)); err != want {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v, want _, %v", err, want)
+	}
+	if len(header) != 0 {
+		t.Fatalf("Received header metadata %v, want none", header)
+	}
+	if got := trailer["key1"]; got != "value1" {
+		t.Fatalf("Received trailer metadata %v, want key1: value1", trailer)
+	}
+	// There is no header to report.
+	wantKinds := []string{"Begin", "OutHeader", "OutPayload", "End"}
+	<-ch.done
+	if got := ch.kinds(); !reflect.DeepEqual(got, wantKinds) {
+		t.Fatalf("TestService/EmptyCall got events %v, want %v", got, wantKinds)
+	}
+	ch.mu.Lock()
+	ch.events = nil
+	ch.done = make(chan struct{})
+	ch.mu.Unlock()
+	stream, err := tc.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{})
+	if err != nil {
+		t.Fatalf("TestService/StreamingOutputCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	if _, err := stream.Recv(); err != want {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, want)
+	}
+	if got := stream.Trailer()["key1"]; got != "value1" {
+		t.Fatalf("%v.Trailer() = %v, want key1: value1", stream, stream.Trailer())
+	}
+	<-ch.done
+	if got := ch.kinds(); !reflect.DeepEqual(got, wantKinds) {
+		t.Fatalf("TestService/StreamingOutputCall got events %v, want %v", got, wantKinds)
+	}
+}
+
+// eagerHeaderServer sends the header of StreamingOutputCall before any
+// message, which it holds until release is closed.
+type eagerHeaderServer struct {
+	testServer
+	release chan struct{}
+}
+
+func (s *eagerHeaderServer) StreamingOutputCall(args *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	if err := stream.SendHeader(metadata.Pairs("request-id", "42")); err != nil {
+		return err
+	}
+	if err := stream.SendHeader(metadata.Pairs("request-id", "43")); err != transport.ErrIllegalHeaderWrite {
+		return grpc.Errorf(codes.Internal, "%v.SendHeader(_) = %v, want %v", stream, err, transport.ErrIllegalHeaderWrite)
+	}
+	<-s.release
+	return s.testServer.StreamingOutputCall(args, stream)
+}
+
+func TestSendHeaderBeforeMessages(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	defer s.Stop()
+	hs := &eagerHeaderServer{release: make(chan struct{})}
+	testpb.RegisterTestServiceServer(s, hs)
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	stream, err := tc.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	})
+	if err != nil {
+		t.Fatalf("%v.StreamingOutputCall(_) = _, %v, want <nil>", tc, err)
+	}
+	// The header arrives while the server holds the messages.
+	want := metadata.Pairs("request-id", "42")
+	if md, err := stream.Header(); err != nil || !reflect.DeepEqual(md, want) {
+		t.Fatalf("%v.Header() = %v, %v, want %v, <nil>", stream, md, err, want)
+	}
+	close(hs.release)
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("%v.Recv() = _, %v, want _, %v", stream, err, io.EOF)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	stream, err := tc.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatalf("%v.FullDuplexCall(_) = _, %v, want <nil>", tc, err)
+	}
+	req := &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: []*testpb.ResponseParameters{{Size: proto.Int32(1)}},
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("%v.Send(%v) = %v, want <nil>", stream, req, err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("%v.Recv() = _, %v, want _, <nil>", stream, err)
+	}
+	// The RPCs in flight fail ...
+	conn.Reconnect()
+	if _, err := stream.Recv(); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("%v.Recv() = _, %v after Reconnect, want _, error code %d", stream, err, codes.Unavailable)
+	}
+	// ... and the next ones go through the new transport.
+	if _, err := tc.EmptyCall(context.Background(), &testpb.Empty{}); err != nil {
+		t.Fatalf("TestService/EmptyCall(_, _) = _, %v after Reconnect, want _, <nil>", err)
+	}
+}
+
+func TestReconnectResetsBackoff(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	bc := grpc.BackoffConfig{BaseDelay: time.Hour, MaxDelay: time.Hour, Multiplier: 1}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBackoffConfig(bc))
+	if err != nil {
+		t.Fatalf("grpc.Dial(%q) = _, %v, want _, <nil>", addr, err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state := conn.State()
+	for state != grpc.TransientFailure {
+		if state, err = conn.WaitForStateChange(ctx, state); err != nil {
+			t.Fatalf("conn.WaitForStateChange(_, %v) = _, %v, want _, <nil>", state, err)
+		}
+	}
+	// The server comes up while the connection backs off for an hour.
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen on %q again: %v", addr, err)
+	}
+	s := grpc.NewServer()
+	testpb.RegisterTestServiceServer(s, &testServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+	conn.Reconnect()
+	for state != grpc.Ready {
+		if state, err = conn.WaitForStateChange(ctx, state); err != nil {
+			t.Fatalf("conn.WaitForStateChange(_, %v) = _, %v after Reconnect, want _, <nil>", state, err)
+		}
+	}
+}
+
+// failingStreamServer fails StreamingOutputCall after sending the responses.
+// done is closed once the handler returns.
+type failingStreamServer struct {
+	testServer
+	done chan struct{}
+}
+
+func (s *failingStreamServer) StreamingOutputCall(args *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	defer close(s.done)
+	if err := s.testServer.StreamingOutputCall(args, stream); err != nil {
+		return err
+	}
+	return grpc.Errorf(codes.Aborted, "failed after %d responses", len(args.GetResponseParameters()))
+}
+
+func TestServerStreamingPartialResults(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	defer s.Stop()
+	fs := &failingStreamServer{done: make(chan struct{})}
+	testpb.RegisterTestServiceServer(s, fs)
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	defer conn.Close()
+	tc := testpb.NewTestServiceClient(conn)
+	const n = 10
+	var params []*testpb.ResponseParameters
+	for i := 0; i < n; i++ {
+		params = append(params, &testpb.ResponseParameters{Size: proto.Int32(int32(1000 * (i + 1)))})
+	}
+	stream, err := tc.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{
+		ResponseType:       testpb.PayloadType_COMPRESSABLE.Enum(),
+		ResponseParameters: params,
+	})
+	if err != nil {
+		t.Fatalf("%v.StreamingOutputCall(_) = _, %v, want <nil>", tc, err)
+	}
+	// Let the status arrive before the client reads the responses, which
+	// are delivered first nonetheless.
+	<-fs.done
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("%v.Recv() = _, %v for the response %d, want _, <nil>", stream, err, i)
+		}
+		if size := len(reply.GetPayload().GetBody()); size != 1000*(i+1) {
+			t.Fatalf("Got the response %d with a payload of %d bytes, want %d", i, size, 1000*(i+1))
+		}
+	}
+	if _, err := stream.Recv(); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("%v.Recv() = _, %v after the responses, want _, error code %d", stream, err, codes.Aborted)
+	}
+}
+
+func TestKeepaliveEnforcementPolicy(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: time.Minute}))
+	defer s.Stop()
+	go s.Serve(lis)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%q) = _, %v, want _, <nil>", lis.Addr(), err)
+	}
+	defer conn.Close()
+	// The client keeps pinging without any RPC.
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("Failed to write the client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write the settings: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := framer.WritePing(false, [8]byte{}); err != nil {
+			t.Fatalf("Failed to write the ping %d: %v", i, err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Failed to read GOAWAY from the server: %v", err)
+		}
+		if f, ok := f.(*http2.GoAwayFrame); ok {
+			if f.ErrCode != http2.ErrCodeEnhanceYourCalm || string(f.DebugData()) != "too_many_pings" {
+				t.Fatalf("Got GOAWAY with %v and %q, want %v and %q", f.ErrCode, f.DebugData(), http2.ErrCodeEnhanceYourCalm, "too_many_pings")
+			}
+			return
+		}
+	}
+}
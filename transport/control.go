@@ -39,9 +39,10 @@ import (
 	"github.com/bradfitz/http2"
 )
 
-// TODO(zhaoq): Make the following configurable.
 const (
-	// The initial window size for flow control.
+	// The initial window size for flow control defined by the HTTP2 spec.
+	// It applies until the peer announces another one, and it is the lower
+	// bound of the windows configurable via DialOptions and ServerConfig.
 	initialWindowSize = 65535
 	// Window update is only sent when the inbound quota reaches
 	// this threshold. Used to reduce the flow control traffic.
@@ -78,6 +79,27 @@ func (resetStream) isItem() bool {
 	return true
 }
 
+type ping struct {
+	ack  bool
+	data [8]byte
+}
+
+func (ping) isItem() bool {
+	return true
+}
+
+// goAway is written with the last stream id, error code and debug data. The
+// transport is closed after a GOAWAY with an error; otherwise it drains.
+type goAway struct {
+	lastStreamID uint32
+	code         http2.ErrCode
+	debugData    []byte
+}
+
+func (goAway) isItem() bool {
+	return true
+}
+
 // quotaPool is a pool which accumulates the quota and sends it to acquire()
 // when it is available.
 type quotaPool struct {
@@ -120,6 +142,13 @@ func (qb *quotaPool) cancel() {
 	}
 }
 
+// updateSendQuota applies the change of the initial window size announced
+// by the peer from oldSize to newSize to the send quota of s.
+func updateSendQuota(s *Stream, oldSize, newSize uint32) {
+	s.sendQuotaPool.cancel()
+	s.sendQuotaPool.add(int(newSize) - int(oldSize))
+}
+
 // acquire returns the channel on which available quota amounts are sent.
 func (qb *quotaPool) acquire() <-chan int {
 	return qb.c
@@ -0,0 +1,363 @@
+/*
+ *
+ * Copyright 2015, Google Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *     * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// This file is the implementation of a gRPC server using the HTTP/2 server of
+// net/http instead of the transport's own HTTP/2 server. It serves a single
+// request per ServerTransport.
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// NewServerHandlerTransport returns a ServerTransport serving the single gRPC
+// request r from inside an http.Handler. The http.Server serving r must
+// support HTTP/2 and trailers. If r is not a gRPC request, it replies to r
+// with an HTTP error and returns a non-nil error.
+func NewServerHandlerTransport(w http.ResponseWriter, r *http.Request) (ServerTransport, error) {
+	if r.ProtoMajor != 2 {
+		return nil, handlerError(w, http.StatusHTTPVersionNotSupported, "gRPC requires HTTP/2")
+	}
+	if r.Method != "POST" {
+		return nil, handlerError(w, http.StatusMethodNotAllowed, fmt.Sprintf("invalid gRPC request method %q", r.Method))
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct != baseContentType && !strings.HasPrefix(ct, baseContentType+"+") && !strings.HasPrefix(ct, baseContentType+";") {
+		return nil, handlerError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("invalid gRPC request content-type %q", ct))
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return nil, handlerError(w, http.StatusInternalServerError, "gRPC requires a ResponseWriter supporting http.Flusher")
+	}
+	ht := &serverHandlerTransport{
+		rw:             w,
+		req:            r,
+		contentSubtype: parseContentSubtype(ct),
+		closedCh:       make(chan struct{}),
+		writes:         make(chan func()),
+	}
+	if v := r.Header.Get("grpc-timeout"); v != "" {
+		d, err := timeoutDecode(v)
+		if err != nil {
+			return nil, handlerError(w, http.StatusBadRequest, fmt.Sprintf("malformed time-out: %v", err))
+		}
+		ht.timeoutSet = true
+		ht.timeout = d
+	}
+	for k, vv := range r.Header {
+		k = strings.ToLower(k)
+		// content-length is set by the HTTP clients of net/http and does
+		// not apply to the response.
+		if isReservedHeader(k) || k == "content-length" || len(vv) == 0 {
+			continue
+		}
+		// MD holds a single value per key, which is the last one as in
+		// the HTTP2 transport.
+		k, v, err := metadata.DecodeKeyValue(k, vv[len(vv)-1])
+		if err != nil {
+			log.Printf("Failed to decode (%q, %q): %v", k, vv[len(vv)-1], err)
+			continue
+		}
+		if ht.headerMD == nil {
+			ht.headerMD = make(metadata.MD)
+		}
+		ht.headerMD[k] = v
+	}
+	return ht, nil
+}
+
+// handlerError replies to the request being served by w with an HTTP error
+// and returns the corresponding error.
+func handlerError(w http.ResponseWriter, code int, msg string) error {
+	http.Error(w, msg, code)
+	return errors.New("transport: " + msg)
+}
+
+// serverHandlerTransport is the ServerTransport of a single request served
+// by an http.Handler. The ResponseWriter is only accessed by the goroutine
+// running HandleStreams, i.e., the ServeHTTP goroutine, to which the writes
+// of the other goroutines are handed over.
+type serverHandlerTransport struct {
+	rw             http.ResponseWriter
+	req            *http.Request
+	contentSubtype string
+	timeoutSet     bool
+	timeout        time.Duration
+	// headerMD is the metadata received in the request headers.
+	headerMD metadata.MD
+
+	closeOnce sync.Once
+	closedCh  chan struct{} // closed on Close
+
+	// writes carries the functions to run in the ServeHTTP goroutine.
+	writes chan func()
+	// headerSent is only accessed in the ServeHTTP goroutine.
+	headerSent bool
+
+	mu sync.Mutex
+	// streamDone is set once WriteStatus is called.
+	streamDone bool
+}
+
+func (ht *serverHandlerTransport) Close() error {
+	ht.closeOnce.Do(func() {
+		close(ht.closedCh)
+	})
+	return nil
+}
+
+// Drain does nothing since the connection is owned by the http.Server. The
+// RPC in progress proceeds.
+func (ht *serverHandlerTransport) Drain() {}
+
+// BufferedBytes returns zero since the buffers are owned by the http.Server.
+func (ht *serverHandlerTransport) BufferedBytes() int { return 0 }
+
+// strAddr is a net.Addr backed by the address string of an http.Request.
+type strAddr string
+
+func (a strAddr) Network() string {
+	return "tcp"
+}
+
+func (a strAddr) String() string {
+	return string(a)
+}
+
+func (ht *serverHandlerTransport) RemoteAddr() net.Addr {
+	return strAddr(ht.req.RemoteAddr)
+}
+
+// do hands fn over to the ServeHTTP goroutine. It fails with ErrConnClosing
+// once the transport is closed.
+func (ht *serverHandlerTransport) do(fn func()) error {
+	select {
+	case <-ht.closedCh:
+		return ErrConnClosing
+	default:
+	}
+	select {
+	case ht.writes <- fn:
+		return nil
+	case <-ht.closedCh:
+		return ErrConnClosing
+	}
+}
+
+// writeCommonHeaders writes the response headers with md unless they have
+// been written. It must be run in the ServeHTTP goroutine.
+func (ht *serverHandlerTransport) writeCommonHeaders(s *Stream, md metadata.MD) {
+	if ht.headerSent {
+		return
+	}
+	ht.headerSent = true
+	h := ht.rw.Header()
+	h.Set("Content-Type", contentType(s.contentSubtype))
+	if s.sendCompress != "" {
+		h.Set("Grpc-Encoding", s.sendCompress)
+	}
+	for k, v := range md {
+		h.Set(metadata.EncodeKeyValue(k, v))
+	}
+	ht.rw.WriteHeader(http.StatusOK)
+}
+
+func (ht *serverHandlerTransport) WriteHeader(s *Stream, md metadata.MD) error {
+	if err := validateMetadata(md); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.headerOk || s.state == streamDone {
+		s.mu.Unlock()
+		return ErrIllegalHeaderWrite
+	}
+	s.headerOk = true
+	s.mu.Unlock()
+	return ht.do(func() {
+		ht.writeCommonHeaders(s, md)
+		ht.rw.(http.Flusher).Flush()
+	})
+}
+
+func (ht *serverHandlerTransport) Write(s *Stream, data []byte, opts *Options) error {
+	s.mu.Lock()
+	s.headerOk = true
+	s.mu.Unlock()
+	// The write happens in the ServeHTTP goroutine, after the caller may have
+	// reused data.
+	data = append([]byte(nil), data...)
+	return ht.do(func() {
+		ht.writeCommonHeaders(s, nil)
+		n, _ := ht.rw.Write(data)
+		atomic.AddInt64(&s.bytesSent, int64(n))
+		ht.rw.(http.Flusher).Flush()
+	})
+}
+
+func (ht *serverHandlerTransport) WriteStatus(s *Stream, statusCode codes.Code, statusDesc string) error {
+	ht.mu.Lock()
+	if ht.streamDone {
+		ht.mu.Unlock()
+		return nil
+	}
+	ht.streamDone = true
+	ht.mu.Unlock()
+	s.mu.Lock()
+	s.state = streamDone
+	details := s.statusDetails
+	s.mu.Unlock()
+	err := ht.do(func() {
+		ht.writeCommonHeaders(s, nil)
+		// The trailers are announced by the prefix since their keys are
+		// not known when the headers are written.
+		h := ht.rw.Header()
+		h.Set(http.TrailerPrefix+"grpc-status", strconv.Itoa(int(statusCode)))
+		h.Set(http.TrailerPrefix+"grpc-message", statusDesc)
+		if len(details) > 0 {
+			k, v := metadata.EncodeKeyValue("grpc-status-details-bin", string(details))
+			h.Set(http.TrailerPrefix+k, v)
+		}
+		for k, v := range s.trailer {
+			k, v = metadata.EncodeKeyValue(k, v)
+			h.Set(http.TrailerPrefix+k, v)
+		}
+	})
+	// The stream is over; let HandleStreams return once the status is
+	// written.
+	ht.Close()
+	return err
+}
+
+func (ht *serverHandlerTransport) HandleStreams(handle func(*Stream)) {
+	// With this transport there is exactly one stream: the HTTP request.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if ht.timeoutSet {
+		ctx, cancel = context.WithTimeout(context.Background(), ht.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	// requestOver is closed once HandleStreams is about to return.
+	requestOver := make(chan struct{})
+	defer close(requestOver)
+	// clientGone receives a value if the connection to the client breaks or
+	// the client resets the stream.
+	var clientGone <-chan bool
+	if cn, ok := ht.rw.(http.CloseNotifier); ok {
+		clientGone = cn.CloseNotify()
+	}
+	go func() {
+		select {
+		case <-requestOver:
+			return
+		case <-ht.closedCh:
+		case <-clientGone:
+		}
+		cancel()
+	}()
+	req := ht.req
+	s := &Stream{
+		st:             ht,
+		method:         req.URL.Path,
+		recvCompress:   req.Header.Get("grpc-encoding"),
+		acceptCompress: req.Header.Get("grpc-accept-encoding"),
+		userAgent:      req.UserAgent(),
+		contentSubtype: ht.contentSubtype,
+		buf:            newRecvBuffer(),
+		windowHandler:  func(int) {}, // net/http does the flow control.
+		cancel:         cancel,
+	}
+	pr := &peer.Peer{Addr: ht.RemoteAddr()}
+	if req.TLS != nil {
+		pr.AuthInfo = credentials.TLSInfo{State: *req.TLS}
+	}
+	ctx = peer.NewContext(ctx, pr)
+	if len(ht.headerMD) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, ht.headerMD)
+	}
+	s.ctx = newContextWithStream(ctx, s)
+	s.dec = &recvBufferReader{
+		ctx:  s.ctx,
+		recv: s.buf,
+	}
+	// readerDone is closed when the goroutine reading the request body
+	// exits.
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			buf := make([]byte, http2MaxFrameLen)
+			n, err := req.Body.Read(buf)
+			if n > 0 {
+				s.write(recvMsg{data: buf[:n]})
+			}
+			if err != nil {
+				if err != io.EOF {
+					err = StreamErrorf(codes.Internal, "transport: %v", err)
+				}
+				s.write(recvMsg{err: err})
+				return
+			}
+		}
+	}()
+	go handle(s)
+	// Run the writes of the handler until the stream is over or the
+	// transport is closed.
+	for {
+		select {
+		case fn := <-ht.writes:
+			fn()
+		case <-ht.closedCh:
+			req.Body.Close()
+			<-readerDone
+			return
+		}
+	}
+}
@@ -36,11 +36,15 @@ package transport
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/http2"
@@ -48,9 +52,15 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
+// defaultConnectTimeout bounds the establishment of a transport when
+// DialOptions.ConnectTimeout is not set.
+const defaultConnectTimeout = 20 * time.Second
+
 // http2Client implements the ClientTransport interface with HTTP2.
 type http2Client struct {
 	target string   // server name/addr
@@ -69,7 +79,7 @@ type http2Client struct {
 	// errorChan is closed to notify the I/O error to the caller.
 	errorChan chan struct{}
 
-	framer *http2.Framer
+	framer *framer
 	hBuf   *bytes.Buffer  // the buffer for HPACK encoding
 	hEnc   *hpack.Encoder // HPACK encoder
 
@@ -81,40 +91,88 @@ type http2Client struct {
 
 	// The scheme used: https if TLS is on, http otherwise.
 	scheme string
+	// authInfo is the auth information of conn; nil if it is not secured.
+	authInfo credentials.AuthInfo
+
+	kp keepalive.ClientParameters
+	// newTimer creates the timers of the keepalive pings.
+	newTimer func(d time.Duration) (<-chan time.Time, func() bool)
+	// headerHook is applied to the header fields of the new streams if it
+	// is not nil.
+	headerHook HeaderHook
+	// userAgent is sent as the user-agent of the streams.
+	userAgent string
+	// maxHeaderListSize is the limit of the size of the received header
+	// lists. Zero means no limit.
+	maxHeaderListSize uint32
+	// activity is set to 1 by the reader whenever a frame is received. The
+	// keepalive goroutine resets it to 0 when it checks the connection.
+	activity uint32
 
-	authCreds []credentials.Credentials
+	// goAway is closed when GOAWAY is received from the server.
+	goAway chan struct{}
+	// goAwayErr describes the latest GOAWAY received from the server. It is
+	// guarded by mu.
+	goAwayErr ConnectionError
 
 	mu            sync.Mutex     // guard the following variables
 	state         transportState // the state of underlying connection
 	activeStreams map[uint32]*Stream
 	// The max number of concurrent streams
 	maxStreams uint32
+	// streamSendQuota is the initial send window of the new streams. It is
+	// updated by the SETTINGS_INITIAL_WINDOW_SIZE from the server.
+	streamSendQuota uint32
 	// Inbound quota for flow control
 	recvQuota int
+	// recvBuffered is the number of bytes of the active streams received
+	// and not read yet. sendBuffered is the number of bytes being written.
+	recvBuffered int
+	sendBuffered int
+	// maxBuffered is the limit of the buffered bytes. Zero means no limit.
+	maxBuffered int
 }
 
 // newHTTP2Client constructs a connected ClientTransport to addr based on HTTP2
 // and starts to receive messages on it. Non-nil error returns if construction
 // fails.
-func newHTTP2Client(addr string, opts *DialOptions) (_ ClientTransport, err error) {
+func newHTTP2Client(ctx context.Context, addr string, opts *DialOptions) (_ ClientTransport, err error) {
 	var (
 		connErr error
 		conn    net.Conn
 	)
 	scheme := "http"
-	for _, c := range opts.AuthOptions {
-		if ccreds, ok := c.(credentials.TransportAuthenticator); ok {
-			scheme = "https"
-			// TODO(zhaoq): Now the first TransportAuthenticator is used if there are
-			// multiple ones provided. Revisit this if it is not appropriate. Probably
-			// place the ClientTransport construction into a separate function to make
-			// things clear.
-			conn, connErr = ccreds.DialWithDialer(&net.Dialer{Timeout: opts.Timeout}, "tcp", addr)
-			break
+	creds := opts.TransportCredentials
+	if creds != nil {
+		scheme = "https"
+	}
+	connectTimeout := opts.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	// The earliest of connectDeadline, opts.Timeout and the deadline of
+	// ctx applies to the dial and the security handshake.
+	connectDeadline := time.Now().Add(connectTimeout)
+	dctx, cancel := context.WithDeadline(ctx, connectDeadline)
+	defer cancel()
+	if opts.Timeout > 0 {
+		dctx, cancel = context.WithTimeout(dctx, opts.Timeout)
+		defer cancel()
+	}
+	dial := opts.Dialer
+	if dial == nil {
+		dial = dialTCP
+	}
+	conn, connErr = dial(dctx, addr)
+	if connErr == nil {
+		// The socket options apply to the raw connection, before it is
+		// wrapped by the credentials.
+		if connErr = setSocketOptions(conn, opts); connErr != nil {
+			conn.Close()
 		}
 	}
-	if scheme == "http" {
-		conn, connErr = net.DialTimeout("tcp", addr, opts.Timeout)
+	if connErr == nil && creds != nil {
+		conn, connErr = creds.ClientHandshake(dctx, addr, conn)
 	}
 	if connErr != nil {
 		return nil, ConnectionErrorf("transport: %v", connErr)
@@ -124,6 +182,11 @@ func newHTTP2Client(addr string, opts *DialOptions) (_ ClientTransport, err erro
 			conn.Close()
 		}
 	}()
+	// A server which never completes the preface must not hold the
+	// connection. The write deadline is cleared once the preface is sent
+	// and the read deadline once the settings of the server are received
+	// by the reader.
+	conn.SetDeadline(connectDeadline)
 	// Send connection preface to server.
 	n, err := conn.Write(clientPreface)
 	if err != nil {
@@ -132,29 +195,47 @@ func newHTTP2Client(addr string, opts *DialOptions) (_ ClientTransport, err erro
 	if n != len(clientPreface) {
 		return nil, ConnectionErrorf("transport: preface mismatch, wrote %d bytes; want %d", n, len(clientPreface))
 	}
-	framer := http2.NewFramer(conn, conn)
-	if err := framer.WriteSettings(); err != nil {
+	framer := newFramer(conn, opts.WriteBufferSize, opts.ReadBufferSize, opts.FrameHook)
+	settings, connIncr := initialSettings(opts.InitialWindowSize, opts.InitialConnWindowSize, opts.MaxHeaderListSize)
+	if err := framer.WriteSettings(settings...); err != nil {
+		return nil, ConnectionErrorf("transport: %v", err)
+	}
+	if connIncr > 0 {
+		if err := framer.WriteWindowUpdate(0, connIncr); err != nil {
+			return nil, ConnectionErrorf("transport: %v", err)
+		}
+	}
+	if err := framer.flush(); err != nil {
 		return nil, ConnectionErrorf("transport: %v", err)
 	}
+	conn.SetWriteDeadline(time.Time{})
 	var buf bytes.Buffer
 	t := &http2Client{
-		target: addr,
-		conn:   conn,
+		target:   addr,
+		conn:     conn,
+		authInfo: authInfoFromConn(conn),
 		// The client initiated stream id is odd starting from 1.
-		nextID:        1,
-		writableChan:  make(chan int, 1),
-		shutdownChan:  make(chan struct{}),
-		errorChan:     make(chan struct{}),
-		framer:        framer,
-		hBuf:          &buf,
-		hEnc:          hpack.NewEncoder(&buf),
-		controlBuf:    newRecvBuffer(),
-		sendQuotaPool: newQuotaPool(initialWindowSize),
-		scheme:        scheme,
-		state:         reachable,
-		activeStreams: make(map[uint32]*Stream),
-		maxStreams:    math.MaxUint32,
-		authCreds:     opts.AuthOptions,
+		nextID:            1,
+		writableChan:      make(chan int, 1),
+		shutdownChan:      make(chan struct{}),
+		errorChan:         make(chan struct{}),
+		framer:            framer,
+		hBuf:              &buf,
+		hEnc:              hpack.NewEncoder(&buf),
+		controlBuf:        newRecvBuffer(),
+		sendQuotaPool:     newQuotaPool(initialWindowSize),
+		scheme:            scheme,
+		state:             reachable,
+		goAway:            make(chan struct{}),
+		activeStreams:     make(map[uint32]*Stream),
+		maxStreams:        math.MaxUint32,
+		streamSendQuota:   initialWindowSize,
+		kp:                opts.KeepaliveParams,
+		newTimer:          opts.newTimer,
+		headerHook:        opts.HeaderHook,
+		userAgent:         userAgent(opts.UserAgent),
+		maxHeaderListSize: opts.MaxHeaderListSize,
+		maxBuffered:       opts.MaxBufferedBytes,
 	}
 	go t.controller()
 	t.writableChan <- 0
@@ -163,24 +244,38 @@ func newHTTP2Client(addr string, opts *DialOptions) (_ ClientTransport, err erro
 	// reads HTTP2 frame from network. Then it dispatches the frame to the
 	// corresponding stream entity.
 	go t.reader()
+	if t.kp.Time > 0 {
+		if t.newTimer == nil {
+			t.newTimer = newTimer
+		}
+		go t.keepalive()
+	}
 	return t, nil
 }
 
 func (t *http2Client) newStream(ctx context.Context, callHdr *CallHdr) *Stream {
+	subtype := callHdr.ContentSubtype
+	if callHdr.ContentType != "" {
+		subtype = parseContentSubtype(callHdr.ContentType)
+	}
 	t.mu.Lock()
 	// TODO(zhaoq): Handle uint32 overflow.
 	s := &Stream{
-		id:            t.nextID,
-		method:        callHdr.Method,
-		buf:           newRecvBuffer(),
-		sendQuotaPool: newQuotaPool(initialWindowSize),
-		headerChan:    make(chan struct{}),
+		id:             t.nextID,
+		method:         callHdr.Method,
+		contentSubtype: subtype,
+		buf:            newRecvBuffer(),
+		headerChan:     make(chan struct{}),
 	}
 	s.windowHandler = func(n int) {
 		t.addRecvQuota(s, n)
 	}
 	// Make a stream be able to cancel the pending operations by itself.
 	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = peer.NewContext(s.ctx, &peer.Peer{
+		Addr:     t.conn.RemoteAddr(),
+		AuthInfo: t.authInfo,
+	})
 	s.dec = &recvBufferReader{
 		ctx:  s.ctx,
 		recv: s.buf,
@@ -190,55 +285,119 @@ func (t *http2Client) newStream(ctx context.Context, callHdr *CallHdr) *Stream {
 	return s
 }
 
+// primaryUA is the user-agent of grpc-go.
+const primaryUA = "grpc-go/0.7"
+
+// userAgent returns the user-agent announcing ua, if it is not empty, ahead
+// of primaryUA.
+func userAgent(ua string) string {
+	if ua == "" {
+		return primaryUA
+	}
+	return ua + " " + primaryUA
+}
+
+// headerFields returns the header fields of a new stream in the default
+// order. The metadata is sorted by key so that the order is deterministic.
+func headerFields(callHdr *CallHdr, scheme, userAgent string) []hpack.HeaderField {
+	ct := callHdr.ContentType
+	if ct == "" {
+		ct = contentType(callHdr.ContentSubtype)
+	}
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":path", Value: callHdr.Method},
+		{Name: ":authority", Value: callHdr.Host},
+		{Name: "content-type", Value: ct},
+		{Name: "te", Value: "trailers"},
+		{Name: "user-agent", Value: userAgent},
+	}
+	if callHdr.SendCompress != "" {
+		fields = append(fields, hpack.HeaderField{Name: "grpc-encoding", Value: callHdr.SendCompress})
+	}
+	if callHdr.AcceptCompress != "" {
+		fields = append(fields, hpack.HeaderField{Name: "grpc-accept-encoding", Value: callHdr.AcceptCompress})
+	}
+	if callHdr.Timeout > 0 {
+		fields = append(fields, hpack.HeaderField{Name: "grpc-timeout", Value: timeoutEncode(callHdr.Timeout)})
+	}
+	keys := make([]string, 0, len(callHdr.Metadata))
+	for k := range callHdr.Metadata {
+		if isReservedHeader(k) {
+			// The user metadata must not override the headers of gRPC.
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		k, v := metadata.EncodeKeyValue(k, callHdr.Metadata[k])
+		fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+	}
+	return fields
+}
+
+// checkPseudoHeaders returns an error if a pseudo-header follows a regular
+// header field in fields, which HTTP/2 forbids.
+func checkPseudoHeaders(fields []hpack.HeaderField) error {
+	regular := false
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			regular = true
+			continue
+		}
+		if regular {
+			return StreamErrorf(codes.Internal, "transport: the pseudo-header %q follows a regular header field", f.Name)
+		}
+	}
+	return nil
+}
+
 // NewStream creates a stream and register it into the transport as "active"
 // streams.
 func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Stream, err error) {
+	if err := validateMetadata(callHdr.Metadata); err != nil {
+		return nil, err
+	}
 	if _, err := wait(ctx, t.shutdownChan, t.writableChan); err != nil {
 		return nil, err
 	}
 	defer func() {
-		if _, ok := err.(ConnectionError); !ok {
+		// The other ConnectionErrors leave the transport unusable.
+		if _, ok := err.(ConnectionError); !ok || err == ErrConnDrain {
 			t.writableChan <- 0
 		}
 	}()
-	// Record the timeout value on the context.
-	var timeout time.Duration
-	if dl, ok := ctx.Deadline(); ok {
-		timeout = dl.Sub(time.Now())
-		if timeout <= 0 {
-			return nil, ContextErr(context.DeadlineExceeded)
-		}
+	// Do not start a stream the transport is not going to track.
+	t.mu.Lock()
+	drain := t.state == draining
+	buffered := t.recvBuffered + t.sendBuffered
+	overBuffered := t.overBuffered()
+	t.mu.Unlock()
+	if drain {
+		return nil, ErrConnDrain
 	}
-	// HPACK encodes various headers.
-	t.hBuf.Reset()
-	t.hEnc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
-	t.hEnc.WriteField(hpack.HeaderField{Name: ":scheme", Value: t.scheme})
-	t.hEnc.WriteField(hpack.HeaderField{Name: ":path", Value: callHdr.Method})
-	t.hEnc.WriteField(hpack.HeaderField{Name: ":authority", Value: callHdr.Host})
-	t.hEnc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
-	t.hEnc.WriteField(hpack.HeaderField{Name: "te", Value: "trailers"})
-	for _, c := range t.authCreds {
-		m, err := c.GetRequestMetadata(ctx)
-		select {
-		case <-ctx.Done():
-			return nil, ContextErr(ctx.Err())
-		default:
-		}
-		if err != nil {
-			return nil, StreamErrorf(codes.InvalidArgument, "transport: %v", err)
-		}
-		for k, v := range m {
-			t.hEnc.WriteField(hpack.HeaderField{Name: k, Value: v})
-		}
+	if overBuffered {
+		return nil, StreamErrorf(codes.ResourceExhausted, "transport: failed to create new stream because %d bytes are buffered, beyond the limit %d.", buffered, t.maxBuffered)
 	}
-	if timeout > 0 {
-		t.hEnc.WriteField(hpack.HeaderField{Name: "grpc-timeout", Value: timeoutEncode(timeout)})
+	if dl, ok := ctx.Deadline(); ok && !dl.After(time.Now()) {
+		return nil, ContextErr(context.DeadlineExceeded)
 	}
-	if md, ok := metadata.FromContext(ctx); ok {
-		for k, v := range md {
-			t.hEnc.WriteField(hpack.HeaderField{Name: k, Value: v})
+	fields := headerFields(callHdr, t.scheme, t.userAgent)
+	if t.headerHook != nil {
+		if fields, err = t.headerHook(fields); err != nil {
+			return nil, StreamErrorf(codes.Internal, "transport: the header hook failed: %v", err)
+		}
+		if err := checkPseudoHeaders(fields); err != nil {
+			return nil, err
 		}
 	}
+	// HPACK encodes various headers.
+	t.hBuf.Reset()
+	for _, f := range fields {
+		t.hEnc.WriteField(f)
+	}
 	first := true
 	endHeaders := false
 	// Sends the headers in a single batch even when they span multiple frames.
@@ -263,6 +422,9 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 			// Sends Continuation frames for the leftover headers.
 			err = t.framer.WriteContinuation(t.nextID, endHeaders, t.hBuf.Next(size))
 		}
+		if err == nil && endHeaders {
+			err = t.framer.flush()
+		}
 		if err != nil {
 			t.notifyError(err)
 			return nil, ConnectionErrorf("transport: %v", err)
@@ -270,6 +432,10 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 	}
 	s := t.newStream(ctx, callHdr)
 	t.mu.Lock()
+	if t.state == draining {
+		t.mu.Unlock()
+		return nil, ErrConnDrain
+	}
 	if t.state != reachable {
 		t.mu.Unlock()
 		return nil, ErrConnClosing
@@ -278,6 +444,7 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 		t.mu.Unlock()
 		return nil, StreamErrorf(codes.Unavailable, "transport: failed to create new stream because the limit has been reached.")
 	}
+	s.sendQuotaPool = newQuotaPool(int(t.streamSendQuota))
 	t.activeStreams[s.id] = s
 	t.mu.Unlock()
 	return s, nil
@@ -288,10 +455,18 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 func (t *http2Client) CloseStream(s *Stream, err error) {
 	t.mu.Lock()
 	delete(t.activeStreams, s.id)
+	t.releaseUnread(s)
+	drained := t.state == draining && len(t.activeStreams) == 0
 	t.mu.Unlock()
+	if drained {
+		t.Close()
+	}
 	s.mu.Lock()
 	if s.state == streamDone {
 		s.mu.Unlock()
+		// The stream was ended by the server. Its context is done all
+		// the same once it is closed.
+		s.cancel()
 		return
 	}
 	if !s.headerDone {
@@ -326,6 +501,11 @@ func (t *http2Client) Close() (err error) {
 	t.mu.Lock()
 	streams := t.activeStreams
 	t.activeStreams = nil
+	// The streams cut by a GOAWAY with an error are told why.
+	closeErr := ErrConnClosing
+	if !t.goAwayErr.Temporary() {
+		closeErr = t.goAwayErr
+	}
 	t.mu.Unlock()
 	// Notify all active streams.
 	for _, s := range streams {
@@ -335,16 +515,44 @@ func (t *http2Client) Close() (err error) {
 			s.headerDone = true
 		}
 		s.mu.Unlock()
-		s.write(recvMsg{err: ErrConnClosing})
+		s.write(recvMsg{err: closeErr})
 	}
 	return
 }
 
+// GracefulClose drains the transport like a GOAWAY received from the server
+// does, and closes it right away if it is broken.
+func (t *http2Client) GracefulClose() <-chan struct{} {
+	t.mu.Lock()
+	if t.state == closing {
+		t.mu.Unlock()
+		return t.shutdownChan
+	}
+	// The streams of a broken transport cannot finish.
+	drained := t.state == unreachable || len(t.activeStreams) == 0
+	if t.state == reachable {
+		t.state = draining
+	}
+	t.mu.Unlock()
+	if drained {
+		t.Close()
+	}
+	return t.shutdownChan
+}
+
 // Write formats the data into HTTP2 data frame(s) and sends it out. The caller
 // should proceed only if Write returns nil.
 // TODO(zhaoq): opts.Delay is ignored in this implementation. Support it later
 // if it improves the performance.
 func (t *http2Client) Write(s *Stream, data []byte, opts *Options) error {
+	t.mu.Lock()
+	t.sendBuffered += len(data)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.sendBuffered -= len(data)
+		t.mu.Unlock()
+	}()
 	r := bytes.NewBuffer(data)
 	for {
 		var p []byte
@@ -393,7 +601,11 @@ func (t *http2Client) Write(s *Stream, data []byte, opts *Options) error {
 		// If WriteData fails, all the pending streams will be handled
 		// by http2Client.Close(). No explicit CloseStream() needs to be
 		// invoked.
-		if err := t.framer.WriteData(s.id, endStream, p); err != nil {
+		err := t.framer.WriteData(s.id, endStream, p)
+		if err == nil {
+			err = t.framer.flush()
+		}
+		if err != nil {
 			t.notifyError(err)
 			return ConnectionErrorf("transport: %v", err)
 		}
@@ -435,10 +647,12 @@ func (t *http2Client) getStream(f http2.Frame) (*Stream, bool) {
 // the cumulative quota exceeds windowUpdateThreshold.
 func (t *http2Client) addRecvQuota(s *Stream, n int) {
 	t.mu.Lock()
-	t.recvQuota += n
-	if t.recvQuota >= windowUpdateThreshold {
-		t.controlBuf.put(&windowUpdate{0, uint32(t.recvQuota)})
-		t.recvQuota = 0
+	// Otherwise, the quota was given back by CloseStream.
+	if t.activeStreams[s.id] == s {
+		s.unread -= n
+		t.recvBuffered -= n
+		t.recvQuota += n
+		t.updateWindow()
 	}
 	t.mu.Unlock()
 
@@ -460,9 +674,41 @@ func (t *http2Client) handleData(f *http2.DataFrame) {
 	// Can this copy be eliminated?
 	data := make([]byte, len(f.Data()))
 	copy(data, f.Data())
+	t.mu.Lock()
+	if t.activeStreams[s.id] == s {
+		s.unread += len(data)
+		t.recvBuffered += len(data)
+	}
+	t.mu.Unlock()
 	s.write(recvMsg{data: data})
 }
 
+// updateWindow sends the window update of the connection once the inbound
+// quota reaches windowUpdateThreshold, unless the bytes received and not read
+// yet reach the limit. t.mu must be held.
+func (t *http2Client) updateWindow() {
+	if t.recvQuota < windowUpdateThreshold || t.maxBuffered > 0 && t.recvBuffered >= t.maxBuffered {
+		return
+	}
+	t.controlBuf.put(&windowUpdate{0, uint32(t.recvQuota)})
+	t.recvQuota = 0
+}
+
+// releaseUnread gives back the inbound quota of the bytes received on s and
+// not read, once s is no longer active. t.mu must be held.
+func (t *http2Client) releaseUnread(s *Stream) {
+	t.recvBuffered -= s.unread
+	t.recvQuota += s.unread
+	s.unread = 0
+	t.updateWindow()
+}
+
+// overBuffered reports whether the buffered bytes reach the limit. t.mu must
+// be held.
+func (t *http2Client) overBuffered() bool {
+	return t.maxBuffered > 0 && t.recvBuffered+t.sendBuffered >= t.maxBuffered
+}
+
 func (t *http2Client) handleRSTStream(f *http2.RSTStreamFrame) {
 	s, ok := t.getStream(f)
 	if !ok {
@@ -474,12 +720,23 @@ func (t *http2Client) handleRSTStream(f *http2.RSTStreamFrame) {
 		return
 	}
 	s.state = streamDone
+	if !s.headerDone {
+		// No header will arrive; unblock Header.
+		close(s.headerChan)
+		s.headerDone = true
+	}
 	s.statusCode, ok = http2RSTErrConvTab[http2.ErrCode(f.ErrCode)]
 	if !ok {
 		log.Println("transport: http2Client.handleRSTStream found no mapped gRPC status for the received http2 error ", f.ErrCode)
+		// A reset never ends the stream with an OK status.
+		s.statusCode = codes.Internal
 	}
+	s.statusDesc = fmt.Sprintf("stream terminated by RST_STREAM with error code: %v", f.ErrCode)
+	err := StreamErrorf(s.statusCode, "%s", s.statusDesc)
 	s.mu.Unlock()
-	s.write(recvMsg{err: io.EOF})
+	// Unlike the io.EOF after the trailer, the error tells the readers that
+	// the stream was reset, even in the middle of a message.
+	s.write(recvMsg{err: err})
 }
 
 func (t *http2Client) handleSettings(f *http2.SettingsFrame) {
@@ -488,14 +745,65 @@ func (t *http2Client) handleSettings(f *http2.SettingsFrame) {
 		t.maxStreams = v
 		t.mu.Unlock()
 	}
+	if v, ok := f.Value(http2.SettingInitialWindowSize); ok {
+		t.mu.Lock()
+		for _, s := range t.activeStreams {
+			updateSendQuota(s, t.streamSendQuota, v)
+		}
+		t.streamSendQuota = v
+		t.mu.Unlock()
+	}
 }
 
 func (t *http2Client) handlePing(f *http2.PingFrame) {
-	// TODO(zhaoq): PingFrame handler to be implemented"
+	if f.Header().Flags.Has(http2.FlagPingAck) {
+		// The ack of a keepalive ping. Receiving it is recorded as activity
+		// by the reader.
+		return
+	}
+	t.controlBuf.put(&ping{ack: true, data: f.Data})
 }
 
 func (t *http2Client) handleGoAway(f *http2.GoAwayFrame) {
-	// TODO(zhaoq): GoAwayFrame handler to be implemented"
+	err := ConnectionError{
+		Desc:        fmt.Sprintf("transport: the server sent GOAWAY with error code %v and debug data %q", f.ErrCode, f.DebugData()),
+		GoAway:      true,
+		GoAwayCode:  f.ErrCode,
+		GoAwayDebug: string(f.DebugData()),
+	}
+	t.mu.Lock()
+	if t.state == closing || t.state == unreachable {
+		t.mu.Unlock()
+		return
+	}
+	if t.state == reachable {
+		t.state = draining
+		close(t.goAway)
+	}
+	t.goAwayErr = err
+	// The streams above LastStreamID were not processed by the server. A
+	// later GOAWAY may lower it.
+	var refused []*Stream
+	for id, s := range t.activeStreams {
+		if id > f.LastStreamID {
+			refused = append(refused, s)
+			delete(t.activeStreams, id)
+		}
+	}
+	drained := len(t.activeStreams) == 0
+	t.mu.Unlock()
+	for _, s := range refused {
+		s.mu.Lock()
+		if !s.headerDone {
+			close(s.headerChan)
+			s.headerDone = true
+		}
+		s.mu.Unlock()
+		s.write(recvMsg{err: err})
+	}
+	if drained {
+		t.Close()
+	}
 }
 
 func (t *http2Client) handleWindowUpdate(f *http2.WindowUpdateFrame) {
@@ -521,6 +829,27 @@ func (t *http2Client) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 	}()
 	endHeaders, err := hDec.decodeClientHTTP2Headers(s, frame)
 	if err != nil {
+		if hDec.broken {
+			// The following header blocks cannot be decoded.
+			s.write(recvMsg{err: err})
+			t.notifyError(err)
+			return nil
+		}
+		s.mu.Lock()
+		if s.state != streamDone {
+			s.state = streamDone
+			if !s.headerDone {
+				// The header is rejected; unblock Header.
+				close(s.headerChan)
+				s.headerDone = true
+			}
+			if se, ok := err.(StreamError); ok {
+				s.statusCode = se.Code
+				s.statusDesc = se.Desc
+				t.controlBuf.put(&resetStream{s.id, statusCodeConvTab[se.Code]})
+			}
+		}
+		s.mu.Unlock()
 		s.write(recvMsg{err: err})
 		// Something wrong. Stops reading even when there is remaining.
 		return nil
@@ -530,27 +859,37 @@ func (t *http2Client) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 	}
 
 	s.mu.Lock()
+	// The status is set before headerChan is closed so that it can be read
+	// as soon as Header returns for a trailers-only response.
+	eos := endStream && s.state != streamDone
+	if eos {
+		if len(hDec.state.mdata) > 0 {
+			s.trailer = hDec.state.mdata
+		}
+		s.state = streamDone
+		s.statusCode = hDec.state.statusCode
+		s.statusDesc = hDec.state.statusDesc
+		s.statusDetails = hDec.state.statusDetails
+	}
 	if !s.headerDone {
-		if !endStream && len(hDec.state.mdata) > 0 {
-			s.header = hDec.state.mdata
+		if endStream {
+			s.trailersOnly = true
+		} else {
+			if len(hDec.state.mdata) > 0 {
+				s.header = hDec.state.mdata
+			}
+			s.headerWireLength = hDec.state.wireLength
 		}
+		s.recvCompress = hDec.state.encoding
+		s.recvContentSubtype = hDec.state.contentSubtype
 		close(s.headerChan)
 		s.headerDone = true
 	}
-	if !endStream || s.state == streamDone {
-		s.mu.Unlock()
-		return nil
-	}
-
-	if len(hDec.state.mdata) > 0 {
-		s.trailer = hDec.state.mdata
-	}
-	s.state = streamDone
-	s.statusCode = hDec.state.statusCode
-	s.statusDesc = hDec.state.statusDesc
 	s.mu.Unlock()
 
-	s.write(recvMsg{err: io.EOF})
+	if eos {
+		s.write(recvMsg{err: io.EOF})
+	}
 	return nil
 }
 
@@ -572,9 +911,10 @@ func (t *http2Client) reader() {
 		t.notifyError(err)
 		return
 	}
+	t.conn.SetReadDeadline(time.Time{})
 	t.handleSettings(sf)
 
-	hDec := newHPACKDecoder()
+	hDec := newHPACKDecoder(t.maxHeaderListSize)
 	var curStream *Stream
 	// loop to keep reading incoming messages on this transport.
 	for {
@@ -583,6 +923,7 @@ func (t *http2Client) reader() {
 			t.notifyError(err)
 			return
 		}
+		atomic.StoreUint32(&t.activity, 1)
 		switch frame := frame.(type) {
 		case *http2.HeadersFrame:
 			var ok bool
@@ -611,6 +952,10 @@ func (t *http2Client) reader() {
 		default:
 			log.Printf("transport: http2Client.reader got unhandled frame type %v.", frame)
 		}
+		if hDec.broken {
+			// The transport is broken; see operateHeaders.
+			return
+		}
 	}
 }
 
@@ -630,9 +975,12 @@ func (t *http2Client) controller() {
 					t.framer.WriteSettings(http2.Setting{i.id, i.val})
 				case *resetStream:
 					t.framer.WriteRSTStream(i.streamID, i.code)
+				case *ping:
+					t.framer.WritePing(i.ack, i.data)
 				default:
 					log.Printf("transport: http2Client.controller got unexpected item type %v\n", i)
 				}
+				t.framer.flush()
 				t.writableChan <- 0
 				continue
 			case <-t.shutdownChan:
@@ -644,17 +992,91 @@ func (t *http2Client) controller() {
 	}
 }
 
+// keepalive running in a separate goroutine pings the server after the
+// transport has been idle for kp.Time, and closes the transport if there is
+// still no activity kp.Timeout after the ping.
+func (t *http2Client) keepalive() {
+	for {
+		if !t.sleep(t.kp.Time) {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&t.activity, 1, 0) {
+			continue
+		}
+		t.mu.Lock()
+		idle := len(t.activeStreams) == 0
+		t.mu.Unlock()
+		if idle && !t.kp.PermitWithoutStream {
+			continue
+		}
+		t.controlBuf.put(&ping{})
+		if !t.sleep(t.kp.Timeout) {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&t.activity, 1, 0) {
+			continue
+		}
+		// The active streams fail with ErrConnClosing so that the
+		// retriable RPCs can be retried on a new transport.
+		t.notifyError(ConnectionErrorf("transport: keepalive ping not acked within %v", t.kp.Timeout))
+		t.Close()
+		return
+	}
+}
+
+// sleep waits for d on a timer of t.newTimer. It returns false if the
+// transport is closed meanwhile.
+func (t *http2Client) sleep(d time.Duration) bool {
+	c, stop := t.newTimer(d)
+	select {
+	case <-c:
+		return true
+	case <-t.shutdownChan:
+		stop()
+		return false
+	}
+}
+
 func (t *http2Client) Error() <-chan struct{} {
 	return t.errorChan
 }
 
-func (t *http2Client) notifyError(err error) {
+func (t *http2Client) GoAway() <-chan struct{} {
+	return t.goAway
+}
+
+func (t *http2Client) Closed() <-chan struct{} {
+	return t.shutdownChan
+}
+
+func (t *http2Client) Saturated() bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	return uint32(len(t.activeStreams)) >= t.maxStreams || t.overBuffered()
+}
+
+func (t *http2Client) BufferedBytes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recvBuffered + t.sendBuffered
+}
+
+func (t *http2Client) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *http2Client) notifyError(err error) {
+	t.mu.Lock()
 	// make sure t.errorChan is closed only once.
 	if t.state == reachable {
 		t.state = unreachable
 		close(t.errorChan)
 		log.Printf("transport: http2Client.notifyError got notified that the client transport was broken %v.", err)
 	}
+	// Nobody else closes a draining transport.
+	drained := t.state == draining
+	t.mu.Unlock()
+	if drained {
+		t.Close()
+	}
 }
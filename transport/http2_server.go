@@ -42,21 +42,32 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bradfitz/http2"
 	"github.com/bradfitz/http2/hpack"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 // ErrIllegalHeaderWrite indicates that setting header is illegal because of
 // the stream's state.
 var ErrIllegalHeaderWrite = errors.New("transport: the stream is done or WriteHeader was already called")
 
+// maxPingStrikes is the number of pings violating the keepalive policy which
+// are tolerated in a row.
+const maxPingStrikes = 2
+
 // http2Server implements the ServerTransport interface with HTTP2.
 type http2Server struct {
-	conn        net.Conn
+	conn net.Conn
+	// authInfo is the auth information of conn; nil if it is not secured.
+	authInfo    credentials.AuthInfo
 	maxStreamID uint32 // max stream ID ever seen
 	// writableChan synchronizes write access to the transport.
 	// A writer acquires the write lock by sending a value on writableChan
@@ -66,54 +77,93 @@ type http2Server struct {
 	// Blocking operations should select on shutdownChan to avoid
 	// blocking forever after Close.
 	shutdownChan chan struct{}
-	framer       *http2.Framer
+	framer       *framer
 	hBuf         *bytes.Buffer  // the buffer for HPACK encoding
 	hEnc         *hpack.Encoder // HPACK encoder
 
 	// The max number of concurrent streams.
 	maxStreams uint32
+	// maxHeaderListSize is the limit of the size of the received header
+	// lists. Zero means no limit.
+	maxHeaderListSize uint32
 	// controlBuf delivers all the control related tasks (e.g., window
 	// updates, reset streams, and various settings) to the controller.
 	controlBuf *recvBuffer
 	// sendQuotaPool provides flow control to outbound message.
 	sendQuotaPool *quotaPool
+	// kep is the keepalive policy enforced on the pings of the client; nil
+	// if there is none.
+	kep *keepalive.EnforcementPolicy
+	// lastPingAt and pingStrikes are only accessed by the reader goroutine.
+	// pingStrikes is the number of pings violating kep in a row.
+	lastPingAt  time.Time
+	pingStrikes int
+	// resetPingStrikes is set atomically to 1 when data or headers are
+	// written, which forgives the pings received before.
+	resetPingStrikes uint32
 
 	mu            sync.Mutex // guard the following
 	state         transportState
 	activeStreams map[uint32]*Stream
+	// streamSendQuota is the initial send window of the new streams. It is
+	// updated by the SETTINGS_INITIAL_WINDOW_SIZE from the client.
+	streamSendQuota uint32
+	// goAwaySent is true once GOAWAY is written while draining.
+	goAwaySent bool
 	// Inbound quota for flow control
 	recvQuota int
+	// recvBuffered is the number of bytes of the active streams received
+	// and not read yet. sendBuffered is the number of bytes being written.
+	recvBuffered int
+	sendBuffered int
+	// maxBuffered is the limit of the buffered bytes. Zero means no limit.
+	maxBuffered int
 }
 
 // newHTTP2Server constructs a ServerTransport based on HTTP2. ConnectionError is
 // returned if something goes wrong.
-func newHTTP2Server(conn net.Conn, maxStreams uint32) (_ ServerTransport, err error) {
-	framer := http2.NewFramer(conn, conn)
+func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err error) {
+	framer := newFramer(conn, config.WriteBufferSize, config.ReadBufferSize, config.FrameHook)
 	// Send initial settings as connection preface to client.
+	settings, connIncr := initialSettings(config.InitialWindowSize, config.InitialConnWindowSize, config.MaxHeaderListSize)
 	// TODO(zhaoq): Have a better way to signal "no limit" because 0 is
 	// permitted in the HTTP2 spec.
+	maxStreams := config.MaxStreams
 	if maxStreams == 0 {
-		err = framer.WriteSettings()
 		maxStreams = math.MaxUint32
 	} else {
-		err = framer.WriteSettings(http2.Setting{http2.SettingMaxConcurrentStreams, maxStreams})
+		settings = append(settings, http2.Setting{http2.SettingMaxConcurrentStreams, maxStreams})
 	}
-	if err != nil {
+	if err = framer.WriteSettings(settings...); err != nil {
+		return
+	}
+	if connIncr > 0 {
+		if err = framer.WriteWindowUpdate(0, connIncr); err != nil {
+			return
+		}
+	}
+	if err = framer.flush(); err != nil {
 		return
 	}
 	var buf bytes.Buffer
 	t := &http2Server{
-		conn:          conn,
-		framer:        framer,
-		hBuf:          &buf,
-		hEnc:          hpack.NewEncoder(&buf),
-		maxStreams:    maxStreams,
-		controlBuf:    newRecvBuffer(),
-		sendQuotaPool: newQuotaPool(initialWindowSize),
-		state:         reachable,
-		writableChan:  make(chan int, 1),
-		shutdownChan:  make(chan struct{}),
-		activeStreams: make(map[uint32]*Stream),
+		conn: conn,
+		// The handshake of conn is done by the writes above.
+		authInfo:          authInfoFromConn(conn),
+		framer:            framer,
+		hBuf:              &buf,
+		hEnc:              hpack.NewEncoder(&buf),
+		maxStreams:        maxStreams,
+		maxHeaderListSize: config.MaxHeaderListSize,
+		maxBuffered:       config.MaxBufferedBytes,
+		kep:               config.KeepalivePolicy,
+		controlBuf:        newRecvBuffer(),
+		sendQuotaPool:     newQuotaPool(initialWindowSize),
+		state:             reachable,
+		writableChan:      make(chan int, 1),
+		shutdownChan:      make(chan struct{}),
+		activeStreams:     make(map[uint32]*Stream),
+		streamSendQuota:   initialWindowSize,
 	}
 	go t.controller()
 	t.writableChan <- 0
@@ -132,6 +182,11 @@ func (t *http2Server) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 	endHeaders, err := hDec.decodeServerHTTP2Headers(s, frame)
 	if err != nil {
 		log.Printf("transport: http2Server.operateHeader found %v", err)
+		if hDec.broken {
+			// The following header blocks cannot be decoded.
+			t.Close()
+			return nil
+		}
 		if se, ok := err.(StreamError); ok {
 			t.controlBuf.put(&resetStream{s.id, statusCodeConvTab[se.Code]})
 		}
@@ -145,15 +200,21 @@ func (t *http2Server) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 		return s
 	}
 	t.mu.Lock()
+	if t.state == draining {
+		t.mu.Unlock()
+		t.controlBuf.put(&resetStream{s.id, http2.ErrCodeRefusedStream})
+		return nil
+	}
 	if t.state != reachable {
 		t.mu.Unlock()
 		return nil
 	}
-	if uint32(len(t.activeStreams)) >= t.maxStreams {
+	if uint32(len(t.activeStreams)) >= t.maxStreams || t.overBuffered() {
 		t.mu.Unlock()
 		t.controlBuf.put(&resetStream{s.id, http2.ErrCodeRefusedStream})
 		return nil
 	}
+	s.sendQuotaPool = newQuotaPool(int(t.streamSendQuota))
 	t.activeStreams[s.id] = s
 	t.mu.Unlock()
 	s.windowHandler = func(n int) {
@@ -168,9 +229,14 @@ func (t *http2Server) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 	// can find out. Required when the server wants to send some metadata
 	// back to the client (unary call only).
 	s.ctx = newContextWithStream(s.ctx, s)
+	// Attach the information of the client to the context.
+	s.ctx = peer.NewContext(s.ctx, &peer.Peer{
+		Addr:     t.conn.RemoteAddr(),
+		AuthInfo: t.authInfo,
+	})
 	// Attach the received metadata to the context.
 	if len(hDec.state.mdata) > 0 {
-		s.ctx = metadata.NewContext(s.ctx, hDec.state.mdata)
+		s.ctx = metadata.NewIncomingContext(s.ctx, hDec.state.mdata)
 	}
 
 	s.dec = &recvBufferReader{
@@ -178,6 +244,10 @@ func (t *http2Server) operateHeaders(hDec *hpackDecoder, s *Stream, frame header
 		recv: s.buf,
 	}
 	s.method = hDec.state.method
+	s.recvCompress = hDec.state.encoding
+	s.acceptCompress = hDec.state.acceptEncoding
+	s.userAgent = hDec.state.userAgent
+	s.contentSubtype = hDec.state.contentSubtype
 
 	wg.Add(1)
 	go func() {
@@ -216,7 +286,7 @@ func (t *http2Server) HandleStreams(handle func(*Stream)) {
 	}
 	t.handleSettings(sf)
 
-	hDec := newHPACKDecoder()
+	hDec := newHPACKDecoder(t.maxHeaderListSize)
 	var curStream *Stream
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -238,10 +308,9 @@ func (t *http2Server) HandleStreams(handle func(*Stream)) {
 			t.maxStreamID = id
 			buf := newRecvBuffer()
 			curStream = &Stream{
-				id:            frame.Header().StreamID,
-				st:            t,
-				buf:           buf,
-				sendQuotaPool: newQuotaPool(initialWindowSize),
+				id:  frame.Header().StreamID,
+				st:  t,
+				buf: buf,
 			}
 			endStream := frame.Header().Flags.Has(http2.FlagHeadersEndStream)
 			curStream = t.operateHeaders(hDec, curStream, frame, endStream, handle, &wg)
@@ -286,10 +355,12 @@ func (t *http2Server) getStream(f http2.Frame) (*Stream, bool) {
 // the cumulative quota exceeds windowUpdateThreshold.
 func (t *http2Server) addRecvQuota(s *Stream, n int) {
 	t.mu.Lock()
-	t.recvQuota += n
-	if t.recvQuota >= windowUpdateThreshold {
-		t.controlBuf.put(&windowUpdate{0, uint32(t.recvQuota)})
-		t.recvQuota = 0
+	// Otherwise, the quota was given back by closeStream.
+	if t.activeStreams[s.id] == s {
+		s.unread -= n
+		t.recvBuffered -= n
+		t.recvQuota += n
+		t.updateWindow()
 	}
 	t.mu.Unlock()
 
@@ -311,6 +382,12 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 	// Can this copy be eliminated?
 	data := make([]byte, len(f.Data()))
 	copy(data, f.Data())
+	t.mu.Lock()
+	if t.activeStreams[s.id] == s {
+		s.unread += len(data)
+		t.recvBuffered += len(data)
+	}
+	t.mu.Unlock()
 	s.write(recvMsg{data: data})
 	if f.Header().Flags.Has(http2.FlagDataEndStream) {
 		// Received the end of stream from the client.
@@ -327,25 +404,82 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 	}
 }
 
+// updateWindow sends the window update of the connection once the inbound
+// quota reaches windowUpdateThreshold, unless the bytes received and not read
+// yet reach the limit. t.mu must be held.
+func (t *http2Server) updateWindow() {
+	if t.recvQuota < windowUpdateThreshold || t.maxBuffered > 0 && t.recvBuffered >= t.maxBuffered {
+		return
+	}
+	t.controlBuf.put(&windowUpdate{0, uint32(t.recvQuota)})
+	t.recvQuota = 0
+}
+
+// releaseUnread gives back the inbound quota of the bytes received on s and
+// not read, once s is no longer active. t.mu must be held.
+func (t *http2Server) releaseUnread(s *Stream) {
+	t.recvBuffered -= s.unread
+	t.recvQuota += s.unread
+	s.unread = 0
+	t.updateWindow()
+}
+
+// overBuffered reports whether the buffered bytes reach the limit. t.mu must
+// be held.
+func (t *http2Server) overBuffered() bool {
+	return t.maxBuffered > 0 && t.recvBuffered+t.sendBuffered >= t.maxBuffered
+}
+
 func (t *http2Server) handleRSTStream(f *http2.RSTStreamFrame) {
 	s, ok := t.getStream(f)
 	if !ok {
 		return
 	}
-	s.mu.Lock()
-	// Sets the stream state to avoid sending RSTStreamFrame to client
-	// unnecessarily.
-	s.state = streamDone
-	s.mu.Unlock()
+	// closeStream marks the stream done, which avoids sending RSTStreamFrame
+	// to client unnecessarily, and cancels its context so that the handler
+	// observes the cancellation.
 	t.closeStream(s)
 }
 
 func (t *http2Server) handleSettings(f *http2.SettingsFrame) {
-	// TODO(zhaoq): Handle the useful settings from client.
+	if v, ok := f.Value(http2.SettingInitialWindowSize); ok {
+		t.mu.Lock()
+		for _, s := range t.activeStreams {
+			updateSendQuota(s, t.streamSendQuota, v)
+		}
+		t.streamSendQuota = v
+		t.mu.Unlock()
+	}
 }
 
 func (t *http2Server) handlePing(f *http2.PingFrame) {
-	// TODO(zhaoq): PingFrame handler to be implemented
+	if f.Header().Flags.Has(http2.FlagPingAck) {
+		return
+	}
+	t.controlBuf.put(&ping{ack: true, data: f.Data})
+	if t.kep == nil {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&t.resetPingStrikes, 1, 0) {
+		t.pingStrikes = 0
+		t.lastPingAt = time.Time{}
+	}
+	now := time.Now()
+	t.mu.Lock()
+	idle := len(t.activeStreams) == 0
+	t.mu.Unlock()
+	if idle && !t.kep.PermitWithoutStream || now.Sub(t.lastPingAt) < t.kep.MinTime {
+		t.pingStrikes++
+	}
+	t.lastPingAt = now
+	if t.pingStrikes == maxPingStrikes+1 {
+		log.Printf("transport: http2Server.handlePing got too many pings from %v", t.conn.RemoteAddr())
+		t.controlBuf.put(&goAway{
+			lastStreamID: t.maxStreamID,
+			code:         http2.ErrCodeEnhanceYourCalm,
+			debugData:    []byte("too_many_pings"),
+		})
+	}
 }
 
 func (t *http2Server) handleWindowUpdate(f *http2.WindowUpdateFrame) {
@@ -384,16 +518,23 @@ func (t *http2Server) writeHeaders(s *Stream, b *bytes.Buffer, endStream bool) e
 		} else {
 			err = t.framer.WriteContinuation(s.id, endHeaders, b.Next(size))
 		}
+		if err == nil && endHeaders {
+			err = t.framer.flush()
+		}
 		if err != nil {
 			t.Close()
 			return ConnectionErrorf("transport: %v", err)
 		}
 	}
+	atomic.StoreUint32(&t.resetPingStrikes, 1)
 	return nil
 }
 
 // WriteHeader sends the header metedata md back to the client.
 func (t *http2Server) WriteHeader(s *Stream, md metadata.MD) error {
+	if err := validateMetadata(md); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	if s.headerOk || s.state == streamDone {
 		s.mu.Unlock()
@@ -406,8 +547,12 @@ func (t *http2Server) WriteHeader(s *Stream, md metadata.MD) error {
 	}
 	t.hBuf.Reset()
 	t.hEnc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
-	t.hEnc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+	t.hEnc.WriteField(hpack.HeaderField{Name: "content-type", Value: contentType(s.contentSubtype)})
+	if s.sendCompress != "" {
+		t.hEnc.WriteField(hpack.HeaderField{Name: "grpc-encoding", Value: s.sendCompress})
+	}
 	for k, v := range md {
+		k, v = metadata.EncodeKeyValue(k, v)
 		t.hEnc.WriteField(hpack.HeaderField{Name: k, Value: v})
 	}
 	if err := t.writeHeaders(s, t.hBuf, false); err != nil {
@@ -427,6 +572,7 @@ func (t *http2Server) WriteStatus(s *Stream, statusCode codes.Code, statusDesc s
 		s.mu.RUnlock()
 		return nil
 	}
+	details := s.statusDetails
 	s.mu.RUnlock()
 	if _, err := wait(s.ctx, t.shutdownChan, t.writableChan); err != nil {
 		return err
@@ -439,8 +585,13 @@ func (t *http2Server) WriteStatus(s *Stream, statusCode codes.Code, statusDesc s
 			Value: strconv.Itoa(int(statusCode)),
 		})
 	t.hEnc.WriteField(hpack.HeaderField{Name: "grpc-message", Value: statusDesc})
+	if len(details) > 0 {
+		k, v := metadata.EncodeKeyValue("grpc-status-details-bin", string(details))
+		t.hEnc.WriteField(hpack.HeaderField{Name: k, Value: v})
+	}
 	// Attach the trailer metadata.
 	for k, v := range s.trailer {
+		k, v = metadata.EncodeKeyValue(k, v)
 		t.hEnc.WriteField(hpack.HeaderField{Name: k, Value: v})
 	}
 	if err := t.writeHeaders(s, t.hBuf, true); err != nil {
@@ -454,6 +605,14 @@ func (t *http2Server) WriteStatus(s *Stream, statusCode codes.Code, statusDesc s
 // Write converts the data into HTTP2 data frame and sends it out. Non-nil error
 // is returns if it fails (e.g., framing error, transport error).
 func (t *http2Server) Write(s *Stream, data []byte, opts *Options) error {
+	t.mu.Lock()
+	t.sendBuffered += len(data)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.sendBuffered -= len(data)
+		t.mu.Unlock()
+	}()
 	// TODO(zhaoq): Support multi-writers for a single stream.
 	var writeHeaderFrame bool
 	s.mu.Lock()
@@ -468,13 +627,20 @@ func (t *http2Server) Write(s *Stream, data []byte, opts *Options) error {
 		}
 		t.hBuf.Reset()
 		t.hEnc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
-		t.hEnc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+		t.hEnc.WriteField(hpack.HeaderField{Name: "content-type", Value: contentType(s.contentSubtype)})
+		if s.sendCompress != "" {
+			t.hEnc.WriteField(hpack.HeaderField{Name: "grpc-encoding", Value: s.sendCompress})
+		}
 		p := http2.HeadersFrameParam{
 			StreamID:      s.id,
 			BlockFragment: t.hBuf.Bytes(),
 			EndHeaders:    true,
 		}
-		if err := t.framer.WriteHeaders(p); err != nil {
+		err := t.framer.WriteHeaders(p)
+		if err == nil {
+			err = t.framer.flush()
+		}
+		if err != nil {
 			t.Close()
 			return ConnectionErrorf("transport: %v", err)
 		}
@@ -483,6 +649,7 @@ func (t *http2Server) Write(s *Stream, data []byte, opts *Options) error {
 	r := bytes.NewBuffer(data)
 	for {
 		if r.Len() == 0 {
+			atomic.AddInt64(&s.bytesSent, int64(len(data)))
 			return nil
 		}
 		size := http2MaxFrameLen
@@ -522,10 +689,15 @@ func (t *http2Server) Write(s *Stream, data []byte, opts *Options) error {
 		if _, err := wait(s.ctx, t.shutdownChan, t.writableChan); err != nil {
 			return err
 		}
-		if err := t.framer.WriteData(s.id, false, p); err != nil {
+		err = t.framer.WriteData(s.id, false, p)
+		if err == nil {
+			err = t.framer.flush()
+		}
+		if err != nil {
 			t.Close()
 			return ConnectionErrorf("transport: %v", err)
 		}
+		atomic.StoreUint32(&t.resetPingStrikes, 1)
 		t.writableChan <- 0
 	}
 
@@ -547,10 +719,28 @@ func (t *http2Server) controller() {
 					t.framer.WriteSettings(http2.Setting{i.id, i.val})
 				case *resetStream:
 					t.framer.WriteRSTStream(i.streamID, i.code)
+				case *ping:
+					t.framer.WritePing(i.ack, i.data)
+				case *goAway:
+					t.framer.WriteGoAway(i.lastStreamID, i.code, i.debugData)
 				default:
 					log.Printf("transport: http2Server.controller got unexpected item type %v\n", i)
 				}
+				t.framer.flush()
 				t.writableChan <- 0
+				if g, ok := i.(*goAway); ok && g.code != http2.ErrCodeNo {
+					t.Close()
+					return
+				}
+				if _, ok := i.(*goAway); ok {
+					t.mu.Lock()
+					t.goAwaySent = true
+					drained := len(t.activeStreams) == 0
+					t.mu.Unlock()
+					if drained {
+						t.Close()
+					}
+				}
 				continue
 			case <-t.shutdownChan:
 				return
@@ -561,6 +751,21 @@ func (t *http2Server) controller() {
 	}
 }
 
+// Drain sends GOAWAY to the client and refuses the new streams. The transport
+// is closed once the active streams are done.
+func (t *http2Server) Drain() {
+	t.mu.Lock()
+	if t.state != reachable {
+		t.mu.Unlock()
+		return
+	}
+	t.state = draining
+	t.mu.Unlock()
+	// The client may have started the streams with higher ids. They are
+	// refused individually.
+	t.controlBuf.put(&goAway{lastStreamID: math.MaxInt32, code: http2.ErrCodeNo})
+}
+
 // Close starts shutting down the http2Server transport.
 // TODO(zhaoq): Now the destruction is not blocked on any pending streams. This
 // could cause some resource issue. Revisit this later.
@@ -588,9 +793,15 @@ func (t *http2Server) Close() (err error) {
 func (t *http2Server) closeStream(s *Stream) {
 	t.mu.Lock()
 	delete(t.activeStreams, s.id)
+	t.releaseUnread(s)
+	drained := t.goAwaySent && len(t.activeStreams) == 0
 	t.mu.Unlock()
+	if drained {
+		t.Close()
+	}
 	s.mu.Lock()
 	if s.state == streamDone {
+		s.mu.Unlock()
 		return
 	}
 	s.state = streamDone
@@ -601,3 +812,13 @@ func (t *http2Server) closeStream(s *Stream) {
 	// other goroutines.
 	s.cancel()
 }
+
+func (t *http2Server) BufferedBytes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recvBuffered + t.sendBuffered
+}
+
+func (t *http2Server) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
@@ -34,14 +34,21 @@
 package transport
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bradfitz/http2"
 	"github.com/bradfitz/http2/hpack"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -86,10 +93,27 @@ type decodeState struct {
 	// the server sent. Client side only.
 	statusCode codes.Code
 	statusDesc string
+	// statusDetails caches the serialized status details received from the
+	// grpc-status-details-bin trailer.
+	statusDetails []byte
+	// encoding is the compression algorithm (grpc-encoding) of the
+	// messages sent by the peer.
+	encoding string
+	// acceptEncoding is the list of the compression algorithms accepted by
+	// the client (grpc-accept-encoding). Server side only.
+	acceptEncoding string
+	// contentSubtype is parsed from the content-type of the peer.
+	contentSubtype string
+	// wireLength is the size of the HPACK encoded header block.
+	wireLength int
+	// listSize is the size of the decoded header list, as defined for
+	// SETTINGS_MAX_HEADER_LIST_SIZE.
+	listSize uint32
 	// Server side only fields.
 	timeoutSet bool
 	timeout    time.Duration
 	method     string
+	userAgent  string
 	// key-value metadata map from the peer.
 	mdata map[string]string
 }
@@ -99,6 +123,18 @@ type hpackDecoder struct {
 	h     *hpack.Decoder
 	state decodeState
 	err   error // The err when decoding
+	// maxListSize is the limit of the size of the header lists. Zero means
+	// no limit.
+	maxListSize uint32
+	// broken is set once a header block is not entirely fed to h, whose
+	// state is then out of sync with the peer: the connection must be
+	// closed.
+	broken bool
+}
+
+// errHeaderListSize returns the error of a header list exceeding max.
+func errHeaderListSize(max uint32) error {
+	return StreamErrorf(codes.Internal, "transport: the header list size exceeds the limit %d", max)
 }
 
 // A headerFrame is either a http2.HeaderFrame or http2.ContinuationFrame.
@@ -119,8 +155,10 @@ func isReservedHeader(hdr string) bool {
 	case "content-type",
 		"grpc-message-type",
 		"grpc-encoding",
+		"grpc-accept-encoding",
 		"grpc-message",
 		"grpc-status",
+		"grpc-status-details-bin",
 		"grpc-timeout",
 		"te",
 		"user-agent":
@@ -130,9 +168,90 @@ func isReservedHeader(hdr string) bool {
 	}
 }
 
-func newHPACKDecoder() *hpackDecoder {
-	d := &hpackDecoder{}
+// initialSettings returns the settings to announce in the connection
+// preface and the increment of the connection window to send right after,
+// given the configured receive windows of the streams and the connection and
+// the limit of the size of the header lists, zero meaning none.
+func initialSettings(streamWindow, connWindow int32, maxHeaderListSize uint32) ([]http2.Setting, uint32) {
+	var ss []http2.Setting
+	if streamWindow > initialWindowSize {
+		ss = append(ss, http2.Setting{ID: http2.SettingInitialWindowSize, Val: uint32(streamWindow)})
+	}
+	if maxHeaderListSize > 0 {
+		ss = append(ss, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: maxHeaderListSize})
+	}
+	var connIncr uint32
+	if connWindow > initialWindowSize {
+		connIncr = uint32(connWindow - initialWindowSize)
+	}
+	return ss, connIncr
+}
+
+const baseContentType = "application/grpc"
+
+// contentType returns the content-type announcing subtype.
+func contentType(subtype string) string {
+	if subtype == "" {
+		return baseContentType
+	}
+	return baseContentType + "+" + subtype
+}
+
+// parseContentSubtype returns the content-subtype of the content-type ct,
+// e.g., "json" for "application/grpc+json; charset=utf-8". It is empty if ct
+// has no subtype or is not a gRPC content-type.
+func parseContentSubtype(ct string) string {
+	if !strings.HasPrefix(ct, baseContentType+"+") {
+		return ""
+	}
+	ct = ct[len(baseContentType)+1:]
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ct))
+}
+
+// authInfoFromConn returns the auth information of conn once its handshake is
+// done. It is nil unless conn is secured by TLS.
+func authInfoFromConn(conn net.Conn) credentials.AuthInfo {
+	if c, ok := conn.(*tls.Conn); ok {
+		return credentials.TLSInfo{State: c.ConnectionState()}
+	}
+	return nil
+}
+
+// validateMetadata checks that md can be sent by the transport: the values of
+// the keys without the "-bin" suffix must be printable ASCII.
+func validateMetadata(md metadata.MD) error {
+	for k, v := range md {
+		if strings.HasSuffix(k, "-bin") {
+			continue
+		}
+		for i := 0; i < len(v); i++ {
+			if v[i] < 0x20 || v[i] > 0x7E {
+				return StreamErrorf(codes.Internal, "transport: the value of metadata %q is not printable ASCII; use a key with the -bin suffix for binary values", k)
+			}
+		}
+	}
+	return nil
+}
+
+// newHPACKDecoder returns a decoder of the header blocks rejecting the header
+// lists larger than maxListSize, unless it is zero.
+func newHPACKDecoder(maxListSize uint32) *hpackDecoder {
+	d := &hpackDecoder{maxListSize: maxListSize}
 	d.h = hpack.NewDecoder(http2InitHeaderTableSize, func(f hpack.HeaderField) {
+		if d.maxListSize > 0 {
+			// Each field costs its length plus an overhead of 32 bytes.
+			d.state.listSize += uint32(len(f.Name) + len(f.Value) + 32)
+			if d.state.listSize > d.maxListSize {
+				d.err = errHeaderListSize(d.maxListSize)
+			}
+		}
+		if d.err != nil {
+			// The header list is rejected; skip the remaining fields.
+			return
+		}
 		switch f.Name {
 		case "grpc-status":
 			code, err := strconv.Atoi(f.Value)
@@ -143,6 +262,19 @@ func newHPACKDecoder() *hpackDecoder {
 			d.state.statusCode = codes.Code(code)
 		case "grpc-message":
 			d.state.statusDesc = f.Value
+		case "grpc-status-details-bin":
+			_, v, err := metadata.DecodeKeyValue(f.Name, f.Value)
+			if err != nil {
+				d.err = StreamErrorf(codes.Internal, "transport: malformed grpc-status-details-bin: %v", err)
+				return
+			}
+			d.state.statusDetails = []byte(v)
+		case "grpc-encoding":
+			d.state.encoding = f.Value
+		case "grpc-accept-encoding":
+			d.state.acceptEncoding = f.Value
+		case "content-type":
+			d.state.contentSubtype = parseContentSubtype(f.Value)
 		case "grpc-timeout":
 			d.state.timeoutSet = true
 			var err error
@@ -153,6 +285,8 @@ func newHPACKDecoder() *hpackDecoder {
 			}
 		case ":path":
 			d.state.method = f.Value
+		case "user-agent":
+			d.state.userAgent = f.Value
 		default:
 			if !isReservedHeader(f.Name) {
 				if d.state.mdata == nil {
@@ -170,21 +304,36 @@ func newHPACKDecoder() *hpackDecoder {
 	return d
 }
 
-func (d *hpackDecoder) decodeClientHTTP2Headers(s *Stream, frame headerFrame) (endHeaders bool, err error) {
-	d.err = nil
-	_, err = d.h.Write(frame.HeaderBlockFragment())
-	if err != nil {
-		err = StreamErrorf(codes.Internal, "transport: HPACK header decode error: %v", err)
+// write feeds the fragment of the header block of frame to the HPACK decoder
+// and reports whether the header block is ended. A header list exceeding the
+// limit is decoded nonetheless so that h keeps in sync with the peer.
+func (d *hpackDecoder) write(frame headerFrame) (endHeaders bool, err error) {
+	d.state.wireLength += len(frame.HeaderBlockFragment())
+	if _, err := d.h.Write(frame.HeaderBlockFragment()); err != nil {
+		d.broken = true
+		return false, StreamErrorf(codes.Internal, "transport: HPACK header decode error: %v", err)
 	}
-
-	if frame.HeadersEnded() {
-		if closeErr := d.h.Close(); closeErr != nil && err == nil {
-			err = StreamErrorf(codes.Internal, "transport: HPACK decoder close error: %v", closeErr)
+	endHeaders = frame.HeadersEnded()
+	if endHeaders {
+		if err := d.h.Close(); err != nil {
+			d.broken = true
+			return true, StreamErrorf(codes.Internal, "transport: HPACK decoder close error: %v", err)
 		}
-		endHeaders = true
 	}
+	if d.maxListSize > 0 && d.state.listSize > d.maxListSize {
+		if !endHeaders {
+			// The rest of the header block is dropped along with the
+			// stream.
+			d.broken = true
+		}
+		return endHeaders, errHeaderListSize(d.maxListSize)
+	}
+	return endHeaders, nil
+}
 
-	if err == nil && d.err != nil {
+func (d *hpackDecoder) decodeClientHTTP2Headers(s *Stream, frame headerFrame) (endHeaders bool, err error) {
+	d.err = nil
+	if endHeaders, err = d.write(frame); err == nil && d.err != nil {
 		err = d.err
 	}
 	return
@@ -192,19 +341,7 @@ func (d *hpackDecoder) decodeClientHTTP2Headers(s *Stream, frame headerFrame) (e
 
 func (d *hpackDecoder) decodeServerHTTP2Headers(s *Stream, frame headerFrame) (endHeaders bool, err error) {
 	d.err = nil
-	_, err = d.h.Write(frame.HeaderBlockFragment())
-	if err != nil {
-		err = StreamErrorf(codes.Internal, "transport: HPACK header decode error: %v", err)
-	}
-
-	if frame.HeadersEnded() {
-		if closeErr := d.h.Close(); closeErr != nil && err == nil {
-			err = StreamErrorf(codes.Internal, "transport: HPACK decoder close error: %v", closeErr)
-		}
-		endHeaders = true
-	}
-
-	if err == nil && d.err != nil {
+	if endHeaders, err = d.write(frame); err == nil && d.err != nil {
 		err = d.err
 	}
 	return
@@ -288,3 +425,101 @@ func timeoutDecode(s string) (time.Duration, error) {
 	}
 	return d * time.Duration(t), nil
 }
+
+// dialTCP connects to addr over TCP. The deadline of ctx applies and ctx being
+// done aborts the dial.
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	deadline, _ := ctx.Deadline()
+	dialer := &net.Dialer{
+		Deadline: deadline,
+		Cancel:   ctx.Done(),
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// tcpConn is implemented by *net.TCPConn and the connections wrapping it
+// which expose its socket options.
+type tcpConn interface {
+	SetNoDelay(noDelay bool) error
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setSocketOptions applies the socket options of opts to conn if it is a TCP
+// connection.
+func setSocketOptions(conn net.Conn, opts *DialOptions) error {
+	c, ok := conn.(tcpConn)
+	if !ok {
+		return nil
+	}
+	if err := c.SetNoDelay(!opts.TCPDelay); err != nil {
+		return err
+	}
+	switch {
+	case opts.TCPKeepAlive > 0:
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return c.SetKeepAlivePeriod(opts.TCPKeepAlive)
+	case opts.TCPKeepAlive < 0:
+		return c.SetKeepAlive(false)
+	}
+	return nil
+}
+
+// framer is an http2.Framer whose reads and writes may be buffered. The
+// buffered writes are sent by flush, which the transports call before they
+// release the write lock so that no frame is left behind.
+type framer struct {
+	*http2.Framer
+	// w is nil if the writes are not buffered.
+	w *bufio.Writer
+}
+
+// newFramer returns a framer on conn with the given buffer sizes. A size
+// which is not positive leaves that direction unbuffered. The frames are
+// passed through hook before being written, unless it is nil.
+func newFramer(conn net.Conn, writeBufferSize, readBufferSize int, hook FrameHook) *framer {
+	f := &framer{}
+	var r io.Reader = conn
+	if readBufferSize > 0 {
+		r = bufio.NewReaderSize(conn, readBufferSize)
+	}
+	var w io.Writer = conn
+	if writeBufferSize > 0 {
+		f.w = bufio.NewWriterSize(conn, writeBufferSize)
+		w = f.w
+	}
+	if hook != nil {
+		w = hookWriter{w, hook}
+	}
+	f.Framer = http2.NewFramer(w, r)
+	return f
+}
+
+// hookWriter applies hook to the writes of an http2.Framer, each of which is
+// an entire frame.
+type hookWriter struct {
+	w    io.Writer
+	hook FrameHook
+}
+
+func (w hookWriter) Write(frame []byte) (int, error) {
+	b, err := w.hook(frame)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return 0, err
+	}
+	// The Framer fails unless all of frame is reported written.
+	return len(frame), nil
+}
+
+// flush writes the buffered frames to the connection.
+func (f *framer) flush() error {
+	if f.w == nil {
+		return nil
+	}
+	return f.w.Flush()
+}
@@ -34,9 +34,17 @@
 package transport
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+	"google.golang.org/grpc/codes"
 )
 
 func TestTimeoutEncode(t *testing.T) {
@@ -85,3 +93,112 @@ func TestTimeoutDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestParseContentSubtype(t *testing.T) {
+	for _, test := range []struct {
+		ct   string
+		want string
+	}{
+		{"application/grpc", ""},
+		{"application/grpc+proto", "proto"},
+		{"application/grpc+JSON", "json"},
+		{"application/grpc+json; charset=utf-8", "json"},
+		{"application/grpcx", ""},
+		{"text/plain", ""},
+	} {
+		if got := parseContentSubtype(test.ct); got != test.want {
+			t.Fatalf("parseContentSubtype(%q) = %q, want %q", test.ct, got, test.want)
+		}
+	}
+}
+
+// fakeHeaderFrame is a header frame carrying the fragment block of a header
+// block, which ends with it if ended is set.
+type fakeHeaderFrame struct {
+	block []byte
+	ended bool
+}
+
+func (f fakeHeaderFrame) Header() http2.FrameHeader   { return http2.FrameHeader{} }
+func (f fakeHeaderFrame) HeaderBlockFragment() []byte { return f.block }
+func (f fakeHeaderFrame) HeadersEnded() bool          { return f.ended }
+
+func TestHeaderListSize(t *testing.T) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	value := strings.Repeat("a", 100)
+	enc.WriteField(hpack.HeaderField{Name: "key1", Value: value})
+	// The size of the list is that of the field plus 32.
+	listSize := uint32(len("key1") + len(value) + 32)
+	for _, test := range []struct {
+		max        uint32
+		ended      bool
+		wantErr    bool
+		wantBroken bool
+	}{
+		{0, true, false, false},
+		{listSize, true, false, false},
+		// The list exceeds the limit but the decoder can go on with the
+		// next header block.
+		{listSize - 1, true, true, false},
+		// The list exceeds the limit before the end of the header block.
+		{listSize - 1, false, true, true},
+	} {
+		d := newHPACKDecoder(test.max)
+		_, err := d.decodeServerHTTP2Headers(nil, fakeHeaderFrame{buf.Bytes(), test.ended})
+		if test.wantErr {
+			if se, ok := err.(StreamError); !ok || se.Code != codes.Internal {
+				t.Fatalf("decodeServerHTTP2Headers(_) with limit %d = _, %v, want _, a StreamError with code %d", test.max, err, codes.Internal)
+			}
+		} else if err != nil || d.state.mdata["key1"] != value {
+			t.Fatalf("decodeServerHTTP2Headers(_) with limit %d = _, %v and got the metadata %v, want _, <nil> and key1", test.max, err, d.state.mdata)
+		}
+		if d.broken != test.wantBroken {
+			t.Fatalf("decodeServerHTTP2Headers(_) with limit %d broke the decoder: %t, want %t", test.max, d.broken, test.wantBroken)
+		}
+	}
+}
+
+type fakeTCPConn struct {
+	net.Conn
+	calls []string
+}
+
+func (c *fakeTCPConn) SetNoDelay(noDelay bool) error {
+	c.calls = append(c.calls, fmt.Sprintf("SetNoDelay(%t)", noDelay))
+	return nil
+}
+
+func (c *fakeTCPConn) SetKeepAlive(keepalive bool) error {
+	c.calls = append(c.calls, fmt.Sprintf("SetKeepAlive(%t)", keepalive))
+	return nil
+}
+
+func (c *fakeTCPConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.calls = append(c.calls, fmt.Sprintf("SetKeepAlivePeriod(%v)", d))
+	return nil
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	for _, test := range []struct {
+		opts  DialOptions
+		calls []string
+	}{
+		{DialOptions{}, []string{"SetNoDelay(true)"}},
+		{DialOptions{TCPDelay: true}, []string{"SetNoDelay(false)"}},
+		{DialOptions{TCPKeepAlive: time.Minute}, []string{"SetNoDelay(true)", "SetKeepAlive(true)", "SetKeepAlivePeriod(1m0s)"}},
+		{DialOptions{TCPKeepAlive: -1}, []string{"SetNoDelay(true)", "SetKeepAlive(false)"}},
+	} {
+		c := &fakeTCPConn{}
+		if err := setSocketOptions(c, &test.opts); err != nil || !reflect.DeepEqual(c.calls, test.calls) {
+			t.Fatalf("setSocketOptions(_, %+v) = %v and made the calls %v, want <nil> and %v", test.opts, err, c.calls, test.calls)
+		}
+	}
+	// The options are ignored by the connections other than TCP.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := setSocketOptions(client, &DialOptions{TCPKeepAlive: time.Minute}); err != nil {
+		t.Fatalf("setSocketOptions(_, _) on a pipe = %v, want <nil>", err)
+	}
+}
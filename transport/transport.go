@@ -44,11 +44,15 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -162,6 +166,12 @@ const (
 
 // Stream represents an RPC in the transport layer.
 type Stream struct {
+	// bytesReceived and bytesSent count the message bytes (including the
+	// gRPC message headers) read from and written to the stream. They are
+	// accessed atomically and kept first for 64-bit alignment.
+	bytesReceived int64
+	bytesSent     int64
+
 	id uint32
 	// nil for client side Stream.
 	st ServerTransport
@@ -172,9 +182,31 @@ type Stream struct {
 	method string
 	buf    *recvBuffer
 	dec    io.Reader
+	// recvCompress is the compression algorithm (grpc-encoding) applied by
+	// the peer on the inbound messages.
+	recvCompress string
+	// acceptCompress is the comma-separated list of the compression
+	// algorithms the client accepts (grpc-accept-encoding). Server side
+	// only.
+	acceptCompress string
+	// userAgent is the user-agent of the client. Server side only.
+	userAgent string
+	// sendCompress is the compression algorithm announced in the headers
+	// for the outbound messages. Server side only.
+	sendCompress string
+	// contentSubtype is the codec name in the content-type of the stream,
+	// i.e., "application/grpc+<contentSubtype>". Empty means the default
+	// "application/grpc".
+	contentSubtype string
+	// recvContentSubtype is the content-subtype of the headers of the
+	// response. Client side only.
+	recvContentSubtype string
 
 	// Inbound quota for flow control
 	recvQuota int
+	// unread is the number of bytes received and not read yet. It is
+	// guarded by the mu of the transport.
+	unread int
 	// The handler to control the window update procedure for both this
 	// particular stream and the associated transport.
 	windowHandler func(int)
@@ -184,6 +216,11 @@ type Stream struct {
 	headerChan chan struct{}
 	// header caches the received header metadata.
 	header metadata.MD
+	// headerWireLength is the size of the encoded header. Client side only.
+	headerWireLength int
+	// trailersOnly is set if the server ended the stream without sending
+	// headers, i.e., the response only had trailers. Client side only.
+	trailersOnly bool
 	// The key-value map of trailer metadata.
 	trailer metadata.MD
 
@@ -195,8 +232,9 @@ type Stream struct {
 	// multiple times.
 	headerDone bool
 	// the status received from the server.
-	statusCode codes.Code
-	statusDesc string
+	statusCode    codes.Code
+	statusDesc    string
+	statusDetails []byte // on the server side: the status details to send
 }
 
 // Header acquires the key-value pairs of header metadata once it
@@ -211,6 +249,33 @@ func (s *Stream) Header() (metadata.MD, error) {
 	}
 }
 
+// HeaderWireLength returns the size in bytes of the HPACK encoded header
+// received on the stream. It must only be called once Header has returned a
+// nil error. Client side only.
+func (s *Stream) HeaderWireLength() int {
+	return s.headerWireLength
+}
+
+// BytesReceived returns the number of message bytes read from the stream so
+// far. It is safe to call concurrently with the RPC.
+func (s *Stream) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.bytesReceived)
+}
+
+// BytesSent returns the number of message bytes written to the stream so
+// far. It is safe to call concurrently with the RPC.
+func (s *Stream) BytesSent() int64 {
+	return atomic.LoadInt64(&s.bytesSent)
+}
+
+// TrailersOnly reports whether the server ended the stream without sending
+// headers, in which case the status and the trailer metadata are available
+// and no message is received. It must only be called once Header has
+// returned a nil error. Client side only.
+func (s *Stream) TrailersOnly() bool {
+	return s.trailersOnly
+}
+
 // Trailer returns the cached trailer metedata. Note that if it is not called
 // after the entire stream is done, it could return an empty MD. Client
 // side only.
@@ -236,6 +301,44 @@ func (s *Stream) Method() string {
 	return s.method
 }
 
+// RecvCompress returns the compression algorithm applied to the inbound
+// messages. It is empty if no compression was announced by the peer.
+func (s *Stream) RecvCompress() string {
+	return s.recvCompress
+}
+
+// AcceptCompress returns the comma-separated list of the compression
+// algorithms the client accepts for the responses. Server side only.
+func (s *Stream) AcceptCompress() string {
+	return s.acceptCompress
+}
+
+// UserAgent returns the user-agent announced by the client. Server side only.
+func (s *Stream) UserAgent() string {
+	return s.userAgent
+}
+
+// SetSendCompress sets the compression algorithm announced by the headers for
+// the outbound messages. It must be called before the headers are written.
+// Server side only.
+func (s *Stream) SetSendCompress(name string) {
+	s.sendCompress = name
+}
+
+// ContentSubtype returns the content-subtype of the stream, e.g., "json" for
+// the content-type "application/grpc+json". It is empty for the plain
+// "application/grpc".
+func (s *Stream) ContentSubtype() string {
+	return s.contentSubtype
+}
+
+// RecvContentSubtype returns the content-subtype of the headers received from
+// the server. It is empty if the content-type has none or is missing. It must
+// be called after Header returns. Client side only.
+func (s *Stream) RecvContentSubtype() string {
+	return s.recvContentSubtype
+}
+
 // StatusCode returns statusCode received from the server.
 func (s *Stream) StatusCode() codes.Code {
 	return s.statusCode
@@ -246,18 +349,37 @@ func (s *Stream) StatusDesc() string {
 	return s.statusDesc
 }
 
+// StatusDetails returns the serialized status details received from the
+// server, if any.
+func (s *Stream) StatusDetails() []byte {
+	return s.statusDetails
+}
+
+// SetStatusDetails sets the serialized status details sent in the
+// grpc-status-details-bin trailer along with the status of the stream. It
+// must be called before WriteStatus. Server side only.
+func (s *Stream) SetStatusDetails(details []byte) {
+	s.mu.Lock()
+	s.statusDetails = details
+	s.mu.Unlock()
+}
+
 // ErrIllegalTrailerSet indicates that the trailer has already been set or it
 // is too late to do so.
 var ErrIllegalTrailerSet = errors.New("transport: trailer has been set")
 
 // SetTrailer sets the trailer metadata which will be sent with the RPC status
-// by the server. This can only be called at most once. Server side only.
+// by the server. This can only be called at most once. It fails if md cannot
+// be sent by the transport. Server side only.
 func (s *Stream) SetTrailer(md metadata.MD) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.trailer != nil {
 		return ErrIllegalTrailerSet
 	}
+	if err := validateMetadata(md); err != nil {
+		return err
+	}
 	s.trailer = md.Copy()
 	return nil
 }
@@ -268,10 +390,12 @@ func (s *Stream) write(m recvMsg) {
 
 // Read reads all the data available for this Stream from the transport and
 // passes them into the decoder, which converts them into a gRPC message stream.
-// The error is io.EOF when the stream is done or another non-nil error if
-// the stream broke.
+// The error is io.EOF when the stream is done with its status, a StreamError
+// if the stream was reset by the peer, or another non-nil error if the stream
+// broke.
 func (s *Stream) Read(p []byte) (n int, err error) {
 	n, err = s.dec.Read(p)
+	atomic.AddInt64(&s.bytesReceived, int64(n))
 	if err != nil {
 		return
 	}
@@ -303,25 +427,140 @@ const (
 	reachable transportState = iota
 	unreachable
 	closing
+	// draining indicates GOAWAY has been sent or received. The active
+	// streams proceed but no new stream is allowed.
+	draining
 )
 
+// ServerConfig consists of all the configurations to establish a server
+// transport.
+type ServerConfig struct {
+	// MaxStreams is the max number of concurrent streams. Zero means no
+	// limit.
+	MaxStreams uint32
+	// InitialWindowSize is the receive window of each stream announced to
+	// the client. Values smaller than 64KB are ignored.
+	InitialWindowSize int32
+	// InitialConnWindowSize is the receive window of the connection.
+	// Values smaller than 64KB are ignored.
+	InitialConnWindowSize int32
+	// WriteBufferSize and ReadBufferSize are the sizes of the buffers of
+	// the connection. Zero means the frames are written and read without
+	// a buffer.
+	WriteBufferSize int
+	ReadBufferSize  int
+	// MaxHeaderListSize is the limit of the size of the header lists
+	// received from the client, announced in the settings. Zero means no
+	// limit.
+	MaxHeaderListSize uint32
+	// MaxBufferedBytes is the limit of the bytes buffered by the
+	// transport, see ServerTransport.BufferedBytes. Beyond it the new
+	// streams are refused and the window of the connection is not updated
+	// until the streams read their data. Zero means no limit.
+	MaxBufferedBytes int
+	// FrameHook, if it is not nil, is applied to every frame written to
+	// the client.
+	FrameHook FrameHook
+	// KeepalivePolicy, if it is not nil, is enforced on the pings of the
+	// client.
+	KeepalivePolicy *keepalive.EnforcementPolicy
+}
+
 // NewServerTransport creates a ServerTransport with conn or non-nil error
 // if it fails.
-func NewServerTransport(protocol string, conn net.Conn, maxStreams uint32) (ServerTransport, error) {
-	return newHTTP2Server(conn, maxStreams)
+func NewServerTransport(protocol string, conn net.Conn, config *ServerConfig) (ServerTransport, error) {
+	return newHTTP2Server(conn, config)
 }
 
 // DialOptions covers all relevant options for dialing a server.
 type DialOptions struct {
-	Protocol    string
-	AuthOptions []credentials.Credentials
-	Timeout     time.Duration
-}
+	Protocol string
+	// TransportCredentials secures the connection if it is not nil.
+	TransportCredentials credentials.TransportAuthenticator
+	Timeout              time.Duration
+	// KeepaliveParams enables the keepalive pings if its Time is positive.
+	KeepaliveParams keepalive.ClientParameters
+	// InitialWindowSize is the receive window of each stream announced to
+	// the server. Values smaller than 64KB are ignored.
+	InitialWindowSize int32
+	// InitialConnWindowSize is the receive window of the connection.
+	// Values smaller than 64KB are ignored.
+	InitialConnWindowSize int32
+	// ConnectTimeout bounds the establishment of the transport, from the
+	// dial until the settings of the server are received. Zero means a
+	// default of 20 seconds. A shorter Timeout or deadline of the context
+	// still applies to the dial and the security handshake.
+	ConnectTimeout time.Duration
+	// Dialer connects to addr instead of net.Dial if it is not nil. ctx is
+	// done once Timeout or ConnectTimeout expires or the establishment is
+	// aborted.
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+	// WriteBufferSize and ReadBufferSize are the sizes of the buffers of
+	// the connection. Zero means the frames are written and read without
+	// a buffer.
+	WriteBufferSize int
+	ReadBufferSize  int
+	// HeaderHook, if it is not nil, is applied to the header fields of
+	// every new stream.
+	HeaderHook HeaderHook
+	// UserAgent, if it is not empty, is prepended to the user-agent of
+	// grpc-go sent with each stream.
+	UserAgent string
+	// MaxHeaderListSize is the limit of the size of the header lists
+	// received from the server, announced in the settings. Zero means no
+	// limit.
+	MaxHeaderListSize uint32
+	// MaxBufferedBytes is the limit of the bytes buffered by the
+	// transport, see ClientTransport.BufferedBytes. Beyond it NewStream
+	// fails and the window of the connection is not updated until the
+	// streams read their data. Zero means no limit.
+	MaxBufferedBytes int
+	// FrameHook, if it is not nil, is applied to every frame written to
+	// the server.
+	FrameHook FrameHook
+	// TCPDelay enables Nagle's algorithm on the connection. By default,
+	// TCP_NODELAY is set so that the small messages are sent at once.
+	TCPDelay bool
+	// TCPKeepAlive is the period of the TCP keepalive probes of the
+	// connection if it is positive; a negative value disables them. Zero
+	// leaves the default of the net package.
+	TCPKeepAlive time.Duration
+	// newTimer, if it is not nil, creates the timers of the keepalive pings
+	// instead of time.NewTimer, e.g., for the tests to fire them at will.
+	// It returns the channel of the timer and the function stopping it.
+	newTimer func(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// newTimer creates a timer with time.NewTimer for the keepalive pings.
+func newTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// HeaderHook adjusts or validates the header fields of a new stream before
+// they are written, e.g., to satisfy an intermediary which is strict about
+// their order. fields are in the default order: the pseudo-headers, the gRPC
+// headers, then the metadata sorted by key. The returned fields are written
+// instead; the pseudo-headers must still precede the other fields. A non-nil
+// error fails the stream. It runs with the write lock of the transport held,
+// so it must not block.
+type HeaderHook func(fields []hpack.HeaderField) ([]hpack.HeaderField, error)
+
+// FrameHook observes or alters the serialized HTTP2 frames, frame header
+// included, before they are written to the connection. The returned bytes are
+// written instead, e.g., a corrupted or truncated copy of frame, which is only
+// valid during the call and may be modified in place. The writes of the
+// transport wait for it, so blocking delays the frame and the following ones.
+// A non-nil error fails the write like an error of the connection. The client
+// connection preface is not a frame and bypasses the hook. It is meant for
+// testing.
+type FrameHook func(frame []byte) ([]byte, error)
 
 // NewClientTransport establishes the transport with the required DialOptions
-// and returns it to the caller.
-func NewClientTransport(target string, opts *DialOptions) (ClientTransport, error) {
-	return newHTTP2Client(target, opts)
+// and returns it to the caller. Establishing the connection (including the
+// security handshake) is aborted if ctx is done.
+func NewClientTransport(ctx context.Context, target string, opts *DialOptions) (ClientTransport, error) {
+	return newHTTP2Client(ctx, target, opts)
 }
 
 // Options provides additional hints and information for message
@@ -338,6 +577,25 @@ type Options struct {
 type CallHdr struct {
 	Host   string // peer host
 	Method string // the operation to perform on the specified host
+	// SendCompress specifies the compression algorithm applied on the
+	// outbound messages. Empty means no compression.
+	SendCompress string
+	// AcceptCompress is the comma-separated list of the compression
+	// algorithms the server may apply on the inbound messages. Empty means
+	// none is announced.
+	AcceptCompress string
+	// ContentSubtype is sent as the content-type
+	// "application/grpc+<ContentSubtype>". Empty means "application/grpc".
+	ContentSubtype string
+	// ContentType, if it is not empty, is sent as the content-type instead
+	// of the one derived from ContentSubtype.
+	ContentType string
+	// Timeout is the remaining time for the server to complete the RPC. It
+	// is sent as the grpc-timeout header. Zero means no timeout.
+	Timeout time.Duration
+	// Metadata is the user metadata sent as the headers of the RPC. Keys
+	// reserved by gRPC are dropped.
+	Metadata metadata.MD
 }
 
 // ClientTransport is the common interface for all gRPC client side transport
@@ -348,8 +606,15 @@ type ClientTransport interface {
 	// is called only once.
 	Close() error
 
+	// GracefulClose refuses new streams and closes the transport once the
+	// active streams are done. The returned channel is closed once the
+	// transport is closed, either by GracefulClose or by Close, which the
+	// caller may still call to abort the active streams.
+	GracefulClose() <-chan struct{}
+
 	// Write sends the data for the given stream. A nil stream indicates
-	// the write is to be performed on the transport as a whole.
+	// the write is to be performed on the transport as a whole. The caller
+	// may reuse data once Write returns.
 	Write(s *Stream, data []byte, opts *Options) error
 
 	// NewStream creates a Stream for an RPC.
@@ -367,6 +632,30 @@ type ClientTransport interface {
 	// and create a new one) in error case. It should not return nil
 	// once the transport is initiated.
 	Error() <-chan struct{}
+
+	// GoAway returns a channel that is closed when the server sends
+	// GOAWAY. The transport refuses new streams afterwards and closes
+	// itself once the active streams are done, so the caller should create
+	// a new transport for the new streams instead of closing this one.
+	GoAway() <-chan struct{}
+
+	// Closed returns a channel that is closed once the transport is closed,
+	// either by Close or by GracefulClose. Unlike Error, it is closed even
+	// if the transport was never broken.
+	Closed() <-chan struct{}
+
+	// RemoteAddr returns the network address of the server this transport
+	// is connected to.
+	RemoteAddr() net.Addr
+
+	// Saturated reports whether the transport has as many active streams
+	// as the server allows or buffers as many bytes as MaxBufferedBytes, in
+	// which case NewStream fails.
+	Saturated() bool
+
+	// BufferedBytes returns the number of bytes of the active streams
+	// which are received and not read yet or being written.
+	BufferedBytes() int
 }
 
 // ServerTransport is the common interface for all gRPC server side transport
@@ -374,12 +663,22 @@ type ClientTransport interface {
 type ServerTransport interface {
 	// WriteStatus sends the status of a stream to the client.
 	WriteStatus(s *Stream, statusCode codes.Code, statusDesc string) error
-	// Write sends the data for the given stream.
+	// Write sends the data for the given stream. The caller may reuse data
+	// once Write returns.
 	Write(s *Stream, data []byte, opts *Options) error
 	// WriteHeader sends the header metedata for the given stream.
 	WriteHeader(s *Stream, md metadata.MD) error
 	// HandleStreams receives incoming streams using the given handler.
 	HandleStreams(func(*Stream))
+	// Drain sends GOAWAY to the client and refuses the new streams. The
+	// transport is closed once all the active streams are done.
+	Drain()
+	// RemoteAddr returns the network address of the client this transport
+	// is connected to.
+	RemoteAddr() net.Addr
+	// BufferedBytes returns the number of bytes of the active streams
+	// which are received and not read yet or being written.
+	BufferedBytes() int
 	// Close tears down the transport. Once it is called, the transport
 	// should not be accessed any more. All the pending streams and their
 	// handlers will be terminated asynchronously.
@@ -405,6 +704,19 @@ func ConnectionErrorf(format string, a ...interface{}) ConnectionError {
 // entire connection and the retry of all the active streams.
 type ConnectionError struct {
 	Desc string
+	// GoAway is set if the error is due to a GOAWAY received from the
+	// server. GoAwayCode and GoAwayDebug are the error code and the debug
+	// data of the frame.
+	GoAway      bool
+	GoAwayCode  http2.ErrCode
+	GoAwayDebug string
+}
+
+// Temporary reports whether the streams failed by e can be retried on
+// another transport. It is false if the server sent GOAWAY with an error code
+// other than NO_ERROR, e.g., because of a protocol error.
+func (e ConnectionError) Temporary() bool {
+	return !e.GoAway || e.GoAwayCode == http2.ErrCodeNo
 }
 
 func (e ConnectionError) Error() string {
@@ -412,7 +724,13 @@ func (e ConnectionError) Error() string {
 }
 
 // Define some common ConnectionErrors.
-var ErrConnClosing = ConnectionError{Desc: "transport is closing"}
+var (
+	ErrConnClosing = ConnectionError{Desc: "transport is closing"}
+	// ErrConnDrain indicates that the transport received GOAWAY or is closed
+	// gracefully and does not accept new streams. The RPC can be retried on
+	// a new transport.
+	ErrConnDrain = ConnectionError{Desc: "transport is draining"}
+)
 
 // StreamError is an error that only affects one stream within a connection.
 type StreamError struct {
@@ -35,19 +35,26 @@ package transport
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"math"
 	"net"
 	"reflect"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
 type server struct {
@@ -57,6 +64,13 @@ type server struct {
 	readyChan chan bool
 	mu        sync.Mutex
 	conns     map[ServerTransport]bool
+	// windowSize is the receive window of the streams and connections.
+	windowSize int32
+	// maxBufferedBytes is the limit of the bytes buffered by each
+	// connection.
+	maxBufferedBytes int
+	// keepalivePolicy is enforced on the pings of the clients.
+	keepalivePolicy *keepalive.EnforcementPolicy
 }
 
 var (
@@ -86,6 +100,12 @@ func (h *testStreamHandler) handleStream(s *Stream) {
 		}
 		log.Fatalf("handleStream got error: %v, want <nil>; result: %v, want %v", err, p, req)
 	}
+	if s.Method() == "foo.Reset" {
+		// Reset the stream in the middle of the response.
+		h.t.Write(s, resp[:len(resp)/2], &Options{})
+		h.t.(*http2Server).controlBuf.put(&resetStream{s.id, http2.ErrCodeCancel})
+		return
+	}
 	// send a response back to the client.
 	h.t.Write(s, resp, &Options{})
 	// send the trailer to end the stream.
@@ -119,16 +139,22 @@ func (s *server) Start(useTLS bool, port int, maxStreams uint32, suspend bool) {
 		log.Fatalf("failed to parse listener address: %v", err)
 	}
 	s.port = p
+	s.conns = make(map[ServerTransport]bool)
 	if s.readyChan != nil {
 		close(s.readyChan)
 	}
-	s.conns = make(map[ServerTransport]bool)
 	for {
 		conn, err := s.lis.Accept()
 		if err != nil {
 			return
 		}
-		t, err := NewServerTransport("http2", conn, maxStreams)
+		t, err := NewServerTransport("http2", conn, &ServerConfig{
+			MaxStreams:            maxStreams,
+			InitialWindowSize:     s.windowSize,
+			InitialConnWindowSize: s.windowSize,
+			MaxBufferedBytes:      s.maxBufferedBytes,
+			KeepalivePolicy:       s.keepalivePolicy,
+		})
 		if err != nil {
 			return
 		}
@@ -182,11 +208,11 @@ func setUp(t *testing.T, useTLS bool, port int, maxStreams uint32, suspend bool)
 			t.Fatalf("Failed to create credentials %v", err)
 		}
 		dopts := DialOptions{
-			AuthOptions: []credentials.Credentials{creds},
+			TransportCredentials: creds,
 		}
-		ct, connErr = NewClientTransport(addr, &dopts)
+		ct, connErr = NewClientTransport(context.Background(), addr, &dopts)
 	} else {
-		ct, connErr = NewClientTransport(addr, &DialOptions{})
+		ct, connErr = NewClientTransport(context.Background(), addr, &DialOptions{})
 	}
 	if connErr != nil {
 		t.Fatalf("failed to create transport: %v", connErr)
@@ -234,6 +260,29 @@ func TestClientSendAndReceive(t *testing.T) {
 	closeServer(server, t)
 }
 
+func TestClientStreamReset(t *testing.T) {
+	server, ct := setUp(t, false, 0, math.MaxUint32, false)
+	defer func() {
+		closeClient(ct, t)
+		closeServer(server, t)
+	}()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Reset"})
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, expectedRequest, &Options{Last: true}); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	// The reset is not mistaken for the end of the stream.
+	p := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(s, p); err != StreamErrorf(codes.Canceled, "stream terminated by RST_STREAM with error code: %v", http2.ErrCodeCancel) {
+		t.Fatalf("io.ReadFull(_, _) = _, %v, want a StreamError with code %d", err, codes.Canceled)
+	}
+	if s.StatusCode() != codes.Canceled {
+		t.Fatalf("s.StatusCode() = %d, want %d", s.StatusCode(), codes.Canceled)
+	}
+}
+
 func TestClientErrorNotify(t *testing.T) {
 	server, ct := setUp(t, true, 0, math.MaxUint32, false)
 	callHdr := &CallHdr{
@@ -254,6 +303,158 @@ func TestClientErrorNotify(t *testing.T) {
 	closeClient(ct, t)
 }
 
+func TestClientGracefulClose(t *testing.T) {
+	server, ct := setUp(t, false, 0, math.MaxUint32, false)
+	defer closeServer(server, t)
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	done := ct.GracefulClose()
+	if _, err := ct.NewStream(context.Background(), callHdr); err != ErrConnDrain {
+		t.Fatalf("ct.NewStream(_, _) = _, %v after GracefulClose, want _, %v", err, ErrConnDrain)
+	}
+	// The active stream still completes.
+	if err := ct.Write(s, expectedRequest, &Options{Last: true}); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(s, p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("io.ReadFull(_, _) = _, %v with %q, want _, <nil> with %q", err, p, expectedResponse)
+	}
+	select {
+	case <-done:
+		t.Fatalf("the transport is closed before its stream")
+	default:
+	}
+	ct.CloseStream(s, nil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the transport is not closed once its stream is done")
+	}
+}
+
+func TestClientConnectTimeout(t *testing.T) {
+	// The server accepts the connection but never sends its preface.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	ct, err := NewClientTransport(context.Background(), lis.Addr().String(), &DialOptions{ConnectTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewClientTransport(_, _, _) = _, %v, want _, <nil>", err)
+	}
+	defer ct.Close()
+	conn := <-accepted
+	defer conn.Close()
+	// The owner of the transport closes it once it reports the error.
+	select {
+	case <-ct.Error():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the transport reported no error without the preface of the server")
+	}
+}
+
+func TestClientGoAwayError(t *testing.T) {
+	for _, test := range []struct {
+		code      http2.ErrCode
+		temporary bool
+	}{
+		{http2.ErrCodeNo, true},
+		{http2.ErrCodeEnhanceYourCalm, false},
+	} {
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		// The server refuses the first stream with GOAWAY.
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := io.ReadFull(conn, make([]byte, len(clientPreface))); err != nil {
+				return
+			}
+			framer := http2.NewFramer(conn, conn)
+			if err := framer.WriteSettings(); err != nil {
+				return
+			}
+			for {
+				f, err := framer.ReadFrame()
+				if err != nil {
+					return
+				}
+				if _, ok := f.(*http2.HeadersFrame); ok {
+					break
+				}
+			}
+			framer.WriteGoAway(0, test.code, []byte("too_many_pings"))
+			// Wait for the client to close the connection.
+			framer.ReadFrame()
+		}()
+		ct, err := NewClientTransport(context.Background(), lis.Addr().String(), &DialOptions{})
+		if err != nil {
+			t.Fatalf("NewClientTransport(_, _, _) = _, %v, want _, <nil>", err)
+		}
+		s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		_, err = s.Read(make([]byte, 1))
+		e, ok := err.(ConnectionError)
+		if !ok || !e.GoAway || e.GoAwayCode != test.code || e.GoAwayDebug != "too_many_pings" || e.Temporary() != test.temporary {
+			t.Fatalf("s.Read(_) = _, %v, want a ConnectionError of a GOAWAY with code %v, debug data %q and Temporary() %t", err, test.code, "too_many_pings", test.temporary)
+		}
+		ct.Close()
+		lis.Close()
+	}
+}
+
+func TestClientConnectTimeoutCleared(t *testing.T) {
+	server := &server{readyChan: make(chan bool)}
+	go server.Start(false, 0, math.MaxUint32, false)
+	server.Wait(t, 2*time.Second)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{ConnectTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer func() {
+		closeClient(ct, t)
+		closeServer(server, t)
+	}()
+	// The established transport outlives the connect timeout.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-ct.Error():
+		t.Fatalf("the transport failed after it was established")
+	default:
+	}
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, expectedRequest, &Options{Last: true}); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(s, p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("io.ReadFull(_, %v) = _, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+}
+
 func performOneRPC(ct ClientTransport) {
 	callHdr := &CallHdr{
 		Host:   "localhost",
@@ -331,8 +532,8 @@ func TestExceedMaxStreamsLimit(t *testing.T) {
 	// The 2nd stream was rejected by the server via a reset.
 	p := make([]byte, len(expectedResponse))
 	_, recvErr := io.ReadFull(s, p)
-	if recvErr != io.EOF || s.StatusCode() != codes.Unavailable {
-		t.Fatalf("Error: %v, StatusCode: %d; want <EOF>, %d", recvErr, s.StatusCode(), codes.Unavailable)
+	if se, ok := recvErr.(StreamError); !ok || se.Code != codes.Unavailable || s.StatusCode() != codes.Unavailable {
+		t.Fatalf("Error: %v, StatusCode: %d; want a StreamError with code %d, %d", recvErr, s.StatusCode(), codes.Unavailable, codes.Unavailable)
 	}
 	// Server's setting has been received. From now on, new stream will be rejected instantly.
 	_, err3 := ct.NewStream(context.Background(), callHdr)
@@ -344,6 +545,105 @@ func TestExceedMaxStreamsLimit(t *testing.T) {
 	}
 }
 
+// waitBufferedBytes waits until f, which returns the bytes buffered by a
+// transport, returns want.
+func waitBufferedBytes(t *testing.T, f func() int, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for f() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("BufferedBytes() = %d, want %d", f(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientMaxBufferedBytes(t *testing.T) {
+	server := &server{readyChan: make(chan bool)}
+	go server.Start(false, 0, math.MaxUint32, false)
+	server.Wait(t, 2*time.Second)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{MaxBufferedBytes: len(expectedResponse)})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer func() {
+		closeClient(ct, t)
+		closeServer(server, t)
+	}()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	for _, read := range []bool{true, false} {
+		s, err := ct.NewStream(context.Background(), callHdr)
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		if err := ct.Write(s, expectedRequest, &Options{Last: true}); err != nil {
+			t.Fatalf("failed to send data: %v", err)
+		}
+		// The response is buffered until it is read or the stream is
+		// closed, and no stream is created meanwhile.
+		waitBufferedBytes(t, ct.BufferedBytes, len(expectedResponse))
+		if !ct.Saturated() {
+			t.Fatalf("ct.Saturated() = false with %d bytes buffered, want true", ct.BufferedBytes())
+		}
+		if _, err := ct.NewStream(context.Background(), callHdr); err == nil || err.(StreamError).Code != codes.ResourceExhausted {
+			t.Fatalf("ct.NewStream(_, _) = _, %v, want _, a StreamError with code %d", err, codes.ResourceExhausted)
+		}
+		if read {
+			p := make([]byte, len(expectedResponse))
+			if _, err := io.ReadFull(s, p); err != nil {
+				t.Fatalf("io.ReadFull(_, _) = _, %v, want _, <nil>", err)
+			}
+		}
+		ct.CloseStream(s, nil)
+		if n := ct.BufferedBytes(); n != 0 {
+			t.Fatalf("ct.BufferedBytes() = %d once the stream is closed, want 0", n)
+		}
+	}
+}
+
+func TestServerMaxBufferedBytes(t *testing.T) {
+	server := &server{readyChan: make(chan bool), maxBufferedBytes: len(expectedRequest)}
+	go server.Start(false, 0, math.MaxUint32, true)
+	server.Wait(t, 2*time.Second)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer func() {
+		closeClient(ct, t)
+		closeServer(server, t)
+	}()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	s1, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := ct.Write(s1, expectedRequest, &Options{Last: true}); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	// The server never reads the request.
+	bufferedBytes := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		var n int
+		for st := range server.conns {
+			n += st.BufferedBytes()
+		}
+		return n
+	}
+	waitBufferedBytes(t, bufferedBytes, len(expectedRequest))
+	s2, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(s2, p); err == nil || err.(StreamError).Code != codes.Unavailable {
+		t.Fatalf("io.ReadFull(_, _) = _, %v, want _, a StreamError with code %d", err, codes.Unavailable)
+	}
+	// Resetting the stream releases its request.
+	ct.CloseStream(s1, ContextErr(context.Canceled))
+	waitBufferedBytes(t, bufferedBytes, 0)
+}
+
 func TestLargeMessage(t *testing.T) {
 	server, ct := setUp(t, true, 0, math.MaxUint32, false)
 	callHdr := &CallHdr{
@@ -400,6 +700,33 @@ func TestLargeMessageSuspension(t *testing.T) {
 	closeServer(server, t)
 }
 
+func TestLargeWindowSuspension(t *testing.T) {
+	server := &server{readyChan: make(chan bool), windowSize: 4 * initialWindowSize}
+	go server.Start(false, 0, math.MaxUint32, true)
+	server.Wait(t, 2*time.Second)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Large",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	// The server announced a window large enough for the message, so Write
+	// succeeds even though the server does not read it.
+	if err := ct.Write(s, expectedRequestLarge, &Options{Last: true, Delay: false}); err != nil {
+		t.Fatalf("Write got %v, want <nil>", err)
+	}
+	closeClient(ct, t)
+	closeServer(server, t)
+}
+
 func TestStreamContext(t *testing.T) {
 	expectedStream := Stream{}
 	ctx := newContextWithStream(context.Background(), &expectedStream)
@@ -458,3 +785,266 @@ func TestClientServerDuplicatedClose(t *testing.T) {
 		t.Fatalf("closeServerWithErr(server) = <nil>, want non-nil")
 	}
 }
+
+// fakeTimer is a keepalive timer fired by the test.
+type fakeTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+// fakeTimers hands the keepalive timers of a transport over to the test,
+// which fires them at will instead of waiting for them.
+type fakeTimers chan fakeTimer
+
+func (f fakeTimers) newTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c := make(chan time.Time, 1)
+	f <- fakeTimer{d, c}
+	return c, func() bool { return true }
+}
+
+// next waits for the next timer.
+func (f fakeTimers) next(t *testing.T) fakeTimer {
+	select {
+	case timer := <-f:
+		return timer
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a keepalive timer")
+		return fakeTimer{}
+	}
+}
+
+// fire waits for the next timer, checks its duration and fires it.
+func (f fakeTimers) fire(t *testing.T, want time.Duration) {
+	timer := f.next(t)
+	if timer.d != want {
+		t.Fatalf("the keepalive timer was set for %v, want %v", timer.d, want)
+	}
+	timer.c <- time.Now()
+}
+
+var keepaliveParams = keepalive.ClientParameters{
+	Time:                time.Minute,
+	Timeout:             time.Second,
+	PermitWithoutStream: true,
+}
+
+func TestKeepaliveAckedPings(t *testing.T) {
+	server := &server{readyChan: make(chan bool)}
+	go server.Start(false, 0, math.MaxUint32, false)
+	server.Wait(t, 2*time.Second)
+	timers := make(fakeTimers)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{
+		KeepaliveParams: keepaliveParams,
+		newTimer:        timers.newTimer,
+	})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer server.Close()
+	defer ct.Close()
+	activity := &ct.(*http2Client).activity
+	for pings := 0; pings < 3; {
+		// The transport waits for kp.Time, and for kp.Timeout after a
+		// ping. The frames of the server preceding the ping count as
+		// activity, which defers it.
+		timer := timers.next(t)
+		switch timer.d {
+		case keepaliveParams.Time:
+		case keepaliveParams.Timeout:
+			// Let the ack arrive.
+			for atomic.LoadUint32(activity) == 0 {
+				runtime.Gosched()
+			}
+			pings++
+		default:
+			t.Fatalf("the keepalive timer was set for %v, want %v or %v", timer.d, keepaliveParams.Time, keepaliveParams.Timeout)
+		}
+		timer.c <- time.Now()
+	}
+	select {
+	case <-ct.Error():
+		t.Fatalf("the transport was closed although the server acked the keepalive pings")
+	default:
+	}
+}
+
+func TestKeepaliveUnackedPings(t *testing.T) {
+	// The listener accepts the connection but never speaks HTTP2 back.
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		conn.Close()
+	}()
+	timers := make(fakeTimers)
+	ct, err := NewClientTransport(context.Background(), lis.Addr().String(), &DialOptions{
+		KeepaliveParams: keepaliveParams,
+		newTimer:        timers.newTimer,
+	})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	timers.fire(t, keepaliveParams.Time)
+	timers.fire(t, keepaliveParams.Timeout)
+	select {
+	case <-ct.Error():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the transport was not closed after the keepalive ping timed out")
+	}
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err == nil {
+		t.Fatalf("ct.NewStream(_, _) = _, <nil>, want _, a ConnectionError")
+	} else if _, ok := err.(ConnectionError); !ok {
+		t.Fatalf("ct.NewStream(_, _) = _, %v, want _, a ConnectionError", err)
+	}
+}
+
+// startPingingClient starts a server enforcing kep and returns a client
+// transport which pings it about every 100ms.
+func startPingingClient(t *testing.T, kep keepalive.EnforcementPolicy) (*server, ClientTransport) {
+	server := &server{readyChan: make(chan bool), keepalivePolicy: &kep}
+	go server.Start(false, 0, math.MaxUint32, true)
+	server.Wait(t, 2*time.Second)
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{
+		KeepaliveParams: keepalive.ClientParameters{
+			Time:                50 * time.Millisecond,
+			Timeout:             50 * time.Millisecond,
+			PermitWithoutStream: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	return server, ct
+}
+
+func TestKeepaliveEnforcementPermitted(t *testing.T) {
+	server, ct := startPingingClient(t, keepalive.EnforcementPolicy{
+		MinTime:             10 * time.Millisecond,
+		PermitWithoutStream: true,
+	})
+	defer server.Close()
+	defer ct.Close()
+	select {
+	case <-ct.Error():
+		t.Fatalf("the transport was closed although the pings follow the keepalive policy")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestKeepaliveEnforcementWithoutStream(t *testing.T) {
+	server, ct := startPingingClient(t, keepalive.EnforcementPolicy{MinTime: 10 * time.Millisecond})
+	defer server.Close()
+	defer ct.Close()
+	select {
+	case <-ct.GoAway():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the server did not send GOAWAY to the client pinging without streams")
+	}
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err == nil {
+		t.Fatalf("ct.NewStream(_, _) = _, <nil> after GOAWAY, want _, non-nil")
+	}
+}
+
+func TestKeepaliveEnforcementTooFrequent(t *testing.T) {
+	server, ct := startPingingClient(t, keepalive.EnforcementPolicy{
+		MinTime:             time.Second,
+		PermitWithoutStream: true,
+	})
+	defer server.Close()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	// The active stream is cut by the GOAWAY.
+	_, err = s.Read(make([]byte, 1))
+	if ce, ok := err.(ConnectionError); !ok || ce.GoAwayCode != http2.ErrCodeEnhanceYourCalm || ce.GoAwayDebug != "too_many_pings" {
+		t.Fatalf("s.Read(_) = _, %v, want _, a ConnectionError with GOAWAY %v and too_many_pings", err, http2.ErrCodeEnhanceYourCalm)
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	callHdr := &CallHdr{
+		Host:     "localhost",
+		Method:   "foo.Small",
+		Timeout:  time.Second,
+		Metadata: metadata.MD{"zz": "1", "aa": "2", "te": "gzip", "mm": "3"},
+	}
+	want := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "foo.Small"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "te", Value: "trailers"},
+		{Name: "user-agent", Value: "grpc-go/0.7"},
+		{Name: "grpc-timeout", Value: timeoutEncode(time.Second)},
+		{Name: "aa", Value: "2"},
+		{Name: "mm", Value: "3"},
+		{Name: "zz", Value: "1"},
+	}
+	for i := 0; i < 10; i++ {
+		if got := headerFields(callHdr, "http", userAgent("")); !reflect.DeepEqual(got, want) {
+			t.Fatalf("headerFields(%v, \"http\", %q) = %v, want %v", callHdr, userAgent(""), got, want)
+		}
+	}
+	for _, test := range []struct {
+		fields  []hpack.HeaderField
+		wantErr bool
+	}{
+		{want, false},
+		{append([]hpack.HeaderField{{Name: ":path", Value: "foo.Small"}, {Name: ":method", Value: "POST"}}, want[4:]...), false},
+		{append(want[4:len(want):len(want)], hpack.HeaderField{Name: ":path", Value: "foo.Small"}), true},
+	} {
+		if err := checkPseudoHeaders(test.fields); (err != nil) != test.wantErr {
+			t.Fatalf("checkPseudoHeaders(%v) = %v, want error: %t", test.fields, err, test.wantErr)
+		}
+	}
+}
+
+func TestHeaderHook(t *testing.T) {
+	server := &server{readyChan: make(chan bool)}
+	go server.Start(false, 0, math.MaxUint32, false)
+	server.Wait(t, 2*time.Second)
+	hook := func(fields []hpack.HeaderField) ([]hpack.HeaderField, error) {
+		for _, f := range fields {
+			if f.Name == ":path" && f.Value == "foo.Rejected" {
+				return nil, errors.New("rejected")
+			}
+		}
+		// Move :authority first.
+		return append([]hpack.HeaderField{fields[3]}, append(fields[:3:3], fields[4:]...)...), nil
+	}
+	ct, err := NewClientTransport(context.Background(), "localhost:"+server.port, &DialOptions{HeaderHook: hook})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Rejected"}); err == nil {
+		t.Fatalf("NewStream(_, foo.Rejected) = _, <nil>, want _, error")
+	} else if e, ok := err.(StreamError); !ok || e.Code != codes.Internal {
+		t.Fatalf("NewStream(_, foo.Rejected) = _, %v, want _, StreamError with code %v", err, codes.Internal)
+	}
+	// The transport is still usable.
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, expectedRequest, &Options{Last: true}); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(s, p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("Error: %v, want <nil>; Result: %v, want %v", err, p, expectedResponse)
+	}
+	closeClient(ct, t)
+	closeServer(server, t)
+}